@@ -4,8 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/chrissnell/sparkyfish/pkg/server"
@@ -19,13 +21,28 @@ func main() {
 		os.Exit(0)
 	}
 
-	cfg := server.Config{}
-	flag.StringVar(&cfg.ListenAddr, "listen-addr", ":7121", "IP:Port to listen on")
-	flag.StringVar(&cfg.Cname, "cname", "", "Canonical hostname reported to clients")
-	flag.StringVar(&cfg.Location, "location", "", "Physical location of server")
-	flag.BoolVar(&cfg.Debug, "debug", false, "Enable verbose logging")
+	if len(os.Args) >= 2 && os.Args[1] == "registry" {
+		if err := runRegistry(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var configPath string
+	cfg := server.DefaultConfig()
+	bindFlags(flag.CommandLine, &cfg, &configPath)
 	flag.Parse()
 
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	cfg.Version = version
 	srv, err := server.New(cfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -35,8 +52,106 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// SIGHUP re-reads the config file and token file. Command-line flags
+	// still take precedence over the file.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig(configPath, os.Args[1:])
+			if err == nil {
+				err = srv.Reload(cfg)
+			}
+			if err != nil {
+				srv.Logger().Error("reload failed; keeping the current configuration", "err", err)
+			}
+		}
+	}()
+
 	if err := srv.ListenAndServe(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// loadConfig reads the config file at path, if any, and applies the
+// command-line flags in args on top of it.
+func loadConfig(path string, args []string) (server.Config, error) {
+	cfg := server.DefaultConfig()
+	if path != "" {
+		var err error
+		if cfg, err = server.LoadConfig(path); err != nil {
+			return cfg, err
+		}
+	}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	bindFlags(fs, &cfg, new(string))
+	return cfg, fs.Parse(args)
+}
+
+// bindFlags defines the server's flags on fs, with cfg's current values as
+// their defaults.
+func bindFlags(fs *flag.FlagSet, cfg *server.Config, configPath *string) {
+	fs.StringVar(configPath, "config", "", "YAML config file; flags given on the command line override it")
+	fs.Func("listen-addr", "Comma-separated IP:Port addresses to listen on; may be repeated (default \":7121\")", addrList(&cfg.ListenAddrs))
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "IP:Port to serve Prometheus metrics on (disabled if empty)")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "IP:Port to also serve the tests over HTTP on, or HTTPS with -tls-cert (disabled if empty)")
+	fs.BoolVar(&cfg.Web, "web", cfg.Web, "Serve a browser test page on -http-addr")
+	fs.BoolVar(&cfg.MDNS, "mdns", cfg.MDNS, "Advertise the server on the local network with DNS-SD over mDNS")
+	fs.StringVar(&cfg.Cname, "cname", cfg.Cname, "Canonical hostname reported to clients")
+	fs.StringVar(&cfg.Location, "location", cfg.Location, "Physical location of server")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Enable verbose logging")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: text or json")
+	fs.IntVar(&cfg.MaxTests, "max-tests", cfg.MaxTests, "Maximum concurrent download/upload tests (0 for unlimited)")
+	fs.IntVar(&cfg.MaxQueue, "max-queue", cfg.MaxQueue, "Maximum tests waiting for a slot when -max-tests is reached")
+	fs.DurationVar(&cfg.Limits.Duration, "max-duration", cfg.Limits.Duration, "Longest throughput test a client may request, in whole seconds")
+	fs.IntVar(&cfg.Limits.Pings, "max-pings", cfg.Limits.Pings, "Most latency probes a client may request")
+	fs.IntVar(&cfg.Limits.Streams, "max-streams", cfg.Limits.Streams, "Most parallel streams a client may request")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "PEM certificate to serve TLS with (requires -tls-key)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "PEM private key for -tls-cert")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", cfg.TLSClientCAFile, "PEM file of CA certificates; clients must present a certificate signed by one of them")
+	fs.StringVar(&cfg.RegistryURL, "registry", cfg.RegistryURL, "Base URL of a registry to send heartbeats to, e.g. https://registry.example.com:7122")
+	fs.StringVar(&cfg.RegistryTokenFile, "registry-token-file", cfg.RegistryTokenFile, "File holding the token the registry requires")
+	fs.StringVar(&cfg.AuthFile, "auth-file", cfg.AuthFile, "Token file; if set, clients must authenticate with one of its tokens")
+	fs.IntVar(&cfg.RateLimit.Tests, "rate-limit-tests", cfg.RateLimit.Tests, "Most throughput tests a client may start per -rate-limit-window (0 for unlimited)")
+	fs.DurationVar(&cfg.RateLimit.Window, "rate-limit-window", cfg.RateLimit.Window, "Window for -rate-limit-tests")
+	fs.Func("rate-limit-bytes", "Most bytes a client may transfer in 24 hours, e.g. 50G (unlimited if unset)", func(s string) error {
+		n, err := server.ParseSize(s)
+		cfg.RateLimit.BytesPerDay = n
+		return err
+	})
+	fs.DurationVar(&cfg.RateLimit.Cooldown, "rate-limit-cooldown", cfg.RateLimit.Cooldown, "Least time between two downloads, or two uploads, from a client")
+	fs.IntVar(&cfg.RateLimit.IPv4Prefix, "rate-limit-ipv4-prefix", cfg.RateLimit.IPv4Prefix, "Prefix length IPv4 clients are grouped by for rate limits")
+	fs.IntVar(&cfg.RateLimit.IPv6Prefix, "rate-limit-ipv6-prefix", cfg.RateLimit.IPv6Prefix, "Prefix length IPv6 clients are grouped by for rate limits")
+	fs.Func("allow", "Comma-separated CIDRs clients may connect from; may be repeated, and adds to the config file's list (all if unset)", prefixList(&cfg.Allow))
+	fs.Func("deny", "Comma-separated CIDRs clients may not connect from; may be repeated, and adds to the config file's list", prefixList(&cfg.Deny))
+}
+
+// prefixList returns a flag.Func that appends comma-separated CIDRs to ps.
+func prefixList(ps *[]netip.Prefix) func(string) error {
+	return func(s string) error {
+		for _, field := range strings.Split(s, ",") {
+			p, err := server.ParsePrefix(field)
+			if err != nil {
+				return err
+			}
+			*ps = append(*ps, p)
+		}
+		return nil
+	}
+}
+
+// addrList returns a flag.Func that replaces *addrs with comma-separated
+// addresses. Repeating the flag adds to the list.
+func addrList(addrs *[]string) func(string) error {
+	replaced := false
+	return func(s string) error {
+		if !replaced {
+			*addrs, replaced = nil, true
+		}
+		for _, addr := range strings.Split(s, ",") {
+			*addrs = append(*addrs, strings.TrimSpace(addr))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/chrissnell/sparkyfish/pkg/registry"
+)
+
+// runRegistry implements the "registry" subcommand.
+func runRegistry(args []string) error {
+	var cfg registry.Config
+	fs := flag.NewFlagSet("registry", flag.ExitOnError)
+	fs.StringVar(&cfg.ListenAddr, "listen-addr", ":7122", "IP:Port to serve the registry API on")
+	fs.DurationVar(&cfg.TTL, "ttl", registry.DefaultTTL, "How long a server stays listed after its last heartbeat")
+	tokenFile := fs.String("token-file", "", "File holding the token servers must send heartbeats with (anyone may register if unset)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s registry [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Serves the list of servers that send heartbeats to it at /v1/servers.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("load token: %w", err)
+		}
+		cfg.Token = strings.TrimSpace(string(data))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	return registry.New(cfg, logger).ListenAndServe(ctx)
+}
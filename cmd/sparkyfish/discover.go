@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chrissnell/sparkyfish/pkg/discovery"
+)
+
+// runDiscover implements the "discover" subcommand.
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", discovery.DefaultBrowseTimeout, "How long to wait for servers to answer")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s discover [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Lists the sparkyfish servers on the local network that advertise themselves over mDNS.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	services, err := discovery.Browse(ctx)
+	if err != nil {
+		return fmt.Errorf("browse: %w", err)
+	}
+	if len(services) == 0 {
+		fmt.Fprintln(os.Stderr, "No servers found on the local network")
+		return nil
+	}
+	printServices(os.Stdout, services)
+	return nil
+}
+
+func printServices(w io.Writer, services []discovery.Service) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tLOCATION\tVERSION\tCAPACITY\tREQUIRES")
+	for _, svc := range services {
+		capacity := "unlimited"
+		if svc.Capacity > 0 {
+			capacity = strconv.Itoa(svc.Capacity)
+		}
+		var requires []string
+		if svc.TLS {
+			requires = append(requires, "-tls")
+		}
+		if svc.Auth {
+			requires = append(requires, "token")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			svc.Instance, svc.Addr(), orDash(svc.Location), orDash(svc.Version), capacity, orDash(strings.Join(requires, ", ")))
+	}
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/history"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+const historyDateLayout = "2006-01-02"
+
+// runHistory implements the "history" subcommand.
+func runHistory(args []string) error {
+	defaultPath, err := history.DefaultPath()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	path := fs.String("file", defaultPath, "History file to read")
+	server := fs.String("server", "", "Only show runs whose server hostname or address contains this string")
+	since := fs.String("since", "", "Only show runs on or after this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "Only show runs on or before this date (YYYY-MM-DD)")
+	trend := fs.Bool("trend", false, "Show a trend summary instead of individual runs")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s history [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	filter := history.Filter{Server: *server}
+	if *since != "" {
+		t, err := time.ParseInLocation(historyDateLayout, *since, time.Local)
+		if err != nil {
+			return fmt.Errorf("parse -since: %w", err)
+		}
+		filter.Since = t
+	}
+	if *until != "" {
+		t, err := time.ParseInLocation(historyDateLayout, *until, time.Local)
+		if err != nil {
+			return fmt.Errorf("parse -until: %w", err)
+		}
+		filter.Until = t.AddDate(0, 0, 1) // inclusive of the whole day
+	}
+
+	results, err := history.Open(*path).Load(filter)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "No matching runs in", *path)
+		return nil
+	}
+
+	if *trend {
+		printTrends(os.Stdout, history.Summarize(results))
+	} else {
+		printRuns(os.Stdout, results)
+	}
+	return nil
+}
+
+func printRuns(w io.Writer, results []*result.Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tSERVER\tLOCATION\tPING ms\tDOWN Mbit/s\tUP Mbit/s")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.2f\t%.1f\t%.1f\n",
+			r.Start.Local().Format("2006-01-02 15:04"),
+			r.Server.Hostname, r.Server.Location,
+			r.Ping.MeanMs, r.Download.MeanMbps, r.Upload.MeanMbps)
+	}
+	tw.Flush()
+}
+
+func printTrends(w io.Writer, t history.Trends) {
+	fmt.Fprintf(w, "Runs: %d (%s to %s)\n\n", t.Runs,
+		t.First.Local().Format(historyDateLayout), t.Last.Local().Format(historyDateLayout))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tMEAN\tMIN\tMAX\tTREND/WEEK")
+	for _, row := range []struct {
+		name  string
+		trend history.Trend
+	}{
+		{"Ping ms", t.PingMs},
+		{"Download Mbit/s", t.Download},
+		{"Upload Mbit/s", t.Upload},
+	} {
+		slope := "-"
+		if t.HasSlope {
+			slope = fmt.Sprintf("%+.2f", row.trend.PerWeek)
+		}
+		fmt.Fprintf(tw, "%s\t%.2f\t%.2f\t%.2f\t%s\n",
+			row.name, row.trend.Mean, row.trend.Min, row.trend.Max, slope)
+	}
+	tw.Flush()
+}
+
+// saveHistory appends each completed run to the default history file.
+func saveHistory(results []*result.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+	path, err := history.DefaultPath()
+	if err != nil {
+		return err
+	}
+	store := history.Open(path)
+	for _, res := range results {
+		res.ClientVersion = version
+		if err := store.Append(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
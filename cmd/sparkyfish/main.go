@@ -1,19 +1,42 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 
-	sf "github.com/chrissnell/sparkyfish/pkg/backend/sparkyfish"
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	// Backends register themselves for their target schemes.
+	_ "github.com/chrissnell/sparkyfish/pkg/backend/iperf3"
+	_ "github.com/chrissnell/sparkyfish/pkg/backend/sfhttp"
+	_ "github.com/chrissnell/sparkyfish/pkg/backend/sparkyfish"
+	"github.com/chrissnell/sparkyfish/pkg/export"
+	"github.com/chrissnell/sparkyfish/pkg/headless"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
 	"github.com/chrissnell/sparkyfish/pkg/tui"
 )
 
 var version = "dev"
 
-const defaultPort = "7121"
+// defaultBackend serves targets given without a scheme, unless -backend
+// names another.
+const defaultBackend = "sparkyfish"
+
+// authTokenEnv names the environment variable holding the authentication
+// token when -auth-token-file is not given.
+const authTokenEnv = "SPARKYFISH_AUTH_TOKEN"
 
 func main() {
 	if len(os.Args) >= 2 && (os.Args[1] == "-v" || os.Args[1] == "--version") {
@@ -21,22 +44,428 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <hostname>[:port]\n", os.Args[0])
+	if len(os.Args) >= 2 && os.Args[1] == "history" {
+		if err := runHistory(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) >= 2 && os.Args[1] == "discover" {
+		if err := runDiscover(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var (
+		runHeadless  bool
+		output       string
+		format       string
+		appendOut    bool
+		samplesCSV   string
+		noHistory    bool
+		tokenFile    string
+		ipv4, ipv6   bool
+		serverList   string
+		listServers  bool
+		backendName  string
+		listBackends bool
+		runUDP       bool
+		udpMbps      float64
+		opts         backend.Options
+	)
+	flag.StringVar(&backendName, "backend", defaultBackend, "Backend for targets given without a scheme:// prefix (see -list-backends)")
+	flag.BoolVar(&listBackends, "list-backends", false, "List the backends compiled in and the target schemes that select them, then exit")
+	flag.BoolVar(&runHeadless, "headless", false, "Run without the terminal UI; print progress to stderr and a summary to stdout")
+	flag.StringVar(&output, "output", "", "Write the test result to this file (\"-\" for stdout)")
+	flag.StringVar(&format, "format", "json", "Result format for -output: "+strings.Join(export.Formats(), ", "))
+	flag.BoolVar(&appendOut, "append", false, "Append to output files instead of truncating; CSV headers are only written to empty files, and must match to append")
+	flag.StringVar(&samplesCSV, "samples-csv", "", "Also write every raw sample as CSV to this file")
+	flag.BoolVar(&noHistory, "no-history", false, "Do not record completed runs in the local history")
+	flag.DurationVar(&opts.Params.Duration, "duration", 0, "Requested length of each throughput test, in whole seconds (server default if 0)")
+	flag.IntVar(&opts.Params.Pings, "pings", 0, "Requested number of latency probes (server default if 0)")
+	flag.IntVar(&opts.Params.Streams, "streams", 0, "Requested number of parallel TCP streams per throughput test (server default if 0)")
+	flag.BoolVar(&opts.LoadedLatency, "loaded-latency", false, "Also measure latency during the throughput tests, to show bufferbloat")
+	flag.BoolVar(&runUDP, "udp", false, "Also run a UDP test after the upload and report packet loss, reordering, and jitter")
+	flag.Float64Var(&udpMbps, "udp-rate", float64(protocol.DefaultUDPRate)/1_000_000, "Bitrate to send the UDP test at, in Mbit/s")
+	flag.IntVar(&opts.UDP.Size, "udp-size", protocol.DefaultUDPSize, "Size of each UDP test datagram, in bytes")
+	flag.BoolVar(&opts.TLS, "tls", false, "Connect to the server over TLS")
+	flag.StringVar(&opts.TLSCAFile, "tls-ca", "", "PEM file of CA certificates to verify the server with instead of the system roots (implies -tls)")
+	flag.StringVar(&opts.TLSServerName, "tls-server-name", "", "Server name to send with SNI and verify the certificate against (implies -tls; default: the server hostname)")
+	flag.StringVar(&opts.TLSCertFile, "tls-cert", "", "PEM client certificate for servers that require one (implies -tls)")
+	flag.StringVar(&opts.TLSKeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.BoolVar(&opts.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "Do not verify the server certificate; for testing only (implies -tls)")
+	flag.StringVar(&opts.AuthUser, "auth-user", "", "User name to authenticate as (default: use the server's shared secret)")
+	flag.BoolVar(&ipv4, "4", false, "Connect over IPv4 only; with -6, test over IPv4 and then IPv6 and compare them (requires -headless)")
+	flag.BoolVar(&ipv6, "6", false, "Connect over IPv6 only; with -4, test over both and compare them")
+	flag.StringVar(&serverList, "server-list", "", "Server list file or URL; without a hostname, test against the server on it with the lowest latency")
+	flag.BoolVar(&listServers, "list-servers", false, "Probe every server on -server-list and list them by latency, then exit")
+	flag.StringVar(&tokenFile, "auth-token-file", "", "File holding the authentication token for servers that require one (default: $"+authTokenEnv+")")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [<scheme>://]<hostname>[:port]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -server-list <file|URL> [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s history [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s discover [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if listBackends {
+		printBackends(os.Stdout, backend.Registered())
+		return
+	}
+	if flag.NArg() < 1 && serverList == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if listServers && serverList == "" {
+		fmt.Fprintln(os.Stderr, "Error: -list-servers requires -server-list")
+		os.Exit(1)
+	}
+
+	if _, err := export.New(format, export.Options{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	outputs := resultOutputs{
+		{path: output, format: format},
+		{path: samplesCSV, format: "csv-samples"},
+	}
+
+	networks := []string{""}
+	switch {
+	case ipv4 && ipv6:
+		networks = []string{"tcp4", "tcp6"}
+	case ipv4:
+		networks = []string{"tcp4"}
+	case ipv6:
+		networks = []string{"tcp6"}
+	}
+	if len(networks) > 1 && !runHeadless {
+		fmt.Fprintln(os.Stderr, "Error: -4 and -6 together require -headless")
+		os.Exit(1)
+	}
+
+	if opts.Params.Duration < 0 || opts.Params.Duration%time.Second != 0 || opts.Params.Pings < 0 || opts.Params.Streams < 0 {
+		fmt.Fprintln(os.Stderr, "Error: -duration must be a whole number of seconds and -pings and -streams must not be negative")
 		os.Exit(1)
 	}
 
-	addr := os.Args[1]
-	if !strings.Contains(addr, ":") {
-		addr = addr + ":" + defaultPort
+	// The UDP flags only apply, and are only checked, with -udp.
+	if runUDP {
+		opts.UDP.Rate = int64(udpMbps * 1_000_000)
+	} else {
+		opts.UDP = protocol.UDPParams{}
 	}
 
-	client := sf.New()
-	model := tui.New(client, addr)
+	if opts.TLSCAFile != "" || opts.TLSServerName != "" || opts.TLSCertFile != "" || opts.TLSInsecureSkipVerify {
+		opts.TLS = true
+	}
+
+	opts.AuthToken = os.Getenv(authTokenEnv)
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: read token: %v\n", err)
+			os.Exit(1)
+		}
+		opts.AuthToken = strings.TrimSpace(string(token))
+	}
+
+	if len(networks) == 1 {
+		opts.Network = networks[0]
+	}
+
+	// The target's scheme picks the backend; bare targets, and servers
+	// from -server-list, use -backend.
+	backendSet := false
+	flag.Visit(func(f *flag.Flag) { backendSet = backendSet || f.Name == "backend" })
+	reg, target, err := selectBackend(flag.Arg(0), backendName, backendSet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// newBackend builds a backend that connects over network. The first
+	// one serves the first run.
+	newBackend := func(network string) (backend.Backend, error) {
+		o := opts
+		o.Network = network
+		b, err := reg.New(o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", reg.Scheme, err)
+		}
+		return b, nil
+	}
+	b, err := newBackend(networks[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if _, ok := b.(backend.UDPTester); runUDP && !ok {
+		fmt.Fprintf(os.Stderr, "Error: -udp is not supported with the %s backend\n", reg.Scheme)
+		os.Exit(1)
+	}
+	if (listServers || target == "") && !servesServerList(reg) {
+		fmt.Fprintf(os.Stderr, "Error: -server-list lists sparkyfish servers and can't be used with the %s backend\n", reg.Scheme)
+		os.Exit(1)
+	}
+
+	if listServers {
+		b.Close()
+		probes, err := rankServers(context.Background(), serverList, reg, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		printProbes(os.Stdout, probes)
+		return
+	}
+
+	var addr string
+	if target != "" {
+		addr = withDefaultPort(target, reg.Port(opts.TLS))
+	} else {
+		probes, err := rankServers(context.Background(), serverList, reg, opts)
+		if err == nil {
+			var nearest serverlist.Probe
+			if nearest, err = serverlist.Nearest(probes); err == nil {
+				addr = nearest.Server.Addr()
+				fmt.Fprintf(os.Stderr, "Selected %s (%.2f ms) out of %d servers\n",
+					addr, float64(nearest.Latency.Microseconds())/1000, len(probes))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if runHeadless {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		// Each address family gets a run of its own. The outputs are
+		// written once every run is over, so that they hold them all.
+		var completed, results []*result.Result
+		failed := false
+		for i, network := range networks {
+			if i > 0 {
+				if b, err = newBackend(network); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			r := headless.New(b, addr, os.Stderr)
+			r.UDP = runUDP
+			res, err := r.Run(ctx)
+			results = append(results, res)
+			if err != nil {
+				if len(networks) > 1 {
+					err = fmt.Errorf("%s: %w", familyName(network), err)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				failed = true
+				if ctx.Err() != nil {
+					break
+				}
+				continue
+			}
+			completed = append(completed, res)
+		}
+		stop()
+
+		if err := outputs.write(results, appendOut); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !noHistory && len(completed) > 0 {
+			if err := saveHistory(completed); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: save history: %v\n", err)
+			}
+		}
+		if !outputs.toStdout() {
+			for i, res := range completed {
+				if i > 0 {
+					fmt.Println()
+				}
+				headless.WriteSummary(os.Stdout, res)
+			}
+			if len(completed) > 1 {
+				fmt.Println()
+				headless.WriteComparison(os.Stdout, completed)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	defer b.Close()
+	model := tui.New(b, addr, tui.Options{LoadedLatency: opts.LoadedLatency, UDP: runUDP})
 
 	p := tea.NewProgram(model, tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
+	final, err := p.Run()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+
+	if !noHistory {
+		if err := saveHistory(final.(tui.Model).Completed()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: save history: %v\n", err)
+		}
+	}
+
+	if outputs.any() {
+		res, done := final.(tui.Model).Result()
+		if !done {
+			fmt.Fprintln(os.Stderr, "Test did not complete; no result written")
+			os.Exit(1)
+		}
+		if err := outputs.write([]*result.Result{res}, appendOut); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// withDefaultPort adds port to addr if it has none. IPv6 literals may be
+// given with or without brackets.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// selectBackend returns the backend for target and the target's
+// address. Targets without a scheme, and the servers of a server list when
+// target is empty, use the backend named by name. If the user set name
+// with -backend, a target's scheme must agree with it.
+func selectBackend(target, name string, explicit bool) (backend.Registration, string, error) {
+	if target == "" {
+		reg, ok := backend.Lookup(name)
+		if !ok {
+			return backend.Registration{}, "", fmt.Errorf("unknown backend %q (see -list-backends)", name)
+		}
+		return reg, "", nil
+	}
+	reg, addr, err := backend.ParseTarget(target, name)
+	if err != nil {
+		return backend.Registration{}, "", err
+	}
+	if explicit && reg.Scheme != name {
+		return backend.Registration{}, "", fmt.Errorf("-backend %s conflicts with the %s:// target", name, reg.Scheme)
+	}
+	return reg, addr, nil
+}
+
+// servesServerList reports whether reg speaks the protocol of the servers
+// on server lists, which are sparkyfish servers over TCP or TLS.
+func servesServerList(reg backend.Registration) bool {
+	return reg.Scheme == "sparkyfish" || reg.Scheme == "sparkyfish+tls"
+}
+
+// printBackends lists the backends compiled in.
+func printBackends(w io.Writer, regs []backend.Registration) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCHEME\tPORT\tDESCRIPTION")
+	for _, r := range regs {
+		port := r.DefaultPort
+		if r.TLSPort != "" {
+			port += " (" + r.TLSPort + " with -tls)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Scheme, port, r.Description)
+	}
+	tw.Flush()
+}
+
+// familyName returns the address family a -4 or -6 network selects.
+func familyName(network string) string {
+	if network == "tcp4" {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// resultOutput is a destination for an exported result. An empty path
+// disables the output; "-" writes to stdout.
+type resultOutput struct {
+	path   string
+	format string
+}
+
+type resultOutputs []resultOutput
+
+func (outs resultOutputs) any() bool {
+	for _, o := range outs {
+		if o.path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (outs resultOutputs) toStdout() bool {
+	for _, o := range outs {
+		if o.path == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// write stamps the client version on results and exports them to every
+// configured output. Several results, one per address family, make a
+// single JSON array or CSV table.
+func (outs resultOutputs) write(results []*result.Result, appendMode bool) error {
+	for _, res := range results {
+		res.ClientVersion = version
+	}
+	for _, o := range outs {
+		if o.path == "" {
+			continue
+		}
+		if err := o.write(results, appendMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o resultOutput) write(results []*result.Result, appendMode bool) error {
+	if o.path == "-" {
+		return export.ExportAll(os.Stdout, o.format, export.Options{}, results)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(o.path, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", o.path, err)
+	}
+
+	var opts export.Options
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		opts.OmitHeader = true
+		// Writes go to the end of the file whatever has been read.
+		if err := export.CheckAppend(o.format, f); err != nil {
+			f.Close()
+			return fmt.Errorf("append to %s: %w", o.path, err)
+		}
+	}
+
+	if err := export.ExportAll(f, o.format, opts, results); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", o.path, err)
+	}
+	return f.Close()
 }
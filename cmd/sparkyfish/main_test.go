@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+func familyResults() []*result.Result {
+	var results []*result.Result
+	for _, family := range []string{"IPv4", "IPv6"} {
+		res := result.New("test.example.com:7121", time.Now())
+		res.SetServer(backend.ServerInfo{Hostname: "test.example.com", Family: family})
+		res.AddPing(backend.PingSample{Latency: 12 * time.Millisecond})
+		res.AddDownload(backend.ThroughputSample{Mbps: 940})
+		res.Finish(time.Now())
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestResultOutputs_Families(t *testing.T) {
+	dir := t.TempDir()
+	outs := resultOutputs{
+		{path: filepath.Join(dir, "result.json"), format: "json"},
+		{path: filepath.Join(dir, "result.csv"), format: "csv"},
+	}
+	if err := outs.write(familyResults(), false); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	data, err := os.ReadFile(outs[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []result.Result
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("parse %s: %v\n%s", outs[0].path, err, data)
+	}
+	if len(got) != 2 || got[0].Server.Family != "IPv4" || got[1].Server.Family != "IPv6" {
+		t.Errorf("JSON holds %+v, want the IPv4 and IPv6 runs", got)
+	}
+
+	data, err = os.ReadFile(outs[1].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "start,") || strings.HasPrefix(lines[2], "start,") {
+		t.Errorf("CSV should be a header and two rows:\n%s", data)
+	}
+}
+
+func TestResultOutputs_Single(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.json")
+	outs := resultOutputs{{path: path, format: "json"}}
+	if err := outs.write(familyResults()[:1], false); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got result.Result
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("a single run should be a JSON object: %v\n%s", err, data)
+	}
+}
+
+func TestResultOutputs_AppendOldHeader(t *testing.T) {
+	// The header written before the TLS, family, and later columns.
+	old := "start,end,server_addr,hostname,location," +
+		"ping_min_ms,ping_max_ms,ping_mean_ms,ping_stddev_ms," +
+		"download_min_mbps,download_max_mbps,download_mean_mbps,download_stddev_mbps," +
+		"upload_min_mbps,upload_max_mbps,upload_mean_mbps,upload_stddev_mbps\n" +
+		"2024-03-01T12:00:00Z,2024-03-01T12:00:35Z,test.example.com:7121,test.example.com,,1,2,1.5,0.5,900,950,940,10,400,420,410,5\n"
+	path := filepath.Join(t.TempDir(), "result.csv")
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outs := resultOutputs{{path: path, format: "csv"}}
+	err := outs.write(familyResults()[:1], true)
+	if err == nil || !strings.Contains(err.Error(), "CSV header differs") {
+		t.Fatalf("expected a header error, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != old {
+		t.Errorf("file changed:\n%s", data)
+	}
+
+	// A file with the current header is appended to.
+	path = filepath.Join(t.TempDir(), "result.csv")
+	outs = resultOutputs{{path: path, format: "csv"}}
+	for range 2 {
+		if err := outs.write(familyResults()[:1], true); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 {
+		t.Errorf("CSV should be a header and two rows:\n%s", data)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
+)
+
+// rankServers loads the server list at source and probes every server on
+// it with a short latency test by reg, using opts' TLS, authentication,
+// and address family settings.
+func rankServers(ctx context.Context, source string, reg backend.Registration, opts backend.Options) ([]serverlist.Probe, error) {
+	servers, err := serverlist.Load(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	opts.Params.Pings = serverlist.ProbePings
+	if _, err := reg.New(opts); err != nil {
+		return nil, err
+	}
+	return serverlist.Rank(ctx, servers, func() backend.Backend {
+		b, _ := reg.New(opts) // opts were checked above
+		return b
+	}), nil
+}
+
+func printProbes(w io.Writer, probes []serverlist.Probe) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tLOCATION\tCAPACITY\tLOAD\tLATENCY")
+	for _, p := range probes {
+		capacity := "-"
+		if p.Server.CapacityMbps > 0 {
+			capacity = strconv.Itoa(p.Server.CapacityMbps) + " Mbit/s"
+		}
+		latency := fmt.Sprintf("%.2f ms", float64(p.Latency.Microseconds())/1000)
+		if p.Err != nil {
+			latency = "unreachable: " + p.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Server.Addr(), orDash(p.Server.Location), capacity, formatLoad(p.Server.Load), latency)
+	}
+	tw.Flush()
+}
+
+// formatLoad describes a server's load as reported to a registry, such
+// as "1/4 tests, 2 queued".
+func formatLoad(l *serverlist.TestLoad) string {
+	if l == nil {
+		return "-"
+	}
+	load := strconv.Itoa(l.Running)
+	if l.MaxTests > 0 {
+		load += "/" + strconv.Itoa(l.MaxTests)
+	}
+	load += " tests"
+	if l.Queued > 0 {
+		load += fmt.Sprintf(", %d queued", l.Queued)
+	}
+	return load
+}
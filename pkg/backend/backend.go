@@ -2,6 +2,7 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
@@ -9,18 +10,124 @@ import (
 type ServerInfo struct {
 	Hostname string
 	Location string
+	Version  string // server software version, empty if not reported
+	TLS      string // negotiated TLS version and cipher suite, empty for plain connections
+	IP       string // server address the client connected to
+	Family   string // address family of IP: "IPv4" or "IPv6"
+
+	// Test parameters agreed with the server for this session.
+	PingCount    int
+	TestDuration time.Duration
+	Streams      int // parallel streams per throughput test
 }
 
 // PingSample is a single round-trip latency measurement.
 type PingSample struct {
 	Seq     int
 	Latency time.Duration
+	Time    time.Time // when the probe was sent
 }
 
 // ThroughputSample is a periodic throughput measurement.
+//
+// Before a test starts, a backend may send samples with QueuePosition set
+// to report that the server has queued the test behind others. Such
+// samples carry no throughput and should not be counted.
+//
+// For tests run over several parallel streams, Mbps is the total and
+// Streams holds the rate of each stream over the same interval.
+//
+// Mbps is measured by the client. For uploads that is how fast data was
+// handed to the network stack, so servers that count what they receive
+// also provide ServerMbps, and the final sample of the test carries the
+// server's totals in Server. That final sample carries no client
+// measurement and, like queue samples, should not be counted.
+//
+// Backends asked to measure latency under load also send samples with
+// Latency set, one per probe run during the test. These carry no
+// throughput either.
 type ThroughputSample struct {
-	Mbps float64
-	Time time.Time
+	Mbps          float64
+	Time          time.Time
+	QueuePosition int       // 1-based position in the server's queue, or 0 once running
+	Streams       []float64 // per-stream Mbps; nil for single-stream tests
+	ServerMbps    float64   // rate reported by the server; 0 if not reported
+	Server        *ServerReport
+	Latency       time.Duration // round trip of a latency probe; 0 for throughput samples
+}
+
+// Measured reports whether s is a throughput measurement, as opposed to a
+// queue notification, the server's final report, or a latency probe.
+func (s ThroughputSample) Measured() bool {
+	return s.QueuePosition == 0 && s.Server == nil && s.Latency == 0
+}
+
+// ServerReport is the server's own count of the data it received during
+// an upload test, summed over all streams.
+type ServerReport struct {
+	Bytes   int64
+	Elapsed time.Duration // from the start of the test to the last byte received
+}
+
+// Mbps returns the average rate implied by the report.
+func (r ServerReport) Mbps() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / r.Elapsed.Seconds() / 1_000_000
+}
+
+// UDPSample is a periodic report of a UDP test, which sends datagrams at
+// a fixed rate to measure the loss, reordering, and jitter that real-time
+// traffic such as VoIP would see.
+//
+// As with ThroughputSample, a backend may first send samples with
+// QueuePosition set while the server queues the test. The others carry
+// the server's counts so far, which are cumulative; the last, with Final
+// set, carries its totals once it knows how many datagrams were sent.
+type UDPSample struct {
+	Time          time.Time
+	QueuePosition int     // 1-based position in the server's queue, or 0 once running
+	TargetMbps    float64 // rate the client sends at
+	PacketSize    int     // bytes per datagram
+	Sent          int64   // datagrams sent so far
+	Received      int64
+	Lost          int64
+	Reordered     int64 // datagrams that arrived after a later one
+	Duplicates    int64
+	Jitter        time.Duration // RFC 3550 interarrival jitter
+	Mbps          float64       // rate the server received since the last sample; over the whole test if Final
+	Final         bool
+}
+
+// LossPercent returns the share of the datagrams the server expected
+// that were lost.
+func (s UDPSample) LossPercent() float64 {
+	expected := s.Received + s.Lost
+	if expected == 0 {
+		return 0
+	}
+	return float64(s.Lost) * 100 / float64(expected)
+}
+
+// BusyError is returned when the server refuses a test because it is at
+// capacity.
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.RetryAfter)
+}
+
+// RateLimitError is returned when the server refuses a test because the
+// client has used up its share of the server for now.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by server, retry after %s", e.RetryAfter)
 }
 
 // Backend abstracts a speed testing protocol.
@@ -40,4 +147,16 @@ type Backend interface {
 	// Upload runs an upload throughput test, sending periodic samples.
 	// The channel is closed when the test completes.
 	Upload(ctx context.Context, results chan<- ThroughputSample) error
+
+	// Close releases the connection Connect holds open for the first
+	// test, if no test has taken it. Callers should close a connected
+	// backend once they are done with it, including when a test fails.
+	Close() error
+}
+
+// UDPTester is implemented by backends that can also run a UDP test.
+type UDPTester interface {
+	// UDP runs a UDP test, sending periodic samples on results.
+	// The channel is closed when the test completes.
+	UDP(ctx context.Context, results chan<- UDPSample) error
 }
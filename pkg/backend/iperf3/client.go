@@ -0,0 +1,520 @@
+// Package iperf3 implements backend.Backend for iperf3 servers, so that
+// sparkyfish can test against the iperf3 servers already deployed on
+// many networks.
+//
+// Each throughput test is an iperf3 TCP test: a control connection that
+// carries the test states and the JSON parameter and result exchanges,
+// and one data connection per stream, tied to the control connection by
+// a cookie. Downloads are run in iperf3's reverse mode.
+//
+// iperf3 has no latency test, so Ping times TCP handshakes with the
+// server instead. To keep the server from taking those connections for a
+// new client, it holds the server with an iperf3 test that sends no data
+// while it probes: a server running a test turns other connections away
+// without logging an error.
+package iperf3
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// DefaultPort is the port iperf3 servers listen on unless told otherwise.
+const DefaultPort = "5201"
+
+const (
+	// blockSize is the size of each write to a data stream, iperf3's
+	// default for TCP.
+	blockSize = 128 * 1024
+	// maxStreams is the most parallel streams iperf3 allows.
+	maxStreams = 128
+
+	reportInterval = 500 * time.Millisecond
+	pingInterval   = 100 * time.Millisecond
+	pingTimeout    = 5 * time.Second
+	controlTimeout = 10 * time.Second
+)
+
+// Config holds client options.
+type Config struct {
+	// Params are the test parameters. Unlike a sparkyfish server, an
+	// iperf3 server runs whatever it is asked to, so zero fields mean the
+	// sparkyfish protocol defaults.
+	Params protocol.Params
+
+	// Network is "tcp4" or "tcp6" to connect over that address family
+	// only. Empty or "tcp" uses whichever address the server's name
+	// resolves to first.
+	Network string
+}
+
+// Client implements backend.Backend for iperf3 servers.
+type Client struct {
+	cfg    Config
+	addr   string
+	server string   // address every connection goes to, pinned by Connect
+	ctrl   *control // opened by Connect for the first test
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+// Close closes the control connection left open by Connect if no test
+// has used it.
+func (c *Client) Close() error {
+	if c.ctrl == nil {
+		return nil
+	}
+	err := c.ctrl.conn.Close()
+	c.ctrl = nil
+	return err
+}
+
+func (c *Client) Connect(ctx context.Context, addr string) (backend.ServerInfo, error) {
+	if c.ctrl != nil {
+		// Connected before without running a test.
+		c.ctrl.conn.Close()
+		c.ctrl = nil
+	}
+	c.addr = addr
+	p := protocol.DefaultParams()
+	if c.cfg.Params.Duration > 0 {
+		p.Duration = c.cfg.Params.Duration
+	}
+	if c.cfg.Params.Pings > 0 {
+		p.Pings = c.cfg.Params.Pings
+	}
+	if c.cfg.Params.Streams > 0 {
+		p.Streams = c.cfg.Params.Streams
+	}
+	if p.Streams > maxStreams {
+		return backend.ServerInfo{}, fmt.Errorf("iperf3 allows at most %d streams", maxStreams)
+	}
+	if p.Duration%time.Second != 0 {
+		return backend.ServerInfo{}, errors.New("iperf3 test duration must be a whole number of seconds")
+	}
+	c.cfg.Params = p
+
+	network := c.cfg.Network
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return backend.ServerInfo{}, fmt.Errorf("invalid network %q", c.cfg.Network)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+	ctrl, err := openControl(ctx, conn)
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+	c.ctrl = ctrl
+	// Data streams and later tests go to the same address, as they must
+	// reach the server that holds the control connection.
+	c.server = conn.RemoteAddr().String()
+
+	info := backend.ServerInfo{
+		Hostname:     host,
+		PingCount:    p.Pings,
+		TestDuration: p.Duration,
+		Streams:      p.Streams,
+	}
+	if ap, err := netip.ParseAddrPort(c.server); err == nil {
+		info.IP = ap.Addr().Unmap().String()
+		info.Family = "IPv6"
+		if ap.Addr().Unmap().Is4() {
+			info.Family = "IPv4"
+		}
+	}
+	return info, nil
+}
+
+// openControl starts a test on conn: it sends a new cookie and waits for
+// the server to ask for the test parameters. conn is closed on error.
+func openControl(ctx context.Context, conn net.Conn) (*control, error) {
+	cookie, err := newCookie()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctrl := &control{conn: conn, cookie: cookie, timeout: controlTimeout}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+	if _, err = conn.Write(cookie); err == nil {
+		err = ctrl.expect(stateParamExchange)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ctrl, nil
+}
+
+// Ping runs an iperf3 test that sends no data and, while the server is
+// held by it, times TCP handshakes with the server.
+func (c *Client) Ping(ctx context.Context, results chan<- backend.PingSample) error {
+	defer close(results)
+
+	pings := c.cfg.Params.Pings
+	length := time.Duration(pings) * pingInterval
+	t, err := c.start(ctx, params{Time: seconds(length) + 1, Parallel: 1})
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	for i := 0; i < pings; i++ {
+		latency, sent, err := c.handshake(ctx)
+		if err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+		select {
+		case results <- backend.PingSample{Seq: i, Latency: latency, Time: sent}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if i < pings-1 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	_, err = t.finish(ctx, time.Since(start))
+	return err
+}
+
+// handshake times the TCP handshake of a new connection to the server,
+// which takes one round trip.
+func (c *Client) handshake(ctx context.Context) (latency time.Duration, start time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	var d net.Dialer
+	start = time.Now()
+	conn, err := d.DialContext(ctx, "tcp", c.server)
+	if err != nil {
+		return 0, start, err
+	}
+	latency = time.Since(start)
+	conn.Close()
+	return latency, start, nil
+}
+
+func (c *Client) Download(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+
+	length := c.cfg.Params.Duration
+	t, err := c.start(ctx, params{Time: seconds(length), Parallel: c.cfg.Params.Streams, Reverse: true})
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	for i, conn := range t.streams {
+		go func() {
+			buf := make([]byte, blockSize)
+			for {
+				n, err := conn.Read(buf)
+				t.counts[i].Add(int64(n))
+				if err != nil {
+					t.fail(err)
+					return
+				}
+			}
+		}()
+	}
+	if err := t.measure(ctx, results, length); err != nil {
+		return err
+	}
+	_, err = t.finish(ctx, length)
+	return err
+}
+
+func (c *Client) Upload(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+
+	block := make([]byte, blockSize)
+	if _, err := rand.Read(block); err != nil {
+		return fmt.Errorf("generate random data: %w", err)
+	}
+
+	length := c.cfg.Params.Duration
+	t, err := c.start(ctx, params{Time: seconds(length), Parallel: c.cfg.Params.Streams})
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, conn := range t.streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				n, err := conn.Write(block)
+				t.counts[i].Add(int64(n))
+				if err != nil {
+					t.fail(err)
+					return
+				}
+			}
+		}()
+	}
+	err = t.measure(ctx, results, length)
+	// Stop sending, cutting short any write blocked on a full buffer.
+	close(stop)
+	for _, conn := range t.streams {
+		conn.SetWriteDeadline(time.Now())
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	server, err := t.finish(ctx, length)
+	if err != nil {
+		return err
+	}
+	// The server was the receiver, so its results confirm the upload.
+	var report backend.ServerReport
+	for _, s := range server.Streams {
+		report.Bytes += s.Bytes
+		report.Elapsed = max(report.Elapsed, time.Duration(s.EndTime*float64(time.Second)))
+	}
+	if report.Elapsed == 0 {
+		report.Elapsed = length
+	}
+	select {
+	case results <- backend.ThroughputSample{Time: time.Now(), Server: &report}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// seconds rounds d up to whole seconds, as iperf3 test lengths are.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// test is an iperf3 test in progress.
+type test struct {
+	ctrl    *control
+	streams []net.Conn
+	counts  []atomic.Int64 // bytes moved on each stream
+	reverse bool           // the server sends
+	failed  chan error     // the first stream to fail
+	stop    func() bool    // stops closing the test when the context ends
+}
+
+// start sets up a test with the given parameters, on the control
+// connection left open by Connect or a new one, and returns once the
+// server has started it. On success the caller must close the test.
+func (c *Client) start(ctx context.Context, p params) (*test, error) {
+	p.TCP = true
+	p.Len = blockSize
+	p.PacingTimer = 1000
+	p.ClientVersion = "sparkyfish"
+
+	ctrl := c.ctrl
+	c.ctrl = nil
+	if ctrl == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", c.server)
+		if err != nil {
+			return nil, err
+		}
+		if ctrl, err = openControl(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &test{
+		ctrl:    ctrl,
+		counts:  make([]atomic.Int64, p.Parallel),
+		reverse: p.Reverse,
+		failed:  make(chan error, 1),
+	}
+	// Closing the connections aborts whatever the test is blocked on.
+	t.stop = context.AfterFunc(ctx, t.closeConns)
+
+	err := t.setup(ctx, c.server, p)
+	if err != nil {
+		t.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// setup sends the test parameters, opens the data streams, and waits for
+// the test to start.
+func (t *test) setup(ctx context.Context, server string, p params) error {
+	if err := t.ctrl.writeJSON(p); err != nil {
+		return fmt.Errorf("send test parameters: %w", err)
+	}
+	if err := t.ctrl.expect(stateCreateStreams); err != nil {
+		return err
+	}
+	var d net.Dialer
+	for i := 0; i < p.Parallel; i++ {
+		conn, err := d.DialContext(ctx, "tcp", server)
+		if err != nil {
+			return fmt.Errorf("open stream %d: %w", i+1, err)
+		}
+		t.streams = append(t.streams, conn)
+		conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+		if _, err := conn.Write(t.ctrl.cookie); err != nil {
+			return fmt.Errorf("open stream %d: %w", i+1, err)
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	if err := t.ctrl.expect(stateTestStart); err != nil {
+		return err
+	}
+	return t.ctrl.expect(stateTestRunning)
+}
+
+// fail records why a stream stopped, if it is the first to.
+func (t *test) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
+// measure reports the throughput of the test every reportInterval until
+// length has passed, a stream fails, or ctx is cancelled.
+func (t *test) measure(ctx context.Context, results chan<- backend.ThroughputSample, length time.Duration) error {
+	timer := time.NewTimer(length)
+	defer timer.Stop()
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	prev := make([]int64, len(t.counts))
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-t.failed:
+			return fmt.Errorf("stream ended early: %w", err)
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+			sample := backend.ThroughputSample{Time: time.Now()}
+			if len(t.counts) > 1 {
+				sample.Streams = make([]float64, len(t.counts))
+			}
+			for i := range t.counts {
+				total := t.counts[i].Load()
+				mbps := float64(total-prev[i]) * 8 / reportInterval.Seconds() / 1_000_000
+				prev[i] = total
+				sample.Mbps += mbps
+				if sample.Streams != nil {
+					sample.Streams[i] = mbps
+				}
+			}
+			select {
+			case results <- sample:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// finish ends the test after elapsed and swaps results with the server,
+// returning the server's.
+func (t *test) finish(ctx context.Context, elapsed time.Duration) (results, error) {
+	ours := results{SenderHasRetransmits: -1}
+	if !t.reverse {
+		ours.SenderHasRetransmits = 0
+	}
+	for i := range t.counts {
+		ours.Streams = append(ours.Streams, streamResult{
+			ID:          streamID(i),
+			Bytes:       t.counts[i].Load(),
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		})
+	}
+
+	var theirs results
+	err := t.ctrl.writeState(stateTestEnd)
+	if err == nil {
+		err = t.ctrl.expect(stateExchangeResults)
+	}
+	if err == nil {
+		if err = t.ctrl.writeJSON(ours); err != nil {
+			err = fmt.Errorf("send results: %w", err)
+		}
+	}
+	if err == nil {
+		if err = t.ctrl.readJSON(&theirs); err != nil {
+			err = fmt.Errorf("read server results: %w", err)
+		}
+	}
+	if err == nil {
+		err = t.ctrl.expect(stateDisplayResults)
+	}
+	if err == nil {
+		err = t.ctrl.writeState(stateIperfDone)
+	}
+	if err == nil {
+		t.ctrl.waitClose()
+	}
+	if err != nil && ctx.Err() != nil {
+		return results{}, ctx.Err()
+	}
+	return theirs, err
+}
+
+// close ends the test's connections.
+func (t *test) close() {
+	t.stop()
+	t.closeConns()
+}
+
+func (t *test) closeConns() {
+	t.ctrl.conn.Close()
+	for _, conn := range t.streams {
+		conn.Close()
+	}
+}
@@ -0,0 +1,179 @@
+package iperf3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t).start()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := New(Config{Params: protocol.Params{Duration: time.Second, Pings: 5, Streams: 2}})
+	info, err := c.Connect(ctx, srv.addr())
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if info.IP != "127.0.0.1" || info.Family != "IPv4" {
+		t.Errorf("server address %s %s, want IPv4 127.0.0.1", info.Family, info.IP)
+	}
+	if info.PingCount != 5 || info.TestDuration != time.Second || info.Streams != 2 {
+		t.Errorf("server info %+v doesn't match the requested parameters", info)
+	}
+
+	pings := make(chan backend.PingSample, 16)
+	if err := c.Ping(ctx, pings); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	var n int
+	for s := range pings {
+		if s.Seq != n || s.Latency <= 0 {
+			t.Errorf("ping sample %+v", s)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("got %d pings, want 5", n)
+	}
+	if d := srv.deniedCount(); d != 5 {
+		t.Errorf("server turned away %d connections, want one per ping", d)
+	}
+
+	down := make(chan backend.ThroughputSample, 16)
+	if err := c.Download(ctx, down); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	checkThroughput(t, "download", down)
+
+	up := make(chan backend.ThroughputSample, 16)
+	if err := c.Upload(ctx, up); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	report := checkThroughput(t, "upload", up)
+	if report == nil || report.Bytes == 0 || report.Elapsed != time.Second {
+		t.Errorf("upload server report %+v, want the bytes received over 1s", report)
+	}
+
+	tests := srv.tests()
+	if len(tests) != 3 {
+		t.Fatalf("server ran %d tests, want 3", len(tests))
+	}
+	if p := tests[0]; p.Parallel != 1 || p.Time != 2 || p.Reverse {
+		t.Errorf("ping test params %+v, want 1 stream for 2s", p)
+	}
+	if p := tests[1]; p.Parallel != 2 || p.Time != 1 || !p.Reverse {
+		t.Errorf("download test params %+v, want 2 reverse streams for 1s", p)
+	}
+	if p := tests[2]; p.Parallel != 2 || p.Time != 1 || p.Reverse {
+		t.Errorf("upload test params %+v, want 2 streams for 1s", p)
+	}
+}
+
+// checkThroughput drains a throughput test's samples, checks them, and
+// returns its server report, if any.
+func checkThroughput(t *testing.T, name string, results <-chan backend.ThroughputSample) *backend.ServerReport {
+	t.Helper()
+	var n int
+	var report *backend.ServerReport
+	for s := range results {
+		if s.Server != nil {
+			report = s.Server
+			continue
+		}
+		n++
+		if len(s.Streams) != 2 {
+			t.Errorf("%s sample has %d stream rates, want 2", name, len(s.Streams))
+		}
+	}
+	if n == 0 {
+		t.Errorf("no %s samples", name)
+	}
+	return report
+}
+
+func TestConnect_Busy(t *testing.T) {
+	srv := newTestServer(t)
+	srv.busy = true
+	srv.start()
+
+	c := New(Config{})
+	if _, err := c.Connect(context.Background(), srv.addr()); !errors.Is(err, ErrBusy) {
+		t.Errorf("Connect: got %v, want ErrBusy", err)
+	}
+}
+
+func TestDownload_ServerError(t *testing.T) {
+	srv := newTestServer(t)
+	srv.errCode = 7
+	srv.start()
+
+	c := New(Config{Params: protocol.Params{Duration: time.Second}})
+	if _, err := c.Connect(context.Background(), srv.addr()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	err := c.Download(context.Background(), make(chan backend.ThroughputSample, 16))
+	var serr *ServerError
+	if !errors.As(err, &serr) || serr.Code != 7 {
+		t.Errorf("Download: got %v, want server error 7", err)
+	}
+}
+
+func TestConnect_Params(t *testing.T) {
+	tests := []struct {
+		name   string
+		params protocol.Params
+		want   string
+	}{
+		{"fractional duration", protocol.Params{Duration: 1500 * time.Millisecond}, "whole number of seconds"},
+		{"too many streams", protocol.Params{Streams: 200}, "at most 128 streams"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(Config{Params: tt.params})
+			_, err := c.Connect(context.Background(), "127.0.0.1:1")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Connect: got %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCookie(t *testing.T) {
+	cookie, err := newCookie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookie) != cookieSize || cookie[cookieSize-1] != 0 {
+		t.Fatalf("cookie %q is not %d NUL-terminated bytes", cookie, cookieSize)
+	}
+	for _, b := range cookie[:cookieSize-1] {
+		if !strings.ContainsRune(cookieChars, rune(b)) {
+			t.Errorf("cookie %q has invalid character %q", cookie, b)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	reg, ok := backend.Lookup("iperf3")
+	if !ok {
+		t.Fatal("iperf3 is not registered")
+	}
+	if reg.Port(false) != DefaultPort {
+		t.Errorf("default port %s, want %s", reg.Port(false), DefaultPort)
+	}
+	if _, err := reg.New(backend.Options{AuthToken: "ignored"}); err != nil {
+		t.Errorf("New: %v", err)
+	}
+	for _, opts := range []backend.Options{{TLS: true}, {AuthUser: "alice"}, {LoadedLatency: true}} {
+		if _, err := reg.New(opts); err == nil {
+			t.Errorf("New(%+v) accepted options iperf3 doesn't support", opts)
+		}
+	}
+}
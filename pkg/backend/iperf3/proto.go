@@ -0,0 +1,215 @@
+package iperf3
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Test states, sent as single signed bytes on the control connection.
+// The values are those of iperf3's iperf_api.h.
+const (
+	stateTestStart       int8 = 1
+	stateTestRunning     int8 = 2
+	stateTestEnd         int8 = 4
+	stateParamExchange   int8 = 9
+	stateCreateStreams   int8 = 10
+	stateServerTerminate int8 = 11
+	stateClientTerminate int8 = 12
+	stateExchangeResults int8 = 13
+	stateDisplayResults  int8 = 14
+	stateIperfDone       int8 = 16
+	stateAccessDenied    int8 = -1
+	stateServerError     int8 = -2
+)
+
+const (
+	// cookieSize is the length of the cookie that ties data streams to
+	// their control connection: 36 characters and a NUL.
+	cookieSize  = 37
+	cookieChars = "abcdefghijklmnopqrstuvwxyz234567"
+
+	// maxJSONSize caps the parameter and result documents read from the
+	// server.
+	maxJSONSize = 1 << 20
+)
+
+// ErrBusy is returned when the server is running another client's test.
+// iperf3 servers run one test at a time and don't say when they'll be
+// free.
+var ErrBusy = errors.New("iperf3 server is busy running another test")
+
+// params are the test parameters the client sends the server. iperf3
+// treats some keys, such as reverse, as set whenever they are present, so
+// those are omitted when false.
+type params struct {
+	TCP           bool   `json:"tcp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"` // seconds
+	Num           int    `json:"num"`
+	BlockCount    int    `json:"blockcount"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"` // the server sends
+	Len           int    `json:"len"`               // block size
+	PacingTimer   int    `json:"pacing_timer"`
+	ClientVersion string `json:"client_version"`
+}
+
+// results are what each side counted, exchanged at the end of a test.
+type results struct {
+	CPUUtilTotal         float64        `json:"cpu_util_total"`
+	CPUUtilUser          float64        `json:"cpu_util_user"`
+	CPUUtilSystem        float64        `json:"cpu_util_system"`
+	SenderHasRetransmits int            `json:"sender_has_retransmits"`
+	Streams              []streamResult `json:"streams"`
+}
+
+type streamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"` // seconds from the start of the test
+}
+
+// streamID returns the ID iperf3 gives the i-th stream of a test, counting
+// from 0. Both sides number streams the same way and match results by ID.
+func streamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+// newCookie returns a random cookie in iperf3's format.
+func newCookie() ([]byte, error) {
+	cookie := make([]byte, cookieSize)
+	if _, err := rand.Read(cookie[:cookieSize-1]); err != nil {
+		return nil, err
+	}
+	for i := range cookieSize - 1 {
+		cookie[i] = cookieChars[int(cookie[i])%len(cookieChars)]
+	}
+	cookie[cookieSize-1] = 0
+	return cookie, nil
+}
+
+// control is the control connection of one test.
+type control struct {
+	conn    net.Conn
+	cookie  []byte
+	timeout time.Duration // for each exchange with the server
+}
+
+// readState reads the next state from the server.
+func (c *control) readState() (int8, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	var b [1]byte
+	if _, err := io.ReadFull(c.conn, b[:]); err != nil {
+		return 0, fmt.Errorf("read test state: %w", err)
+	}
+	return int8(b[0]), nil
+}
+
+// expect reads the next state and returns an error unless it is want.
+func (c *control) expect(want int8) error {
+	state, err := c.readState()
+	if err != nil {
+		return err
+	}
+	if state == want {
+		return nil
+	}
+	return c.stateError(state)
+}
+
+// stateError explains why the server sent state instead of the next step
+// of the test.
+func (c *control) stateError(state int8) error {
+	switch state {
+	case stateAccessDenied:
+		return ErrBusy
+	case stateServerError:
+		// Followed by iperf3's own error number and the system's errno.
+		var codes [8]byte
+		if _, err := io.ReadFull(c.conn, codes[:]); err != nil {
+			return errors.New("iperf3 server error")
+		}
+		return &ServerError{
+			Code:  int32(binary.BigEndian.Uint32(codes[:4])),
+			Errno: int32(binary.BigEndian.Uint32(codes[4:])),
+		}
+	case stateServerTerminate:
+		return errors.New("iperf3 server terminated the test")
+	default:
+		return fmt.Errorf("unexpected iperf3 test state %d", state)
+	}
+}
+
+// writeState sends a state to the server.
+func (c *control) writeState(state int8) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write([]byte{byte(state)}); err != nil {
+		return fmt.Errorf("send test state: %w", err)
+	}
+	return nil
+}
+
+// waitClose waits for the server to close the connection after a test,
+// which it does once it is ready for the next one.
+func (c *control) waitClose() {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	io.Copy(io.Discard, c.conn)
+}
+
+// writeJSON sends v as a JSON document preceded by its length.
+func (c *control) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err = c.conn.Write(append(msg, data...))
+	return err
+}
+
+// readJSON reads a length-prefixed JSON document into v.
+func (c *control) readJSON(v any) error {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxJSONSize {
+		return fmt.Errorf("document of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ServerError is an error the server reported with iperf3's SERVER_ERROR
+// state.
+type ServerError struct {
+	Code  int32 // iperf3's error number (i_errno)
+	Errno int32 // the server's errno at the time, or 0
+}
+
+func (e *ServerError) Error() string {
+	if e.Errno != 0 {
+		return fmt.Sprintf("iperf3 server error %d (errno %d)", e.Code, e.Errno)
+	}
+	return fmt.Sprintf("iperf3 server error %d", e.Code)
+}
@@ -0,0 +1,32 @@
+package iperf3
+
+import (
+	"errors"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+func init() {
+	backend.Register(backend.Registration{
+		Scheme:      "iperf3",
+		Description: "iperf3 server",
+		DefaultPort: DefaultPort,
+		New:         newBackend,
+	})
+}
+
+// newBackend builds a Client from opts, rejecting the options iperf3
+// servers have no equivalent for. iperf3 servers don't authenticate
+// sparkyfish clients, so a token meant for sparkyfish servers is ignored,
+// but naming a user is an error.
+func newBackend(opts backend.Options) (backend.Backend, error) {
+	switch {
+	case opts.TLS:
+		return nil, errors.New("iperf3 servers do not support TLS")
+	case opts.AuthUser != "":
+		return nil, errors.New("iperf3 servers do not support authentication")
+	case opts.LoadedLatency:
+		return nil, errors.New("latency under load is not supported with iperf3")
+	}
+	return New(Config{Params: opts.Params, Network: opts.Network}), nil
+}
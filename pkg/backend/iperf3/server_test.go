@@ -0,0 +1,282 @@
+package iperf3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer is an in-process stand-in for an iperf3 server. Like iperf3
+// it runs one test at a time and turns other connections away while a
+// test is running.
+type testServer struct {
+	ln net.Listener
+
+	// busy makes the server deny every test, as if another client's test
+	// were running.
+	busy bool
+	// errCode makes the server answer test parameters with a server
+	// error carrying this code.
+	errCode int32
+
+	mu       sync.Mutex
+	running  bool
+	cookie   []byte        // of the running test
+	streams  chan net.Conn // data streams of the running test, while it sets up
+	received []params      // parameters of each test, in order
+	denied   int           // connections turned away
+	err      error         // the first protocol error seen
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		if err := s.error(); err != nil {
+			t.Errorf("server: %v", err)
+		}
+	})
+	return s
+}
+
+// start serves connections until the test ends.
+func (s *testServer) start() *testServer {
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr() string { return s.ln.Addr().String() }
+
+func (s *testServer) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *testServer) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *testServer) tests() []params {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]params(nil), s.received...)
+}
+
+func (s *testServer) deniedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.denied
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	s.mu.Lock()
+	running, streams, want := s.running, s.streams, s.cookie
+	if running && streams == nil {
+		s.denied++
+	}
+	s.mu.Unlock()
+
+	ctrl := &control{conn: conn, timeout: 5 * time.Second}
+	if running && streams == nil {
+		ctrl.writeState(stateAccessDenied)
+		conn.Close()
+		return
+	}
+
+	cookie := make([]byte, cookieSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if running {
+		if !bytes.Equal(cookie, want) {
+			s.fail(fmt.Errorf("stream cookie %q, want %q", cookie, want))
+			conn.Close()
+			return
+		}
+		streams <- conn
+		return
+	}
+
+	s.mu.Lock()
+	s.running, s.cookie = true, cookie
+	s.mu.Unlock()
+	// As with iperf3, the server is ready for the next test by the time
+	// the client sees the control connection close.
+	defer conn.Close()
+	defer func() {
+		s.mu.Lock()
+		s.running, s.cookie, s.streams = false, nil, nil
+		s.mu.Unlock()
+	}()
+	ctrl.cookie = cookie
+	if err := s.run(ctrl); err != nil {
+		s.fail(err)
+	}
+}
+
+// run runs the server side of a test on ctrl.
+func (s *testServer) run(ctrl *control) error {
+	if s.busy {
+		return ctrl.writeState(stateAccessDenied)
+	}
+	if err := ctrl.writeState(stateParamExchange); err != nil {
+		return err
+	}
+	var p params
+	if err := ctrl.readJSON(&p); err != nil {
+		return fmt.Errorf("read params: %w", err)
+	}
+	s.mu.Lock()
+	s.received = append(s.received, p)
+	s.mu.Unlock()
+	if s.errCode != 0 {
+		state := stateServerError
+		msg := []byte{byte(state)}
+		msg = binary.BigEndian.AppendUint32(msg, uint32(s.errCode))
+		msg = binary.BigEndian.AppendUint32(msg, 0)
+		_, err := ctrl.conn.Write(msg)
+		return err
+	}
+	if !p.TCP || p.Parallel < 1 || p.Time < 1 {
+		return fmt.Errorf("invalid params %+v", p)
+	}
+
+	streams := make(chan net.Conn, p.Parallel)
+	s.mu.Lock()
+	s.streams = streams
+	s.mu.Unlock()
+	if err := ctrl.writeState(stateCreateStreams); err != nil {
+		return err
+	}
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range p.Parallel {
+		select {
+		case conn := <-streams:
+			conns = append(conns, conn)
+		case <-time.After(5 * time.Second):
+			return errors.New("timed out waiting for streams")
+		}
+	}
+	s.mu.Lock()
+	s.streams = nil
+	s.mu.Unlock()
+	if err := ctrl.writeState(stateTestStart); err != nil {
+		return err
+	}
+	if err := ctrl.writeState(stateTestRunning); err != nil {
+		return err
+	}
+
+	counts := make([]atomic.Int64, len(conns))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, blockSize)
+			for {
+				var n int
+				var err error
+				if p.Reverse {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+					n, err = conn.Write(buf)
+				} else {
+					n, err = conn.Read(buf)
+				}
+				counts[i].Add(int64(n))
+				if err != nil {
+					// A sender times out only to check whether to stop.
+					var ne net.Error
+					if p.Reverse && errors.As(err, &ne) && ne.Timeout() {
+						continue
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	// The client ends the test.
+	ctrl.timeout = time.Duration(p.Time)*time.Second + 5*time.Second
+	err := ctrl.expect(stateTestEnd)
+	close(stop)
+	if !p.Reverse {
+		// Let the receivers drain what the client sent before it stopped.
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("waiting for test end: %w", err)
+	}
+	ctrl.timeout = 5 * time.Second
+
+	if err := ctrl.writeState(stateExchangeResults); err != nil {
+		return err
+	}
+	var client results
+	if err := ctrl.readJSON(&client); err != nil {
+		return fmt.Errorf("read client results: %w", err)
+	}
+	if len(client.Streams) != len(conns) {
+		return fmt.Errorf("client sent results for %d streams, want %d", len(client.Streams), len(conns))
+	}
+	ours := results{SenderHasRetransmits: -1}
+	for i := range conns {
+		if id := client.Streams[i].ID; id != streamID(i) {
+			return fmt.Errorf("client stream %d has id %d, want %d", i, id, streamID(i))
+		}
+		ours.Streams = append(ours.Streams, streamResult{
+			ID:      streamID(i),
+			Bytes:   counts[i].Load(),
+			EndTime: float64(p.Time),
+		})
+	}
+	if err := ctrl.writeJSON(ours); err != nil {
+		return err
+	}
+	if err := ctrl.writeState(stateDisplayResults); err != nil {
+		return err
+	}
+	return ctrl.expect(stateIperfDone)
+}
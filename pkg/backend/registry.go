@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// Options are the client settings a backend is built from. They cover
+// every backend; each takes the ones it supports and rejects the rest.
+type Options struct {
+	// Params are the test parameters to request from the server. Zero
+	// fields leave the choice to the server.
+	Params protocol.Params
+
+	// Network is "tcp4" or "tcp6" to connect over that address family
+	// only. Empty or "tcp" uses whichever address the server's name
+	// resolves to first.
+	Network string
+
+	// TLS connects over TLS. The server is verified against the system
+	// roots, or against TLSCAFile if set, using the host from the server
+	// address unless TLSServerName overrides it. TLSCertFile and
+	// TLSKeyFile present a client certificate.
+	TLS                   bool
+	TLSCAFile             string
+	TLSServerName         string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+
+	// AuthToken authenticates the client to servers that require it.
+	// AuthUser names the user the token belongs to; leave it empty for a
+	// server's shared secret.
+	AuthUser  string
+	AuthToken string
+
+	// LoadedLatency measures latency during the throughput tests.
+	LoadedLatency bool
+
+	// UDP are the rate and datagram size of the UDP test, for backends
+	// that implement UDPTester. Zero fields take the backend's defaults.
+	UDP protocol.UDPParams
+}
+
+// Registration describes a backend that targets select by the scheme of
+// their URL, such as "iperf3" in iperf3://host.
+type Registration struct {
+	Scheme      string
+	Description string
+
+	// DefaultPort is the port of targets that don't give one. TLSPort,
+	// if set, replaces it when Options.TLS is set.
+	DefaultPort string
+	TLSPort     string
+
+	// New builds the backend, or reports the options it doesn't support.
+	New func(Options) (Backend, error)
+}
+
+// Port returns the port of targets that don't give one.
+func (r Registration) Port(tls bool) string {
+	if tls && r.TLSPort != "" {
+		return r.TLSPort
+	}
+	return r.DefaultPort
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Registration)
+)
+
+// Register makes a backend available under r.Scheme. It is meant to be
+// called from the init function of the backend's package, so that every
+// backend compiled into a program is available to it. Register panics if
+// the scheme is already taken.
+func Register(r Registration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if r.Scheme == "" || r.New == nil {
+		panic("backend: Register needs a scheme and a New func")
+	}
+	if _, dup := registry[r.Scheme]; dup {
+		panic("backend: Register called twice for scheme " + r.Scheme)
+	}
+	registry[r.Scheme] = r
+}
+
+// Lookup returns the backend registered for scheme.
+func Lookup(scheme string) (Registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	r, ok := registry[strings.ToLower(scheme)]
+	return r, ok
+}
+
+// Registered returns every registered backend, sorted by scheme.
+func Registered() []Registration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	regs := make([]Registration, 0, len(registry))
+	for _, r := range registry {
+		regs = append(regs, r)
+	}
+	slices.SortFunc(regs, func(a, b Registration) int { return strings.Compare(a.Scheme, b.Scheme) })
+	return regs
+}
+
+// ParseTarget splits a target into the backend that serves it and the
+// address to connect to. A target is either scheme://host[:port], or a
+// bare host[:port] for the backend registered as def. The address keeps
+// the target's port, if it has one.
+func ParseTarget(target, def string) (Registration, string, error) {
+	scheme, addr := def, target
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return Registration{}, "", fmt.Errorf("invalid target %q: %w", target, err)
+		}
+		if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return Registration{}, "", fmt.Errorf("invalid target %q: want scheme://host[:port]", target)
+		}
+		scheme, addr = u.Scheme, u.Host
+	}
+	if addr == "" {
+		return Registration{}, "", errors.New("target has no host")
+	}
+	r, ok := Lookup(scheme)
+	if !ok {
+		return Registration{}, "", fmt.Errorf("unknown backend %q", scheme)
+	}
+	return r, addr, nil
+}
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"context"
+	"testing"
+)
+
+type nopBackend struct{}
+
+func (nopBackend) Connect(context.Context, string) (ServerInfo, error)     { return ServerInfo{}, nil }
+func (nopBackend) Ping(context.Context, chan<- PingSample) error           { return nil }
+func (nopBackend) Download(context.Context, chan<- ThroughputSample) error { return nil }
+func (nopBackend) Upload(context.Context, chan<- ThroughputSample) error   { return nil }
+func (nopBackend) Close() error                                            { return nil }
+
+func init() {
+	for _, scheme := range []string{"test", "test+tls"} {
+		Register(Registration{
+			Scheme:      scheme,
+			DefaultPort: "1",
+			TLSPort:     "2",
+			New:         func(Options) (Backend, error) { return nopBackend{}, nil },
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		scheme  string
+		addr    string
+		wantErr bool
+	}{
+		{"example.com", "test", "example.com", false},
+		{"example.com:7121", "test", "example.com:7121", false},
+		{"[2001:db8::1]:7121", "test", "[2001:db8::1]:7121", false},
+		{"test+tls://example.com", "test+tls", "example.com", false},
+		{"TEST://example.com:80/", "test", "example.com:80", false},
+		{"test://[2001:db8::1]", "test", "[2001:db8::1]", false},
+		{"nope://example.com", "", "", true},
+		{"test://example.com/path", "", "", true},
+		{"test://user@example.com", "", "", true},
+		{"test://", "", "", true},
+	}
+	for _, tt := range tests {
+		reg, addr, err := ParseTarget(tt.target, "test")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTarget(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if reg.Scheme != tt.scheme || addr != tt.addr {
+			t.Errorf("ParseTarget(%q) = %q, %q, want %q, %q", tt.target, reg.Scheme, addr, tt.scheme, tt.addr)
+		}
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	var schemes []string
+	for _, r := range Registered() {
+		schemes = append(schemes, r.Scheme)
+	}
+	if len(schemes) != 2 || schemes[0] != "test" || schemes[1] != "test+tls" {
+		t.Errorf("Registered() = %v, want [test test+tls]", schemes)
+	}
+
+	reg, _ := Lookup("test")
+	if reg.Port(false) != "1" || reg.Port(true) != "2" {
+		t.Errorf("Port = %s, %s, want 1 and 2", reg.Port(false), reg.Port(true))
+	}
+}
@@ -0,0 +1,552 @@
+// Package sfhttp implements backend.Backend over sparkyfish-server's HTTP
+// transport, for networks that only let web traffic out. It uses
+// net/http, so it honours the usual proxy environment variables
+// (HTTPS_PROXY, HTTP_PROXY, NO_PROXY).
+//
+// Latency is the round trip of a small request on a kept-alive
+// connection. Each throughput test is reserved first, which queues it on
+// the server like a TCP test, and then runs as one streamed request per
+// stream. See docs/PROTOCOL.md for the HTTP API.
+package sfhttp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+const (
+	reportInterval = 500 * time.Millisecond
+	pingInterval   = 100 * time.Millisecond
+	readSize       = 64 * 1024
+	randBufSize    = 10 * 1024 * 1024 // 10 MB
+)
+
+// Config holds client options.
+type Config struct {
+	// Params are the test parameters to request from the server. Zero
+	// fields leave the choice to the server.
+	Params protocol.Params
+
+	// TLS, if not nil, makes the client use HTTPS with this
+	// configuration. Unless it sets a server name, the host from the
+	// server address is verified.
+	TLS *tls.Config
+
+	// AuthToken authenticates the client to servers that require it.
+	// AuthUser names the user the token belongs to; leave it empty for a
+	// server's shared secret. Each request answers a challenge from the
+	// server, so the token itself is never sent.
+	AuthUser  string
+	AuthToken string
+
+	// Network is "tcp4" or "tcp6" to connect over that address family
+	// only. Empty or "tcp" uses whichever address the server's name
+	// resolves to first.
+	Network string
+}
+
+// Client implements backend.Backend for the HTTP transport.
+type Client struct {
+	cfg    Config
+	http   *http.Client
+	addr   string // host:port of the server
+	base   string // URL the API paths are relative to
+	params protocol.Params
+
+	mu       sync.Mutex
+	serverIP string // address of the first direct connection; empty through a proxy
+
+	randBuf []byte
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) Connect(ctx context.Context, addr string) (backend.ServerInfo, error) {
+	switch c.cfg.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return backend.ServerInfo{}, fmt.Errorf("invalid network %q", c.cfg.Network)
+	}
+	if c.cfg.AuthUser != "" && !protocol.ValidUser(c.cfg.AuthUser) {
+		return backend.ServerInfo{}, fmt.Errorf("invalid user name %q", c.cfg.AuthUser)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+
+	c.addr = addr
+	c.base = "http://" + addr
+	if c.cfg.TLS != nil {
+		c.base = "https://" + addr
+	}
+	c.serverIP = ""
+	c.http = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         c.dial,
+		TLSClientConfig:     c.cfg.TLS,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// Random data doesn't compress, and a proxy that tried would
+		// only get in the way.
+		DisableCompression: true,
+		// Stick to HTTP/1.1, which gives each stream a connection of its
+		// own. HTTP/2 would multiplex them over one.
+		TLSNextProto:        map[string]func(string, *tls.Conn) http.RoundTripper{},
+		MaxIdleConnsPerHost: 2,
+	}}
+
+	resp, err := c.get(ctx, protocol.HTTPHelloPath, c.cfg.Params.Query())
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+	defer resp.Body.Close()
+	var hello protocol.Hello
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&hello); err != nil {
+		return backend.ServerInfo{}, fmt.Errorf("read hello: %w", err)
+	}
+	if c.params, err = protocol.ParseParams(hello.Params); err != nil {
+		return backend.ServerInfo{}, fmt.Errorf("read hello: %w", err)
+	}
+
+	info := backend.ServerInfo{
+		Hostname:     hello.Cname,
+		Location:     hello.Location,
+		Version:      hello.Version,
+		PingCount:    c.params.Pings,
+		TestDuration: c.params.Duration,
+		Streams:      c.params.Streams,
+	}
+	if info.Hostname == "" {
+		info.Hostname = host
+	}
+	if resp.TLS != nil {
+		info.TLS = tls.VersionName(resp.TLS.Version) + ", " + tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+	c.mu.Lock()
+	if ap, err := netip.ParseAddrPort(c.serverIP); err == nil {
+		info.IP = ap.Addr().Unmap().String()
+		info.Family = "IPv6"
+		if ap.Addr().Unmap().Is4() {
+			info.Family = "IPv4"
+		}
+	}
+	c.mu.Unlock()
+	return info, nil
+}
+
+// dial connects to the server or a proxy. Once the server has been
+// reached directly, later connections to it go to the same address, so
+// that a test's streams reach the server that reserved it even behind
+// round-robin DNS. Through a proxy, the proxy decides.
+func (c *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.cfg.Network != "" {
+		network = c.cfg.Network
+	}
+	var d net.Dialer
+	if addr != c.addr {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	c.mu.Lock()
+	pinned := c.serverIP
+	c.mu.Unlock()
+	if pinned != "" {
+		return d.DialContext(ctx, network, pinned)
+	}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.serverIP == "" {
+		c.serverIP = conn.RemoteAddr().String()
+	}
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// Close closes the kept-alive connections. The server holds no state for
+// a client between tests, so there is nothing else to release.
+func (c *Client) Close() error {
+	if c.http != nil {
+		c.http.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (c *Client) Ping(ctx context.Context, results chan<- backend.PingSample) error {
+	defer close(results)
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for i := 0; i < c.params.Pings; i++ {
+		// The challenge, if any, is fetched before the clock starts.
+		req, err := c.request(ctx, http.MethodGet, protocol.HTTPPingPath, nil, nil)
+		if err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+		start := time.Now()
+		resp, err := c.send(req)
+		if err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+		// Drain the body so that the connection is reused.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		latency := time.Since(start)
+
+		select {
+		case results <- backend.PingSample{Seq: i, Latency: latency, Time: start}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if i < c.params.Pings-1 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) Download(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+
+	token, params, err := c.reserve(ctx, "download", results)
+	if err != nil {
+		return err
+	}
+	// Ending the test cancels whatever is left of the streams.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counts := make([]atomic.Int64, params.Streams)
+	ended := make(chan error, params.Streams)
+	for i := range params.Streams {
+		resp, err := c.get(ctx, protocol.HTTPDownloadPath, url.Values{"test": {token}})
+		if err != nil {
+			return fmt.Errorf("start stream %d: %w", i+1, err)
+		}
+		go func() {
+			defer resp.Body.Close()
+			buf := make([]byte, readSize)
+			for {
+				n, err := resp.Body.Read(buf)
+				counts[i].Add(int64(n))
+				if errors.Is(err, io.EOF) {
+					ended <- nil
+					return
+				}
+				if err != nil {
+					ended <- err
+					return
+				}
+			}
+		}()
+	}
+	_, err = measure(ctx, results, counts, ended, params.Duration+protocol.RecvGrace)
+	return err
+}
+
+func (c *Client) Upload(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+
+	if c.randBuf == nil {
+		c.randBuf = make([]byte, randBufSize)
+		if _, err := rand.Read(c.randBuf); err != nil {
+			return fmt.Errorf("generate random data: %w", err)
+		}
+	}
+
+	token, params, err := c.reserve(ctx, "upload", results)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := make(chan struct{})
+	counts := make([]atomic.Int64, params.Streams)
+	reports := make([]protocol.UploadReport, params.Streams)
+	ended := make(chan error, params.Streams)
+	for i := range params.Streams {
+		body := &uploadBody{data: c.randBuf, stop: stop, count: &counts[i]}
+		go func() {
+			resp, err := c.do(ctx, http.MethodPost, protocol.HTTPUploadPath, url.Values{"test": {token}}, body)
+			if err != nil {
+				ended <- fmt.Errorf("stream %d: %w", i+1, err)
+				return
+			}
+			defer resp.Body.Close()
+			err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&reports[i])
+			if err != nil {
+				err = fmt.Errorf("stream %d: read server report: %w", i+1, err)
+			}
+			ended <- err
+		}()
+	}
+
+	finished, err := measure(ctx, results, counts, ended, params.Duration)
+	close(stop)
+	if err != nil {
+		return err
+	}
+
+	// The server answers each stream with what it received once the
+	// stream's body ends. One that fails to answer in time is not an
+	// error; the client's own measurement stands.
+	timer := time.NewTimer(protocol.RecvGrace)
+	defer timer.Stop()
+	for ; finished < params.Streams; finished++ {
+		select {
+		case err := <-ended:
+			if err != nil {
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var total backend.ServerReport
+	for _, r := range reports {
+		total.Bytes += r.Bytes
+		total.Elapsed = max(total.Elapsed, time.Duration(r.ElapsedMs)*time.Millisecond)
+	}
+	select {
+	case results <- backend.ThroughputSample{Time: time.Now(), Server: &total}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// uploadBody is the body of an upload stream: random data, counted as it
+// is read, until stop is closed.
+type uploadBody struct {
+	data   []byte
+	offset int
+	stop   <-chan struct{}
+	count  *atomic.Int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.stop:
+		return 0, io.EOF
+	default:
+	}
+	n := copy(p, b.data[b.offset:])
+	b.offset = (b.offset + n) % len(b.data)
+	b.count.Add(int64(n))
+	return n, nil
+}
+
+// reserve reserves a test on the server, reporting its place in the
+// server's queue on results while it waits, and returns the test's token
+// and parameters.
+func (c *Client) reserve(ctx context.Context, test string, results chan<- backend.ThroughputSample) (string, protocol.Params, error) {
+	q := c.cfg.Params.Query()
+	q.Set("test", test)
+	resp, err := c.do(ctx, http.MethodPost, protocol.HTTPTestsPath, q, nil)
+	if err != nil {
+		return "", protocol.Params{}, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var status protocol.TestStatus
+		if err := dec.Decode(&status); err != nil {
+			if ctx.Err() != nil {
+				return "", protocol.Params{}, ctx.Err()
+			}
+			return "", protocol.Params{}, fmt.Errorf("read test status: %w", err)
+		}
+		if status.Test != "" {
+			params, err := protocol.ParseParams(status.Params)
+			if err != nil {
+				return "", protocol.Params{}, fmt.Errorf("read test status: %w", err)
+			}
+			if params.Streams < 1 || params.Duration <= 0 {
+				return "", protocol.Params{}, fmt.Errorf("invalid test parameters %q", status.Params)
+			}
+			return status.Test, params, nil
+		}
+		if status.Queue > 0 {
+			select {
+			case results <- backend.ThroughputSample{Time: time.Now(), QueuePosition: status.Queue}:
+			case <-ctx.Done():
+				return "", protocol.Params{}, ctx.Err()
+			}
+		}
+	}
+}
+
+// measure reports the throughput of a test every reportInterval, from
+// the bytes counted on each stream, until timeout passes, every stream
+// has ended, or one fails. It returns the number of streams that ended.
+func measure(ctx context.Context, results chan<- backend.ThroughputSample, counts []atomic.Int64, ended <-chan error, timeout time.Duration) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	var finished int
+	prev := make([]int64, len(counts))
+	for {
+		select {
+		case <-ctx.Done():
+			return finished, ctx.Err()
+		case err := <-ended:
+			if err != nil {
+				return finished, err
+			}
+			if finished++; finished == len(counts) {
+				return finished, nil
+			}
+		case <-timer.C:
+			return finished, nil
+		case <-ticker.C:
+			sample := backend.ThroughputSample{Time: time.Now()}
+			if len(counts) > 1 {
+				sample.Streams = make([]float64, len(counts))
+			}
+			for i := range counts {
+				total := counts[i].Load()
+				mbps := float64(total-prev[i]) * 8 / reportInterval.Seconds() / 1_000_000
+				prev[i] = total
+				sample.Mbps += mbps
+				if sample.Streams != nil {
+					sample.Streams[i] = mbps
+				}
+			}
+			select {
+			case results <- sample:
+			case <-ctx.Done():
+				return finished, ctx.Err()
+			}
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, path, q, nil)
+}
+
+// do sends a request to the server and returns the response if it
+// succeeded, as send does.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body io.Reader) (*http.Response, error) {
+	req, err := c.request(ctx, method, path, q, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+// request builds a request to the server. If the client has a token, it
+// fetches a challenge and answers it in the request's Authorization
+// header.
+func (c *Client) request(ctx context.Context, method, path string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := c.base + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.cfg.AuthToken != "" {
+		challenge, err := c.challenge(ctx)
+		if err != nil {
+			return nil, err
+		}
+		user := c.cfg.AuthUser
+		if user == "" {
+			user = protocol.SharedUser
+		}
+		req.Header.Set("Authorization", protocol.HTTPAuthorization(c.cfg.AuthToken, user, challenge))
+	}
+	return req, nil
+}
+
+// challenge fetches an authentication challenge from the server.
+func (c *Client) challenge(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+protocol.HTTPChallengePath, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return "", fmt.Errorf("authentication challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	var ch protocol.Challenge
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&ch); err != nil {
+		return "", fmt.Errorf("read authentication challenge: %w", err)
+	}
+	// Drain the body so that the connection is reused, as the ping that
+	// may follow should not time a new one.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if _, err := hex.DecodeString(ch.Challenge); err != nil || len(ch.Challenge) != 2*protocol.ChallengeLen {
+		return "", fmt.Errorf("invalid authentication challenge: %q", ch.Challenge)
+	}
+	return ch.Challenge, nil
+}
+
+// send sends a request to the server and returns the response if it
+// succeeded. Refusals are returned as errors, as backend.BusyError and
+// backend.RateLimitError where they apply.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		if retry > 0 {
+			return nil, &backend.BusyError{RetryAfter: time.Duration(retry) * time.Second}
+		}
+	case http.StatusTooManyRequests:
+		return nil, &backend.RateLimitError{RetryAfter: time.Duration(retry) * time.Second}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if text := strings.TrimSpace(string(msg)); text != "" {
+		return nil, fmt.Errorf("server error: %s: %s", resp.Status, text)
+	}
+	return nil, fmt.Errorf("server error: %s", resp.Status)
+}
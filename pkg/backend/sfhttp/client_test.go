@@ -0,0 +1,171 @@
+package sfhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// fakeServer is a minimal stand-in for sparkyfish-server's HTTP
+// transport. Its tests last one second and it queues each reservation
+// once before granting it.
+type fakeServer struct {
+	streams  int
+	received atomic.Int64
+	auth     string // "user:token" required, if set
+
+	challenges sync.Map // issued and not yet answered
+	issued     atomic.Int64
+}
+
+func (f *fakeServer) handler() http.Handler {
+	params := protocol.Params{Duration: time.Second, Pings: 3, Streams: f.streams}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+protocol.HTTPHelloPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(protocol.Hello{Cname: "fake.example.com", Version: "1.0", Params: params.String(), Limits: params.String()})
+	})
+	mux.HandleFunc("GET "+protocol.HTTPChallengePath, func(w http.ResponseWriter, r *http.Request) {
+		challenge := fmt.Sprintf("%032x", f.issued.Add(1))
+		f.challenges.Store(challenge, true)
+		json.NewEncoder(w).Encode(protocol.Challenge{Challenge: challenge})
+	})
+	mux.HandleFunc("GET "+protocol.HTTPPingPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST "+protocol.HTTPTestsPath, func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		enc.Encode(protocol.TestStatus{Queue: 1})
+		enc.Encode(protocol.TestStatus{Test: "t1", Params: params.String()})
+	})
+	mux.HandleFunc("GET "+protocol.HTTPDownloadPath, func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64*1024)
+		for end := time.Now().Add(params.Duration); time.Now().Before(end); {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("POST "+protocol.HTTPUploadPath, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		n, _ := io.Copy(io.Discard, r.Body)
+		f.received.Add(n)
+		json.NewEncoder(w).Encode(protocol.UploadReport{Bytes: n, ElapsedMs: time.Since(start).Milliseconds()})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.auth != "" && r.URL.Path != protocol.HTTPChallengePath {
+			user, token, _ := strings.Cut(f.auth, ":")
+			got, challenge, response, ok := protocol.ParseHTTPAuthorization(r.Header.Get("Authorization"))
+			_, issued := f.challenges.LoadAndDelete(challenge)
+			if !ok || !issued || got != user || response != protocol.AuthResponse(token, user, challenge) {
+				http.Error(w, "authentication failed", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func TestClient(t *testing.T) {
+	f := &fakeServer{streams: 2, auth: "alice:t0k3n"}
+	ts := httptest.NewServer(f.handler())
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := New(Config{AuthUser: "alice", AuthToken: "t0k3n"})
+	info, err := c.Connect(ctx, strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := backend.ServerInfo{
+		Hostname: "fake.example.com", Version: "1.0", IP: "127.0.0.1", Family: "IPv4",
+		PingCount: 3, TestDuration: time.Second, Streams: 2,
+	}
+	if info != want {
+		t.Errorf("info = %+v, want %+v", info, want)
+	}
+
+	pings := make(chan backend.PingSample, 10)
+	if err := c.Ping(ctx, pings); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for range pings {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("%d pings, want 3", n)
+	}
+
+	samples := make(chan backend.ThroughputSample, 100)
+	if err := c.Download(ctx, samples); err != nil {
+		t.Fatal(err)
+	}
+	var queued, measured bool
+	for s := range samples {
+		if s.QueuePosition == 1 {
+			queued = true
+		}
+		if s.Measured() && s.Mbps > 0 && len(s.Streams) == 2 {
+			measured = true
+		}
+	}
+	if !queued || !measured {
+		t.Errorf("download: queue position reported %v, throughput measured %v", queued, measured)
+	}
+
+	samples = make(chan backend.ThroughputSample, 100)
+	if err := c.Upload(ctx, samples); err != nil {
+		t.Fatal(err)
+	}
+	var report *backend.ServerReport
+	for s := range samples {
+		if s.Server != nil {
+			report = s.Server
+		}
+	}
+	if report == nil || report.Bytes != f.received.Load() || report.Bytes == 0 {
+		t.Errorf("upload report %+v, server received %d bytes", report, f.received.Load())
+	}
+}
+
+func TestDo_Errors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/busy":
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/limited":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			http.Error(w, "authentication failed", http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	c := New(Config{})
+	if _, err := c.Connect(context.Background(), strings.TrimPrefix(ts.URL, "http://")); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Connect: %v, want authentication failure", err)
+	}
+
+	var busy *backend.BusyError
+	if _, err := c.get(context.Background(), "/busy", nil); !errors.As(err, &busy) || busy.RetryAfter != 7*time.Second {
+		t.Errorf("busy: %v", err)
+	}
+	var limited *backend.RateLimitError
+	if _, err := c.get(context.Background(), "/limited", nil); !errors.As(err, &limited) || limited.RetryAfter != 30*time.Second {
+		t.Errorf("rate limited: %v", err)
+	}
+}
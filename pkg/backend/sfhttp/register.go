@@ -0,0 +1,58 @@
+package sfhttp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/backend/sparkyfish"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func init() {
+	backend.Register(backend.Registration{
+		Scheme:      "http",
+		Description: "sparkyfish server's HTTP transport",
+		DefaultPort: "80",
+		TLSPort:     "443",
+		New:         newBackend,
+	})
+	backend.Register(backend.Registration{
+		Scheme:      "https",
+		Description: "sparkyfish server's HTTP transport over TLS",
+		DefaultPort: "443",
+		New: func(opts backend.Options) (backend.Backend, error) {
+			opts.TLS = true
+			return newBackend(opts)
+		},
+	})
+}
+
+// newBackend builds a Client from opts. The TLS options are the same as
+// for the TCP protocol, so the sparkyfish backend loads them.
+func newBackend(opts backend.Options) (backend.Backend, error) {
+	if opts.LoadedLatency {
+		return nil, errors.New("latency under load is not supported over HTTP")
+	}
+	if opts.AuthUser != "" && !protocol.ValidUser(opts.AuthUser) {
+		return nil, fmt.Errorf("invalid user name %q", opts.AuthUser)
+	}
+	tlsConf, err := sparkyfish.Config{
+		TLS:                   opts.TLS,
+		TLSCAFile:             opts.TLSCAFile,
+		TLSServerName:         opts.TLSServerName,
+		TLSCertFile:           opts.TLSCertFile,
+		TLSKeyFile:            opts.TLSKeyFile,
+		TLSInsecureSkipVerify: opts.TLSInsecureSkipVerify,
+	}.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return New(Config{
+		Params:    opts.Params,
+		TLS:       tlsConf,
+		AuthUser:  opts.AuthUser,
+		AuthToken: opts.AuthToken,
+		Network:   opts.Network,
+	}), nil
+}
@@ -0,0 +1,111 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+const testChallenge = "00112233445566778899aabbccddeeff"
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		token    string
+		request  string // last line of the HELO response
+		result   string // server's answer to the client's AUTH line
+		wantAuth string // AUTH line the client should send; empty if none
+		wantErr  error
+	}{
+		{name: "open server", token: "t0k3n", request: "OPEN"},
+		{name: "open server without token", request: "OPEN"},
+		{
+			name: "user token", user: "alice", token: "t0k3n",
+			request:  "AUTH " + testChallenge,
+			result:   "OK",
+			wantAuth: "AUTH alice " + protocol.AuthResponse("t0k3n", "alice", testChallenge),
+		},
+		{
+			name: "shared secret", token: "sh4red",
+			request:  "AUTH " + testChallenge,
+			result:   "OK",
+			wantAuth: "AUTH - " + protocol.AuthResponse("sh4red", protocol.SharedUser, testChallenge),
+		},
+		{
+			name: "rejected", user: "alice", token: "guess",
+			request:  "AUTH " + testChallenge,
+			result:   "ERR:Authentication failed",
+			wantAuth: "AUTH alice " + protocol.AuthResponse("guess", "alice", testChallenge),
+			wantErr:  ErrAuthFailed,
+		},
+		{name: "no token", request: "AUTH " + testChallenge, wantErr: ErrAuthRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, server := pipeSession(3)
+			defer s.Close()
+			defer server.Close()
+
+			sent := make(chan string, 1)
+			go func() {
+				server.Write([]byte(tt.request + "\n"))
+				if tt.result == "" {
+					return
+				}
+				line, _ := bufio.NewReader(server).ReadString('\n')
+				sent <- strings.TrimSpace(line)
+				server.Write([]byte(tt.result + "\n"))
+			}()
+
+			err := s.authenticate(tt.user, tt.token)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+
+			if tt.wantAuth != "" {
+				if got := <-sent; got != tt.wantAuth {
+					t.Errorf("client sent %q, want %q", got, tt.wantAuth)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticate_InvalidChallenge(t *testing.T) {
+	for _, line := range []string{"AUTH", "AUTH xyz", "AUTH 0011", "WELCOME"} {
+		t.Run(line, func(t *testing.T) {
+			s, server := pipeSession(3)
+			defer s.Close()
+			defer server.Close()
+
+			go server.Write([]byte(line + "\n"))
+			if err := s.authenticate("alice", "t0k3n"); err == nil {
+				t.Errorf("expected an error for %q", line)
+			}
+		})
+	}
+}
+
+func TestHelo_AuthRequired(t *testing.T) {
+	s, server := pipeSession(2)
+	defer s.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		server.Write([]byte("ERR:Authentication required\n"))
+	}()
+
+	if _, err := s.helo("host:7121", protocol.Params{}); !errors.Is(err, ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired, got %v", err)
+	}
+}
@@ -9,14 +9,12 @@ import (
 	"time"
 
 	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
 const (
-	reportInterval       = 500 * time.Millisecond
-	throughputTestLength = 10 * time.Second
-	downloadGrace        = 2 * time.Second // extra time for server startup
-	numPings             = 30
-	randBufSize          = 10 * 1024 * 1024 // 10 MB
+	reportInterval = 500 * time.Millisecond
+	randBufSize    = 10 * 1024 * 1024 // 10 MB
 )
 
 // blockSizeForElapsed returns a ramping block size so that charts update
@@ -35,26 +33,86 @@ func blockSizeForElapsed(elapsed time.Duration) int64 {
 	}
 }
 
+// Config holds client options.
+type Config struct {
+	// Params are the test parameters to request from the server. Zero
+	// fields leave the choice to the server. Servers that only speak
+	// protocol version 0 always run the defaults.
+	Params protocol.Params
+
+	// TLS wraps every connection in TLS. The server is verified against
+	// the system roots, or against TLSCAFile if set, using the host from
+	// the server address unless TLSServerName overrides it.
+	// TLSCertFile and TLSKeyFile present a client certificate to servers
+	// that require one.
+	TLS                   bool
+	TLSCAFile             string
+	TLSServerName         string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool // accept any server certificate; for testing only
+
+	// AuthToken authenticates the client to servers that require it.
+	// AuthUser names the user the token belongs to; leave it empty for a
+	// server's shared secret.
+	AuthUser  string
+	AuthToken string
+
+	// Network is "tcp4" or "tcp6" to connect over that address family
+	// only. Empty or "tcp" uses whichever address the server's name
+	// resolves to first.
+	Network string
+
+	// LoadedLatency runs latency probes on a separate session during the
+	// throughput tests, to measure how much the test's traffic delays
+	// everything else on the link (bufferbloat).
+	LoadedLatency bool
+	// UDP are the rate and datagram size of the UDP test. Zero fields
+	// take protocol.DefaultUDPParams.
+	UDP protocol.UDPParams
+}
+
 // Client implements backend.Backend for the sparkyfish protocol.
 type Client struct {
+	cfg        Config
+	opts       dialOptions // set up by Connect
 	addr       string
 	serverInfo backend.ServerInfo
 	randBuf    []byte
 	sess       *session // reused from Connect for the first command
 }
 
-func New() *Client {
-	return &Client{}
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
 }
 
 func (c *Client) Connect(ctx context.Context, addr string) (backend.ServerInfo, error) {
 	c.addr = addr
 
-	s, info, err := dial(addr)
+	tlsConf, err := c.cfg.TLSConfig()
+	if err != nil {
+		return backend.ServerInfo{}, err
+	}
+	if c.cfg.AuthUser != "" && !protocol.ValidUser(c.cfg.AuthUser) {
+		return backend.ServerInfo{}, fmt.Errorf("invalid user name %q", c.cfg.AuthUser)
+	}
+	switch c.cfg.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return backend.ServerInfo{}, fmt.Errorf("invalid network %q", c.cfg.Network)
+	}
+	c.opts = dialOptions{network: c.cfg.Network, tls: tlsConf, user: c.cfg.AuthUser, token: c.cfg.AuthToken}
+
+	s, info, err := dial(ctx, addr, c.cfg.Params, c.opts)
 	if err != nil {
 		return backend.ServerInfo{}, err
 	}
 	c.sess = s
+	// Later sessions go to the same address, so that extra streams join
+	// their test on the same server even behind round-robin DNS, and
+	// skip the rejected HELO if the server only speaks version 0.
+	c.opts.ip = info.IP
+	c.opts.legacy = s.version == 0
 
 	c.serverInfo = info
 	return info, nil
@@ -72,6 +130,7 @@ func (c *Client) Ping(ctx context.Context, results chan<- backend.PingSample) er
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
+	numPings := s.params.Pings
 	for i := 0; i < numPings; i++ {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -87,7 +146,7 @@ func (c *Client) Ping(ctx context.Context, results chan<- backend.PingSample) er
 		latency := time.Since(start)
 
 		select {
-		case results <- backend.PingSample{Seq: i, Latency: latency}:
+		case results <- backend.PingSample{Seq: i, Latency: latency, Time: start}:
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -108,19 +167,26 @@ func (c *Client) Ping(ctx context.Context, results chan<- backend.PingSample) er
 func (c *Client) Download(ctx context.Context, results chan<- backend.ThroughputSample) error {
 	defer close(results)
 
-	s := c.sess
-	if err := s.writeCommand("SND"); err != nil {
-		return fmt.Errorf("send SND: %w", err)
+	sessions, err := c.startStreams(ctx, "SND", results)
+	if err != nil {
+		return err
+	}
+	defer closeAll(sessions)
+	if c.cfg.LoadedLatency {
+		defer c.startLatencyProbes(ctx, sessions[0].params.Duration+protocol.RecvGrace, results)()
 	}
 
-	return c.measureThroughput(ctx, s, results, func(size int64) (int64, error) {
-		return io.CopyN(io.Discard, s.conn, size)
-	}, throughputTestLength+downloadGrace)
+	copyBlocks := make([]func(size int64) (int64, error), len(sessions))
+	for i, s := range sessions {
+		copyBlocks[i] = func(size int64) (int64, error) {
+			return io.CopyN(io.Discard, s.reader, size)
+		}
+	}
+	return c.measureThroughput(ctx, results, copyBlocks, nil, sessions[0].params.Duration+protocol.RecvGrace)
 }
 
 func (c *Client) Upload(ctx context.Context, results chan<- backend.ThroughputSample) error {
 	defer close(results)
-	defer c.sess.Close()
 
 	// Generate random data for upload on first use
 	if c.randBuf == nil {
@@ -130,78 +196,258 @@ func (c *Client) Upload(ctx context.Context, results chan<- backend.ThroughputSa
 		}
 	}
 
-	s := c.sess
-	if err := s.writeCommand("RCV"); err != nil {
-		return fmt.Errorf("send RCV: %w", err)
+	sessions, err := c.startStreams(ctx, "RCV", results)
+	if err != nil {
+		return err
+	}
+	defer closeAll(sessions)
+	if c.cfg.LoadedLatency {
+		defer c.startLatencyProbes(ctx, sessions[0].params.Duration+protocol.RecvGrace, results)()
+	}
+
+	copyBlocks := make([]func(size int64) (int64, error), len(sessions))
+	for i, s := range sessions {
+		reader := bytes.NewReader(c.randBuf)
+		copyBlocks[i] = func(size int64) (int64, error) {
+			if int64(reader.Len()) <= size {
+				reader.Seek(0, io.SeekStart)
+			}
+			return io.CopyN(s.conn, reader, size)
+		}
+	}
+	// Version 2 servers report what they receive, so the upload rate can
+	// be confirmed rather than inferred from how fast we could write.
+	if sessions[0].version < 2 {
+		return c.measureThroughput(ctx, results, copyBlocks, nil, sessions[0].params.Duration)
+	}
+	reports := make([]*uploadReports, len(sessions))
+	for i, s := range sessions {
+		reports[i] = watchUploadReports(s)
+	}
+	serverRate := func() float64 {
+		var total float64
+		for _, r := range reports {
+			total += r.currentRate()
+		}
+		return total
+	}
+	if err := c.measureThroughput(ctx, results, copyBlocks, serverRate, sessions[0].params.Duration); err != nil {
+		return err
+	}
+	return finishUpload(ctx, sessions, reports, results)
+}
+
+// finishUpload tells the server that the upload is over by half-closing
+// every stream, then waits for the server's totals and sends them on
+// results. A server that fails to report in time is not an error; the
+// client's own measurement stands.
+func finishUpload(ctx context.Context, sessions []*session, reports []*uploadReports, results chan<- backend.ThroughputSample) error {
+	for _, s := range sessions {
+		if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+
+	timer := time.NewTimer(protocol.RecvGrace)
+	defer timer.Stop()
+
+	var total backend.ServerReport
+	for _, r := range reports {
+		select {
+		case report, ok := <-r.final:
+			if !ok {
+				return nil
+			}
+			total.Bytes += report.Bytes
+			total.Elapsed = max(total.Elapsed, report.Elapsed)
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case results <- backend.ThroughputSample{Time: time.Now(), Server: &total}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	reader := bytes.NewReader(c.randBuf)
-	return c.measureThroughput(ctx, s, results, func(size int64) (int64, error) {
-		if int64(reader.Len()) <= size {
-			reader.Seek(0, io.SeekStart)
+// startStreams sends cmd on a fresh session and waits for the server to
+// start the test. If the server granted more than one stream, it then
+// opens the extra sessions, which join the first one's test using the
+// token from its GO line. On success the caller must close every session.
+func (c *Client) startStreams(ctx context.Context, cmd string, results chan<- backend.ThroughputSample) ([]*session, error) {
+	first, err := c.takeSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := first.writeCommand(cmd); err != nil {
+		first.Close()
+		return nil, fmt.Errorf("send %s: %w", cmd, err)
+	}
+	token, err := first.awaitStart(ctx, results)
+	if err != nil {
+		first.Close()
+		return nil, err
+	}
+
+	sessions := []*session{first}
+	if token == "" {
+		return sessions, nil
+	}
+
+	request := c.cfg.Params
+	request.Streams = first.params.Streams
+	request.Join = token
+	for i := 1; i < first.params.Streams; i++ {
+		s, _, err := dial(ctx, c.addr, request, c.opts)
+		if err != nil {
+			closeAll(sessions)
+			return nil, fmt.Errorf("open stream %d: %w", i+1, err)
+		}
+		sessions = append(sessions, s)
+		if err := s.writeCommand(cmd); err != nil {
+			closeAll(sessions)
+			return nil, fmt.Errorf("send %s on stream %d: %w", cmd, i+1, err)
+		}
+		if _, err := s.awaitStart(ctx, results); err != nil {
+			closeAll(sessions)
+			return nil, fmt.Errorf("start stream %d: %w", i+1, err)
 		}
-		return io.CopyN(s.conn, reader, size)
-	}, throughputTestLength)
+	}
+	return sessions, nil
+}
+
+func closeAll(sessions []*session) {
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+// Close closes the session left open by Connect if no test has used it.
+func (c *Client) Close() error {
+	if c.sess == nil {
+		return nil
+	}
+	err := c.sess.Close()
+	c.sess = nil
+	return err
+}
+
+// takeSession hands over the session left open by Connect, or dials a new
+// one if it has already been used by a throughput test. The caller must
+// close it. Each throughput test needs its own connection: after SND the
+// server half-closes its side, so it could not send the status lines that
+// precede RCV.
+func (c *Client) takeSession(ctx context.Context) (*session, error) {
+	if s := c.sess; s != nil {
+		c.sess = nil
+		return s, nil
+	}
+	s, _, err := dial(ctx, c.addr, c.cfg.Params, c.opts)
+	return s, err
 }
 
-// measureThroughput runs a throughput test with ramping block sizes.
-// copyBlock is called repeatedly to transfer one block of the given size.
+// streamBytes reports a block transferred on one stream.
+type streamBytes struct {
+	stream int
+	n      int64
+}
+
+// measureThroughput runs a throughput test with ramping block sizes over
+// one or more parallel streams. copyBlocks[i] is called repeatedly to
+// transfer one block of the given size on stream i. Samples report the
+// total rate and, for more than one stream, the rate of each. If
+// serverRate is not nil, it supplies each sample's ServerMbps.
 func (c *Client) measureThroughput(
 	ctx context.Context,
-	s *session,
 	results chan<- backend.ThroughputSample,
-	copyBlock func(size int64) (int64, error),
+	copyBlocks []func(size int64) (int64, error),
+	serverRate func() float64,
 	timeout time.Duration,
 ) error {
-	timer := time.NewTimer(timeout)
+	stop := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(stop) })
 	defer timer.Stop()
 
+	// done releases the copy goroutines if we return early.
+	done := make(chan struct{})
+	defer close(done)
+
 	ticker := time.NewTicker(reportInterval)
 	defer ticker.Stop()
 
 	start := time.Now()
-	var totalBytes, prevBytes int64
-
-	// Byte-counting goroutine
-	bytesCh := make(chan int64, 256)
-	copyDone := make(chan error, 1)
-	go func() {
-		for {
-			select {
-			case <-timer.C:
-				copyDone <- nil
-				return
-			default:
-			}
-			size := blockSizeForElapsed(time.Since(start))
-			n, err := copyBlock(size)
-			if err != nil {
-				if err == io.EOF || isConnectionClosed(err) {
+	totals := make([]int64, len(copyBlocks))
+	prev := make([]int64, len(copyBlocks))
+
+	// Byte-counting goroutines, one per stream
+	bytesCh := make(chan streamBytes, 256)
+	copyDone := make(chan error, len(copyBlocks))
+	for i, copyBlock := range copyBlocks {
+		go func() {
+			for {
+				select {
+				case <-stop:
 					copyDone <- nil
 					return
+				default:
+				}
+				size := blockSizeForElapsed(time.Since(start))
+				n, err := copyBlock(size)
+				if err != nil {
+					if err == io.EOF || isConnectionClosed(err) {
+						copyDone <- nil
+						return
+					}
+					copyDone <- err
+					return
+				}
+				select {
+				case bytesCh <- streamBytes{stream: i, n: n}:
+				case <-done:
+					return
 				}
-				copyDone <- err
-				return
 			}
-			bytesCh <- n
-		}
-	}()
+		}()
+	}
 
+	running := len(copyBlocks)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case err := <-copyDone:
-			return err
-		case n := <-bytesCh:
-			totalBytes += n
+			if err != nil {
+				return err
+			}
+			if running--; running == 0 {
+				return nil
+			}
+		case b := <-bytesCh:
+			totals[b.stream] += b.n
 		case <-ticker.C:
-			delta := totalBytes - prevBytes
-			mbps := float64(delta) * 8 / reportInterval.Seconds() / 1_000_000
-			prevBytes = totalBytes
+			sample := backend.ThroughputSample{Time: time.Now()}
+			if len(totals) > 1 {
+				sample.Streams = make([]float64, len(totals))
+			}
+			for i := range totals {
+				mbps := float64(totals[i]-prev[i]) * 8 / reportInterval.Seconds() / 1_000_000
+				prev[i] = totals[i]
+				sample.Mbps += mbps
+				if sample.Streams != nil {
+					sample.Streams[i] = mbps
+				}
+			}
+			if serverRate != nil {
+				sample.ServerMbps = serverRate()
+			}
 
 			select {
-			case results <- backend.ThroughputSample{Mbps: mbps, Time: time.Now()}:
+			case results <- sample:
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -0,0 +1,108 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// fixedRate returns a copy func that transfers a block every interval.
+func fixedRate(interval time.Duration) func(size int64) (int64, error) {
+	return func(size int64) (int64, error) {
+		time.Sleep(interval)
+		return size, nil
+	}
+}
+
+func TestMeasureThroughput_Streams(t *testing.T) {
+	c := New(Config{})
+	results := make(chan backend.ThroughputSample, 16)
+
+	// Stream 0 moves blocks ten times as often as stream 1.
+	copyBlocks := []func(size int64) (int64, error){
+		fixedRate(5 * time.Millisecond),
+		fixedRate(50 * time.Millisecond),
+	}
+	if err := c.measureThroughput(context.Background(), results, copyBlocks, nil, 1200*time.Millisecond); err != nil {
+		t.Fatalf("measureThroughput: %v", err)
+	}
+	close(results)
+
+	var n int
+	for s := range results {
+		n++
+		if len(s.Streams) != 2 {
+			t.Fatalf("sample has %d stream rates, want 2", len(s.Streams))
+		}
+		if sum := s.Streams[0] + s.Streams[1]; sum != s.Mbps {
+			t.Errorf("total %.2f Mbps != sum of streams %.2f", s.Mbps, sum)
+		}
+		if s.Streams[0] <= s.Streams[1] {
+			t.Errorf("stream rates %v: expected stream 0 to be faster", s.Streams)
+		}
+	}
+	if n == 0 {
+		t.Fatal("no samples reported")
+	}
+}
+
+func TestMeasureThroughput_SingleStream(t *testing.T) {
+	c := New(Config{})
+	results := make(chan backend.ThroughputSample, 16)
+
+	copyBlocks := []func(size int64) (int64, error){fixedRate(5 * time.Millisecond)}
+	if err := c.measureThroughput(context.Background(), results, copyBlocks, nil, 600*time.Millisecond); err != nil {
+		t.Fatalf("measureThroughput: %v", err)
+	}
+	close(results)
+
+	for s := range results {
+		if s.Streams != nil {
+			t.Errorf("single-stream sample has stream rates %v", s.Streams)
+		}
+	}
+}
+
+func TestMeasureThroughput_StreamError(t *testing.T) {
+	c := New(Config{})
+	results := make(chan backend.ThroughputSample, 16)
+
+	errBoom := errors.New("boom")
+	copyBlocks := []func(size int64) (int64, error){
+		fixedRate(5 * time.Millisecond),
+		func(size int64) (int64, error) { return 0, errBoom },
+	}
+	err := c.measureThroughput(context.Background(), results, copyBlocks, nil, 5*time.Second)
+	if !errors.Is(err, errBoom) {
+		t.Errorf("expected stream error, got %v", err)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	reg, ok := backend.Lookup("sparkyfish+tls")
+	if !ok {
+		t.Fatal("sparkyfish+tls is not registered")
+	}
+	b, err := reg.New(backend.Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !b.(*Client).cfg.TLS {
+		t.Error("sparkyfish+tls target does not use TLS")
+	}
+
+	reg, _ = backend.Lookup("sparkyfish")
+	for _, opts := range []backend.Options{
+		{AuthUser: "not a user"},
+		{TLS: true, TLSCertFile: "cert.pem"},
+		{UDP: protocol.UDPParams{Size: 9000}},
+	} {
+		if _, err := reg.New(opts); err == nil {
+			t.Errorf("New(%+v) accepted invalid options", opts)
+		}
+	}
+}
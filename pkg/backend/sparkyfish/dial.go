@@ -0,0 +1,163 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/resolver"
+)
+
+const (
+	// attemptDelay is how long a connection attempt gets before the next
+	// address is tried alongside it (RFC 8305, section 5).
+	attemptDelay = 250 * time.Millisecond
+	// attemptTimeout bounds each connection attempt, so that a dead
+	// address fails instead of hanging.
+	attemptTimeout = 10 * time.Second
+	// handshakeTimeout bounds the HELO handshake and authentication.
+	handshakeTimeout = 10 * time.Second
+)
+
+// connect opens a TCP connection to port on host. If opts.ip is set, it
+// connects to that address only. Otherwise it resolves host, keeps the
+// addresses of opts.network's family, and races them Happy Eyeballs style
+// (RFC 8305): a new attempt starts every attemptDelay, or as soon as the
+// previous one fails, and the first connection to succeed is used.
+func connect(ctx context.Context, host, port string, opts dialOptions) (net.Conn, error) {
+	ips := []string{opts.ip}
+	if opts.ip == "" {
+		var err error
+		if ips, err = resolver.LookupHost(ctx, host); err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		if opts.network != "" && opts.network != "tcp" {
+			ips = slices.DeleteFunc(ips, func(ip string) bool { return familyOf(ip) != familyName(opts.network) })
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("resolve %s: no %s address", host, familyName(opts.network))
+			}
+		}
+	}
+
+	conn, err := race(ctx, interleave(ips), port)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", net.JoinHostPort(host, port), err)
+	}
+	return conn, nil
+}
+
+// race connects to the first of ips that accepts a connection on port.
+// It returns the error from the first address if they all fail.
+func race(ctx context.Context, ips []string, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(ips)) // buffered so that losers never block
+	dialer := net.Dialer{Timeout: attemptTimeout}
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				// Close connections that succeed after this one.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			if next < len(ips) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// interleave reorders ips so that address families alternate, starting
+// with the family of the resolver's first choice (RFC 8305, section 4).
+// Each family keeps its own order.
+func interleave(ips []string) []string {
+	if len(ips) == 0 {
+		return ips
+	}
+	first := familyOf(ips[0])
+	var preferred, other []string
+	for _, ip := range ips {
+		if familyOf(ip) == first {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	out := make([]string, 0, len(ips))
+	for i := 0; i < max(len(preferred), len(other)); i++ {
+		if i < len(preferred) {
+			out = append(out, preferred[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
+
+// familyOf returns "IPv4" or "IPv6" for an IP address or IP:port, or ""
+// if it is neither.
+func familyOf(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return ""
+		}
+		ip = ap.Addr()
+	}
+	if ip.Unmap().Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// familyName returns the address family a network restricts dialing to.
+func familyName(network string) string {
+	if network == "tcp4" {
+		return "IPv4"
+	}
+	return "IPv6"
+}
@@ -0,0 +1,123 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// unreachable is a documentation address (RFC 5737) that connection
+// attempts either hang on or fail to reach.
+const unreachable = "192.0.2.1"
+
+func TestInterleave(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.1"}},
+		{
+			[]string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+			[]string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		},
+		{
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"},
+			[]string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3"},
+		},
+		{
+			[]string{"192.0.2.1", "2001:db8::1", "2001:db8::2"},
+			[]string{"192.0.2.1", "2001:db8::1", "2001:db8::2"},
+		},
+	}
+	for _, tt := range tests {
+		if got := interleave(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("interleave(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRace_DeadFirstAddress(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	start := time.Now()
+	conn, err := race(context.Background(), []string{unreachable, "127.0.0.1"}, port)
+	if err != nil {
+		t.Fatalf("race: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, ln.Addr())
+	}
+	if elapsed := time.Since(start); elapsed > attemptDelay+time.Second {
+		t.Errorf("took %v to fall back to the second address", elapsed)
+	}
+}
+
+func TestRace_AllFail(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	if _, err := race(context.Background(), []string{"127.0.0.1", "127.0.0.1"}, port); err == nil {
+		t.Fatal("expected an error with nothing listening")
+	}
+}
+
+func TestConnect_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := connect(ctx, unreachable, "7121", dialOptions{})
+	if err == nil {
+		t.Skip("unreachable address accepted a connection")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connect returned %v after the context was cancelled", elapsed)
+	}
+}
+
+func TestDial_CancelledDuringHandshake(t *testing.T) {
+	// A server that accepts connections but never answers HELO.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, _, err = dial(ctx, ln.Addr().String(), protocol.Params{}, dialOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial returned %v after the context was cancelled", elapsed)
+	}
+}
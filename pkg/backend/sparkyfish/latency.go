@@ -0,0 +1,87 @@
+package sparkyfish
+
+import (
+	"context"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+// minProbeInterval is the shortest interval between latency probes run
+// under load, the same as between the pings of the idle latency test.
+const minProbeInterval = 100 * time.Millisecond
+
+// startLatencyProbes opens a session for an ECO test that runs alongside
+// a throughput test lasting about length, and sends the round trip of
+// each probe on results as a sample with Latency set. The returned func
+// stops the probes; it must be called before results is closed.
+//
+// Loaded latency is extra to the throughput test, so if the session can't
+// be opened the test runs without it.
+func (c *Client) startLatencyProbes(ctx context.Context, length time.Duration, results chan<- backend.ThroughputSample) (stop func()) {
+	request := c.cfg.Params
+	request.Pings = int(length / minProbeInterval)
+	s, _, err := dial(ctx, c.addr, request, c.opts)
+	if err != nil {
+		return func() {}
+	}
+	if err := s.writeCommand("ECO"); err != nil {
+		s.Close()
+		return func() {}
+	}
+
+	// Spread the pings the server allowed over the whole test.
+	interval := minProbeInterval
+	if s.params.Pings > 0 {
+		interval = max(interval, length/time.Duration(s.params.Pings))
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		probeLatency(ctx, s, interval, done, results)
+	}()
+	return func() {
+		close(done)
+		s.Close() // unblocks a probe waiting for its echo
+		<-finished
+	}
+}
+
+// probeLatency runs the client side of an ECO test on s, sending a probe
+// every interval until done is closed or the pings agreed with the server
+// are used up. A failed probe ends the test without an error, as closing
+// the session is also how the probes are stopped.
+func probeLatency(ctx context.Context, s *session, interval time.Duration, done <-chan struct{}, results chan<- backend.ThroughputSample) {
+	buf := make([]byte, 1)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; i < s.params.Pings; i++ {
+		start := time.Now()
+		if _, err := s.conn.Write([]byte{46}); err != nil {
+			return
+		}
+		if _, err := s.conn.Read(buf); err != nil {
+			return
+		}
+		sample := backend.ThroughputSample{Time: start, Latency: time.Since(start)}
+
+		select {
+		case results <- sample:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
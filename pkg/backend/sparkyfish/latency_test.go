@@ -0,0 +1,70 @@
+package sparkyfish
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// echo answers ECO probes on conn until it is closed.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestProbeLatency(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+	go echo(server)
+	s.params = protocol.Params{Pings: 3}
+
+	results := make(chan backend.ThroughputSample, 10)
+	probeLatency(context.Background(), s, time.Millisecond, make(chan struct{}), results)
+	close(results)
+
+	var n int
+	for sample := range results {
+		n++
+		if sample.Latency <= 0 || sample.Time.IsZero() {
+			t.Errorf("probe %d: got %+v, want a latency and a time", n, sample)
+		}
+		if sample.Measured() {
+			t.Errorf("probe %d counts as a throughput measurement", n)
+		}
+	}
+	if n != 3 {
+		t.Errorf("got %d probes, want one per agreed ping (3)", n)
+	}
+}
+
+func TestProbeLatency_Stopped(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+	go echo(server)
+	s.params = protocol.Params{Pings: 1000}
+
+	results := make(chan backend.ThroughputSample, 1000)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		probeLatency(context.Background(), s, time.Millisecond, done, results)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("probes did not stop")
+	}
+	if n := len(results); n == 0 || n >= 1000 {
+		t.Errorf("got %d probes, want some but not all", n)
+	}
+}
@@ -3,65 +3,157 @@ package sparkyfish
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chrissnell/sparkyfish/pkg/backend"
-	"github.com/chrissnell/sparkyfish/pkg/resolver"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
-const protocolVersion = 0
+// protocolVersion is the highest version this client speaks.
+const protocolVersion = protocol.Version
+
+// errVersionRejected is returned by helo when the server rejects the
+// requested protocol version instead of answering with its own, as
+// servers that predate version negotiation do.
+var errVersionRejected = errors.New("protocol version not supported by server")
+
+var (
+	// ErrAuthRequired is returned when the server requires authentication
+	// and the client has no token.
+	ErrAuthRequired = errors.New("server requires authentication")
+	// ErrAuthFailed is returned when the server rejects the client's
+	// credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+)
 
 // session represents a single TCP connection to the sparkyfish server.
 type session struct {
-	conn   net.Conn
-	reader *bufio.Reader
+	conn    net.Conn
+	reader  *bufio.Reader
+	version int             // negotiated protocol version
+	params  protocol.Params // test parameters in effect; defaults for version 0
+	limits  protocol.Params // server limits; unknown (zero) for version 0
+}
+
+// dialOptions hold the connection settings shared by every session of a
+// Client.
+type dialOptions struct {
+	network string      // "tcp4" or "tcp6" to use only that address family; "" for either
+	ip      string      // if set, connect to this address instead of resolving the host
+	tls     *tls.Config // nil for plain TCP
+	user    string      // user name to authenticate as; protocol.SharedUser for a shared secret
+	token   string      // authentication token; empty if the client has none
+	legacy  bool        // the server predates version negotiation; ask for version 0 straight away
+}
+
+// dial opens a TCP connection, wrapped in TLS if opts.tls is set, and
+// performs the HELO handshake, requesting the given test parameters.
+// Servers that speak an older version answer with it, and the session
+// continues at that version. Servers that predate negotiation reject the
+// version instead; they only speak version 0, so dial reconnects once
+// with it unless opts.legacy says to start there, and they always run
+// the default parameters. Returns a session and the server info from the
+// handshake. Cancelling ctx aborts the dial and handshake, but not the
+// session once it is returned.
+func dial(ctx context.Context, addr string, request protocol.Params, opts dialOptions) (*session, backend.ServerInfo, error) {
+	if opts.legacy {
+		return dialVersion(ctx, addr, 0, request, opts)
+	}
+	s, info, err := dialVersion(ctx, addr, protocolVersion, request, opts)
+	if errors.Is(err, errVersionRejected) {
+		return dialVersion(ctx, addr, 0, request, opts)
+	}
+	return s, info, err
 }
 
-// dial opens a TCP connection and performs the HELO handshake.
-// Returns a session and the server info from the handshake.
-func dial(addr string) (*session, backend.ServerInfo, error) {
+// dialVersion opens a connection and performs the HELO handshake, and
+// authentication if the server asks for it, using the given protocol
+// version.
+func dialVersion(ctx context.Context, addr string, version int, request protocol.Params, opts dialOptions) (*session, backend.ServerInfo, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, backend.ServerInfo{}, fmt.Errorf("parse address %s: %w", addr, err)
 	}
 
-	ctx := context.Background()
-	ips, err := resolver.LookupHost(ctx, host)
+	conn, err := connect(ctx, host, port, opts)
 	if err != nil {
-		return nil, backend.ServerInfo{}, fmt.Errorf("resolve %s: %w", host, err)
+		return nil, backend.ServerInfo{}, err
 	}
 
-	var conn net.Conn
-	var lastErr error
-	for _, ip := range ips {
-		conn, lastErr = net.Dial("tcp", net.JoinHostPort(ip, port))
-		if lastErr == nil {
-			break
+	s, info, err := handshake(ctx, conn, addr, version, request, opts)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, backend.ServerInfo{}, ctx.Err()
 		}
+		return nil, backend.ServerInfo{}, err
 	}
-	if lastErr != nil {
-		return nil, backend.ServerInfo{}, fmt.Errorf("dial %s: %w", addr, lastErr)
+	return s, info, nil
+}
+
+// handshake sets up TLS if enabled and performs the HELO handshake and
+// authentication on conn. It gives up after handshakeTimeout, or when ctx
+// is cancelled.
+func handshake(ctx context.Context, conn net.Conn, addr string, version int, request protocol.Params, opts dialOptions) (*session, backend.ServerInfo, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(addr)
+	ip := conn.RemoteAddr().String()
+	var tlsState string
+	if opts.tls != nil {
+		tc, err := startTLS(ctx, conn, host, opts.tls)
+		if err != nil {
+			return nil, backend.ServerInfo{}, fmt.Errorf("connect to %s: %w", addr, err)
+		}
+		conn = tc
+		tlsState = describeTLS(tc.ConnectionState())
 	}
 
 	s := &session{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		version: version,
 	}
 
-	info, err := s.helo(addr)
+	info, err := s.helo(addr, request)
 	if err != nil {
-		conn.Close()
 		return nil, backend.ServerInfo{}, err
 	}
+	info.TLS = tlsState
+	if ap, err := netip.ParseAddrPort(ip); err == nil {
+		info.IP = ap.Addr().Unmap().String()
+		info.Family = familyOf(info.IP)
+	}
+
+	if s.version >= 3 {
+		if err := s.authenticate(opts.user, opts.token); err != nil {
+			return nil, backend.ServerInfo{}, err
+		}
+	}
 
+	if !stop() {
+		return nil, backend.ServerInfo{}, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
 	return s, info, nil
 }
 
-// helo performs the HELO handshake and returns server metadata.
-func (s *session) helo(addr string) (backend.ServerInfo, error) {
-	if err := s.writeCommand(fmt.Sprintf("HELO%d", protocolVersion)); err != nil {
+// helo performs the HELO handshake and returns server metadata. If the
+// server answers with an older version, the session continues at that
+// version. For version 1 it also sends the requested parameters and records the
+// accepted values, the server's limits and its software version.
+func (s *session) helo(addr string, request protocol.Params) (backend.ServerInfo, error) {
+	if err := s.writeCommand(fmt.Sprintf("HELO%d", s.version)); err != nil {
 		return backend.ServerInfo{}, fmt.Errorf("send HELO: %w", err)
 	}
 
@@ -69,10 +161,31 @@ func (s *session) helo(addr string) (backend.ServerInfo, error) {
 	if err != nil {
 		return backend.ServerInfo{}, fmt.Errorf("read HELO response: %w", err)
 	}
-	if strings.TrimSpace(response) != "HELO" {
+	response = strings.TrimSpace(response)
+	if response == "ERR:Protocol version not supported" {
+		return backend.ServerInfo{}, errVersionRejected
+	}
+	if strings.HasPrefix(response, "ERR:") {
+		return backend.ServerInfo{}, serverError(response)
+	}
+	if v, ok := strings.CutPrefix(response, "HELO "); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n >= s.version {
+			return backend.ServerInfo{}, fmt.Errorf("invalid HELO response: %q", response)
+		}
+		s.version = n
+	} else if response != "HELO" {
 		return backend.ServerInfo{}, fmt.Errorf("invalid HELO response: %q", response)
 	}
 
+	// The request is only sent once the server has accepted the version,
+	// so an older server never has unread data when it hangs up.
+	if s.version >= 1 {
+		if err := s.writeCommand(request.String()); err != nil {
+			return backend.ServerInfo{}, fmt.Errorf("send parameters: %w", err)
+		}
+	}
+
 	cname, err := s.reader.ReadString('\n')
 	if err != nil {
 		return backend.ServerInfo{}, fmt.Errorf("read cname: %w", err)
@@ -92,7 +205,161 @@ func (s *session) helo(addr string) (backend.ServerInfo, error) {
 		location = ""
 	}
 
-	return backend.ServerInfo{Hostname: cname, Location: location}, nil
+	var version string
+	s.params = protocol.DefaultParams()
+	if s.version >= 1 {
+		accepted, err := s.readParams()
+		if err != nil {
+			return backend.ServerInfo{}, fmt.Errorf("read accepted parameters: %w", err)
+		}
+		s.params = accepted.Accept(protocol.Params{}) // defaults for anything left unset
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return backend.ServerInfo{}, fmt.Errorf("read server limits: %w", err)
+		}
+		if s.limits, err = protocol.ParseParams(line); err != nil {
+			return backend.ServerInfo{}, fmt.Errorf("read server limits: %w", err)
+		}
+		version = sanitize(protocol.ServerVersion(line))
+	}
+
+	return backend.ServerInfo{
+		Hostname:     cname,
+		Location:     location,
+		Version:      version,
+		PingCount:    s.params.Pings,
+		TestDuration: s.params.Duration,
+		Streams:      s.params.Streams,
+	}, nil
+}
+
+// authenticate reads the last line of a version 3 HELO response. An open
+// server sends OPEN. Otherwise it sends a challenge, which the client
+// answers with its user name and protocol.AuthResponse for its token.
+func (s *session) authenticate(user, token string) error {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read authentication request: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "OPEN" {
+		return nil
+	}
+
+	challenge, ok := strings.CutPrefix(line, "AUTH ")
+	if !ok {
+		return fmt.Errorf("unexpected authentication request: %q", line)
+	}
+	if _, err := hex.DecodeString(challenge); err != nil || len(challenge) != 2*protocol.ChallengeLen {
+		return fmt.Errorf("invalid authentication challenge: %q", line)
+	}
+	if token == "" {
+		return ErrAuthRequired
+	}
+	if user == "" {
+		user = protocol.SharedUser
+	}
+
+	if err := s.writeCommand(fmt.Sprintf("AUTH %s %s", user, protocol.AuthResponse(token, user, challenge))); err != nil {
+		return fmt.Errorf("send authentication: %w", err)
+	}
+	line, err = s.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read authentication result: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "OK":
+		return nil
+	case strings.HasPrefix(line, "ERR:"):
+		return serverError(line)
+	default:
+		return fmt.Errorf("unexpected authentication result: %q", line)
+	}
+}
+
+// readParams reads one parameter line.
+func (s *session) readParams() (protocol.Params, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return protocol.Params{}, err
+	}
+	return protocol.ParseParams(line)
+}
+
+// awaitStart reads the status lines that a version 1 server sends after
+// SND or RCV, forwarding queue positions to results until the server
+// says GO. It returns the join token from the GO line, which is only
+// present when the test runs over several streams. It returns immediately
+// for version 0 sessions.
+func (s *session) awaitStart(ctx context.Context, results chan<- backend.ThroughputSample) (token string, err error) {
+	return s.awaitGo(func(pos int) error {
+		select {
+		case results <- backend.ThroughputSample{QueuePosition: pos, Time: time.Now()}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// awaitGo does the work of awaitStart, calling queued with each queue
+// position the server reports.
+func (s *session) awaitGo(queued func(pos int) error) (token string, err error) {
+	if s.version < 1 {
+		return "", nil
+	}
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("read test status: %w", err)
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "GO":
+			return "", nil
+		case strings.HasPrefix(line, "GO "):
+			token := strings.TrimPrefix(line, "GO ")
+			if !protocol.ValidToken(token) {
+				return "", fmt.Errorf("invalid join token: %q", line)
+			}
+			return token, nil
+		case strings.HasPrefix(line, "QUEUE "):
+			pos, err := strconv.Atoi(strings.TrimPrefix(line, "QUEUE "))
+			if err != nil {
+				return "", fmt.Errorf("invalid queue status: %q", line)
+			}
+			if err := queued(pos); err != nil {
+				return "", err
+			}
+		case strings.HasPrefix(line, "ERR:"):
+			return "", serverError(line)
+		default:
+			return "", fmt.Errorf("unexpected test status: %q", line)
+		}
+	}
+}
+
+// serverError converts an ERR: line from the server into an error,
+// recognizing the busy, rate limit, and authentication responses.
+func serverError(line string) error {
+	msg := sanitize(strings.TrimPrefix(line, "ERR:"))
+	switch msg {
+	case "Authentication required":
+		return ErrAuthRequired
+	case "Authentication failed":
+		return ErrAuthFailed
+	}
+	var secs int
+	if _, err := fmt.Sscanf(msg, "Server busy, retry after %d seconds", &secs); err == nil {
+		return &backend.BusyError{RetryAfter: time.Duration(secs) * time.Second}
+	}
+	if _, err := fmt.Sscanf(msg, "Rate limit exceeded, retry after %d seconds", &secs); err == nil {
+		return &backend.RateLimitError{RetryAfter: time.Duration(secs) * time.Second}
+	}
+	return fmt.Errorf("server error: %s", msg)
 }
 
 // writeCommand sends a command string followed by \r\n.
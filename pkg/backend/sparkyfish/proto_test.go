@@ -0,0 +1,374 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// pipeSession returns a session on one end of a pipe and the raw server end.
+func pipeSession(version int) (*session, net.Conn) {
+	client, server := net.Pipe()
+	return &session{conn: client, reader: bufio.NewReader(client), version: version}, server
+}
+
+func TestAwaitStart_Queue(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+
+	go server.Write([]byte("QUEUE 2\nQUEUE 1\nGO\n"))
+
+	results := make(chan backend.ThroughputSample, 10)
+	if token, err := s.awaitStart(context.Background(), results); err != nil || token != "" {
+		t.Fatalf("awaitStart = %q, %v", token, err)
+	}
+	close(results)
+
+	var positions []int
+	for r := range results {
+		positions = append(positions, r.QueuePosition)
+	}
+	if len(positions) != 2 || positions[0] != 2 || positions[1] != 1 {
+		t.Errorf("queue positions = %v, want [2 1]", positions)
+	}
+}
+
+func TestAwaitStart_Busy(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+
+	go server.Write([]byte("ERR:Server busy, retry after 12 seconds\n"))
+
+	_, err := s.awaitStart(context.Background(), make(chan backend.ThroughputSample, 1))
+	var busy *backend.BusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("expected BusyError, got %v", err)
+	}
+	if busy.RetryAfter != 12*time.Second {
+		t.Errorf("RetryAfter = %v, want 12s", busy.RetryAfter)
+	}
+}
+
+func TestAwaitStart_RateLimited(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+
+	go server.Write([]byte("ERR:Rate limit exceeded, retry after 300 seconds\n"))
+
+	_, err := s.awaitStart(context.Background(), make(chan backend.ThroughputSample, 1))
+	var limited *backend.RateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("expected RateLimitError, got %v", err)
+	}
+	if limited.RetryAfter != 5*time.Minute {
+		t.Errorf("RetryAfter = %v, want 5m", limited.RetryAfter)
+	}
+}
+
+func TestAwaitStart_Version0(t *testing.T) {
+	s, server := pipeSession(0)
+	defer s.Close()
+	defer server.Close()
+
+	// Nothing is read from the server for version 0 sessions.
+	if _, err := s.awaitStart(context.Background(), nil); err != nil {
+		t.Errorf("awaitStart on version 0: %v", err)
+	}
+}
+
+func TestAwaitStart_JoinToken(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"GO 3f9a0c\n", "3f9a0c", false},
+		{"GO not-hex\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s, server := pipeSession(1)
+			defer s.Close()
+			defer server.Close()
+
+			go server.Write([]byte(tt.line))
+
+			token, err := s.awaitStart(context.Background(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("awaitStart error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if token != tt.want {
+				t.Errorf("token = %q, want %q", token, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelo_VersionRejected(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		server.Write([]byte("ERR:Protocol version not supported\n"))
+	}()
+
+	if _, err := s.helo("host:7121", protocol.Params{}); !errors.Is(err, errVersionRejected) {
+		t.Errorf("expected errVersionRejected, got %v", err)
+	}
+}
+
+func TestHelo_Downgrade(t *testing.T) {
+	tests := []struct {
+		response    string
+		wantVersion int
+		wantErr     bool
+	}{
+		{"HELO 2", 2, false},
+		{"HELO 4", 0, true}, // not older than requested
+		{"HELO 0", 0, true}, // version 0 servers can't negotiate
+		{"HELO x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.response, func(t *testing.T) {
+			s, server := pipeSession(4)
+			defer s.Close()
+			defer server.Close()
+
+			go func() {
+				r := bufio.NewReader(server)
+				r.ReadString('\n')
+				server.Write([]byte(tt.response + "\n"))
+				r.ReadString('\n')
+				server.Write([]byte("host\nnone\nduration=10 pings=30 streams=1\n\n"))
+			}()
+
+			_, err := s.helo("host:7121", protocol.Params{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("helo error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && s.version != tt.wantVersion {
+				t.Errorf("session version = %d, want %d", s.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestHelo_V1Negotiation(t *testing.T) {
+	s, server := pipeSession(1)
+	defer s.Close()
+	defer server.Close()
+
+	request := protocol.Params{Duration: 60 * time.Second, Pings: 10}
+	got := make(chan []string, 1)
+	go func() {
+		r := bufio.NewReader(server)
+		helo, _ := r.ReadString('\n')
+		server.Write([]byte("HELO\n"))
+		params, _ := r.ReadString('\n')
+		got <- []string{helo, params}
+		server.Write([]byte("host.example.com\nnone\nduration=30 pings=10 streams=1\nduration=30 pings=100 streams=8 version=1.4.0\n"))
+	}()
+
+	info, err := s.helo("host:7121", request)
+	if err != nil {
+		t.Fatalf("helo: %v", err)
+	}
+
+	sent := <-got
+	if sent[0] != "HELO1\r\n" || sent[1] != "duration=60 pings=10\r\n" {
+		t.Errorf("client sent %q", sent)
+	}
+
+	want := protocol.Params{Duration: 30 * time.Second, Pings: 10, Streams: 1}
+	if s.params != want {
+		t.Errorf("session params = %+v, want %+v", s.params, want)
+	}
+	if s.limits.Streams != 8 {
+		t.Errorf("session limits = %+v", s.limits)
+	}
+	if info.Hostname != "host.example.com" || info.Location != "" {
+		t.Errorf("unexpected server info: %+v", info)
+	}
+	if info.TestDuration != 30*time.Second || info.PingCount != 10 {
+		t.Errorf("server info params = %v/%d", info.TestDuration, info.PingCount)
+	}
+	if info.Version != "1.4.0" {
+		t.Errorf("server version = %q, want 1.4.0", info.Version)
+	}
+
+	// The version reaches the JSON result.
+	res := result.New("host:7121", time.Now())
+	res.SetServer(info)
+	var buf bytes.Buffer
+	if err := res.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Server struct {
+			Version string `json:"version"`
+		} `json:"server"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("parse JSON: %v", err)
+	}
+	if doc.Server.Version != "1.4.0" {
+		t.Errorf("JSON server version = %q, want 1.4.0:\n%s", doc.Server.Version, buf.String())
+	}
+}
+
+func TestHelo_V0Defaults(t *testing.T) {
+	s, server := pipeSession(0)
+	defer s.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		server.Write([]byte("HELO\nnone\nnone\n"))
+	}()
+
+	info, err := s.helo("host:7121", protocol.Params{Pings: 5})
+	if err != nil {
+		t.Fatalf("helo: %v", err)
+	}
+	if s.params != protocol.DefaultParams() {
+		t.Errorf("version 0 session params = %+v, want defaults", s.params)
+	}
+	if info.Hostname != "host" {
+		t.Errorf("expected hostname from addr, got %q", info.Hostname)
+	}
+}
+
+// heloServer starts a listener on host that answers a single version 0
+// HELO, or skips the test if the address family isn't available.
+func heloServer(t *testing.T, host string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("listen on %s: %v", host, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("HELO\nnone\nnone\n"))
+	}()
+	return ln.Addr().String()
+}
+
+func TestDial_Network(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		network    string
+		wantFamily string
+		wantErr    string
+	}{
+		{"any over IPv4", "127.0.0.1", "", "IPv4", ""},
+		{"IPv4", "127.0.0.1", "tcp4", "IPv4", ""},
+		{"IPv6", "::1", "tcp6", "IPv6", ""},
+		{"no IPv6 address", "127.0.0.1", "tcp6", "", "no IPv6 address"},
+		{"no IPv4 address", "::1", "tcp4", "", "no IPv4 address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := heloServer(t, tt.host)
+			s, info, err := dialVersion(context.Background(), addr, 0, protocol.Params{}, dialOptions{network: tt.network})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer s.Close()
+			if info.Family != tt.wantFamily {
+				t.Errorf("family = %q, want %q", info.Family, tt.wantFamily)
+			}
+			if info.IP != tt.host {
+				t.Errorf("IP = %q, want %q", info.IP, tt.host)
+			}
+		})
+	}
+}
+
+// TestDial_LegacyServer checks that a server predating version
+// negotiation costs one extra connection, not one per version, and only
+// on the first dial.
+func TestDial_LegacyServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conns := make(chan string, protocolVersion+1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			helo, _ := bufio.NewReader(conn).ReadString('\n')
+			helo = strings.TrimSpace(helo)
+			conns <- helo
+			if helo != "HELO0" {
+				conn.Write([]byte("ERR:Protocol version not supported\n"))
+			} else {
+				conn.Write([]byte("HELO\nnone\nnone\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	s, _, err := dial(context.Background(), ln.Addr().String(), protocol.Params{}, dialOptions{})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	s.Close()
+	if s.version != 0 {
+		t.Errorf("session version = %d, want 0", s.version)
+	}
+
+	// Once known, a legacy server is asked for version 0 straight away.
+	s, _, err = dial(context.Background(), ln.Addr().String(), protocol.Params{}, dialOptions{legacy: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	s.Close()
+	ln.Close()
+
+	var got []string
+	for helo := range conns {
+		got = append(got, helo)
+	}
+	if want := []string{fmt.Sprintf("HELO%d", protocolVersion), "HELO0", "HELO0"}; !slices.Equal(got, want) {
+		t.Errorf("server saw %q, want %q", got, want)
+	}
+}
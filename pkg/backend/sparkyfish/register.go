@@ -0,0 +1,60 @@
+package sparkyfish
+
+import (
+	"fmt"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// DefaultPort is the port sparkyfish servers listen on unless told
+// otherwise.
+const DefaultPort = "7121"
+
+func init() {
+	backend.Register(backend.Registration{
+		Scheme:      "sparkyfish",
+		Description: "sparkyfish server over TCP",
+		DefaultPort: DefaultPort,
+		New:         newBackend,
+	})
+	backend.Register(backend.Registration{
+		Scheme:      "sparkyfish+tls",
+		Description: "sparkyfish server over TLS",
+		DefaultPort: DefaultPort,
+		New: func(opts backend.Options) (backend.Backend, error) {
+			opts.TLS = true
+			return newBackend(opts)
+		},
+	})
+}
+
+// newBackend builds a Client from opts, checking the ones that can be
+// checked before connecting. The sparkyfish protocol supports every
+// option.
+func newBackend(opts backend.Options) (backend.Backend, error) {
+	cfg := Config{
+		Params:                opts.Params,
+		TLS:                   opts.TLS,
+		TLSCAFile:             opts.TLSCAFile,
+		TLSServerName:         opts.TLSServerName,
+		TLSCertFile:           opts.TLSCertFile,
+		TLSKeyFile:            opts.TLSKeyFile,
+		TLSInsecureSkipVerify: opts.TLSInsecureSkipVerify,
+		AuthUser:              opts.AuthUser,
+		AuthToken:             opts.AuthToken,
+		Network:               opts.Network,
+		LoadedLatency:         opts.LoadedLatency,
+		UDP:                   opts.UDP,
+	}
+	if _, err := cfg.TLSConfig(); err != nil {
+		return nil, err
+	}
+	if cfg.AuthUser != "" && !protocol.ValidUser(cfg.AuthUser) {
+		return nil, fmt.Errorf("invalid user name %q", cfg.AuthUser)
+	}
+	if err := cfg.udpParams().Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
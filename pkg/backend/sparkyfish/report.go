@@ -0,0 +1,84 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+// uploadReports follows the RCVD and DONE lines that a version 2 server
+// sends on one stream during an upload test.
+type uploadReports struct {
+	mu      sync.Mutex
+	bytes   int64
+	elapsed time.Duration
+	rate    float64 // Mbps between the last two RCVD lines
+
+	// final receives the DONE totals. It is closed without a value if the
+	// stream ends before the server reports them.
+	final chan backend.ServerReport
+}
+
+// watchUploadReports starts reading reports from s. Nothing else may read
+// from s afterwards.
+func watchUploadReports(s *session) *uploadReports {
+	r := &uploadReports{final: make(chan backend.ServerReport, 1)}
+	go r.read(s.reader)
+	return r
+}
+
+func (r *uploadReports) read(reader *bufio.Reader) {
+	defer close(r.final)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		kind, report, err := parseReport(line)
+		if err != nil {
+			return
+		}
+		if kind == "DONE" {
+			r.final <- report
+			return
+		}
+		r.update(report)
+	}
+}
+
+// update records an interim report and the rate since the previous one.
+func (r *uploadReports) update(report backend.ServerReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case report.Bytes == r.bytes:
+		r.rate = 0
+	case report.Elapsed > r.elapsed:
+		r.rate = float64(report.Bytes-r.bytes) * 8 / (report.Elapsed - r.elapsed).Seconds() / 1_000_000
+	}
+	r.bytes, r.elapsed = report.Bytes, report.Elapsed
+}
+
+// currentRate returns the server-confirmed rate from the latest reports.
+func (r *uploadReports) currentRate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
+
+// parseReport parses a "RCVD <bytes> <ms>" or "DONE <bytes> <ms>" line.
+func parseReport(line string) (kind string, report backend.ServerReport, err error) {
+	var ms int64
+	line = strings.TrimSpace(line)
+	if _, err := fmt.Sscanf(line, "%s %d %d", &kind, &report.Bytes, &ms); err != nil ||
+		(kind != "RCVD" && kind != "DONE") || report.Bytes < 0 || ms < 0 {
+		return "", backend.ServerReport{}, fmt.Errorf("invalid receive report: %q", line)
+	}
+	report.Elapsed = time.Duration(ms) * time.Millisecond
+	return kind, report, nil
+}
@@ -0,0 +1,73 @@
+package sparkyfish
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+func TestParseReport(t *testing.T) {
+	tests := []struct {
+		line     string
+		wantKind string
+		want     backend.ServerReport
+		wantErr  bool
+	}{
+		{"RCVD 1048576 500\n", "RCVD", backend.ServerReport{Bytes: 1048576, Elapsed: 500 * time.Millisecond}, false},
+		{"DONE 0 0\n", "DONE", backend.ServerReport{}, false},
+		{"GO\n", "", backend.ServerReport{}, true},
+		{"RCVD many 500\n", "", backend.ServerReport{}, true},
+		{"SENT 10 10\n", "", backend.ServerReport{}, true},
+		{"RCVD -1 10\n", "", backend.ServerReport{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			kind, got, err := parseReport(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReport error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if kind != tt.wantKind || got != tt.want {
+				t.Errorf("parseReport = %q %+v, want %q %+v", kind, got, tt.wantKind, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadReports(t *testing.T) {
+	s, server := pipeSession(2)
+	defer s.Close()
+	defer server.Close()
+
+	r := watchUploadReports(s)
+	// 2,000,000 bytes in the 500 ms between the two RCVD lines is 32 Mbit/s.
+	server.Write([]byte("RCVD 1000000 500\nRCVD 3000000 1000\n"))
+	server.Write([]byte("DONE 4000000 1250\n"))
+
+	final, ok := <-r.final
+	if !ok {
+		t.Fatal("no DONE report")
+	}
+	if rate := r.currentRate(); rate != 32 {
+		t.Errorf("interim rate = %.2f Mbit/s, want 32", rate)
+	}
+	if final.Bytes != 4000000 || final.Elapsed != 1250*time.Millisecond {
+		t.Errorf("final report = %+v", final)
+	}
+	if mbps := final.Mbps(); mbps != 25.6 {
+		t.Errorf("final rate = %.2f Mbit/s, want 25.6", mbps)
+	}
+}
+
+func TestUploadReports_StreamEnds(t *testing.T) {
+	s, server := pipeSession(2)
+	defer s.Close()
+
+	r := watchUploadReports(s)
+	server.Write([]byte("RCVD 1000 100\n"))
+	server.Close()
+
+	if _, ok := <-r.final; ok {
+		t.Error("expected final to be closed without a report")
+	}
+}
@@ -0,0 +1,75 @@
+package sparkyfish
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake with the server.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig builds the TLS configuration described by cfg. It returns nil
+// if TLS is not enabled.
+func (cfg Config) TLSConfig() (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if cfg.TLSCAFile != "" {
+		data, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS CA: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("load TLS CA: no certificates found in %s", cfg.TLSCAFile)
+		}
+	}
+
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, errors.New("a TLS client certificate requires both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// startTLS performs the client side of a TLS handshake on conn. Unless
+// conf sets a server name, host is used for SNI and verification.
+func startTLS(ctx context.Context, conn net.Conn, host string, conf *tls.Config) (*tls.Conn, error) {
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tc := tls.Client(conn, conf)
+
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tc, nil
+}
+
+// describeTLS summarizes the negotiated TLS parameters for display, e.g.
+// "TLS 1.3, TLS_AES_128_GCM_SHA256".
+func describeTLS(state tls.ConnectionState) string {
+	return tls.VersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+}
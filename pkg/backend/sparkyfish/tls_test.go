@@ -0,0 +1,163 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/chrissnell/sparkyfish/pkg/internal/testcert"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// tlsServer starts a TLS listener that answers a single HELO from an open
+// server.
+// If clientCA is set, clients must present a certificate it signed.
+func tlsServer(t *testing.T, certs testcert.Files, clientCA string) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		conf.ClientCAs.AppendCertsFromPEM(pem)
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("HELO\n"))
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte("localhost\nnone\nduration=10 pings=30 streams=1\nduration=30 pings=100 streams=8\nOPEN\n"))
+	}()
+	return ln.Addr().String()
+}
+
+func TestDial_TLS(t *testing.T) {
+	certs := testcert.Generate(t)
+
+	tests := []struct {
+		name     string
+		clientCA string // CA the server requires client certificates from
+		cfg      Config
+		wantErr  bool
+	}{
+		{
+			name: "trusted CA",
+			cfg:  Config{TLS: true, TLSCAFile: certs.CA},
+		},
+		{
+			name:    "untrusted CA",
+			cfg:     Config{TLS: true, TLSCAFile: certs.OtherCA},
+			wantErr: true,
+		},
+		{
+			name:    "server name mismatch",
+			cfg:     Config{TLS: true, TLSCAFile: certs.CA, TLSServerName: "speedtest.example.com"},
+			wantErr: true,
+		},
+		{
+			name: "server name override",
+			cfg:  Config{TLS: true, TLSCAFile: certs.CA, TLSServerName: "localhost"},
+		},
+		{
+			name: "insecure skip verify",
+			cfg:  Config{TLS: true, TLSInsecureSkipVerify: true},
+		},
+		{
+			name:     "client certificate",
+			clientCA: certs.CA,
+			cfg:      Config{TLS: true, TLSCAFile: certs.CA, TLSCertFile: certs.ClientCert, TLSKeyFile: certs.ClientKey},
+		},
+		{
+			name:     "missing client certificate",
+			clientCA: certs.CA,
+			cfg:      Config{TLS: true, TLSCAFile: certs.CA},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := tlsServer(t, certs, tt.clientCA)
+			conf, err := tt.cfg.TLSConfig()
+			if err != nil {
+				t.Fatalf("tlsConfig: %v", err)
+			}
+
+			s, info, err := dial(context.Background(), addr, protocol.Params{}, dialOptions{tls: conf})
+			if tt.wantErr {
+				if err == nil {
+					s.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer s.Close()
+
+			if info.Hostname != "localhost" {
+				t.Errorf("hostname = %q", info.Hostname)
+			}
+			if !strings.HasPrefix(info.TLS, "TLS 1.3, ") {
+				t.Errorf("TLS = %q", info.TLS)
+			}
+		})
+	}
+}
+
+func TestConfig_TLSConfig(t *testing.T) {
+	certs := testcert.Generate(t)
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", cfg: Config{TLSCAFile: certs.CA}, wantNil: true},
+		{name: "system roots", cfg: Config{TLS: true}},
+		{name: "missing CA file", cfg: Config{TLS: true, TLSCAFile: certs.CA + ".missing"}, wantErr: true},
+		{name: "CA file without certificates", cfg: Config{TLS: true, TLSCAFile: certs.ServerKey}, wantErr: true},
+		{name: "cert without key", cfg: Config{TLS: true, TLSCertFile: certs.ClientCert}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := tt.cfg.TLSConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (conf == nil) != tt.wantNil {
+				t.Errorf("conf = %v, wantNil %v", conf, tt.wantNil)
+			}
+		})
+	}
+}
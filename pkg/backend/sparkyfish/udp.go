@@ -0,0 +1,224 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// udpParams returns the UDP test parameters to request, with defaults
+// for the fields cfg leaves unset.
+func (cfg Config) udpParams() protocol.UDPParams {
+	p := cfg.UDP
+	def := protocol.DefaultUDPParams()
+	if p.Rate <= 0 {
+		p.Rate = def.Rate
+	}
+	if p.Size <= 0 {
+		p.Size = def.Size
+	}
+	return p
+}
+
+// UDP runs a UDP test against a protocol version 4 server. Once the
+// server starts the test, the client sends datagrams at the configured
+// rate for the test duration to the UDP port the server names, while the
+// server reports what has arrived. The client then sends the number of
+// datagrams it sent, and the server answers with its final counts.
+func (c *Client) UDP(ctx context.Context, results chan<- backend.UDPSample) error {
+	defer close(results)
+
+	p := c.cfg.udpParams()
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	s, err := c.takeSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if s.version < 4 {
+		return fmt.Errorf("server does not support UDP tests (protocol version %d)", s.version)
+	}
+
+	if err := s.writeCommand("UDP " + p.String()); err != nil {
+		return fmt.Errorf("send UDP: %w", err)
+	}
+	if _, err := s.awaitGo(func(pos int) error {
+		return sendUDPSample(ctx, results, backend.UDPSample{QueuePosition: pos, Time: time.Now()})
+	}); err != nil {
+		return err
+	}
+	port, token, err := s.readUDPStart()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return fmt.Errorf("server address: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	sendCtx, stopSending := context.WithCancel(ctx)
+	defer stopSending()
+	var sent atomic.Int64
+	sendDone := make(chan error, 1)
+	go func() {
+		sendDone <- sendDatagrams(sendCtx, conn, token, p, s.params.Duration, &sent)
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			line, err := s.reader.ReadString('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case lines <- strings.TrimSpace(line):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sample := func(stats protocol.UDPStats) backend.UDPSample {
+		return backend.UDPSample{
+			Time:       time.Now(),
+			TargetMbps: float64(p.Rate) / 1_000_000,
+			PacketSize: p.Size,
+			Sent:       sent.Load(),
+			Received:   stats.Received,
+			Lost:       stats.Lost,
+			Reordered:  stats.Reordered,
+			Duplicates: stats.Duplicates,
+			Jitter:     stats.Jitter,
+		}
+	}
+
+	var last protocol.UDPStats
+	var deadline <-chan time.Time
+	for {
+		select {
+		case err := <-sendDone:
+			if err != nil {
+				return err
+			}
+			if err := s.writeCommand(fmt.Sprintf("SENT %d", sent.Load())); err != nil {
+				return fmt.Errorf("send SENT: %w", err)
+			}
+			timer := time.NewTimer(protocol.UDPDrain + protocol.RecvGrace)
+			defer timer.Stop()
+			deadline = timer.C
+		case line := <-lines:
+			kind, fields, _ := strings.Cut(line, " ")
+			if kind != "STAT" && kind != "DONE" {
+				if strings.HasPrefix(line, "ERR:") {
+					return serverError(line)
+				}
+				return fmt.Errorf("unexpected UDP report: %q", line)
+			}
+			stats, err := protocol.ParseUDPStats(fields)
+			if err != nil {
+				return fmt.Errorf("invalid UDP report %q: %w", line, err)
+			}
+			smp := sample(stats)
+			if kind == "DONE" {
+				smp.Final = true
+				smp.Mbps = backend.ServerReport{Bytes: stats.Bytes, Elapsed: stats.Elapsed}.Mbps()
+				return sendUDPSample(ctx, results, smp)
+			}
+			smp.Mbps = backend.ServerReport{Bytes: stats.Bytes - last.Bytes, Elapsed: protocol.ReportInterval}.Mbps()
+			last = stats
+			if err := sendUDPSample(ctx, results, smp); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return fmt.Errorf("read UDP report: %w", err)
+		case <-deadline:
+			return errors.New("server did not report the end of the UDP test")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readUDPStart reads the line that starts a UDP test, which names the
+// server's UDP port and the token that marks the test's datagrams.
+func (s *session) readUDPStart() (port int, token uint64, err error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return 0, 0, fmt.Errorf("read UDP start: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "ERR:") {
+		return 0, 0, serverError(line)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "UDP" {
+		return 0, 0, fmt.Errorf("unexpected UDP start: %q", line)
+	}
+	port, err = strconv.Atoi(fields[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, 0, fmt.Errorf("invalid UDP port: %q", line)
+	}
+	token, err = strconv.ParseUint(fields[2], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid UDP token: %q", line)
+	}
+	return port, token, nil
+}
+
+// sendDatagrams sends the datagrams of a test of duration d on conn at
+// p's rate, counting them in sent. Datagrams are paced by the clock
+// rather than by sleeping a fixed interval, so that oversleeping sends a
+// short burst instead of lowering the rate.
+func sendDatagrams(ctx context.Context, conn net.Conn, token uint64, p protocol.UDPParams, d time.Duration, sent *atomic.Int64) error {
+	buf := make([]byte, p.Size)
+	interval := p.Interval()
+	total := p.Packets(d)
+	start := time.Now()
+	for seq := int64(0); seq < total; {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		due := min(int64(time.Since(start)/interval)+1, total)
+		for ; seq < due; seq++ {
+			protocol.UDPHeader{Token: token, Seq: uint64(seq), Sent: time.Since(start)}.Put(buf)
+			if _, err := conn.Write(buf); err != nil {
+				return fmt.Errorf("send datagram: %w", err)
+			}
+			sent.Store(seq + 1)
+		}
+		time.Sleep(time.Duration(due)*interval - time.Since(start))
+	}
+	return nil
+}
+
+func sendUDPSample(ctx context.Context, results chan<- backend.UDPSample, s backend.UDPSample) error {
+	select {
+	case results <- s:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
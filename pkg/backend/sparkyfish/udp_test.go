@@ -0,0 +1,168 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// udpServer plays the server side of a UDP test on a loopback TCP
+// connection, dropping every tenth datagram, and returns a client whose
+// next session is the connection's other end.
+func udpServer(t *testing.T, cfg Config, duration time.Duration) *Client {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+		pc.Close()
+	})
+
+	const token = 0xfeedface
+	go func() {
+		reader := bufio.NewReader(server)
+		line, _ := reader.ReadString('\n')
+		p, err := protocol.ParseUDPParams(strings.TrimPrefix(strings.TrimSpace(line), "UDP "))
+		if err != nil {
+			fmt.Fprintf(server, "ERR:Invalid UDP parameters received\n")
+			return
+		}
+		fmt.Fprintf(server, "QUEUE 1\nGO\nUDP %d %x\n", pc.LocalAddr().(*net.UDPAddr).Port, token)
+
+		var stats protocol.UDPStats
+		sentLine := make(chan string, 1)
+		go func() {
+			line, _ := reader.ReadString('\n')
+			sentLine <- strings.TrimSpace(line)
+		}()
+		buf := make([]byte, protocol.MaxUDPSize)
+		lastReport := time.Now()
+		for {
+			pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			if n, _, err := pc.ReadFrom(buf); err == nil {
+				h, ok := protocol.ParseUDPHeader(buf[:n])
+				if ok && h.Token == token && n == p.Size && h.Seq%10 != 9 {
+					stats.Received++
+					stats.Bytes += int64(n)
+				}
+			}
+			select {
+			case line := <-sentLine:
+				var sent int64
+				fmt.Sscanf(line, "SENT %d", &sent)
+				stats.Lost = sent - stats.Received
+				stats.Elapsed = duration
+				fmt.Fprintf(server, "DONE %s\n", stats)
+				return
+			default:
+			}
+			if time.Since(lastReport) >= protocol.ReportInterval {
+				fmt.Fprintf(server, "STAT %s\n", stats)
+				lastReport = time.Now()
+			}
+		}
+	}()
+
+	c := New(cfg)
+	c.sess = &session{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		version: protocolVersion,
+		params:  protocol.Params{Duration: duration, Pings: 1, Streams: 1},
+	}
+	return c
+}
+
+func TestUDP(t *testing.T) {
+	cfg := Config{UDP: protocol.UDPParams{Rate: 800_000, Size: 100}} // 1000 packets per second
+	c := udpServer(t, cfg, time.Second)
+
+	results := make(chan backend.UDPSample, 100)
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.UDP(context.Background(), results) }()
+
+	var samples []backend.UDPSample
+	for s := range results {
+		samples = append(samples, s)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("UDP: %v", err)
+	}
+
+	if len(samples) < 3 || samples[0].QueuePosition != 1 {
+		t.Fatalf("samples = %+v, want a queue position, reports, and the final counts", samples)
+	}
+	final := samples[len(samples)-1]
+	if !final.Final {
+		t.Fatalf("last sample %+v is not final", final)
+	}
+	if final.Sent != 1000 {
+		t.Errorf("sent %d datagrams, want 1000", final.Sent)
+	}
+	if final.Received != 900 || final.Lost != 100 || final.LossPercent() != 10 {
+		t.Errorf("final counts %+v, want 900 received and 100 lost", final)
+	}
+	if final.TargetMbps != 0.8 || final.PacketSize != 100 {
+		t.Errorf("final sample reports %.1f Mbit/s at %d bytes, want the configured rate", final.TargetMbps, final.PacketSize)
+	}
+}
+
+func TestUDP_OldServer(t *testing.T) {
+	s, server := pipeSession(3)
+	defer server.Close()
+	c := New(Config{})
+	c.sess = s
+
+	err := c.UDP(context.Background(), make(chan backend.UDPSample, 1))
+	if err == nil || !strings.Contains(err.Error(), "does not support UDP") {
+		t.Errorf("expected an unsupported error, got %v", err)
+	}
+}
+
+func TestReadUDPStart(t *testing.T) {
+	tests := []struct {
+		line    string
+		port    int
+		token   uint64
+		wantErr bool
+	}{
+		{"UDP 7121 00000000feedface", 7121, 0xfeedface, false},
+		{"UDP 0 feedface", 0, 0, true},
+		{"UDP 7121 nothex", 0, 0, true},
+		{"UDP 7121", 0, 0, true},
+		{"ERR:UDP tests are not available", 0, 0, true},
+	}
+	for _, tt := range tests {
+		s, server := pipeSession(4)
+		go server.Write([]byte(tt.line + "\n"))
+		port, token, err := s.readUDPStart()
+		if (err != nil) != tt.wantErr || port != tt.port || token != tt.token {
+			t.Errorf("readUDPStart(%q) = %d, %x, %v", tt.line, port, token, err)
+		}
+		s.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,136 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultBrowseTimeout is how long Browse listens for answers when ctx
+// has no deadline.
+const DefaultBrowseTimeout = 2 * time.Second
+
+// Browse asks the local network for sparkyfish servers and returns those
+// that answer before ctx's deadline, or DefaultBrowseTimeout, sorted by
+// instance name.
+func Browse(ctx context.Context) ([]Service, error) {
+	return browse(ctx, mdnsGroup)
+}
+
+// browse sends a PTR query for the service type to group from an
+// unconnected socket, so that responders reply straight to it, and
+// collects the answers.
+func browse(ctx context.Context, group *net.UDPAddr) ([]Service, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultBrowseTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	query := new(dns.Msg)
+	query.SetQuestion(serviceName, dns.TypePTR)
+	query.RecursionDesired = false
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(packed, group); err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*Service) // by instance name
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break // deadline reached
+		}
+		var resp dns.Msg
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || resp.Id != query.Id {
+			continue
+		}
+		collect(found, append(resp.Answer, resp.Extra...))
+	}
+	if err := ctx.Err(); err != nil && err != context.DeadlineExceeded {
+		return nil, err
+	}
+
+	services := make([]Service, 0, len(found))
+	for _, svc := range found {
+		if svc.Port != 0 {
+			services = append(services, *svc)
+		}
+	}
+	slices.SortFunc(services, func(a, b Service) int { return strings.Compare(a.Instance, b.Instance) })
+	return services, nil
+}
+
+// collect adds the services that the records of one response describe to
+// found. Instances without an SRV record are kept, but left without a
+// port, so that the caller can drop them.
+func collect(found map[string]*Service, rrs []dns.RR) {
+	// Addresses are keyed by host name, which the SRV record links to.
+	hostAddrs := make(map[string][]string)
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			key := strings.ToLower(rr.Hdr.Name)
+			hostAddrs[key] = append(hostAddrs[key], rr.A.String())
+		case *dns.AAAA:
+			if rr.AAAA.IsLinkLocalUnicast() {
+				continue // useless without the interface it was seen on
+			}
+			key := strings.ToLower(rr.Hdr.Name)
+			hostAddrs[key] = append(hostAddrs[key], rr.AAAA.String())
+		}
+	}
+
+	instance := func(name string) *Service {
+		label, rest := firstLabel(name)
+		if !strings.EqualFold(rest, serviceName) {
+			return nil
+		}
+		key := strings.ToLower(name)
+		if found[key] == nil {
+			found[key] = &Service{Instance: label}
+		}
+		return found[key]
+	}
+	for _, rr := range rrs {
+		if rr.Header().Ttl == 0 {
+			continue // a goodbye
+		}
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if strings.EqualFold(rr.Hdr.Name, serviceName) {
+				instance(rr.Ptr)
+			}
+		case *dns.SRV:
+			if svc := instance(rr.Hdr.Name); svc != nil {
+				svc.Port = int(rr.Port)
+				svc.Host, _ = firstLabel(rr.Target)
+				for _, addr := range hostAddrs[strings.ToLower(rr.Target)] {
+					if !slices.Contains(svc.Addrs, addr) {
+						svc.Addrs = append(svc.Addrs, addr)
+					}
+				}
+			}
+		case *dns.TXT:
+			if svc := instance(rr.Hdr.Name); svc != nil {
+				svc.parseTXT(rr.Txt)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package discovery advertises sparkyfish servers on the local network
+// with DNS-SD over multicast DNS (RFC 6762, RFC 6763), and browses for
+// them.
+package discovery
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ServiceType is the DNS-SD service type sparkyfish servers register.
+const ServiceType = "_sparkyfish._tcp"
+
+const (
+	domain       = "local."
+	serviceName  = ServiceType + "." + domain
+	servicesName = "_services._dns-sd._udp." + domain // lists every service type on the link (RFC 6763, section 9)
+)
+
+// mdnsGroup is the IPv4 multicast group and port mDNS runs on.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Service describes an advertised server.
+type Service struct {
+	Instance string   // instance name, unique on the link; the server's cname or hostname
+	Host     string   // host name, without the ".local" domain
+	Port     int      // TCP port the server listens on
+	Addrs    []string // IP addresses the server can be reached at
+	Cname    string   // canonical hostname the server reports to clients
+	Location string
+	Version  string // server software version
+	Protocol int    // highest protocol version the server speaks
+	Capacity int    // concurrent throughput tests the server runs; 0 for unlimited
+	TLS      bool   // the server only accepts TLS connections
+	Auth     bool   // the server requires authentication
+}
+
+// Addr returns an address to connect to the server at: its first IP
+// address, or its .local host name if it advertised none.
+func (s Service) Addr() string {
+	host := s.Host + ".local"
+	if len(s.Addrs) > 0 {
+		host = s.Addrs[0]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.Port))
+}
+
+// instanceName returns the fully qualified DNS-SD name of the instance.
+func (s Service) instanceName() string {
+	return escapeLabel(s.Instance) + "." + serviceName
+}
+
+// hostName returns the fully qualified .local name of the host.
+func (s Service) hostName() string {
+	return escapeLabel(s.Host) + "." + domain
+}
+
+// txt returns the TXT record strings describing s. Empty values are left
+// out, and values are cut to fit the 255-byte limit of a TXT string.
+func (s Service) txt() []string {
+	txt := []string{"txtvers=1"}
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		entry := key + "=" + value
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		txt = append(txt, entry)
+	}
+	add("cname", s.Cname)
+	add("location", s.Location)
+	add("version", s.Version)
+	add("proto", strconv.Itoa(s.Protocol))
+	add("capacity", strconv.Itoa(s.Capacity))
+	if s.TLS {
+		add("tls", "1")
+	}
+	if s.Auth {
+		add("auth", "1")
+	}
+	return txt
+}
+
+// parseTXT fills in the fields of s that its TXT record describes.
+// Unknown keys are ignored, so that servers can add new ones.
+func (s *Service) parseTXT(txt []string) {
+	for _, entry := range txt {
+		key, value, _ := strings.Cut(entry, "=")
+		switch strings.ToLower(key) {
+		case "cname":
+			s.Cname = value
+		case "location":
+			s.Location = value
+		case "version":
+			s.Version = value
+		case "proto":
+			s.Protocol, _ = strconv.Atoi(value)
+		case "capacity":
+			s.Capacity, _ = strconv.Atoi(value)
+		case "tls":
+			s.TLS = value == "1"
+		case "auth":
+			s.Auth = value == "1"
+		}
+	}
+}
+
+// escapeLabel escapes s for use as a single label of a domain name in
+// presentation format. Instance names may hold dots and spaces.
+func escapeLabel(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '.', '\\', '(', ')', ';', ' ', '@', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// firstLabel returns the unescaped first label of the domain name in
+// presentation format, and the rest of the name after its dot.
+func firstLabel(name string) (label, rest string) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			return b.String(), name[i+1:]
+		case c == '\\' && i+3 < len(name) && isDigits(name[i+1:i+4]):
+			n, _ := strconv.Atoi(name[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(name):
+			i++
+			b.WriteByte(name[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), ""
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testService = Service{
+	Instance: "Denver Office (rack 2)",
+	Host:     "speedtest",
+	Port:     7121,
+	Addrs:    []string{"192.0.2.10", "2001:db8::10"},
+	Cname:    "speedtest.example.com",
+	Location: "Denver, CO",
+	Version:  "1.2.0",
+	Protocol: 3,
+	Capacity: 2,
+	TLS:      true,
+}
+
+// multicastResponder runs a Responder for svc on a multicast group with a
+// free port, or skips the test if multicast isn't available.
+func multicastResponder(t *testing.T, svc Service) *net.UDPAddr {
+	t.Helper()
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	group := &net.UDPAddr{IP: mdnsGroup.IP, Port: port}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r := NewResponder(svc)
+	r.group = group
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Serve(ctx, conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return group
+}
+
+func TestBrowse(t *testing.T) {
+	group := multicastResponder(t, testService)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	got, err := browse(ctx, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Skip("no answer over multicast")
+	}
+	if want := []Service{testService}; !reflect.DeepEqual(got, want) {
+		t.Errorf("browse:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestResponder_Answer(t *testing.T) {
+	r := NewResponder(testService)
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantTypes []uint16 // of the answer section
+	}{
+		{"browse", serviceName, dns.TypePTR, []uint16{dns.TypePTR}},
+		{"service types", servicesName, dns.TypePTR, []uint16{dns.TypePTR}},
+		{"instance SRV", testService.instanceName(), dns.TypeSRV, []uint16{dns.TypeSRV}},
+		{"instance TXT", testService.instanceName(), dns.TypeTXT, []uint16{dns.TypeTXT}},
+		{"instance ANY", testService.instanceName(), dns.TypeANY, []uint16{dns.TypeSRV, dns.TypeTXT}},
+		{"host A", "speedtest.local.", dns.TypeA, []uint16{dns.TypeA}},
+		{"host AAAA, any case", "SpeedTest.local.", dns.TypeAAAA, []uint16{dns.TypeAAAA}},
+		{"other service", "_http._tcp.local.", dns.TypePTR, nil},
+		{"other host", "printer.local.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion(tt.qname, tt.qtype)
+			resp := r.answer(query, false)
+			if tt.wantTypes == nil {
+				if resp != nil {
+					t.Fatalf("expected no answer, got %v", resp.Answer)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("no answer")
+			}
+			var types []uint16
+			for _, rr := range resp.Answer {
+				types = append(types, rr.Header().Rrtype)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("answer types = %v, want %v", types, tt.wantTypes)
+			}
+			if resp.Id != 0 || len(resp.Question) != 0 {
+				t.Error("multicast answer should have no ID or question")
+			}
+		})
+	}
+}
+
+func TestResponder_AnswerLegacy(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion(serviceName, dns.TypePTR)
+	resp := NewResponder(testService).answer(query, true)
+	if resp.Id != query.Id || len(resp.Question) != 1 {
+		t.Errorf("legacy answer should echo the ID and question")
+	}
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		if rr.Header().Ttl > legacyTTL {
+			t.Errorf("TTL %d > %d for %s", rr.Header().Ttl, legacyTTL, rr)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	r := NewResponder(testService)
+	query := new(dns.Msg)
+	query.SetQuestion(serviceName, dns.TypePTR)
+	resp := r.answer(query, false)
+
+	found := make(map[string]*Service)
+	collect(found, append(resp.Answer, resp.Extra...))
+	if len(found) != 1 {
+		t.Fatalf("found %d services, want 1", len(found))
+	}
+	for _, svc := range found {
+		if !reflect.DeepEqual(*svc, testService) {
+			t.Errorf("collect:\n got %+v\nwant %+v", *svc, testService)
+		}
+	}
+
+	// A goodbye doesn't bring the service back.
+	found = make(map[string]*Service)
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = 0
+	}
+	collect(found, resp.Answer)
+	if len(found) != 0 {
+		t.Errorf("goodbye added %d services", len(found))
+	}
+}
+
+func TestServiceAddr(t *testing.T) {
+	tests := []struct {
+		svc  Service
+		want string
+	}{
+		{Service{Host: "speedtest", Port: 7121, Addrs: []string{"192.0.2.10"}}, "192.0.2.10:7121"},
+		{Service{Host: "speedtest", Port: 7121, Addrs: []string{"2001:db8::10"}}, "[2001:db8::10]:7121"},
+		{Service{Host: "speedtest", Port: 7121}, "speedtest.local:7121"},
+	}
+	for _, tt := range tests {
+		if got := tt.svc.Addr(); got != tt.want {
+			t.Errorf("Addr() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestFirstLabel(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantLabel string
+		wantRest  string
+	}{
+		{"speedtest.local.", "speedtest", "local."},
+		{`Denver\ Office\.2._sparkyfish._tcp.local.`, "Denver Office.2", "_sparkyfish._tcp.local."},
+		{`caf\195\169.local.`, "café", "local."},
+		{"local", "local", ""},
+	}
+	for _, tt := range tests {
+		label, rest := firstLabel(tt.name)
+		if label != tt.wantLabel || rest != tt.wantRest {
+			t.Errorf("firstLabel(%q) = %q, %q; want %q, %q", tt.name, label, rest, tt.wantLabel, tt.wantRest)
+		}
+	}
+}
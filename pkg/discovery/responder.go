@@ -0,0 +1,246 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Record TTLs recommended by RFC 6762, section 10: host name records
+	// expire sooner than the rest, since addresses change more often.
+	hostTTL    = 120
+	serviceTTL = 4500
+	// legacyTTL caps the TTLs sent to one-shot queriers that don't speak
+	// mDNS themselves (RFC 6762, section 6.7).
+	legacyTTL = 10
+	// announceInterval separates the two announcements sent on startup
+	// (RFC 6762, section 8.3).
+	announceInterval = time.Second
+)
+
+// Responder answers mDNS queries for a Service.
+type Responder struct {
+	svc   Service
+	group *net.UDPAddr
+}
+
+// NewResponder creates a Responder advertising svc.
+func NewResponder(svc Service) *Responder {
+	return &Responder{svc: svc, group: mdnsGroup}
+}
+
+// ListenAndServe joins the mDNS multicast group, announces the service,
+// and answers queries for it until ctx is cancelled. On the way out it
+// sends a goodbye so that browsers forget the service right away.
+func (r *Responder) ListenAndServe(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, r.group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			r.announce(conn, serviceTTL)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(announceInterval):
+			}
+		}
+	}()
+
+	err = r.Serve(ctx, conn)
+	r.announce(conn, 0)
+	return err
+}
+
+// Serve answers the queries that arrive on conn until ctx is cancelled.
+// Replies go to the multicast group, or straight back to the querier if
+// it asked for a unicast reply or isn't an mDNS responder itself.
+func (r *Responder) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil || query.Response || query.Opcode != dns.OpcodeQuery {
+			continue
+		}
+
+		legacy := false
+		if addr, ok := from.(*net.UDPAddr); ok && addr.Port != r.group.Port {
+			legacy = true
+		}
+		resp := r.answer(&query, legacy)
+		if resp == nil {
+			continue
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		to := net.Addr(r.group)
+		if legacy || unicastRequested(&query) {
+			to = from
+		}
+		conn.WriteTo(packed, to)
+	}
+}
+
+// announce sends every record of the service unsolicited, with the given
+// TTL; a TTL of 0 withdraws them.
+func (r *Responder) announce(conn net.PacketConn, ttl uint32) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	resp.Answer = append(r.serviceRecords(), r.addressRecords()...)
+	for _, rr := range resp.Answer {
+		rr.Header().Ttl = ttl
+	}
+	if packed, err := resp.Pack(); err == nil {
+		conn.WriteTo(packed, r.group)
+	}
+}
+
+// answer builds the response to query, or returns nil if it asks about
+// nothing this responder knows. Legacy queriers get their question and
+// ID echoed back and short TTLs.
+func (r *Responder) answer(query *dns.Msg, legacy bool) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+
+	records := r.serviceRecords()
+	ptr, srv, txt := records[0], records[1], records[2]
+	addrs := r.addressRecords()
+	for _, q := range query.Question {
+		name, qtype := q.Name, q.Qtype
+		switch {
+		case strings.EqualFold(name, servicesName) && (qtype == dns.TypePTR || qtype == dns.TypeANY):
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: header(servicesName, dns.TypePTR, serviceTTL),
+				Ptr: serviceName,
+			})
+		case strings.EqualFold(name, serviceName) && (qtype == dns.TypePTR || qtype == dns.TypeANY):
+			resp.Answer = append(resp.Answer, ptr)
+			resp.Extra = append(resp.Extra, srv, txt)
+			resp.Extra = append(resp.Extra, addrs...)
+		case strings.EqualFold(name, r.svc.instanceName()):
+			if qtype == dns.TypeSRV || qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, srv)
+				resp.Extra = append(resp.Extra, addrs...)
+			}
+			if qtype == dns.TypeTXT || qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, txt)
+			}
+		case strings.EqualFold(name, r.svc.hostName()):
+			for _, rr := range addrs {
+				if qtype == rr.Header().Rrtype || qtype == dns.TypeANY {
+					resp.Answer = append(resp.Answer, rr)
+				}
+			}
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	resp.Answer = dns.Dedup(resp.Answer, nil)
+	resp.Extra = dns.Dedup(resp.Extra, nil)
+
+	if legacy {
+		resp.Id = query.Id
+		resp.Question = query.Question
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			rr.Header().Ttl = min(rr.Header().Ttl, legacyTTL)
+		}
+	}
+	return resp
+}
+
+// serviceRecords returns the PTR, SRV and TXT records of the service.
+func (r *Responder) serviceRecords() []dns.RR {
+	instance := r.svc.instanceName()
+	return []dns.RR{
+		&dns.PTR{Hdr: header(serviceName, dns.TypePTR, serviceTTL), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV, hostTTL), Port: uint16(r.svc.Port), Target: r.svc.hostName()},
+		&dns.TXT{Hdr: header(instance, dns.TypeTXT, serviceTTL), Txt: r.svc.txt()},
+	}
+}
+
+// addressRecords returns the A and AAAA records of the host.
+func (r *Responder) addressRecords() []dns.RR {
+	var rrs []dns.RR
+	for _, s := range r.svc.Addrs {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		if ip.Unmap().Is4() {
+			rrs = append(rrs, &dns.A{Hdr: header(r.svc.hostName(), dns.TypeA, hostTTL), A: ip.AsSlice()})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: header(r.svc.hostName(), dns.TypeAAAA, hostTTL), AAAA: ip.AsSlice()})
+		}
+	}
+	return rrs
+}
+
+func header(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
+
+// unicastRequested reports whether any question of query has the
+// unicast-response bit set (RFC 6762, section 5.4).
+func unicastRequested(query *dns.Msg) bool {
+	for _, q := range query.Question {
+		if q.Qclass&(1<<15) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalAddrs returns the addresses of the host's multicast-capable
+// interfaces that are up, leaving out loopback and link-local addresses.
+func LocalAddrs() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifAddrs {
+			prefix, err := netip.ParsePrefix(a.String())
+			if err != nil || prefix.Addr().IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, prefix.Addr().String())
+		}
+	}
+	return addrs, nil
+}
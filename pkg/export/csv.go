@@ -0,0 +1,192 @@
+package export
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// csvHeader lists the CSV columns. New columns go at the end, so that
+// rows keep their meaning for tools that read columns by position.
+var csvHeader = []string{
+	"start", "end", "server_addr", "hostname", "location",
+	"ping_min_ms", "ping_max_ms", "ping_mean_ms", "ping_stddev_ms",
+	"download_min_mbps", "download_max_mbps", "download_mean_mbps", "download_stddev_mbps",
+	"upload_min_mbps", "upload_max_mbps", "upload_mean_mbps", "upload_stddev_mbps",
+	"upload_server_mbps", "tls", "family", "ip",
+	"download_loaded_latency_ms", "download_rpm", "upload_loaded_latency_ms", "upload_rpm",
+	"ping_median_ms", "ping_p95_ms", "ping_jitter_ms", "download_steady_mbps", "upload_steady_mbps",
+	"udp_sent", "udp_lost", "udp_loss_percent", "udp_reordered", "udp_duplicates", "udp_jitter_ms",
+}
+
+// CSV writes one row of aggregates per run. upload_server_mbps is empty
+// unless the server reported what it received, and tls is empty unless
+// the run used TLS. family and ip are the address family and server
+// address the run used. The loaded latency and RPM columns are empty
+// unless latency was measured during that test. The steady columns hold
+// the throughput estimated without TCP slow start. The udp columns are
+// empty unless the run included a UDP test.
+type CSV struct {
+	OmitHeader bool
+}
+
+// Header returns the header row.
+func (CSV) Header() []string { return csvHeader }
+
+func (c CSV) Export(w io.Writer, res *result.Result) error {
+	cw := csv.NewWriter(w)
+	if !c.OmitHeader {
+		cw.Write(csvHeader)
+	}
+	row := []string{
+		formatTime(res.Start), formatTime(res.End),
+		res.Server.Addr, res.Server.Hostname, res.Server.Location,
+		formatFloat(res.Ping.MinMs), formatFloat(res.Ping.MaxMs),
+		formatFloat(res.Ping.MeanMs), formatFloat(res.Ping.StdDevMs),
+		formatFloat(res.Download.MinMbps), formatFloat(res.Download.MaxMbps),
+		formatFloat(res.Download.MeanMbps), formatFloat(res.Download.StdDevMbps),
+		formatFloat(res.Upload.MinMbps), formatFloat(res.Upload.MaxMbps),
+		formatFloat(res.Upload.MeanMbps), formatFloat(res.Upload.StdDevMbps),
+		optionalFloat(res.Upload.ServerMbps), res.Server.TLS, res.Server.Family, res.Server.IP,
+	}
+	row = append(row, loadedLatency(res.Download.LoadedLatency)...)
+	row = append(row, loadedLatency(res.Upload.LoadedLatency)...)
+	row = append(row,
+		formatFloat(res.Ping.MedianMs), formatFloat(res.Ping.P95Ms), formatFloat(res.Ping.JitterMs),
+		formatFloat(res.Download.SteadyMbps), formatFloat(res.Upload.SteadyMbps),
+	)
+	row = append(row, udp(res.UDP)...)
+	cw.Write(row)
+	cw.Flush()
+	return cw.Error()
+}
+
+var csvSamplesHeader = []string{"start", "test", "seq", "time", "latency_ms", "mbps", "stream"}
+
+// CSVSamples writes one row per raw sample. Rows from the same run share
+// the run's start time so they can be grouped after appending. Samples
+// from multi-stream tests are followed by a row for each stream, numbered
+// from 0 in the stream column; the total row leaves it empty. Latency
+// probes run during a throughput test are listed as download_latency or
+// upload_latency rows, and the server's reports during a UDP test as udp
+// rows.
+type CSVSamples struct {
+	OmitHeader bool
+}
+
+// Header returns the header row.
+func (CSVSamples) Header() []string { return csvSamplesHeader }
+
+func (c CSVSamples) Export(w io.Writer, res *result.Result) error {
+	cw := csv.NewWriter(w)
+	if !c.OmitHeader {
+		cw.Write(csvSamplesHeader)
+	}
+
+	start := formatTime(res.Start)
+	for _, s := range res.Ping.Samples {
+		cw.Write([]string{start, "ping", strconv.Itoa(s.Seq), formatTime(s.Time), formatFloat(s.LatencyMs), "", ""})
+	}
+	for _, dir := range []struct {
+		name string
+		t    result.Throughput
+	}{
+		{"download", res.Download},
+		{"upload", res.Upload},
+	} {
+		for i, s := range dir.t.Samples {
+			seq, t := strconv.Itoa(i), formatTime(s.Time)
+			cw.Write([]string{start, dir.name, seq, t, "", formatFloat(s.Mbps), ""})
+			for j, mbps := range s.Streams {
+				cw.Write([]string{start, dir.name, seq, t, "", formatFloat(mbps), strconv.Itoa(j)})
+			}
+		}
+		if l := dir.t.LoadedLatency; l != nil {
+			for _, s := range l.Samples {
+				cw.Write([]string{start, dir.name + "_latency", strconv.Itoa(s.Seq), formatTime(s.Time), formatFloat(s.LatencyMs), "", ""})
+			}
+		}
+	}
+	if res.UDP != nil {
+		for i, s := range res.UDP.Samples {
+			cw.Write([]string{start, "udp", strconv.Itoa(i), formatTime(s.Time), "", formatFloat(s.Mbps), ""})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// headerExporter is implemented by formats that start with a header row.
+type headerExporter interface {
+	Header() []string
+}
+
+// CheckAppend reports whether results in the named format can be
+// appended to existing, the current contents of a file. A CSV file must
+// start with the header the format writes: rows are written in its
+// column order, which changes as columns are added.
+func CheckAppend(name string, existing io.Reader) error {
+	exp, err := New(name, Options{})
+	if err != nil {
+		return err
+	}
+	h, ok := exp.(headerExporter)
+	if !ok {
+		return nil
+	}
+	r := csv.NewReader(existing)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read CSV header: %w", err)
+	}
+	if !slices.Equal(header, h.Header()) {
+		return errors.New("CSV header differs from the columns this version writes; append to a new file")
+	}
+	return nil
+}
+
+// udp returns the UDP columns for u, which are empty if u is nil.
+func udp(u *result.UDP) []string {
+	if u == nil {
+		return make([]string, 6)
+	}
+	return []string{
+		strconv.FormatInt(u.Sent, 10), strconv.FormatInt(u.Lost, 10), formatFloat(u.LossPercent),
+		strconv.FormatInt(u.Reordered, 10), strconv.FormatInt(u.Duplicates, 10), formatFloat(u.JitterMs),
+	}
+}
+
+// loadedLatency returns the loaded latency columns for l, which are
+// empty if l is nil.
+func loadedLatency(l *result.LoadedLatency) []string {
+	if l == nil {
+		return []string{"", ""}
+	}
+	return []string{formatFloat(l.MeanMs), strconv.Itoa(l.RPM)}
+}
+
+// optionalFloat formats f, or returns an empty string for zero, which
+// marks a value that was not reported.
+func optionalFloat(f float64) string {
+	if f == 0 {
+		return ""
+	}
+	return formatFloat(f)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,99 @@
+// Package export writes test results in formats consumed by external
+// tooling: JSON documents, CSV rows, and InfluxDB line protocol.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// Exporter writes a test result in a particular format.
+type Exporter interface {
+	Export(w io.Writer, res *result.Result) error
+}
+
+// multiExporter is implemented by exporters whose format needs several
+// results written as one.
+type multiExporter interface {
+	ExportAll(w io.Writer, results []*result.Result) error
+}
+
+// Options controls format-specific behavior when constructing an Exporter.
+type Options struct {
+	// OmitHeader suppresses the CSV header row, for appending to an
+	// existing file.
+	OmitHeader bool
+}
+
+var formats = map[string]func(Options) Exporter{
+	"json":        func(Options) Exporter { return JSON{} },
+	"csv":         func(o Options) Exporter { return CSV{OmitHeader: o.OmitHeader} },
+	"csv-samples": func(o Options) Exporter { return CSVSamples{OmitHeader: o.OmitHeader} },
+	"influx":      func(Options) Exporter { return LineProtocol{} },
+}
+
+// New returns the Exporter registered under name.
+func New(name string, opts Options) (Exporter, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown export format %q (available: %v)", name, Formats())
+	}
+	return f(opts), nil
+}
+
+// Formats returns the names of all registered formats, sorted.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExportAll writes several results, such as the IPv4 and IPv6 runs of a
+// test, in the named format. Formats that can't just write one result
+// after another get a single document holding them all: JSON an array,
+// and CSV one header. A single result is written as by Export.
+func ExportAll(w io.Writer, name string, opts Options, results []*result.Result) error {
+	exp, err := New(name, opts)
+	if err != nil {
+		return err
+	}
+	if all, ok := exp.(multiExporter); ok && len(results) > 1 {
+		return all.ExportAll(w, results)
+	}
+	for _, res := range results {
+		if err := exp.Export(w, res); err != nil {
+			return err
+		}
+		opts.OmitHeader = true
+		if exp, err = New(name, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSON writes the result as an indented JSON document.
+type JSON struct{}
+
+func (JSON) Export(w io.Writer, res *result.Result) error {
+	return res.WriteJSON(w)
+}
+
+// ExportAll writes the results as an indented JSON array.
+func (JSON) ExportAll(w io.Writer, results []*result.Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,146 @@
+package export
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata/")
+
+// fixture builds a deterministic result with a handful of samples.
+func fixture() *result.Result {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := result.New("speedtest.example.com:7121", start)
+	r.ClientVersion = "v1.0.0"
+	r.SetServer(backend.ServerInfo{Hostname: "speedtest.example.com", Location: "Dallas, TX", TLS: "TLS 1.3, TLS_AES_128_GCM_SHA256", Family: "IPv6", IP: "2001:db8::10"})
+
+	for i, d := range []time.Duration{10, 12, 14} {
+		r.AddPing(backend.PingSample{
+			Seq:     i,
+			Latency: d * time.Millisecond,
+			Time:    start.Add(time.Duration(i) * 100 * time.Millisecond),
+		})
+	}
+	for i, v := range []float64{100, 150.5} {
+		r.AddDownload(backend.ThroughputSample{Mbps: v, Time: start.Add(5*time.Second + time.Duration(i)*500*time.Millisecond)})
+	}
+	for i, d := range []time.Duration{40, 60} {
+		r.AddDownload(backend.ThroughputSample{Latency: d * time.Millisecond, Time: start.Add(5*time.Second + time.Duration(i)*100*time.Millisecond)})
+	}
+	for i, v := range [][]float64{{12, 8}, {15, 10}} {
+		r.AddUpload(backend.ThroughputSample{
+			Mbps:       v[0] + v[1],
+			Streams:    v,
+			ServerMbps: v[0] + v[1] - 1,
+			Time:       start.Add(20*time.Second + time.Duration(i)*500*time.Millisecond),
+		})
+	}
+	r.AddUpload(backend.ThroughputSample{Server: &backend.ServerReport{Bytes: 2_750_000, Elapsed: time.Second}})
+	for i, lost := range []int64{1, 3} {
+		r.AddUDP(backend.UDPSample{
+			TargetMbps: 4, PacketSize: 1200, Sent: int64(i+1) * 200, Received: int64(i+1)*200 - lost, Lost: lost,
+			Jitter: time.Duration(i+1) * time.Millisecond, Mbps: 3.9, Time: start.Add(30*time.Second + time.Duration(i)*500*time.Millisecond),
+		})
+	}
+	r.AddUDP(backend.UDPSample{TargetMbps: 4, PacketSize: 1200, Sent: 400, Received: 396, Lost: 4, Reordered: 2, Jitter: 1500 * time.Microsecond, Mbps: 3.96, Final: true})
+	r.Finish(start.Add(35 * time.Second))
+	return r
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		format string
+		opts   Options
+	}{
+		{"result.json", "json", Options{}},
+		{"result.csv", "csv", Options{}},
+		{"result_noheader.csv", "csv", Options{OmitHeader: true}},
+		{"samples.csv", "csv-samples", Options{}},
+		{"result.influx", "influx", Options{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			exp, err := New(tt.format, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := exp.Export(&buf, fixture()); err != nil {
+				t.Fatalf("Export: %v", err)
+			}
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read golden file (run with -update to create): %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("output mismatch for %s\ngot:\n%s\nwant:\n%s", tt.golden, buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestNew_UnknownFormat(t *testing.T) {
+	if _, err := New("xml", Options{}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestCheckAppend(t *testing.T) {
+	current, err := os.ReadFile(filepath.Join("testdata", "result.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, format, existing string
+		wantErr                bool
+	}{
+		{"empty", "csv", "", false},
+		{"current header", "csv", string(current), false},
+		{"old header", "csv", "start,end,server_addr\n", true},
+		{"other format's header", "csv-samples", string(current), true},
+		{"json", "json", "{}\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAppend(tt.format, strings.NewReader(tt.existing))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckAppend error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEscapeTag(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "none"},
+		{"plain", "plain"},
+		{"Dallas, TX", `Dallas\,\ TX`},
+		{"a=b", `a\=b`},
+	}
+	for _, tt := range tests {
+		if got := escapeTag(tt.in); got != tt.want {
+			t.Errorf("escapeTag(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// LineProtocol writes InfluxDB line protocol: one sparkyfish_result point
+// with the run aggregates, followed by a sparkyfish_ping or
+// sparkyfish_throughput point for every raw sample. Samples from
+// multi-stream tests add a sparkyfish_stream point per stream, kept in a
+// separate measurement so that summing throughput points is not skewed.
+// Latency probes run during a throughput test are sparkyfish_loaded_ping
+// points, tagged with the test's direction, and the server's reports
+// during a UDP test sparkyfish_udp points.
+// Runs over TLS are tagged with the TLS version and cipher suite, and every
+// run with its address family, so that runs can be compared along either.
+type LineProtocol struct{}
+
+func (LineProtocol) Export(w io.Writer, res *result.Result) error {
+	tags := "server=" + escapeTag(res.Server.Hostname)
+	if res.Server.Location != "" {
+		tags += ",location=" + escapeTag(res.Server.Location)
+	}
+	if res.Server.TLS != "" {
+		tags += ",tls=" + escapeTag(res.Server.TLS)
+	}
+	if res.Server.Family != "" {
+		tags += ",family=" + escapeTag(res.Server.Family)
+	}
+
+	fields := []string{
+		"ping_min_ms=" + formatFloat(res.Ping.MinMs),
+		"ping_max_ms=" + formatFloat(res.Ping.MaxMs),
+		"ping_mean_ms=" + formatFloat(res.Ping.MeanMs),
+		"ping_stddev_ms=" + formatFloat(res.Ping.StdDevMs),
+		"ping_median_ms=" + formatFloat(res.Ping.MedianMs),
+		"ping_p95_ms=" + formatFloat(res.Ping.P95Ms),
+		"ping_jitter_ms=" + formatFloat(res.Ping.JitterMs),
+		"download_max_mbps=" + formatFloat(res.Download.MaxMbps),
+		"download_mean_mbps=" + formatFloat(res.Download.MeanMbps),
+		"download_steady_mbps=" + formatFloat(res.Download.SteadyMbps),
+		"upload_max_mbps=" + formatFloat(res.Upload.MaxMbps),
+		"upload_mean_mbps=" + formatFloat(res.Upload.MeanMbps),
+		"upload_steady_mbps=" + formatFloat(res.Upload.SteadyMbps),
+	}
+	if res.Upload.ServerMbps > 0 {
+		fields = append(fields, "upload_server_mbps="+formatFloat(res.Upload.ServerMbps))
+	}
+	if l := res.Download.LoadedLatency; l != nil {
+		fields = append(fields, "download_loaded_latency_ms="+formatFloat(l.MeanMs), fmt.Sprintf("download_rpm=%di", l.RPM))
+	}
+	if l := res.Upload.LoadedLatency; l != nil {
+		fields = append(fields, "upload_loaded_latency_ms="+formatFloat(l.MeanMs), fmt.Sprintf("upload_rpm=%di", l.RPM))
+	}
+	if u := res.UDP; u != nil {
+		fields = append(fields,
+			fmt.Sprintf("udp_sent=%di", u.Sent),
+			fmt.Sprintf("udp_lost=%di", u.Lost),
+			"udp_loss_percent="+formatFloat(u.LossPercent),
+			fmt.Sprintf("udp_reordered=%di", u.Reordered),
+			fmt.Sprintf("udp_duplicates=%di", u.Duplicates),
+			"udp_jitter_ms="+formatFloat(u.JitterMs),
+			"udp_mbps="+formatFloat(u.Mbps),
+		)
+	}
+	if _, err := fmt.Fprintf(w, "sparkyfish_result,%s %s%s\n",
+		tags, strings.Join(fields, ","), timestamp(res.Start)); err != nil {
+		return err
+	}
+
+	for _, s := range res.Ping.Samples {
+		if _, err := fmt.Fprintf(w, "sparkyfish_ping,%s seq=%di,latency_ms=%s%s\n",
+			tags, s.Seq, formatFloat(s.LatencyMs), timestamp(s.Time)); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []struct {
+		name string
+		t    result.Throughput
+	}{
+		{"download", res.Download},
+		{"upload", res.Upload},
+	} {
+		for _, s := range dir.t.Samples {
+			serverField := ""
+			if s.ServerMbps > 0 {
+				serverField = ",server_mbps=" + formatFloat(s.ServerMbps)
+			}
+			if _, err := fmt.Fprintf(w, "sparkyfish_throughput,%s,direction=%s mbps=%s%s%s\n",
+				tags, dir.name, formatFloat(s.Mbps), serverField, timestamp(s.Time)); err != nil {
+				return err
+			}
+			for i, mbps := range s.Streams {
+				if _, err := fmt.Fprintf(w, "sparkyfish_stream,%s,direction=%s,stream=%d mbps=%s%s\n",
+					tags, dir.name, i, formatFloat(mbps), timestamp(s.Time)); err != nil {
+					return err
+				}
+			}
+		}
+		if l := dir.t.LoadedLatency; l != nil {
+			for _, s := range l.Samples {
+				if _, err := fmt.Fprintf(w, "sparkyfish_loaded_ping,%s,direction=%s seq=%di,latency_ms=%s%s\n",
+					tags, dir.name, s.Seq, formatFloat(s.LatencyMs), timestamp(s.Time)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if res.UDP != nil {
+		for _, s := range res.UDP.Samples {
+			if _, err := fmt.Fprintf(w, "sparkyfish_udp,%s mbps=%s,received=%di,lost=%di,jitter_ms=%s%s\n",
+				tags, formatFloat(s.Mbps), s.Received, s.Lost, formatFloat(s.JitterMs), timestamp(s.Time)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var tagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// escapeTag escapes a tag value per the line protocol spec. Empty values
+// are not allowed, so they are replaced with "none".
+func escapeTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return tagEscaper.Replace(s)
+}
+
+// timestamp returns the point's timestamp with its leading separator, or
+// an empty string for a zero time so the database assigns one on write.
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return " " + strconv.FormatInt(t.UnixNano(), 10)
+}
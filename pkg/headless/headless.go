@@ -0,0 +1,285 @@
+// Package headless runs a sparkyfish test without a terminal UI, for use
+// from cron, CI, or any session without a TTY.
+package headless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// Runner drives a backend through ping, download, and upload tests, and
+// optionally a UDP test, writing a progress line for every sample it receives.
+type Runner struct {
+	backend  backend.Backend
+	addr     string
+	progress io.Writer
+
+	// UDP also runs a UDP test after the upload. The backend must
+	// implement backend.UDPTester.
+	UDP bool
+}
+
+// New creates a Runner. Progress lines are written to progress, typically stderr.
+func New(b backend.Backend, addr string, progress io.Writer) *Runner {
+	return &Runner{backend: b, addr: addr, progress: progress}
+}
+
+// Run executes the full test sequence and returns the collected result.
+// If any test fails or produces no samples, the partial result is
+// returned along with the error.
+func (r *Runner) Run(ctx context.Context) (*result.Result, error) {
+	res := result.New(r.addr, time.Now())
+
+	info, err := r.backend.Connect(ctx, r.addr)
+	if err != nil {
+		return res, fmt.Errorf("connect: %w", err)
+	}
+	defer r.backend.Close()
+	res.SetServer(info)
+	r.logf("connected to %s", serverName(res.Server))
+
+	if err := r.runPing(ctx, res); err != nil {
+		return res, err
+	}
+
+	r.logf("download: starting")
+	if err := r.runThroughput(ctx, "download", r.backend.Download, res.AddDownload); err != nil {
+		return res, err
+	}
+
+	r.logf("upload: starting")
+	if err := r.runThroughput(ctx, "upload", r.backend.Upload, res.AddUpload); err != nil {
+		return res, err
+	}
+
+	if r.UDP {
+		tester, ok := r.backend.(backend.UDPTester)
+		if !ok {
+			return res, errors.New("udp: backend does not support UDP tests")
+		}
+		r.logf("udp: starting")
+		if err := r.runUDP(ctx, tester, res); err != nil {
+			return res, err
+		}
+	}
+
+	res.Finish(time.Now())
+	return res, nil
+}
+
+func (r *Runner) runPing(ctx context.Context, res *result.Result) error {
+	ch := make(chan backend.PingSample, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.backend.Ping(ctx, ch)
+	}()
+
+	var n int
+	for s := range ch {
+		n++
+		res.AddPing(s)
+		r.logf("ping %d: %.2f ms", s.Seq+1, ms(s.Latency))
+	}
+
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	if n == 0 {
+		return errors.New("ping: no samples received")
+	}
+	return nil
+}
+
+func (r *Runner) runThroughput(
+	ctx context.Context,
+	name string,
+	test func(context.Context, chan<- backend.ThroughputSample) error,
+	record func(backend.ThroughputSample),
+) error {
+	ch := make(chan backend.ThroughputSample, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- test(ctx, ch)
+	}()
+
+	var n int
+	for s := range ch {
+		if s.QueuePosition > 0 {
+			r.logf("%s: waiting for server (position %d)", name, s.QueuePosition)
+			continue
+		}
+		record(s)
+		if s.Latency > 0 {
+			// Latency probes come several times a second, so they
+			// only show up in the summary.
+			continue
+		}
+		if s.Server != nil {
+			r.logf("%s: server received %.1f MB in %.2fs (%.1f Mbit/s)",
+				name, float64(s.Server.Bytes)/1_000_000, s.Server.Elapsed.Seconds(), s.Server.Mbps())
+			continue
+		}
+		n++
+
+		line := fmt.Sprintf("%s: %.1f Mbit/s", name, s.Mbps)
+		if s.ServerMbps > 0 {
+			line += fmt.Sprintf(", server %.1f Mbit/s", s.ServerMbps)
+		}
+		if len(s.Streams) > 1 {
+			rates := make([]string, len(s.Streams))
+			for i, mbps := range s.Streams {
+				rates[i] = fmt.Sprintf("%.1f", mbps)
+			}
+			line += fmt.Sprintf(" (streams: %s)", strings.Join(rates, " / "))
+		}
+		r.logf("%s", line)
+	}
+
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: no samples received", name)
+	}
+	return nil
+}
+
+func (r *Runner) runUDP(ctx context.Context, tester backend.UDPTester, res *result.Result) error {
+	ch := make(chan backend.UDPSample, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tester.UDP(ctx, ch)
+	}()
+
+	var final bool
+	for s := range ch {
+		if s.QueuePosition > 0 {
+			r.logf("udp: waiting for server (position %d)", s.QueuePosition)
+			continue
+		}
+		res.AddUDP(s)
+		if s.Final {
+			final = true
+			r.logf("udp: server received %d of %d datagrams, %d lost (%.2f%%)",
+				s.Received, s.Sent, s.Lost, s.LossPercent())
+			continue
+		}
+		r.logf("udp: %.1f Mbit/s, %d lost, jitter %.2f ms", s.Mbps, s.Lost, ms(s.Jitter))
+	}
+
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("udp: %w", err)
+	}
+	if !final {
+		return errors.New("udp: no final report received")
+	}
+	return nil
+}
+
+func (r *Runner) logf(format string, args ...any) {
+	fmt.Fprintf(r.progress, format+"\n", args...)
+}
+
+// WriteSummary writes a short human-readable summary of res.
+func WriteSummary(w io.Writer, res *result.Result) {
+	fmt.Fprintf(w, "Server:   %s\n", serverName(res.Server))
+	if res.Server.TLS != "" {
+		fmt.Fprintf(w, "TLS:      %s\n", res.Server.TLS)
+	}
+	fmt.Fprintf(w, "Latency:  min %.2f ms, max %.2f ms, avg %.2f ms, σ %.2f ms\n",
+		res.Ping.MinMs, res.Ping.MaxMs, res.Ping.MeanMs, res.Ping.StdDevMs)
+	fmt.Fprintf(w, "          median %.2f ms, p95 %.2f ms, IQR %.2f ms, jitter %.2f ms\n",
+		res.Ping.MedianMs, res.Ping.P95Ms, res.Ping.IQRMs, res.Ping.JitterMs)
+	fmt.Fprintf(w, "Download: avg %.1f Mbit/s, max %.1f Mbit/s, steady %.1f Mbit/s\n",
+		res.Download.MeanMbps, res.Download.MaxMbps, res.Download.SteadyMbps)
+	fmt.Fprintf(w, "Upload:   avg %.1f Mbit/s, max %.1f Mbit/s, steady %.1f Mbit/s",
+		res.Upload.MeanMbps, res.Upload.MaxMbps, res.Upload.SteadyMbps)
+	if res.Upload.ServerMbps > 0 {
+		fmt.Fprintf(w, ", server-confirmed %.1f Mbit/s", res.Upload.ServerMbps)
+	}
+	fmt.Fprintln(w)
+	if dl, ul := res.Download.LoadedLatency, res.Upload.LoadedLatency; dl != nil || ul != nil {
+		fmt.Fprintf(w, "Loaded:   download %s, upload %s\n", loadedLatency(dl), loadedLatency(ul))
+	}
+	if u := res.UDP; u != nil {
+		fmt.Fprintf(w, "UDP:      %d sent at %.1f Mbit/s (%d B), lost %d (%.2f%%), reordered %d, duplicates %d, jitter %.2f ms\n",
+			u.Sent, u.TargetMbps, u.PacketSize, u.Lost, u.LossPercent, u.Reordered, u.Duplicates, u.JitterMs)
+	}
+}
+
+// loadedLatency formats the latency measured during a throughput test,
+// with its increase over idle and the responsiveness it implies.
+func loadedLatency(l *result.LoadedLatency) string {
+	if l == nil {
+		return "not measured"
+	}
+	return fmt.Sprintf("avg %.2f ms (%+.2f ms, %d RPM)", l.MeanMs, l.IncreaseMs, l.RPM)
+}
+
+// WriteComparison writes the aggregates of several runs side by side, one
+// column per run headed by its address family, for comparing IPv4 with
+// IPv6 on the same server.
+func WriteComparison(w io.Writer, results []*result.Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	type row struct {
+		label string
+		value func(*result.Result) string
+	}
+	rows := []row{
+		{"", func(r *result.Result) string { return r.Server.Family }},
+		{"Latency", func(r *result.Result) string { return fmt.Sprintf("%.2f ms", r.Ping.MeanMs) }},
+		{"Jitter", func(r *result.Result) string { return fmt.Sprintf("%.2f ms", r.Ping.JitterMs) }},
+		{"Download", func(r *result.Result) string { return fmt.Sprintf("%.1f Mbit/s", r.Download.MeanMbps) }},
+		{"Upload", func(r *result.Result) string { return fmt.Sprintf("%.1f Mbit/s", r.Upload.MeanMbps) }},
+	}
+	if slices.ContainsFunc(results, func(r *result.Result) bool { return r.UDP != nil }) {
+		rows = append(rows,
+			row{"UDP loss", func(r *result.Result) string {
+				if r.UDP == nil {
+					return "-"
+				}
+				return fmt.Sprintf("%.2f%%", r.UDP.LossPercent)
+			}},
+			row{"UDP jitter", func(r *result.Result) string {
+				if r.UDP == nil {
+					return "-"
+				}
+				return fmt.Sprintf("%.2f ms", r.UDP.JitterMs)
+			}},
+		)
+	}
+	for _, row := range rows {
+		fmt.Fprint(tw, row.label)
+		for _, r := range results {
+			fmt.Fprint(tw, "\t", row.value(r))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+func serverName(s result.Server) string {
+	name := s.Hostname
+	if s.Location != "" {
+		name += " :: " + s.Location
+	}
+	if s.Family != "" && s.IP != "" {
+		name += " (" + s.Family + " " + s.IP + ")"
+	} else if s.Family != "" {
+		name += " (" + s.Family + ")"
+	}
+	return name
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
@@ -0,0 +1,254 @@
+package headless
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// fakeBackend emits fixed samples and can be told to fail a given test.
+type fakeBackend struct {
+	failPing     error
+	failDownload error
+	failUpload   error
+	serverReport *backend.ServerReport // sent at the end of the upload if set
+	loaded       time.Duration         // latency under load sent with the download if set
+	closed       bool
+}
+
+func (f *fakeBackend) Connect(ctx context.Context, addr string) (backend.ServerInfo, error) {
+	return backend.ServerInfo{Hostname: "test.example.com", Location: "Seattle, WA"}, nil
+}
+
+func (f *fakeBackend) Ping(ctx context.Context, results chan<- backend.PingSample) error {
+	defer close(results)
+	for i, ms := range []int{10, 20, 30} {
+		results <- backend.PingSample{Seq: i, Latency: time.Duration(ms) * time.Millisecond}
+	}
+	return f.failPing
+}
+
+func (f *fakeBackend) Download(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+	for _, v := range []float64{100, 200, 300} {
+		results <- backend.ThroughputSample{Mbps: v, Time: time.Now()}
+		if f.loaded > 0 {
+			results <- backend.ThroughputSample{Latency: f.loaded, Time: time.Now()}
+		}
+	}
+	return f.failDownload
+}
+
+func (f *fakeBackend) Upload(ctx context.Context, results chan<- backend.ThroughputSample) error {
+	defer close(results)
+	for _, v := range []float64{10, 20} {
+		results <- backend.ThroughputSample{Mbps: v, Time: time.Now()}
+	}
+	if f.serverReport != nil {
+		results <- backend.ThroughputSample{Time: time.Now(), Server: f.serverReport}
+	}
+	return f.failUpload
+}
+
+func (f *fakeBackend) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestRun_Success(t *testing.T) {
+	var progress, out bytes.Buffer
+	r := New(&fakeBackend{}, "test.example.com:7121", &progress)
+
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if res.End.IsZero() {
+		t.Error("expected End to be set on success")
+	}
+	if len(res.Ping.Samples) != 3 || len(res.Download.Samples) != 3 || len(res.Upload.Samples) != 2 {
+		t.Errorf("unexpected sample counts: ping=%d dl=%d ul=%d",
+			len(res.Ping.Samples), len(res.Download.Samples), len(res.Upload.Samples))
+	}
+
+	WriteSummary(&out, res)
+	summary := out.String()
+	for _, want := range []string{
+		"Server:   test.example.com :: Seattle, WA",
+		"Latency:  min 10.00 ms, max 30.00 ms, avg 20.00 ms",
+		"          median 20.00 ms, p95 29.00 ms, IQR 10.00 ms, jitter 1.21 ms",
+		"Download: avg 200.0 Mbit/s, max 300.0 Mbit/s, steady 250.0 Mbit/s",
+		"Upload:   avg 15.0 Mbit/s, max 20.0 Mbit/s, steady 20.0 Mbit/s",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary missing %q:\n%s", want, summary)
+		}
+	}
+
+	if !strings.Contains(progress.String(), "ping 3: 30.00 ms") {
+		t.Errorf("progress missing ping line:\n%s", progress.String())
+	}
+}
+
+func TestRun_ServerReport(t *testing.T) {
+	var progress, out bytes.Buffer
+	report := &backend.ServerReport{Bytes: 1_500_000, Elapsed: time.Second}
+	r := New(&fakeBackend{serverReport: report}, "test.example.com:7121", &progress)
+
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(res.Upload.Samples) != 2 {
+		t.Errorf("server report counted as a sample: %d upload samples", len(res.Upload.Samples))
+	}
+
+	WriteSummary(&out, res)
+	if want := "Upload:   avg 15.0 Mbit/s, max 20.0 Mbit/s, steady 20.0 Mbit/s, server-confirmed 12.0 Mbit/s"; !strings.Contains(out.String(), want) {
+		t.Errorf("summary missing %q:\n%s", want, out.String())
+	}
+	if want := "upload: server received 1.5 MB in 1.00s (12.0 Mbit/s)"; !strings.Contains(progress.String(), want) {
+		t.Errorf("progress missing %q:\n%s", want, progress.String())
+	}
+}
+
+func TestRun_LoadedLatency(t *testing.T) {
+	var progress, out bytes.Buffer
+	r := New(&fakeBackend{loaded: 40 * time.Millisecond}, "test.example.com:7121", &progress)
+
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(res.Download.Samples) != 3 {
+		t.Errorf("latency probes counted as throughput: %d download samples", len(res.Download.Samples))
+	}
+	if l := res.Download.LoadedLatency; l == nil || len(l.Samples) != 3 {
+		t.Fatalf("loaded latency = %+v, want 3 samples", l)
+	}
+	if strings.Contains(progress.String(), "download: 0.0 Mbit/s") {
+		t.Errorf("progress logs latency probes as throughput:\n%s", progress.String())
+	}
+
+	WriteSummary(&out, res)
+	if want := "Loaded:   download avg 40.00 ms (+20.00 ms, 1500 RPM), upload not measured"; !strings.Contains(out.String(), want) {
+		t.Errorf("summary missing %q:\n%s", want, out.String())
+	}
+}
+
+// udpBackend is a fakeBackend that also runs a UDP test.
+type udpBackend struct {
+	fakeBackend
+}
+
+func (f *udpBackend) UDP(ctx context.Context, results chan<- backend.UDPSample) error {
+	defer close(results)
+	results <- backend.UDPSample{QueuePosition: 1}
+	results <- backend.UDPSample{TargetMbps: 4, PacketSize: 1200, Sent: 200, Received: 199, Lost: 1, Jitter: 2 * time.Millisecond, Mbps: 3.9}
+	results <- backend.UDPSample{
+		TargetMbps: 4, PacketSize: 1200, Sent: 400, Received: 396, Lost: 4, Reordered: 2,
+		Jitter: 1500 * time.Microsecond, Mbps: 3.96, Final: true,
+	}
+	return nil
+}
+
+func TestRun_UDP(t *testing.T) {
+	var progress, out bytes.Buffer
+	r := New(&udpBackend{}, "test.example.com:7121", &progress)
+	r.UDP = true
+
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if res.UDP == nil || len(res.UDP.Samples) != 1 {
+		t.Fatalf("UDP result = %+v, want one interim sample", res.UDP)
+	}
+	for _, want := range []string{
+		"udp: waiting for server (position 1)",
+		"udp: 3.9 Mbit/s, 1 lost, jitter 2.00 ms",
+		"udp: server received 396 of 400 datagrams, 4 lost (1.00%)",
+	} {
+		if !strings.Contains(progress.String(), want) {
+			t.Errorf("progress missing %q:\n%s", want, progress.String())
+		}
+	}
+
+	WriteSummary(&out, res)
+	if want := "UDP:      400 sent at 4.0 Mbit/s (1200 B), lost 4 (1.00%), reordered 2, duplicates 0, jitter 1.50 ms"; !strings.Contains(out.String(), want) {
+		t.Errorf("summary missing %q:\n%s", want, out.String())
+	}
+
+	// Backends without a UDP test fail it rather than skip it.
+	r = New(&fakeBackend{}, "test.example.com:7121", &progress)
+	r.UDP = true
+	if _, err := r.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "udp:") {
+		t.Errorf("expected a udp error, got %v", err)
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	v4 := result.New("test.example.com:7121", time.Now())
+	v4.SetServer(backend.ServerInfo{Hostname: "test.example.com", Family: "IPv4"})
+	v4.AddPing(backend.PingSample{Latency: 12 * time.Millisecond})
+	v4.AddDownload(backend.ThroughputSample{Mbps: 940})
+	v4.AddUpload(backend.ThroughputSample{Mbps: 410})
+
+	v6 := result.New("test.example.com:7121", time.Now())
+	v6.SetServer(backend.ServerInfo{Hostname: "test.example.com", Family: "IPv6"})
+	v6.AddPing(backend.PingSample{Latency: 9500 * time.Microsecond})
+	v6.AddDownload(backend.ThroughputSample{Mbps: 925.5})
+	v6.AddUpload(backend.ThroughputSample{Mbps: 400})
+
+	var out bytes.Buffer
+	WriteComparison(&out, []*result.Result{v4, v6})
+	want := `           IPv4           IPv6
+Latency    12.00 ms       9.50 ms
+Jitter     0.00 ms        0.00 ms
+Download   940.0 Mbit/s   925.5 Mbit/s
+Upload     410.0 Mbit/s   400.0 Mbit/s
+`
+	if out.String() != want {
+		t.Errorf("comparison:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRun_Failure(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		backend *fakeBackend
+		prefix  string
+	}{
+		{"ping", &fakeBackend{failPing: boom}, "ping:"},
+		{"download", &fakeBackend{failDownload: boom}, "download:"},
+		{"upload", &fakeBackend{failUpload: boom}, "upload:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var progress bytes.Buffer
+			r := New(tt.backend, "host:7121", &progress)
+
+			res, err := r.Run(context.Background())
+			if !errors.Is(err, boom) {
+				t.Fatalf("expected wrapped boom error, got %v", err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.prefix) {
+				t.Errorf("error %q does not start with %q", err, tt.prefix)
+			}
+			if !res.End.IsZero() {
+				t.Error("expected End to be unset on failure")
+			}
+			if !tt.backend.closed {
+				t.Error("backend not closed after a failed test")
+			}
+		})
+	}
+}
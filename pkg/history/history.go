@@ -0,0 +1,195 @@
+// Package history persists completed test results to a local JSON Lines
+// file so that runs can be listed and compared over time.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/measure"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+const (
+	maxLineSize  = 16 * 1024 * 1024 // generous cap for a single result with samples
+	minTrendSpan = 24 * time.Hour   // shorter spans extrapolate noise into weekly slopes
+)
+
+// DefaultPath returns the history file location under the XDG data
+// directory: $XDG_DATA_HOME/sparkyfish/history.jsonl, falling back to
+// ~/.local/share when XDG_DATA_HOME is unset.
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("locate home directory: %w", err)
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "sparkyfish", "history.jsonl"), nil
+}
+
+// Store is an append-only file of results, one JSON document per line.
+type Store struct {
+	path string
+}
+
+// Open returns a Store backed by the file at path. The file and its
+// parent directory are created on the first Append.
+func Open(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path returns the location of the backing file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Append adds res to the end of the store.
+func (s *Store) Append(res *result.Result) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("create history directory: %w", err)
+	}
+
+	line, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("encode result: %w", err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write history: %w", err)
+	}
+	return f.Close()
+}
+
+// Filter selects results from the store. Zero-valued fields match everything.
+type Filter struct {
+	Server string    // case-insensitive substring of the server hostname or address
+	Since  time.Time // results started at or after this time
+	Until  time.Time // results started before this time
+}
+
+func (f Filter) match(r *result.Result) bool {
+	if f.Server != "" {
+		needle := strings.ToLower(f.Server)
+		if !strings.Contains(strings.ToLower(r.Server.Hostname), needle) &&
+			!strings.Contains(strings.ToLower(r.Server.Addr), needle) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && r.Start.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.Start.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Load returns all results matching f, in the order they were stored.
+// A missing history file yields no results and no error.
+func (s *Store) Load(f Filter) ([]*result.Result, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	var results []*result.Result
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var r result.Result
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", s.path, lineNo, err)
+		}
+		if f.match(&r) {
+			results = append(results, &r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	return results, nil
+}
+
+// Trend summarizes one metric across a series of runs.
+type Trend struct {
+	Mean    float64
+	Min     float64
+	Max     float64
+	PerWeek float64 // least-squares slope, in metric units per week; see Trends.HasSlope
+}
+
+// Trends summarizes ping, download, and upload means across results.
+type Trends struct {
+	Runs     int
+	First    time.Time
+	Last     time.Time
+	HasSlope bool // false if the runs span too little time for PerWeek to mean anything
+	PingMs   Trend
+	Download Trend
+	Upload   Trend
+}
+
+// Summarize computes trends over results, which need not be sorted.
+func Summarize(results []*result.Result) Trends {
+	t := Trends{Runs: len(results)}
+	if len(results) == 0 {
+		return t
+	}
+
+	t.First, t.Last = results[0].Start, results[0].Start
+	weeks := make([]float64, len(results))
+	ping := make([]float64, len(results))
+	dl := make([]float64, len(results))
+	ul := make([]float64, len(results))
+	for i, r := range results {
+		if r.Start.Before(t.First) {
+			t.First = r.Start
+		}
+		if r.Start.After(t.Last) {
+			t.Last = r.Start
+		}
+		weeks[i] = float64(r.Start.Unix()) / (7 * 24 * 3600)
+		ping[i] = r.Ping.MeanMs
+		dl[i] = r.Download.MeanMbps
+		ul[i] = r.Upload.MeanMbps
+	}
+
+	t.HasSlope = t.Last.Sub(t.First) >= minTrendSpan
+	t.PingMs = trend(weeks, ping, t.HasSlope)
+	t.Download = trend(weeks, dl, t.HasSlope)
+	t.Upload = trend(weeks, ul, t.HasSlope)
+	return t
+}
+
+func trend(weeks, vals []float64, withSlope bool) Trend {
+	min, max := measure.MinMax(vals)
+	t := Trend{Mean: measure.Mean(vals), Min: min, Max: max}
+	if withSlope {
+		t.PerWeek, _ = measure.LinearFit(weeks, vals)
+	}
+	return t
+}
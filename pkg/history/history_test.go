@@ -0,0 +1,133 @@
+package history
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+func run(host string, start time.Time, dl float64) *result.Result {
+	r := result.New(host+":7121", start)
+	r.SetServer(backend.ServerInfo{Hostname: host})
+	r.AddPing(backend.PingSample{Latency: 10 * time.Millisecond, Time: start})
+	r.AddDownload(backend.ThroughputSample{Mbps: dl, Time: start})
+	r.AddUpload(backend.ThroughputSample{Mbps: dl / 10, Time: start})
+	r.Finish(start.Add(30 * time.Second))
+	return r
+}
+
+func TestAppendLoad(t *testing.T) {
+	s := Open(filepath.Join(t.TempDir(), "nested", "history.jsonl"))
+
+	day := 24 * time.Hour
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, host := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		if err := s.Append(run(host, base.Add(time.Duration(i)*day), 100)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"all", Filter{}, 3},
+		{"server", Filter{Server: "A.EXAMPLE"}, 2},
+		{"since", Filter{Since: base.Add(day)}, 2},
+		{"until", Filter{Until: base.Add(day)}, 1},
+		{"server and range", Filter{Server: "a.", Since: base.Add(day), Until: base.Add(3 * day)}, 1},
+		{"no match", Filter{Server: "c.example.com"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Load(tt.filter)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("Load(%+v) returned %d results, want %d", tt.filter, len(got), tt.want)
+			}
+		})
+	}
+
+	all, _ := s.Load(Filter{})
+	if len(all[0].Download.Samples) != 1 {
+		t.Errorf("raw samples not persisted: %+v", all[0].Download)
+	}
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	s := Open(filepath.Join(t.TempDir(), "missing.jsonl"))
+	got, err := s.Load(Filter{})
+	if err != nil || got != nil {
+		t.Errorf("Load on missing file = (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestLoad_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	os.WriteFile(path, []byte("{not json\n"), 0o644)
+	if _, err := Open(path).Load(Filter{}); err == nil {
+		t.Error("expected error for corrupt history")
+	}
+}
+
+func TestDefaultPath(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/data")
+	got, err := DefaultPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("/data", "sparkyfish", "history.jsonl"); got != want {
+		t.Errorf("DefaultPath() = %q, want %q", got, want)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// Download drops by 10 Mbit/s every week
+	results := []*result.Result{
+		run("a", base.Add(2*week), 80),
+		run("a", base, 100),
+		run("a", base.Add(week), 90),
+	}
+
+	tr := Summarize(results)
+	if tr.Runs != 3 || !tr.First.Equal(base) || !tr.Last.Equal(base.Add(2*week)) {
+		t.Errorf("unexpected run range: %+v", tr)
+	}
+	if tr.Download.Mean != 90 || tr.Download.Min != 80 || tr.Download.Max != 100 {
+		t.Errorf("unexpected download summary: %+v", tr.Download)
+	}
+	if math.Abs(tr.Download.PerWeek-(-10)) > 1e-6 {
+		t.Errorf("download trend = %v/week, want -10", tr.Download.PerWeek)
+	}
+	if !tr.HasSlope {
+		t.Error("expected HasSlope for runs two weeks apart")
+	}
+	if tr.PingMs.PerWeek != 0 {
+		t.Errorf("ping trend = %v/week, want 0", tr.PingMs.PerWeek)
+	}
+}
+
+func TestSummarize_ShortSpan(t *testing.T) {
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tr := Summarize([]*result.Result{
+		run("a", base, 100),
+		run("a", base.Add(time.Minute), 200),
+	})
+	if tr.HasSlope || tr.Download.PerWeek != 0 {
+		t.Errorf("expected no slope for runs a minute apart, got %+v", tr)
+	}
+	if tr.Download.Mean != 150 {
+		t.Errorf("download mean = %v, want 150", tr.Download.Mean)
+	}
+}
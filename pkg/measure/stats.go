@@ -2,6 +2,7 @@ package measure
 
 import (
 	"math"
+	"slices"
 	"time"
 )
 
@@ -63,3 +64,156 @@ func DurationStats(pings []time.Duration) (min, max, mean, stddev time.Duration)
 	fmin, fmax := MinMax(vals)
 	return time.Duration(fmin), time.Duration(fmax), time.Duration(Mean(vals)), time.Duration(StdDev(vals))
 }
+
+// LinearFit returns the slope and intercept of the least-squares line
+// through the points (xs[i], ys[i]). Returns (0, Mean(ys)) if there are
+// fewer than two points or all xs are equal.
+func LinearFit(xs, ys []float64) (slope, intercept float64) {
+	n := len(xs)
+	if len(ys) < n {
+		n = len(ys)
+	}
+	if n < 2 {
+		return 0, Mean(ys[:n])
+	}
+
+	mx, my := Mean(xs[:n]), Mean(ys[:n])
+	var num, den float64
+	for i := 0; i < n; i++ {
+		dx := xs[i] - mx
+		num += dx * (ys[i] - my)
+		den += dx * dx
+	}
+	if den == 0 {
+		return 0, my
+	}
+	slope = num / den
+	return slope, my - slope*mx
+}
+
+// Percentile returns the p-th percentile (0-100) of vals, interpolating
+// linearly between the two nearest ranks. vals need not be sorted and is
+// not modified. Returns 0 for empty slices.
+func Percentile(vals []float64, p float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(vals)
+	slices.Sort(sorted)
+	return percentile(sorted, p)
+}
+
+// percentile is Percentile for vals that are already sorted.
+func percentile(sorted []float64, p float64) float64 {
+	p = math.Max(0, math.Min(100, p))
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// Median returns the median of vals. Returns 0 for empty slices.
+func Median(vals []float64) float64 {
+	return Percentile(vals, 50)
+}
+
+// IQR returns the interquartile range of vals: the spread of its middle
+// half, which unlike StdDev isn't inflated by a few outliers. Returns 0
+// for empty slices.
+func IQR(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(vals)
+	slices.Sort(sorted)
+	return percentile(sorted, 75) - percentile(sorted, 25)
+}
+
+// MeanAbsDev returns the mean absolute deviation of vals from their mean.
+// Returns 0 for empty slices.
+func MeanAbsDev(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	m := Mean(vals)
+	var sum float64
+	for _, v := range vals {
+		sum += math.Abs(v - m)
+	}
+	return sum / float64(len(vals))
+}
+
+// Jitter returns the interarrival jitter of RFC 3550 (section 6.4.1) for
+// a series of transit times, such as the round trips of consecutive
+// pings: a running average of the change between neighbours, smoothed
+// with a gain of 1/16 so that it follows the recent variation. Returns 0
+// for fewer than two values.
+func Jitter(transits []float64) float64 {
+	var j float64
+	for i := 1; i < len(transits); i++ {
+		d := math.Abs(transits[i] - transits[i-1])
+		j += (d - j) / 16
+	}
+	return j
+}
+
+// EWMA returns the exponentially weighted moving average of vals, in
+// order, where each value is given the weight alpha (0-1] and the average
+// so far the rest. The first value seeds the average. Returns 0 for empty
+// slices.
+func EWMA(vals []float64, alpha float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	avg := vals[0]
+	for _, v := range vals[1:] {
+		avg = alpha*v + (1-alpha)*avg
+	}
+	return avg
+}
+
+// TrimmedMean returns the mean of vals after dropping the given fraction
+// (0-0.5) of the lowest and of the highest values. Returns 0 for empty
+// slices.
+func TrimmedMean(vals []float64, trim float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(vals)
+	slices.Sort(sorted)
+	n := int(float64(len(sorted)) * math.Max(0, math.Min(0.5, trim)))
+	if 2*n >= len(sorted) {
+		return Median(sorted)
+	}
+	return Mean(sorted[n : len(sorted)-n])
+}
+
+const (
+	// steadyAlpha smooths throughput samples to find the peak rate
+	// without being fooled by a single fast interval.
+	steadyAlpha = 0.3
+	// steadyThreshold is the share of the smoothed peak rate at which a
+	// test counts as past TCP slow start.
+	steadyThreshold = 0.8
+	// steadyTrim is the share of samples dropped at each end of the
+	// steady part, to ignore stalls and bursts.
+	steadyTrim = 0.1
+)
+
+// SteadyThroughput estimates the rate a connection sustains from the
+// periodic samples of a throughput test, which the mean understates
+// because it includes the ramp-up of TCP slow start. It skips the samples
+// before the rate first reaches 80% of the peak of its EWMA, and returns
+// the trimmed mean of the rest. Returns 0 for empty slices.
+func SteadyThroughput(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	avg, peak := samples[0], samples[0]
+	for _, v := range samples[1:] {
+		avg = steadyAlpha*v + (1-steadyAlpha)*avg
+		peak = max(peak, avg)
+	}
+	start := slices.IndexFunc(samples, func(v float64) bool { return v >= steadyThreshold*peak })
+	return TrimmedMean(samples[start:], steadyTrim)
+}
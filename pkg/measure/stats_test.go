@@ -108,3 +108,219 @@ func TestDurationStatsEmpty(t *testing.T) {
 		t.Errorf("DurationStats(nil) = (%v, %v, %v, %v), want all zeros", min, max, mean, stddev)
 	}
 }
+
+func TestLinearFit(t *testing.T) {
+	tests := []struct {
+		name          string
+		xs, ys        []float64
+		wantSlope     float64
+		wantIntercept float64
+	}{
+		{"empty", nil, nil, 0, 0},
+		{"single", []float64{1}, []float64{4}, 0, 4},
+		{"flat", []float64{0, 1, 2}, []float64{5, 5, 5}, 0, 5},
+		{"line", []float64{0, 1, 2, 3}, []float64{1, 3, 5, 7}, 2, 1},
+		{"decreasing", []float64{1, 2, 3}, []float64{30, 20, 10}, -10, 40},
+		{"same x", []float64{2, 2}, []float64{1, 3}, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slope, intercept := LinearFit(tt.xs, tt.ys)
+			if !approxEqual(slope, tt.wantSlope, 1e-9) || !approxEqual(intercept, tt.wantIntercept, 1e-9) {
+				t.Errorf("LinearFit(%v, %v) = (%v, %v), want (%v, %v)",
+					tt.xs, tt.ys, slope, intercept, tt.wantSlope, tt.wantIntercept)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		p    float64
+		want float64
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []float64{7}, 95, 7},
+		{"min", []float64{3, 1, 2}, 0, 1},
+		{"max", []float64{3, 1, 2}, 100, 3},
+		{"exact rank", []float64{10, 20, 30, 40, 50}, 25, 20},
+		{"interpolated", []float64{10, 20, 30, 40}, 50, 25},
+		{"unsorted", []float64{40, 10, 30, 20}, 90, 37},
+		{"out of range", []float64{1, 2}, 150, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Percentile(tt.vals, tt.p)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("Percentile(%v, %v) = %v, want %v", tt.vals, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPercentileDoesNotSort(t *testing.T) {
+	vals := []float64{3, 1, 2}
+	Percentile(vals, 50)
+	if vals[0] != 3 || vals[1] != 1 || vals[2] != 2 {
+		t.Errorf("Percentile modified its input: %v", vals)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"odd", []float64{5, 1, 3}, 3},
+		{"even", []float64{4, 1, 3, 2}, 2.5},
+		{"outlier", []float64{10, 11, 12, 500}, 11.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Median(tt.vals)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("Median(%v) = %v, want %v", tt.vals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIQR(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []float64{4}, 0},
+		{"uniform", []float64{2, 2, 2, 2}, 0},
+		{"known", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}, 4},
+		{"outlier ignored", []float64{1, 2, 3, 4, 5, 6, 7, 8, 900}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IQR(tt.vals)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("IQR(%v) = %v, want %v", tt.vals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeanAbsDev(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []float64{5}, 0},
+		{"known", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 1.5},
+		{"symmetric", []float64{-1, 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MeanAbsDev(tt.vals)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("MeanAbsDev(%v) = %v, want %v", tt.vals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		transits []float64
+		want     float64
+	}{
+		{"empty", nil, 0},
+		{"single", []float64{20}, 0},
+		{"steady", []float64{20, 20, 20, 20}, 0},
+		{"one step", []float64{20, 36}, 1},
+		{"step up and back", []float64{20, 36, 20}, 1 + 15.0/16},
+		{"alternating", []float64{10, 26, 10, 26}, 16 * (1 - math.Pow(15.0/16, 3))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Jitter(tt.transits)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("Jitter(%v) = %v, want %v", tt.transits, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	tests := []struct {
+		name  string
+		vals  []float64
+		alpha float64
+		want  float64
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []float64{8}, 0.5, 8},
+		{"half", []float64{0, 8, 8}, 0.5, 6},
+		{"latest only", []float64{1, 2, 3}, 1, 3},
+		{"first only", []float64{1, 2, 3}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EWMA(tt.vals, tt.alpha)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("EWMA(%v, %v) = %v, want %v", tt.vals, tt.alpha, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		trim float64
+		want float64
+	}{
+		{"empty", nil, 0.1, 0},
+		{"no trim", []float64{1, 2, 3, 10}, 0, 4},
+		{"trim ends", []float64{100, 5, 6, 7, 0}, 0.2, 6},
+		{"too few to trim", []float64{1, 2, 9}, 0.1, 4},
+		{"half", []float64{1, 2, 3, 4}, 0.5, 2.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TrimmedMean(tt.vals, tt.trim)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("TrimmedMean(%v, %v) = %v, want %v", tt.vals, tt.trim, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSteadyThroughput(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		want    float64
+	}{
+		{"empty", nil, 0},
+		{"flat", []float64{100, 100, 100, 100}, 100},
+		{"slow start skipped", []float64{5, 20, 60, 100, 100, 100, 100, 100, 100, 100}, 100},
+		{"stall trimmed", []float64{100, 100, 100, 100, 100, 100, 100, 100, 100, 0}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SteadyThroughput(tt.samples)
+			if !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("SteadyThroughput(%v) = %v, want %v", tt.samples, got, tt.want)
+			}
+			if mean := Mean(tt.samples); got < mean {
+				t.Errorf("SteadyThroughput(%v) = %v, below the mean %v", tt.samples, got, mean)
+			}
+		})
+	}
+}
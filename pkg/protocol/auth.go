@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// ChallengeLen is the number of random bytes in an authentication
+// challenge. Challenges are sent as lowercase hex.
+const ChallengeLen = 16
+
+// MaxUserLen is the longest user name accepted during authentication.
+const MaxUserLen = 64
+
+// SharedUser is sent in place of a user name by clients that authenticate
+// with a server's shared secret rather than a per-user token.
+const SharedUser = "-"
+
+// AuthResponse returns the answer to an authentication challenge: the
+// lowercase hex HMAC-SHA256, keyed with token, of the user name and the
+// challenge. Only the answer goes over the wire, never the token.
+func AuthResponse(token, user, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("sparkyfish-auth\x00" + user + "\x00" + challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidUser reports whether s can be used as a user name: 1 to MaxUserLen
+// letters, digits, and the characters "._@-", other than SharedUser.
+func ValidUser(s string) bool {
+	if len(s) == 0 || len(s) > MaxUserLen || s == SharedUser {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '@', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthResponse(t *testing.T) {
+	const challenge = "00112233445566778899aabbccddeeff"
+	got := AuthResponse("s3cret", "alice", challenge)
+
+	if len(got) != 64 {
+		t.Fatalf("response %q is not a hex SHA-256 digest", got)
+	}
+	if got != AuthResponse("s3cret", "alice", challenge) {
+		t.Error("response is not deterministic")
+	}
+	for _, other := range []string{
+		AuthResponse("wrong", "alice", challenge),
+		AuthResponse("s3cret", "bob", challenge),
+		AuthResponse("s3cret", "alice", "ffeeddccbbaa99887766554433221100"),
+	} {
+		if other == got {
+			t.Errorf("response did not depend on all inputs: %q", other)
+		}
+	}
+}
+
+func TestValidUser(t *testing.T) {
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"alice", true},
+		{"ops-team_1", true},
+		{"alice@example.com", true},
+		{"", false},
+		{SharedUser, false},
+		{"two words", false},
+		{"tab\tuser", false},
+		{string(make([]byte, MaxUserLen+1)), false},
+	}
+	for _, tt := range tests {
+		if got := ValidUser(tt.user); got != tt.want {
+			t.Errorf("ValidUser(%q) = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPAuthorization(t *testing.T) {
+	const challenge = "00112233445566778899aabbccddeeff"
+	v := HTTPAuthorization("s3cret", "alice", challenge)
+	user, ch, response, ok := ParseHTTPAuthorization(v)
+	if !ok || user != "alice" || ch != challenge || response != AuthResponse("s3cret", "alice", challenge) {
+		t.Errorf("ParseHTTPAuthorization(%q) = %q, %q, %q, %v", v, user, ch, response, ok)
+	}
+	if strings.Contains(v, "s3cret") {
+		t.Errorf("header %q holds the token", v)
+	}
+	for _, bad := range []string{"", "Basic YWxpY2U6czNjcmV0", "Sparkyfish alice " + challenge} {
+		if _, _, _, ok := ParseHTTPAuthorization(bad); ok {
+			t.Errorf("ParseHTTPAuthorization(%q) accepted", bad)
+		}
+	}
+}
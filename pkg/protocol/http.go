@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Paths of the HTTP transport, which runs the same tests as the TCP
+// protocol over plain HTTP requests, for networks that only let web
+// traffic out. See docs/PROTOCOL.md.
+const (
+	HTTPHelloPath     = "/v1/hello"
+	HTTPChallengePath = "/v1/challenge"
+	HTTPPingPath      = "/v1/ping"
+	HTTPTestsPath     = "/v1/tests"
+	HTTPDownloadPath  = "/v1/download"
+	HTTPUploadPath    = "/v1/upload"
+
+	// The browser test page runs its latency probes over a WebSocket at
+	// HTTPWebSocketPath, and its test streams over WebSockets at
+	// HTTPWebSocketPath+"/download" and +"/upload". The server summarizes
+	// its samples at HTTPResultsPath.
+	HTTPWebSocketPath = "/v1/ws"
+	HTTPResultsPath   = "/v1/results"
+)
+
+// Hello is the server's answer to an HTTP hello request: its name, and
+// the test parameters it grants and its limits, as parameter lines.
+type Hello struct {
+	Cname    string `json:"cname,omitempty"`
+	Location string `json:"location,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Params   string `json:"params"`
+	Limits   string `json:"limits"`
+}
+
+// HTTPAuthScheme is the scheme of the Authorization header that answers
+// an authentication challenge over HTTP. The header holds the scheme, the
+// user name (SharedUser for a shared secret), the challenge, and
+// AuthResponse for them, separated by spaces. Each challenge answers for
+// a single request.
+const HTTPAuthScheme = "Sparkyfish"
+
+// Challenge is the server's answer to an HTTP challenge request.
+type Challenge struct {
+	Challenge string `json:"challenge"`
+}
+
+// HTTPAuthorization returns the Authorization header value that answers
+// challenge with token on behalf of user.
+func HTTPAuthorization(token, user, challenge string) string {
+	return strings.Join([]string{HTTPAuthScheme, user, challenge, AuthResponse(token, user, challenge)}, " ")
+}
+
+// ParseHTTPAuthorization splits an Authorization header value in
+// HTTPAuthScheme. It reports false for other schemes and malformed
+// values.
+func ParseHTTPAuthorization(v string) (user, challenge, response string, ok bool) {
+	fields := strings.Fields(v)
+	if len(fields) != 4 || !strings.EqualFold(fields[0], HTTPAuthScheme) {
+		return "", "", "", false
+	}
+	return fields[1], fields[2], fields[3], true
+}
+
+// TestStatus is one line of the server's answer to an HTTP test
+// reservation. While the test waits for a slot, Queue is its position.
+// Once it may start, Test is the token its streams present and Params
+// the parameters it runs with, as a parameter line.
+type TestStatus struct {
+	Queue  int    `json:"queue,omitempty"`
+	Test   string `json:"test,omitempty"`
+	Params string `json:"params,omitempty"`
+}
+
+// UploadReport is the server's answer to an HTTP upload: what it
+// received on that stream, like the TCP protocol's DONE line.
+type UploadReport struct {
+	Bytes     int64 `json:"bytes"`
+	ElapsedMs int64 `json:"elapsed_ms"` // from the start of the upload to the last byte
+}
+
+// Query returns p as URL query parameters, with the same keys and
+// values as its parameter line.
+func (p Params) Query() url.Values {
+	q := url.Values{}
+	for _, field := range strings.Fields(p.String()) {
+		key, value, _ := strings.Cut(field, "=")
+		q.Set(key, value)
+	}
+	return q
+}
+
+// ParseQuery parses parameters given as URL query parameters. As with
+// ParseParams, unknown keys are ignored.
+func ParseQuery(q url.Values) (Params, error) {
+	var fields []string
+	for _, key := range []string{"duration", "pings", "streams"} {
+		if !q.Has(key) {
+			continue
+		}
+		value := q.Get(key)
+		if strings.ContainsAny(value, " \t\r\n") {
+			return Params{}, fmt.Errorf("invalid value for %s: %q", key, value)
+		}
+		fields = append(fields, key+"="+value)
+	}
+	return ParseParams(strings.Join(fields, " "))
+}
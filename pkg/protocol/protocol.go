@@ -0,0 +1,177 @@
+// Package protocol holds the definitions shared by the sparkyfish client
+// and server: protocol versions, default test parameters, the parameter
+// lines exchanged during a version 1 handshake, the challenge-response
+// used by version 3 authentication, and the version 4 UDP test.
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the newest protocol version implemented by this module.
+const Version = 4
+
+// ReportInterval is how often a version 2 server reports the bytes it has
+// received during an upload test.
+const ReportInterval = 500 * time.Millisecond
+
+// Default test parameters, used for version 0 sessions and for any
+// parameter a version 1 client leaves unset.
+const (
+	DefaultDuration = 10 * time.Second
+	DefaultPings    = 30
+	DefaultStreams  = 1
+)
+
+// RecvGrace is how much longer than the test duration the server keeps
+// reading during an upload test, and the client during a download test,
+// to allow for connection startup.
+const RecvGrace = 2 * time.Second
+
+// Params are the negotiable parameters of a test session. On the wire they
+// are a single line of space-separated key=value pairs, with the duration
+// in whole seconds:
+//
+//	duration=10 pings=30 streams=1
+//
+// A zero value means "unset": the server's default applies in a request,
+// and no limit is advertised in a limits line.
+type Params struct {
+	Duration time.Duration
+	Pings    int
+	Streams  int
+
+	// Join is set on the extra connections of a multi-stream test to the
+	// token the server sent in the GO line of the first stream, so that
+	// they share its test slot instead of queueing separately.
+	Join string
+}
+
+// MaxTokenLen is the longest join token accepted in a parameter line.
+const MaxTokenLen = 32
+
+// DefaultParams returns the parameters used when none are negotiated.
+func DefaultParams() Params {
+	return Params{Duration: DefaultDuration, Pings: DefaultPings, Streams: DefaultStreams}
+}
+
+// String formats p as a parameter line, omitting unset values.
+func (p Params) String() string {
+	var fields []string
+	if p.Duration > 0 {
+		fields = append(fields, "duration="+strconv.Itoa(int(p.Duration/time.Second)))
+	}
+	if p.Pings > 0 {
+		fields = append(fields, "pings="+strconv.Itoa(p.Pings))
+	}
+	if p.Streams > 0 {
+		fields = append(fields, "streams="+strconv.Itoa(p.Streams))
+	}
+	if p.Join != "" {
+		fields = append(fields, "join="+p.Join)
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseParams parses a parameter line. Unknown keys are ignored so that
+// later protocol revisions can add parameters; malformed pairs and
+// negative values are errors.
+func ParseParams(line string) (Params, error) {
+	var p Params
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Params{}, fmt.Errorf("malformed parameter %q", field)
+		}
+		switch key {
+		case "duration", "pings", "streams":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return Params{}, fmt.Errorf("invalid value for %s: %q", key, value)
+			}
+			switch key {
+			case "duration":
+				p.Duration = time.Duration(n) * time.Second
+			case "pings":
+				p.Pings = n
+			case "streams":
+				p.Streams = n
+			}
+		case "join":
+			if !ValidToken(value) {
+				return Params{}, fmt.Errorf("invalid join token %q", value)
+			}
+			p.Join = value
+		}
+	}
+	return p, nil
+}
+
+// ValidToken reports whether s can be used as a join token: 1 to
+// MaxTokenLen lowercase hex digits.
+func ValidToken(s string) bool {
+	if len(s) == 0 || len(s) > MaxTokenLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Accept returns the parameters a server grants for request: unset values
+// take defaults, and values above limits are reduced to the limit.
+// Unset limits do not constrain.
+func (request Params) Accept(limits Params) Params {
+	def := DefaultParams()
+	p := request
+	if p.Duration <= 0 {
+		p.Duration = def.Duration
+	}
+	if p.Pings <= 0 {
+		p.Pings = def.Pings
+	}
+	if p.Streams <= 0 {
+		p.Streams = def.Streams
+	}
+
+	if limits.Duration > 0 && p.Duration > limits.Duration {
+		p.Duration = limits.Duration
+	}
+	if limits.Pings > 0 && p.Pings > limits.Pings {
+		p.Pings = limits.Pings
+	}
+	if limits.Streams > 0 && p.Streams > limits.Streams {
+		p.Streams = limits.Streams
+	}
+	return p
+}
+
+// LimitsLine formats the limits line of a version 1 HELO response. A
+// server that knows its software version adds it as a version key,
+// which clients that predate it ignore like any unknown key. Whitespace
+// in the version is replaced, as it would split the value.
+func LimitsLine(limits Params, version string) string {
+	line := limits.String()
+	if version = strings.Join(strings.Fields(version), "_"); version != "" {
+		line += " version=" + version
+	}
+	return line
+}
+
+// ServerVersion returns the software version named in a limits line, or
+// "" if the server didn't send one.
+func ServerVersion(line string) string {
+	for _, field := range strings.Fields(line) {
+		if v, ok := strings.CutPrefix(field, "version="); ok {
+			return v
+		}
+	}
+	return ""
+}
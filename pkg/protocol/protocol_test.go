@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParams_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Params
+		line string
+	}{
+		{"full", Params{Duration: 10 * time.Second, Pings: 30, Streams: 4}, "duration=10 pings=30 streams=4"},
+		{"partial", Params{Pings: 5}, "pings=5"},
+		{"join", Params{Streams: 4, Join: "0af3"}, "streams=4 join=0af3"},
+		{"empty", Params{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.String(); got != tt.line {
+				t.Errorf("String() = %q, want %q", got, tt.line)
+			}
+			got, err := ParseParams(tt.line)
+			if err != nil {
+				t.Fatalf("ParseParams(%q): %v", tt.line, err)
+			}
+			if got != tt.p {
+				t.Errorf("ParseParams(%q) = %+v, want %+v", tt.line, got, tt.p)
+			}
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Params
+		wantErr bool
+	}{
+		{"unknown key ignored", "pings=10 colour=7", Params{Pings: 10}, false},
+		{"unknown non-numeric key ignored", "colour=blue pings=10", Params{Pings: 10}, false},
+		{"invalid join token", "join=XYZ", Params{}, true},
+		{"extra whitespace", "  duration=5   streams=2 ", Params{Duration: 5 * time.Second, Streams: 2}, false},
+		{"missing equals", "pings", Params{}, true},
+		{"non-numeric", "pings=many", Params{}, true},
+		{"negative", "duration=-1", Params{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseParams(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseParams(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseParams(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	limits := Params{Duration: 30 * time.Second, Pings: 100, Streams: 8}
+	tests := []struct {
+		name    string
+		request Params
+		limits  Params
+		want    Params
+	}{
+		{"defaults", Params{}, limits, DefaultParams()},
+		{"within limits", Params{Duration: 20 * time.Second, Pings: 50, Streams: 4}, limits,
+			Params{Duration: 20 * time.Second, Pings: 50, Streams: 4}},
+		{"clamped", Params{Duration: time.Minute, Pings: 1000, Streams: 64}, limits, limits},
+		{"no limits", Params{Duration: time.Hour}, Params{},
+			Params{Duration: time.Hour, Pings: DefaultPings, Streams: DefaultStreams}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.request.Accept(tt.limits); got != tt.want {
+				t.Errorf("Accept = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParams_Query(t *testing.T) {
+	p := Params{Duration: 10 * time.Second, Pings: 30, Streams: 4}
+	q := p.Query()
+	if got := q.Encode(); got != "duration=10&pings=30&streams=4" {
+		t.Errorf("Query() = %q", got)
+	}
+	got, err := ParseQuery(q)
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+	if got != p {
+		t.Errorf("ParseQuery(%q) = %+v, want %+v", q.Encode(), got, p)
+	}
+
+	q.Set("streams", "1 pings=5")
+	if _, err := ParseQuery(q); err == nil {
+		t.Error("ParseQuery accepted a value holding another parameter")
+	}
+}
+
+func TestLimitsLine(t *testing.T) {
+	limits := Params{Duration: 30 * time.Second, Pings: 100, Streams: 8}
+	line := LimitsLine(limits, "1.4.0 beta")
+	if line != "duration=30 pings=100 streams=8 version=1.4.0_beta" {
+		t.Errorf("LimitsLine = %q", line)
+	}
+	if got, err := ParseParams(line); err != nil || got != limits {
+		t.Errorf("ParseParams(%q) = %+v, %v, want %+v", line, got, err, limits)
+	}
+	if v := ServerVersion(line); v != "1.4.0_beta" {
+		t.Errorf("ServerVersion(%q) = %q", line, v)
+	}
+	if v := ServerVersion(LimitsLine(limits, "")); v != "" {
+		t.Errorf("ServerVersion without a version = %q", v)
+	}
+}
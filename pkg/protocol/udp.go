@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDP test limits and defaults. A datagram starts with a UDPHeaderSize
+// header and is at most MaxUDPSize bytes, which fits a 1500-byte Ethernet
+// MTU over IPv4 without fragmentation. The defaults approximate an HD
+// video call.
+const (
+	UDPHeaderSize    = 24
+	MaxUDPSize       = 1472
+	MaxUDPPacketRate = 100_000 // packets per second
+
+	DefaultUDPRate = 4_000_000 // bit/s
+	DefaultUDPSize = 1200
+)
+
+// UDPDrain is how long after the client reports the end of a UDP test
+// the server keeps counting datagrams that are still in flight.
+const UDPDrain = 500 * time.Millisecond
+
+// UDPParams are the parameters of a UDP test, sent after the UDP command
+// as key=value pairs, with the rate in bits per second and the size in
+// bytes per datagram:
+//
+//	rate=4000000 size=1200
+type UDPParams struct {
+	Rate int64
+	Size int
+}
+
+// DefaultUDPParams returns the parameters used when a client doesn't
+// choose its own.
+func DefaultUDPParams() UDPParams {
+	return UDPParams{Rate: DefaultUDPRate, Size: DefaultUDPSize}
+}
+
+func (p UDPParams) String() string {
+	return fmt.Sprintf("rate=%d size=%d", p.Rate, p.Size)
+}
+
+// Validate checks that p describes a test the server will run: a
+// positive rate, a size the header fits in, and no more than
+// MaxUDPPacketRate packets per second.
+func (p UDPParams) Validate() error {
+	switch {
+	case p.Rate <= 0:
+		return fmt.Errorf("invalid UDP rate %d", p.Rate)
+	case p.Size < UDPHeaderSize || p.Size > MaxUDPSize:
+		return fmt.Errorf("UDP packet size %d is outside %d-%d bytes", p.Size, UDPHeaderSize, MaxUDPSize)
+	case p.Rate > int64(MaxUDPPacketRate)*int64(p.Size)*8:
+		return fmt.Errorf("UDP rate %d bit/s needs more than %d packets per second at %d bytes", p.Rate, MaxUDPPacketRate, p.Size)
+	}
+	return nil
+}
+
+// Interval returns the time between datagrams at p's rate.
+func (p UDPParams) Interval() time.Duration {
+	return time.Duration(int64(p.Size) * 8 * int64(time.Second) / p.Rate)
+}
+
+// Packets returns how many datagrams a test of duration d sends.
+func (p UDPParams) Packets(d time.Duration) int64 {
+	return int64(d / p.Interval())
+}
+
+// ParseUDPParams parses and validates UDP test parameters. Unknown keys
+// are ignored, as in ParseParams.
+func ParseUDPParams(line string) (UDPParams, error) {
+	var p UDPParams
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return UDPParams{}, fmt.Errorf("malformed parameter %q", field)
+		}
+		switch key {
+		case "rate", "size":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return UDPParams{}, fmt.Errorf("invalid value for %s: %q", key, value)
+			}
+			if key == "rate" {
+				p.Rate = n
+			} else {
+				p.Size = int(min(n, MaxUDPSize+1))
+			}
+		}
+	}
+	if err := p.Validate(); err != nil {
+		return UDPParams{}, err
+	}
+	return p, nil
+}
+
+// UDPStats are the server's counts for a UDP test, sent as key=value
+// pairs after STAT and DONE:
+//
+//	received=4150 lost=12 reordered=3 duplicates=0 jitter_us=870 bytes=4980000 elapsed_ms=9998
+//
+// Lost counts the sequence numbers that never arrived: up to the highest
+// seen while the test runs, and up to the number the client sent in the
+// final report. Reordered counts datagrams that arrived after one with a
+// higher sequence number. Jitter is the RFC 3550 interarrival jitter.
+// Elapsed runs from the start of the test to the last datagram.
+type UDPStats struct {
+	Received   int64
+	Lost       int64
+	Reordered  int64
+	Duplicates int64
+	Jitter     time.Duration
+	Bytes      int64
+	Elapsed    time.Duration
+}
+
+func (s UDPStats) String() string {
+	return fmt.Sprintf("received=%d lost=%d reordered=%d duplicates=%d jitter_us=%d bytes=%d elapsed_ms=%d",
+		s.Received, s.Lost, s.Reordered, s.Duplicates, s.Jitter.Microseconds(), s.Bytes, s.Elapsed.Milliseconds())
+}
+
+// ParseUDPStats parses the counts sent after STAT and DONE. Unknown keys
+// are ignored.
+func ParseUDPStats(line string) (UDPStats, error) {
+	var s UDPStats
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return UDPStats{}, fmt.Errorf("malformed UDP stat %q", field)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return UDPStats{}, fmt.Errorf("invalid value for %s: %q", key, value)
+		}
+		switch key {
+		case "received":
+			s.Received = n
+		case "lost":
+			s.Lost = n
+		case "reordered":
+			s.Reordered = n
+		case "duplicates":
+			s.Duplicates = n
+		case "jitter_us":
+			s.Jitter = time.Duration(n) * time.Microsecond
+		case "bytes":
+			s.Bytes = n
+		case "elapsed_ms":
+			s.Elapsed = time.Duration(n) * time.Millisecond
+		}
+	}
+	return s, nil
+}
+
+// UDPHeader is the start of every datagram of a UDP test: the test's
+// token, the datagram's sequence number from 0, and when it was sent, as
+// time since the client started sending. All three are big-endian 64-bit
+// integers; the rest of the datagram is padding.
+type UDPHeader struct {
+	Token uint64
+	Seq   uint64
+	Sent  time.Duration
+}
+
+// Put writes h to the first UDPHeaderSize bytes of b.
+func (h UDPHeader) Put(b []byte) {
+	binary.BigEndian.PutUint64(b[0:], h.Token)
+	binary.BigEndian.PutUint64(b[8:], h.Seq)
+	binary.BigEndian.PutUint64(b[16:], uint64(h.Sent))
+}
+
+// ParseUDPHeader reads the header of datagram b. It returns false if b is
+// too short to hold one.
+func ParseUDPHeader(b []byte) (UDPHeader, bool) {
+	if len(b) < UDPHeaderSize {
+		return UDPHeader{}, false
+	}
+	return UDPHeader{
+		Token: binary.BigEndian.Uint64(b[0:]),
+		Seq:   binary.BigEndian.Uint64(b[8:]),
+		Sent:  time.Duration(binary.BigEndian.Uint64(b[16:])),
+	}, true
+}
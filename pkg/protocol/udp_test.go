@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUDPParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    UDPParams
+		wantErr bool
+	}{
+		{"valid", "rate=4000000 size=1200", UDPParams{Rate: 4_000_000, Size: 1200}, false},
+		{"unknown key ignored", "rate=64000 size=160 codec=g711", UDPParams{Rate: 64_000, Size: 160}, false},
+		{"missing rate", "size=1200", UDPParams{}, true},
+		{"header doesn't fit", "rate=64000 size=20", UDPParams{}, true},
+		{"too large", "rate=64000 size=9000", UDPParams{}, true},
+		{"too many packets", "rate=1000000000 size=100", UDPParams{}, true},
+		{"non-numeric", "rate=fast size=1200", UDPParams{}, true},
+		{"missing equals", "rate", UDPParams{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUDPParams(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUDPParams(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseUDPParams(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+
+	p := DefaultUDPParams()
+	if got, err := ParseUDPParams(p.String()); err != nil || got != p {
+		t.Errorf("round trip of %+v = %+v, %v", p, got, err)
+	}
+}
+
+func TestUDPParams_Packets(t *testing.T) {
+	p := UDPParams{Rate: 64_000, Size: 160} // 50 packets per second
+	if got := p.Interval(); got != 20*time.Millisecond {
+		t.Errorf("Interval() = %v, want 20ms", got)
+	}
+	if got := p.Packets(10 * time.Second); got != 500 {
+		t.Errorf("Packets(10s) = %d, want 500", got)
+	}
+}
+
+func TestUDPStats_RoundTrip(t *testing.T) {
+	s := UDPStats{
+		Received:   4150,
+		Lost:       12,
+		Reordered:  3,
+		Duplicates: 1,
+		Jitter:     870 * time.Microsecond,
+		Bytes:      4_980_000,
+		Elapsed:    9998 * time.Millisecond,
+	}
+	line := "received=4150 lost=12 reordered=3 duplicates=1 jitter_us=870 bytes=4980000 elapsed_ms=9998"
+	if got := s.String(); got != line {
+		t.Errorf("String() = %q, want %q", got, line)
+	}
+	got, err := ParseUDPStats(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != s {
+		t.Errorf("ParseUDPStats = %+v, want %+v", got, s)
+	}
+
+	if _, err := ParseUDPStats("received=-1"); err == nil {
+		t.Error("negative count accepted")
+	}
+}
+
+func TestUDPHeader(t *testing.T) {
+	h := UDPHeader{Token: 0x0123456789abcdef, Seq: 42, Sent: 1500 * time.Millisecond}
+	b := make([]byte, 100)
+	h.Put(b)
+	got, ok := ParseUDPHeader(b)
+	if !ok || got != h {
+		t.Errorf("ParseUDPHeader = %+v, %v, want %+v", got, ok, h)
+	}
+	if _, ok := ParseUDPHeader(b[:UDPHeaderSize-1]); ok {
+		t.Error("parsed a truncated header")
+	}
+}
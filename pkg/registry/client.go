@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Send posts hb to the registry at baseURL, authenticating with token if
+// it is set.
+func Send(ctx context.Context, baseURL, token string, hb Heartbeat) error {
+	return request(ctx, http.MethodPost, baseURL, token, hb)
+}
+
+// Remove asks the registry at baseURL to stop listing the server hb
+// describes.
+func Remove(ctx context.Context, baseURL, token string, hb Heartbeat) error {
+	return request(ctx, http.MethodDelete, baseURL, token, hb)
+}
+
+func request(ctx context.Context, method, baseURL, token string, hb Heartbeat) error {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(baseURL, "/") + "/v1/heartbeat"
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package registry keeps a list of the sparkyfish servers of a fleet.
+// Servers send it heartbeats with their name, location, and load, and it
+// serves the servers heard from recently as a server list (see package
+// serverlist) that clients can pick the nearest server from.
+//
+// The HTTP API:
+//
+//	POST   /v1/heartbeat  register or refresh a server; the body is a Heartbeat
+//	DELETE /v1/heartbeat  remove a server that is shutting down; same body
+//	GET    /v1/servers    the current server list
+//
+// If the registry has a token, heartbeats must carry it in an
+// "Authorization: Bearer" header. The server list is public.
+package registry
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
+)
+
+const (
+	// DefaultTTL is how long a server stays listed after its last
+	// heartbeat: three missed heartbeats.
+	DefaultTTL = 3 * HeartbeatInterval
+	// HeartbeatInterval is how often servers should send heartbeats.
+	HeartbeatInterval = 30 * time.Second
+
+	maxBodySize = 64 * 1024
+	// maxServers caps the list, so that bogus heartbeats can't exhaust
+	// the registry's memory.
+	maxServers = 10000
+)
+
+// Heartbeat is what a server reports to the registry.
+type Heartbeat struct {
+	// Host is the name clients should connect to. If empty, the registry
+	// lists the address the heartbeat came from.
+	Host     string              `json:"host,omitempty"`
+	Port     int                 `json:"port"`
+	Location string              `json:"location,omitempty"`
+	Load     serverlist.TestLoad `json:"load"`
+}
+
+// Config holds registry options.
+type Config struct {
+	ListenAddr string
+	TTL        time.Duration // how long servers stay listed without a heartbeat
+	Token      string        // if set, heartbeats must carry it
+}
+
+// Registry tracks servers by their heartbeats.
+type Registry struct {
+	cfg    Config
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	servers map[string]*entry // by host:port
+}
+
+type entry struct {
+	server serverlist.Server
+	seen   time.Time
+}
+
+// New creates a Registry. A zero TTL means DefaultTTL.
+func New(cfg Config, logger *slog.Logger) *Registry {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	return &Registry{
+		cfg:     cfg,
+		logger:  logger,
+		now:     time.Now,
+		servers: make(map[string]*entry),
+	}
+}
+
+// ListenAndServe serves the registry's HTTP API on cfg.ListenAddr until
+// ctx is cancelled.
+func (r *Registry) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", r.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", r.cfg.ListenAddr, err)
+	}
+	srv := &http.Server{Handler: r.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		ticker := time.NewTicker(r.cfg.TTL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				srv.Close()
+				return
+			case <-ticker.C:
+				r.expire()
+			}
+		}
+	}()
+
+	r.logger.Info("listening", "addr", ln.Addr(), "ttl", r.cfg.TTL, "auth", r.cfg.Token != "")
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the registry's HTTP API.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/heartbeat", r.handleHeartbeat)
+	mux.HandleFunc("DELETE /v1/heartbeat", r.handleHeartbeat)
+	mux.HandleFunc("GET /v1/servers", r.handleServers)
+	return mux
+}
+
+func (r *Registry) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
+	if !r.authorized(req) {
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	var hb Heartbeat
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err := dec.Decode(&hb); err != nil {
+		http.Error(w, "invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hb.Host == "" {
+		hb.Host, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	if err := hb.validate(); err != nil {
+		http.Error(w, "invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server := serverlist.Server{Host: hb.Host, Port: hb.Port, Location: hb.Location, Load: &hb.Load}
+	key := server.Addr()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Method == http.MethodDelete {
+		if _, ok := r.servers[key]; ok {
+			delete(r.servers, key)
+			r.logger.Info("server removed", "server", key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	e, ok := r.servers[key]
+	if !ok {
+		if len(r.servers) >= maxServers {
+			http.Error(w, "registry full", http.StatusServiceUnavailable)
+			return
+		}
+		e = &entry{}
+		r.servers[key] = e
+		r.logger.Info("server registered", "server", key, "location", hb.Location)
+	}
+	e.server, e.seen = server, r.now()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Registry) handleServers(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverlist.List{Servers: r.Servers()})
+}
+
+// Servers returns the servers heard from within the TTL, sorted by
+// address.
+func (r *Registry) Servers() []serverlist.Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servers := []serverlist.Server{}
+	for _, e := range r.servers {
+		if r.now().Sub(e.seen) <= r.cfg.TTL {
+			servers = append(servers, e.server)
+		}
+	}
+	slices.SortFunc(servers, func(a, b serverlist.Server) int { return cmp.Compare(a.Addr(), b.Addr()) })
+	return servers
+}
+
+// expire forgets the servers whose heartbeats have gone stale.
+func (r *Registry) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, e := range r.servers {
+		if r.now().Sub(e.seen) > r.cfg.TTL {
+			delete(r.servers, key)
+			r.logger.Info("server expired", "server", key, "last_seen", e.seen)
+		}
+	}
+}
+
+func (r *Registry) authorized(req *http.Request) bool {
+	if r.cfg.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(r.cfg.Token)) == 1
+}
+
+func (hb Heartbeat) validate() error {
+	if hb.Host == "" || strings.ContainsAny(hb.Host, " /\\") {
+		return fmt.Errorf("invalid host %q", hb.Host)
+	}
+	if hb.Port < 1 || hb.Port > 65535 {
+		return fmt.Errorf("invalid port %d", hb.Port)
+	}
+	if hb.Load.Running < 0 || hb.Load.Queued < 0 || hb.Load.MaxTests < 0 {
+		return errors.New("load must not be negative")
+	}
+	return nil
+}
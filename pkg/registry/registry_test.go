@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
+)
+
+// testRegistry returns a registry with a clock the test controls, served
+// over HTTP.
+func testRegistry(t *testing.T, cfg Config) (*Registry, *httptest.Server, *time.Time) {
+	t.Helper()
+	r := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	srv := httptest.NewServer(r.Handler())
+	t.Cleanup(srv.Close)
+	return r, srv, &now
+}
+
+func fetchList(t *testing.T, url string) []serverlist.Server {
+	t.Helper()
+	resp, err := http.Get(url + "/v1/servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(data), `"servers":[]`) {
+		return nil
+	}
+	servers, err := serverlist.Parse(data)
+	if err != nil {
+		t.Fatalf("parse server list: %v", err)
+	}
+	return servers
+}
+
+func TestRegistry_Heartbeats(t *testing.T) {
+	r, srv, now := testRegistry(t, Config{TTL: time.Minute})
+	ctx := context.Background()
+
+	denver := Heartbeat{Host: "denver.example.com", Port: 7121, Location: "Denver, CO", Load: serverlist.TestLoad{Running: 1, MaxTests: 2}}
+	if err := Send(ctx, srv.URL, "", denver); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(30 * time.Second)
+	dallas := Heartbeat{Host: "dallas.example.com", Port: 7121, Location: "Dallas, TX"}
+	if err := Send(ctx, srv.URL+"/", "", dallas); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []serverlist.Server{
+		{Host: "dallas.example.com", Port: 7121, Location: "Dallas, TX", Load: &serverlist.TestLoad{}},
+		{Host: "denver.example.com", Port: 7121, Location: "Denver, CO", Load: &serverlist.TestLoad{Running: 1, MaxTests: 2}},
+	}
+	if got := fetchList(t, srv.URL); !reflect.DeepEqual(got, want) {
+		t.Errorf("servers:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Denver's heartbeat goes stale; a newer one updates Dallas.
+	*now = now.Add(45 * time.Second)
+	dallas.Load.Queued = 3
+	if err := Send(ctx, srv.URL, "", dallas); err != nil {
+		t.Fatal(err)
+	}
+	got := fetchList(t, srv.URL)
+	if len(got) != 1 || got[0].Host != "dallas.example.com" || got[0].Load.Queued != 3 {
+		t.Errorf("after denver went stale: %+v", got)
+	}
+	r.expire()
+	if len(r.servers) != 1 {
+		t.Errorf("expire left %d servers, want 1", len(r.servers))
+	}
+
+	if err := Remove(ctx, srv.URL, "", dallas); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchList(t, srv.URL); len(got) != 0 {
+		t.Errorf("after removal: %+v", got)
+	}
+}
+
+func TestRegistry_HostFromSender(t *testing.T) {
+	_, srv, _ := testRegistry(t, Config{})
+	if err := Send(context.Background(), srv.URL, "", Heartbeat{Port: 7121}); err != nil {
+		t.Fatal(err)
+	}
+	got := fetchList(t, srv.URL)
+	if len(got) != 1 || got[0].Host != "127.0.0.1" {
+		t.Errorf("servers = %+v, want 127.0.0.1", got)
+	}
+}
+
+func TestRegistry_Token(t *testing.T) {
+	_, srv, _ := testRegistry(t, Config{Token: "s3cret"})
+	hb := Heartbeat{Host: "denver.example.com", Port: 7121}
+	ctx := context.Background()
+
+	for _, token := range []string{"", "wrong"} {
+		if err := Send(ctx, srv.URL, token, hb); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("token %q: expected 401, got %v", token, err)
+		}
+	}
+	if err := Send(ctx, srv.URL, "s3cret", hb); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchList(t, srv.URL); len(got) != 1 {
+		t.Errorf("servers = %+v, want 1", got)
+	}
+}
+
+func TestRegistry_InvalidHeartbeat(t *testing.T) {
+	_, srv, _ := testRegistry(t, Config{})
+	tests := []struct {
+		name string
+		hb   Heartbeat
+	}{
+		{"no port", Heartbeat{Host: "denver.example.com"}},
+		{"port", Heartbeat{Host: "denver.example.com", Port: 70000}},
+		{"host", Heartbeat{Host: "denver example", Port: 7121}},
+		{"load", Heartbeat{Host: "denver.example.com", Port: 7121, Load: serverlist.TestLoad{Running: -1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Send(context.Background(), srv.URL, "", tt.hb)
+			if err == nil || !strings.Contains(err.Error(), "400") {
+				t.Errorf("expected 400, got %v", err)
+			}
+		})
+	}
+
+	resp, err := http.Post(srv.URL+"/v1/heartbeat", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want 400", resp.StatusCode)
+	}
+}
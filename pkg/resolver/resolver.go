@@ -3,19 +3,23 @@ package resolver
 import (
 	"context"
 	"net"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-const mdnsTimeout = 2 * time.Second
+const (
+	mdnsTimeout    = 2 * time.Second
+	mdnsFamilyWait = 200 * time.Millisecond
+)
 
 var mdnsIPv4Addr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
 
-// LookupHost resolves a hostname to IP addresses. For .local names, it
-// tries mDNS first (multicast to 224.0.0.251:5353) before falling back
-// to the system resolver.
+// LookupHost resolves a hostname to IPv4 and IPv6 addresses. For .local
+// names, it tries mDNS first (multicast to 224.0.0.251:5353) before
+// falling back to the system resolver.
 func LookupHost(ctx context.Context, name string) ([]string, error) {
 	normalized := strings.TrimSuffix(strings.ToLower(name), ".")
 
@@ -30,18 +34,11 @@ func LookupHost(ctx context.Context, name string) ([]string, error) {
 	return net.DefaultResolver.LookupHost(ctx, name)
 }
 
-// lookupMDNSHost sends an A query to the mDNS IPv4 multicast group using
-// an unconnected UDP socket so we can receive the reply from any source IP.
+// lookupMDNSHost sends A and AAAA queries to the mDNS IPv4 multicast
+// group using an unconnected UDP socket so we can receive replies from any
+// source IP. Once one address family has answered, it waits at most
+// mdnsFamilyWait for the other.
 func lookupMDNSHost(ctx context.Context, name string) ([]string, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
-	m.RecursionDesired = false
-
-	packed, err := m.Pack()
-	if err != nil {
-		return nil, err
-	}
-
 	conn, err := net.ListenPacket("udp4", ":0")
 	if err != nil {
 		return nil, err
@@ -54,13 +51,25 @@ func lookupMDNSHost(ctx context.Context, name string) ([]string, error) {
 	}
 	conn.SetDeadline(deadline)
 
-	if _, err := conn.WriteTo(packed, mdnsIPv4Addr); err != nil {
-		return nil, err
+	pending := make(map[uint16]bool) // query IDs still waiting for an answer
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), qtype)
+		m.RecursionDesired = false
+
+		packed, err := m.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.WriteTo(packed, mdnsIPv4Addr); err != nil {
+			return nil, err
+		}
+		pending[m.Id] = true
 	}
 
 	buf := make([]byte, 1500)
 	var ips []string
-	for {
+	for len(pending) > 0 {
 		n, _, err := conn.ReadFrom(buf)
 		if err != nil {
 			break
@@ -69,17 +78,35 @@ func lookupMDNSHost(ctx context.Context, name string) ([]string, error) {
 		if err := resp.Unpack(buf[:n]); err != nil {
 			continue
 		}
-		// Match our query ID
-		if resp.Id != m.Id {
+		// Match our query IDs
+		if !pending[resp.Id] {
 			continue
 		}
+		delete(pending, resp.Id)
+
 		for _, ans := range resp.Answer {
-			if a, ok := ans.(*dns.A); ok {
-				ips = append(ips, a.A.String())
+			var ip string
+			switch rr := ans.(type) {
+			case *dns.A:
+				ip = rr.A.String()
+			case *dns.AAAA:
+				// A link-local address is useless without the interface it
+				// was seen on, which an unconnected socket doesn't tell us.
+				if rr.AAAA.IsLinkLocalUnicast() {
+					continue
+				}
+				ip = rr.AAAA.String()
+			default:
+				continue
+			}
+			if !slices.Contains(ips, ip) {
+				ips = append(ips, ip)
 			}
 		}
 		if len(ips) > 0 {
-			return ips, nil
+			if wait := time.Now().Add(mdnsFamilyWait); wait.Before(deadline) {
+				conn.SetDeadline(wait)
+			}
 		}
 	}
 
@@ -0,0 +1,319 @@
+// Package result defines the machine-readable document produced by a
+// completed (or partial) speed test.
+package result
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+	"github.com/chrissnell/sparkyfish/pkg/measure"
+)
+
+// Result captures everything measured during one test run: server
+// metadata, every raw sample, and the aggregates computed from them.
+type Result struct {
+	ClientVersion string     `json:"client_version"`
+	Server        Server     `json:"server"`
+	Start         time.Time  `json:"start"`
+	End           time.Time  `json:"end"`
+	Ping          Ping       `json:"ping"`
+	Download      Throughput `json:"download"`
+	Upload        Throughput `json:"upload"`
+	UDP           *UDP       `json:"udp,omitempty"`
+}
+
+// Server describes the server a test was run against.
+type Server struct {
+	Addr     string `json:"addr"`
+	Hostname string `json:"hostname"`
+	Location string `json:"location,omitempty"`
+	Version  string `json:"version,omitempty"`
+	TLS      string `json:"tls,omitempty"`    // TLS version and cipher suite; empty for plain TCP
+	IP       string `json:"ip,omitempty"`     // address the client connected to
+	Family   string `json:"family,omitempty"` // "IPv4" or "IPv6"
+}
+
+// Ping holds latency samples and their aggregates, in milliseconds.
+// Besides the mean, it gives the median and 95th percentile, which show
+// the tail the mean hides, and three measures of spread: the IQR, the
+// mean absolute deviation, and the RFC 3550 jitter between consecutive
+// samples, which is what real-time traffic such as VoIP suffers from.
+type Ping struct {
+	Samples      []PingSample `json:"samples"`
+	MinMs        float64      `json:"min_ms"`
+	MaxMs        float64      `json:"max_ms"`
+	MeanMs       float64      `json:"mean_ms"`
+	StdDevMs     float64      `json:"stddev_ms"`
+	MedianMs     float64      `json:"median_ms"`
+	P95Ms        float64      `json:"p95_ms"`
+	IQRMs        float64      `json:"iqr_ms"`
+	MeanAbsDevMs float64      `json:"mean_abs_dev_ms"`
+	JitterMs     float64      `json:"jitter_ms"`
+}
+
+// PingSample is a single latency measurement.
+type PingSample struct {
+	Seq       int       `json:"seq"`
+	Time      time.Time `json:"time"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+// Throughput holds periodic throughput samples and their aggregates, in Mbit/s.
+//
+// For uploads to servers that report what they received, ServerBytes and
+// ServerMbps hold the server's totals, which are more trustworthy than the
+// client's own measurement. LoadedLatency is set if latency was measured
+// during the test.
+//
+// SteadyMbps estimates the rate the connection sustains once TCP slow
+// start is over, which the mean understates on short or slow-starting
+// tests.
+type Throughput struct {
+	Samples       []ThroughputSample `json:"samples"`
+	MinMbps       float64            `json:"min_mbps"`
+	MaxMbps       float64            `json:"max_mbps"`
+	MeanMbps      float64            `json:"mean_mbps"`
+	StdDevMbps    float64            `json:"stddev_mbps"`
+	MedianMbps    float64            `json:"median_mbps"`
+	SteadyMbps    float64            `json:"steady_mbps"`
+	ServerBytes   int64              `json:"server_bytes,omitempty"`
+	ServerMbps    float64            `json:"server_mbps,omitempty"`
+	LoadedLatency *LoadedLatency     `json:"loaded_latency,omitempty"`
+}
+
+// LoadedLatency holds the latency measured while a throughput test loaded
+// the connection, in milliseconds. IncreaseMs is how much the mean rose
+// above the idle latency of the ping test, and RPM is the responsiveness
+// under load: how many round trips of the mean latency fit in a minute.
+type LoadedLatency struct {
+	Samples    []PingSample `json:"samples"`
+	MinMs      float64      `json:"min_ms"`
+	MaxMs      float64      `json:"max_ms"`
+	MeanMs     float64      `json:"mean_ms"`
+	StdDevMs   float64      `json:"stddev_ms"`
+	IncreaseMs float64      `json:"increase_ms"`
+	RPM        int          `json:"rpm"`
+}
+
+// ThroughputSample is a single periodic throughput measurement. For
+// multi-stream tests Mbps is the total and Streams the rate of each stream.
+// ServerMbps is the rate the server reported for the same interval, if any.
+type ThroughputSample struct {
+	Time       time.Time `json:"time"`
+	Mbps       float64   `json:"mbps"`
+	Streams    []float64 `json:"streams,omitempty"`
+	ServerMbps float64   `json:"server_mbps,omitempty"`
+}
+
+// UDP holds the outcome of a UDP test: datagrams sent at a fixed rate,
+// and the server's count of those lost, reordered, and duplicated, with
+// the RFC 3550 jitter of their arrival. Mbps is the rate the server
+// received. Samples are the server's interim reports.
+type UDP struct {
+	Samples     []UDPSample `json:"samples"`
+	TargetMbps  float64     `json:"target_mbps"`
+	PacketSize  int         `json:"packet_size"`
+	Sent        int64       `json:"sent"`
+	Received    int64       `json:"received"`
+	Lost        int64       `json:"lost"`
+	LossPercent float64     `json:"loss_percent"`
+	Reordered   int64       `json:"reordered"`
+	Duplicates  int64       `json:"duplicates"`
+	JitterMs    float64     `json:"jitter_ms"`
+	Mbps        float64     `json:"mbps"`
+}
+
+// UDPSample is one of the server's interim reports during a UDP test,
+// with counts so far and the rate received since the last report.
+type UDPSample struct {
+	Time     time.Time `json:"time"`
+	Mbps     float64   `json:"mbps"`
+	Received int64     `json:"received"`
+	Lost     int64     `json:"lost"`
+	JitterMs float64   `json:"jitter_ms"`
+}
+
+// New starts a Result for a test against addr.
+func New(addr string, start time.Time) *Result {
+	return &Result{
+		Server: Server{Addr: addr},
+		Start:  start,
+	}
+}
+
+// SetServer records the metadata returned by the backend handshake.
+func (r *Result) SetServer(info backend.ServerInfo) {
+	r.Server.Hostname = info.Hostname
+	r.Server.Location = info.Location
+	r.Server.Version = info.Version
+	r.Server.TLS = info.TLS
+	r.Server.IP = info.IP
+	r.Server.Family = info.Family
+}
+
+// AddPing records a latency sample and updates the ping aggregates.
+func (r *Result) AddPing(s backend.PingSample) {
+	r.Ping.Samples = append(r.Ping.Samples, PingSample{Seq: s.Seq, Time: s.Time, LatencyMs: ms(s.Latency)})
+
+	vals := make([]float64, len(r.Ping.Samples))
+	for i, p := range r.Ping.Samples {
+		vals[i] = p.LatencyMs
+	}
+	r.Ping.MinMs, r.Ping.MaxMs = measure.MinMax(vals)
+	r.Ping.MeanMs = measure.Mean(vals)
+	r.Ping.StdDevMs = measure.StdDev(vals)
+	r.Ping.MedianMs = measure.Median(vals)
+	r.Ping.P95Ms = measure.Percentile(vals, 95)
+	r.Ping.IQRMs = measure.IQR(vals)
+	r.Ping.MeanAbsDevMs = measure.MeanAbsDev(vals)
+	r.Ping.JitterMs = measure.Jitter(vals)
+}
+
+// AddDownload records a download sample and updates the download
+// aggregates. A sample carrying the server's final report sets the
+// server totals instead, and a latency probe the loaded latency, compared
+// with the ping test run before it.
+func (r *Result) AddDownload(s backend.ThroughputSample) {
+	r.Download.add(s, r.Ping.MeanMs)
+}
+
+// AddUpload records an upload sample and updates the upload aggregates.
+// A sample carrying the server's final report sets the server totals
+// instead, and a latency probe the loaded latency.
+func (r *Result) AddUpload(s backend.ThroughputSample) {
+	r.Upload.add(s, r.Ping.MeanMs)
+}
+
+// AddUDP records a UDP test report. The counts are cumulative, so each
+// report replaces the totals; the final report also sets the rate over
+// the whole test. Queue notifications are ignored.
+func (r *Result) AddUDP(s backend.UDPSample) {
+	if s.QueuePosition > 0 {
+		return
+	}
+	if r.UDP == nil {
+		r.UDP = &UDP{}
+	}
+	u := r.UDP
+	u.TargetMbps = s.TargetMbps
+	u.PacketSize = s.PacketSize
+	u.Sent = s.Sent
+	u.Received = s.Received
+	u.Lost = s.Lost
+	u.LossPercent = s.LossPercent()
+	u.Reordered = s.Reordered
+	u.Duplicates = s.Duplicates
+	u.JitterMs = ms(s.Jitter)
+	if s.Final {
+		u.Mbps = s.Mbps
+		return
+	}
+
+	u.Samples = append(u.Samples, UDPSample{Time: s.Time, Mbps: s.Mbps, Received: s.Received, Lost: s.Lost, JitterMs: u.JitterMs})
+	vals := make([]float64, len(u.Samples))
+	for i, v := range u.Samples {
+		vals[i] = v.Mbps
+	}
+	u.Mbps = measure.Mean(vals)
+}
+
+// Finish stamps the end time of the run.
+func (r *Result) Finish(end time.Time) {
+	r.End = end
+}
+
+// WriteJSON writes the result as indented JSON.
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Recompute returns a result with r's metadata and samples and aggregates
+// computed from the samples as the client computes them. It lets samples
+// collected elsewhere, such as by the browser test, be summarized the
+// same way. Aggregates in r are ignored, except for the server totals.
+func Recompute(r *Result) *Result {
+	out := New(r.Server.Addr, r.Start)
+	out.ClientVersion = r.ClientVersion
+	out.Server = r.Server
+	for _, p := range r.Ping.Samples {
+		out.AddPing(backend.PingSample{Seq: p.Seq, Time: p.Time, Latency: fromMs(p.LatencyMs)})
+	}
+	out.Download.recompute(&r.Download, out.Ping.MeanMs)
+	out.Upload.recompute(&r.Upload, out.Ping.MeanMs)
+	out.Finish(r.End)
+	return out
+}
+
+func (t *Throughput) recompute(in *Throughput, idleMs float64) {
+	for _, s := range in.Samples {
+		t.add(backend.ThroughputSample{Time: s.Time, Mbps: s.Mbps, Streams: s.Streams, ServerMbps: s.ServerMbps}, idleMs)
+	}
+	if in.LoadedLatency != nil {
+		for _, p := range in.LoadedLatency.Samples {
+			if d := fromMs(p.LatencyMs); d > 0 {
+				t.add(backend.ThroughputSample{Time: p.Time, Latency: d}, idleMs)
+			}
+		}
+	}
+	t.ServerBytes = in.ServerBytes
+	t.ServerMbps = in.ServerMbps
+}
+
+func (t *Throughput) add(s backend.ThroughputSample, idleMs float64) {
+	if s.Server != nil {
+		t.ServerBytes = s.Server.Bytes
+		t.ServerMbps = s.Server.Mbps()
+		return
+	}
+	if s.Latency > 0 {
+		if t.LoadedLatency == nil {
+			t.LoadedLatency = &LoadedLatency{}
+		}
+		t.LoadedLatency.add(s, idleMs)
+		return
+	}
+	t.Samples = append(t.Samples, ThroughputSample{Time: s.Time, Mbps: s.Mbps, Streams: s.Streams, ServerMbps: s.ServerMbps})
+
+	vals := make([]float64, len(t.Samples))
+	for i, v := range t.Samples {
+		vals[i] = v.Mbps
+	}
+	t.MinMbps, t.MaxMbps = measure.MinMax(vals)
+	t.MeanMbps = measure.Mean(vals)
+	t.StdDevMbps = measure.StdDev(vals)
+	t.MedianMbps = measure.Median(vals)
+	t.SteadyMbps = measure.SteadyThroughput(vals)
+}
+
+func (l *LoadedLatency) add(s backend.ThroughputSample, idleMs float64) {
+	l.Samples = append(l.Samples, PingSample{Seq: len(l.Samples), Time: s.Time, LatencyMs: ms(s.Latency)})
+
+	vals := make([]float64, len(l.Samples))
+	for i, p := range l.Samples {
+		vals[i] = p.LatencyMs
+	}
+	l.MinMs, l.MaxMs = measure.MinMax(vals)
+	l.MeanMs = measure.Mean(vals)
+	l.StdDevMs = measure.StdDev(vals)
+	l.IncreaseMs = 0
+	if idleMs > 0 {
+		l.IncreaseMs = l.MeanMs - idleMs
+	}
+	l.RPM = 0
+	if l.MeanMs > 0 {
+		l.RPM = int(math.Round(60_000 / l.MeanMs))
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
+
+func fromMs(v float64) time.Duration {
+	return time.Duration(math.Round(v*1000)) * time.Microsecond
+}
@@ -0,0 +1,205 @@
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+func approxEqual(a, b, epsilon float64) bool {
+	return math.Abs(a-b) < epsilon
+}
+
+func TestAggregates(t *testing.T) {
+	r := New("host:7121", time.Unix(0, 0))
+	r.SetServer(backend.ServerInfo{Hostname: "host", Location: "Seattle, WA"})
+
+	for i, d := range []time.Duration{10, 20, 30} {
+		r.AddPing(backend.PingSample{Seq: i, Latency: d * time.Millisecond})
+	}
+	for _, v := range []float64{100, 200, 300} {
+		r.AddDownload(backend.ThroughputSample{Mbps: v})
+	}
+	r.AddUpload(backend.ThroughputSample{Mbps: 50})
+
+	if r.Ping.MinMs != 10 || r.Ping.MaxMs != 30 || r.Ping.MeanMs != 20 {
+		t.Errorf("ping aggregates = %+v", r.Ping)
+	}
+	if !approxEqual(r.Ping.StdDevMs, math.Sqrt(200.0/3.0), 1e-9) {
+		t.Errorf("ping stddev = %v", r.Ping.StdDevMs)
+	}
+	if r.Ping.MedianMs != 20 || r.Ping.P95Ms != 29 || r.Ping.IQRMs != 10 {
+		t.Errorf("ping percentiles = %+v", r.Ping)
+	}
+	if !approxEqual(r.Ping.MeanAbsDevMs, 20.0/3.0, 1e-9) || !approxEqual(r.Ping.JitterMs, 10.0/16+(10-10.0/16)/16, 1e-9) {
+		t.Errorf("ping mean absolute deviation = %v, jitter = %v", r.Ping.MeanAbsDevMs, r.Ping.JitterMs)
+	}
+	if r.Download.MinMbps != 100 || r.Download.MaxMbps != 300 || r.Download.MeanMbps != 200 {
+		t.Errorf("download aggregates = %+v", r.Download)
+	}
+	// The first sample is below 80% of the smoothed peak, so it counts as
+	// slow start.
+	if r.Download.MedianMbps != 200 || r.Download.SteadyMbps != 250 {
+		t.Errorf("download median = %v, steady = %v", r.Download.MedianMbps, r.Download.SteadyMbps)
+	}
+	if r.Upload.MeanMbps != 50 || r.Upload.StdDevMbps != 0 {
+		t.Errorf("upload aggregates = %+v", r.Upload)
+	}
+}
+
+func TestServerReport(t *testing.T) {
+	r := New("host:7121", time.Unix(0, 0))
+	r.AddUpload(backend.ThroughputSample{Mbps: 50, ServerMbps: 40})
+	r.AddUpload(backend.ThroughputSample{Server: &backend.ServerReport{Bytes: 5_000_000, Elapsed: time.Second}})
+
+	if len(r.Upload.Samples) != 1 || r.Upload.Samples[0].ServerMbps != 40 {
+		t.Errorf("upload samples = %+v", r.Upload.Samples)
+	}
+	if r.Upload.MeanMbps != 50 {
+		t.Errorf("server report changed the client aggregates: %+v", r.Upload)
+	}
+	if r.Upload.ServerBytes != 5_000_000 || r.Upload.ServerMbps != 40 {
+		t.Errorf("server totals = %d bytes, %.1f Mbit/s", r.Upload.ServerBytes, r.Upload.ServerMbps)
+	}
+}
+
+func TestLoadedLatency(t *testing.T) {
+	r := New("host:7121", time.Unix(0, 0))
+	for i, d := range []time.Duration{10, 20, 30} {
+		r.AddPing(backend.PingSample{Seq: i, Latency: d * time.Millisecond})
+	}
+	r.AddDownload(backend.ThroughputSample{Mbps: 100})
+	for _, d := range []time.Duration{50, 100, 150} {
+		r.AddDownload(backend.ThroughputSample{Latency: d * time.Millisecond})
+	}
+
+	if len(r.Download.Samples) != 1 || r.Download.MeanMbps != 100 {
+		t.Errorf("latency probes changed the throughput aggregates: %+v", r.Download)
+	}
+	l := r.Download.LoadedLatency
+	if l == nil {
+		t.Fatal("no loaded latency recorded")
+	}
+	if len(l.Samples) != 3 || l.Samples[2].Seq != 2 || l.Samples[2].LatencyMs != 150 {
+		t.Errorf("loaded latency samples = %+v", l.Samples)
+	}
+	if l.MinMs != 50 || l.MaxMs != 150 || l.MeanMs != 100 {
+		t.Errorf("loaded latency aggregates = %+v", l)
+	}
+	if l.IncreaseMs != 80 {
+		t.Errorf("increase = %v ms, want 80 (100 ms loaded, 20 ms idle)", l.IncreaseMs)
+	}
+	if l.RPM != 600 {
+		t.Errorf("RPM = %d, want 600 round trips of 100 ms per minute", l.RPM)
+	}
+	if r.Upload.LoadedLatency != nil {
+		t.Errorf("upload has loaded latency without probes: %+v", r.Upload.LoadedLatency)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	r := New("host:7121", time.Unix(0, 0))
+	r.AddUDP(backend.UDPSample{QueuePosition: 1})
+	if r.UDP != nil {
+		t.Fatalf("queue notification recorded: %+v", r.UDP)
+	}
+
+	r.AddUDP(backend.UDPSample{TargetMbps: 4, PacketSize: 1200, Sent: 200, Received: 198, Lost: 2, Jitter: time.Millisecond, Mbps: 3})
+	r.AddUDP(backend.UDPSample{TargetMbps: 4, PacketSize: 1200, Sent: 400, Received: 396, Lost: 2, Jitter: 2 * time.Millisecond, Mbps: 5})
+	if u := r.UDP; len(u.Samples) != 2 || u.Mbps != 4 || u.JitterMs != 2 || u.Samples[0].JitterMs != 1 {
+		t.Errorf("after interim reports: %+v", u)
+	}
+
+	// The final report replaces the counts and sets the overall rate.
+	r.AddUDP(backend.UDPSample{
+		TargetMbps: 4, PacketSize: 1200, Sent: 400, Received: 396, Lost: 4, Reordered: 3, Duplicates: 1,
+		Jitter: 1500 * time.Microsecond, Mbps: 3.9, Final: true,
+	})
+	want := UDP{
+		TargetMbps: 4, PacketSize: 1200, Sent: 400, Received: 396, Lost: 4, LossPercent: 1,
+		Reordered: 3, Duplicates: 1, JitterMs: 1.5, Mbps: 3.9,
+	}
+	got := *r.UDP
+	if len(got.Samples) != 2 {
+		t.Errorf("final report recorded as a sample: %+v", got.Samples)
+	}
+	got.Samples = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UDP = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteJSON_RoundTrip(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := New("host:7121", start)
+	r.ClientVersion = "v1.2.3"
+	r.SetServer(backend.ServerInfo{Hostname: "host"})
+	r.AddPing(backend.PingSample{Seq: 0, Latency: 1500 * time.Microsecond})
+	r.AddDownload(backend.ThroughputSample{Mbps: 42, Time: start.Add(time.Second)})
+	r.Finish(start.Add(30 * time.Second))
+
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Result
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if got.ClientVersion != "v1.2.3" || got.Server.Addr != "host:7121" {
+		t.Errorf("metadata mismatch: %+v", got)
+	}
+	if !got.Start.Equal(start) || !got.End.Equal(start.Add(30*time.Second)) {
+		t.Errorf("timestamps mismatch: start=%v end=%v", got.Start, got.End)
+	}
+	if len(got.Ping.Samples) != 1 || got.Ping.Samples[0].LatencyMs != 1.5 {
+		t.Errorf("ping samples mismatch: %+v", got.Ping.Samples)
+	}
+	if len(got.Download.Samples) != 1 || got.Download.Samples[0].Mbps != 42 {
+		t.Errorf("download samples mismatch: %+v", got.Download.Samples)
+	}
+	if got.Upload.Samples != nil {
+		t.Errorf("expected no upload samples, got %+v", got.Upload.Samples)
+	}
+}
+
+func TestRecompute(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := New("host:7121", start)
+	want.ClientVersion = "web/1.2.3"
+	want.SetServer(backend.ServerInfo{Hostname: "host", IP: "192.0.2.1", Family: "IPv4"})
+	for i, d := range []time.Duration{1500, 2250, 1750} {
+		want.AddPing(backend.PingSample{Seq: i, Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Latency: d * time.Microsecond})
+	}
+	for i, v := range []float64{100, 400, 380, 420} {
+		want.AddDownload(backend.ThroughputSample{Time: start.Add(time.Duration(i+5) * time.Second), Mbps: v, Streams: []float64{v / 2, v / 2}})
+	}
+	want.AddDownload(backend.ThroughputSample{Time: start.Add(6 * time.Second), Latency: 12 * time.Millisecond})
+	want.AddUpload(backend.ThroughputSample{Time: start.Add(10 * time.Second), Mbps: 50})
+	want.AddUpload(backend.ThroughputSample{Server: &backend.ServerReport{Bytes: 6_250_000, Elapsed: time.Second}})
+	want.Finish(start.Add(20 * time.Second))
+
+	// Only the samples and server totals go in; everything else is
+	// computed again.
+	in := &Result{ClientVersion: want.ClientVersion, Server: want.Server, Start: want.Start, End: want.End}
+	in.Ping.Samples = want.Ping.Samples
+	in.Download.Samples = want.Download.Samples
+	in.Download.LoadedLatency = &LoadedLatency{Samples: want.Download.LoadedLatency.Samples}
+	in.Upload.Samples = want.Upload.Samples
+	in.Upload.ServerBytes, in.Upload.ServerMbps = want.Upload.ServerBytes, want.Upload.ServerMbps
+	in.Upload.MaxMbps = 1e6
+
+	var wantJSON, gotJSON bytes.Buffer
+	want.WriteJSON(&wantJSON)
+	Recompute(in).WriteJSON(&gotJSON)
+	if gotJSON.String() != wantJSON.String() {
+		t.Errorf("recomputed result:\n%s\nwant:\n%s", gotJSON.String(), wantJSON.String())
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+var (
+	errAuthRequired = errors.New("authentication required")
+	errAuthFailed   = errors.New("authentication failed")
+)
+
+// tokens maps user names to their authentication tokens. The shared
+// secret, if any, is stored under protocol.SharedUser. A nil map means the
+// server does not require authentication.
+type tokens map[string]string
+
+// loadTokens reads a token file. Each line holds either a user name and
+// its token, separated by whitespace, or a token on its own, which is the
+// shared secret for clients that don't give a user name. Blank lines and
+// lines starting with # are ignored.
+func loadTokens(path string) (tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load tokens: %w", err)
+	}
+	defer f.Close()
+
+	t := tokens{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var user, token string
+		switch fields := strings.Fields(line); len(fields) {
+		case 1:
+			user, token = protocol.SharedUser, fields[0]
+		case 2:
+			user, token = fields[0], fields[1]
+			if !protocol.ValidUser(user) {
+				return nil, fmt.Errorf("load tokens: %s:%d: invalid user name %q", path, n, user)
+			}
+		default:
+			return nil, fmt.Errorf("load tokens: %s:%d: expected \"[user] token\"", path, n)
+		}
+
+		if _, dup := t[user]; dup {
+			if user == protocol.SharedUser {
+				return nil, fmt.Errorf("load tokens: %s:%d: more than one shared secret", path, n)
+			}
+			return nil, fmt.Errorf("load tokens: %s:%d: duplicate user %q", path, n, user)
+		}
+		t[user] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load tokens: %w", err)
+	}
+	if len(t) == 0 {
+		return nil, fmt.Errorf("load tokens: %s has no tokens", path)
+	}
+	return t, nil
+}
+
+// authenticate finishes a version 3 handshake. Servers without tokens send
+// OPEN. Otherwise the server sends a random challenge and the client must
+// answer with its user name and protocol.AuthResponse for its token.
+func (c *conn) authenticate(auth tokens) error {
+	if auth == nil {
+		_, err := fmt.Fprintf(c.rwc, "OPEN\n")
+		return err
+	}
+
+	buf := make([]byte, protocol.ChallengeLen)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("generate challenge: %w", err)
+	}
+	challenge := hex.EncodeToString(buf)
+	if _, err := fmt.Fprintf(c.rwc, "AUTH %s\n", challenge); err != nil {
+		return err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: read response: %v", errAuthRequired, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "AUTH" {
+		fmt.Fprintf(c.rwc, "ERR:Authentication failed\n")
+		return fmt.Errorf("%w: malformed response", errAuthFailed)
+	}
+	user, response := fields[1], fields[2]
+
+	token, ok := auth[user]
+	if !ok || !hmac.Equal([]byte(response), []byte(protocol.AuthResponse(token, user, challenge))) {
+		fmt.Fprintf(c.rwc, "ERR:Authentication failed\n")
+		return fmt.Errorf("%w: user %q", errAuthFailed, user)
+	}
+
+	c.user = user
+	_, err = fmt.Fprintf(c.rwc, "OK\n")
+	return err
+}
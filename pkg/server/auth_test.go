@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func writeTokens(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    tokens
+		wantErr string
+	}{
+		{
+			name:    "users and shared secret",
+			content: "# comment\n\nalice  t0k3n\nbob\tsecond\nsh4red\n",
+			want:    tokens{"alice": "t0k3n", "bob": "second", protocol.SharedUser: "sh4red"},
+		},
+		{name: "empty", content: "# nothing\n", wantErr: "has no tokens"},
+		{name: "too many fields", content: "alice t0k3n extra\n", wantErr: ":1: expected"},
+		{name: "invalid user", content: "al/ice t0k3n\n", wantErr: "invalid user name"},
+		{name: "duplicate user", content: "alice a\nalice b\n", wantErr: ":2: duplicate user"},
+		{name: "two shared secrets", content: "a\nb\n", wantErr: "more than one shared secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadTokens(writeTokens(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("tokens = %v, want %v", got, tt.want)
+			}
+			for user, token := range tt.want {
+				if got[user] != token {
+					t.Errorf("tokens[%q] = %q, want %q", user, got[user], token)
+				}
+			}
+		})
+	}
+}
+
+// v3Handshake sends a version 3 HELO with default parameters and reads
+// the response up to and including the authentication line.
+func v3Handshake(t *testing.T, client io.Writer, reader *bufio.Reader) string {
+	t.Helper()
+	go client.Write([]byte("HELO3\r\n"))
+	if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != "HELO" {
+		t.Fatalf("expected HELO, got %q", line)
+	}
+	go client.Write([]byte("\r\n"))
+	for i := 0; i < 4; i++ {
+		reader.ReadString('\n') // cname, location, params, limits
+	}
+	line, _ := reader.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+func TestHandshake_V3Open(t *testing.T) {
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
+	}()
+
+	if line := v3Handshake(t, client, bufio.NewReader(client)); line != "OPEN" {
+		t.Errorf("expected OPEN, got %q", line)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	if c.user != "" {
+		t.Errorf("user = %q on an open server", c.user)
+	}
+}
+
+func TestHandshake_V3Auth(t *testing.T) {
+	auth := tokens{"alice": "t0k3n", protocol.SharedUser: "sh4red"}
+
+	tests := []struct {
+		name     string
+		response func(challenge string) string
+		wantResp string
+		wantErr  error
+		wantUser string
+	}{
+		{
+			name: "user token",
+			response: func(ch string) string {
+				return "AUTH alice " + protocol.AuthResponse("t0k3n", "alice", ch)
+			},
+			wantResp: "OK",
+			wantUser: "alice",
+		},
+		{
+			name: "shared secret",
+			response: func(ch string) string {
+				return "AUTH - " + protocol.AuthResponse("sh4red", protocol.SharedUser, ch)
+			},
+			wantResp: "OK",
+			wantUser: protocol.SharedUser,
+		},
+		{
+			name: "wrong token",
+			response: func(ch string) string {
+				return "AUTH alice " + protocol.AuthResponse("guess", "alice", ch)
+			},
+			wantResp: "ERR:Authentication failed",
+			wantErr:  errAuthFailed,
+		},
+		{
+			name: "token of another user",
+			response: func(ch string) string {
+				return "AUTH alice " + protocol.AuthResponse("sh4red", protocol.SharedUser, ch)
+			},
+			wantResp: "ERR:Authentication failed",
+			wantErr:  errAuthFailed,
+		},
+		{
+			name: "unknown user",
+			response: func(ch string) string {
+				return "AUTH mallory " + protocol.AuthResponse("t0k3n", "mallory", ch)
+			},
+			wantResp: "ERR:Authentication failed",
+			wantErr:  errAuthFailed,
+		},
+		{
+			name:     "malformed",
+			response: func(string) string { return "LOGIN alice" },
+			wantResp: "ERR:Authentication failed",
+			wantErr:  errAuthFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := pipeConn()
+			defer c.rwc.Close()
+			defer client.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- c.handshake("host", "loc", "", DefaultLimits(), auth)
+			}()
+
+			reader := bufio.NewReader(client)
+			line := v3Handshake(t, client, reader)
+			challenge, ok := strings.CutPrefix(line, "AUTH ")
+			if !ok || len(challenge) != 2*protocol.ChallengeLen {
+				t.Fatalf("expected AUTH challenge, got %q", line)
+			}
+
+			go client.Write([]byte(tt.response(challenge) + "\r\n"))
+			if resp, _ := reader.ReadString('\n'); strings.TrimSpace(resp) != tt.wantResp {
+				t.Errorf("response = %q, want %q", resp, tt.wantResp)
+			}
+
+			err := <-errCh
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake returned error: %v", err)
+			}
+			if c.user != tt.wantUser {
+				t.Errorf("user = %q, want %q", c.user, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestHandshake_AuthChallengesDiffer(t *testing.T) {
+	auth := tokens{"alice": "t0k3n"}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c, client := pipeConn()
+		go c.handshake("host", "loc", "", DefaultLimits(), auth)
+		line := v3Handshake(t, client, bufio.NewReader(client))
+		if seen[line] {
+			t.Errorf("challenge repeated: %q", line)
+		}
+		seen[line] = true
+		client.Close()
+		c.rwc.Close()
+	}
+}
+
+func TestHandleConn_AuthRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		helo   string
+		reason string
+	}{
+		{"version 0 client", "HELO0", "auth_required"},
+		{"version 2 client", "HELO2", "auth_required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer()
+			s.settings.Store(&settings{auth: tokens{"alice": "t0k3n"}})
+			client, done := serve(s)
+			defer client.Close()
+
+			go client.Write([]byte(tt.helo + "\r\n"))
+			resp, _ := bufio.NewReader(client).ReadString('\n')
+			if strings.TrimSpace(resp) != "ERR:Authentication required" {
+				t.Errorf("expected authentication ERR, got %q", resp)
+			}
+			<-done
+
+			if got := testutil.ToFloat64(s.metrics.handshakeFailures.WithLabelValues(tt.reason)); got != 1 {
+				t.Errorf("handshake failures{reason=%q} = %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestHandleConn_AuthFailedMetric(t *testing.T) {
+	s := testServer()
+	s.settings.Store(&settings{auth: tokens{"alice": "t0k3n"}})
+	client, done := serve(s)
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	v3Handshake(t, client, reader)
+	go client.Write([]byte("AUTH alice 00\r\n"))
+	reader.ReadString('\n')
+	<-done
+
+	if got := testutil.ToFloat64(s.metrics.handshakeFailures.WithLabelValues("auth_failed")); got != 1 {
+		t.Errorf("handshake failures{reason=\"auth_failed\"} = %v, want 1", got)
+	}
+}
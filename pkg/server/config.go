@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// DefaultConfig returns the configuration used for settings that neither
+// the config file nor the command line set.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddrs: []string{":7121"},
+		LogFormat:   "text",
+		MaxQueue:    10,
+		Limits:      DefaultLimits(),
+		RateLimit:   RateLimit{Window: time.Hour, IPv4Prefix: 32, IPv6Prefix: 64},
+	}
+}
+
+// fileConfig is the layout of the YAML config file. Every field is
+// optional; unset fields keep their value from DefaultConfig.
+type fileConfig struct {
+	Listen  stringList `yaml:"listen"`
+	Metrics string     `yaml:"metrics"`
+	HTTP    string     `yaml:"http"`
+	Web     bool       `yaml:"web"`
+	MDNS    bool       `yaml:"mdns"`
+
+	Registry struct {
+		URL       string `yaml:"url"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"registry"`
+	Cname    string `yaml:"cname"`
+	Location string `yaml:"location"`
+
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+
+	Limits struct {
+		MaxTests    int      `yaml:"max_tests"`
+		MaxQueue    int      `yaml:"max_queue"`
+		MaxDuration duration `yaml:"max_duration"`
+		MaxPings    int      `yaml:"max_pings"`
+		MaxStreams  int      `yaml:"max_streams"`
+	} `yaml:"limits"`
+
+	TLS struct {
+		Cert     string `yaml:"cert"`
+		Key      string `yaml:"key"`
+		ClientCA string `yaml:"client_ca"`
+	} `yaml:"tls"`
+
+	Auth struct {
+		TokensFile string `yaml:"tokens_file"`
+	} `yaml:"auth"`
+
+	RateLimit struct {
+		Tests       int      `yaml:"tests"`
+		Window      duration `yaml:"window"`
+		BytesPerDay byteSize `yaml:"bytes_per_day"`
+		Cooldown    duration `yaml:"cooldown"`
+		IPv4Prefix  int      `yaml:"ipv4_prefix"`
+		IPv6Prefix  int      `yaml:"ipv6_prefix"`
+	} `yaml:"rate_limit"`
+
+	Allow []prefix `yaml:"allow"`
+	Deny  []prefix `yaml:"deny"`
+}
+
+// LoadConfig reads a YAML config file on top of DefaultConfig. Unknown
+// keys are errors, so that typos don't go unnoticed. The result has not
+// been validated; New and Reload do that.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("load config: %w", err)
+	}
+
+	def := DefaultConfig()
+	var fc fileConfig
+	fc.Listen = def.ListenAddrs
+	fc.Log.Level = "info"
+	fc.Log.Format = def.LogFormat
+	fc.Limits.MaxQueue = def.MaxQueue
+	fc.Limits.MaxDuration = duration(def.Limits.Duration)
+	fc.Limits.MaxPings = def.Limits.Pings
+	fc.Limits.MaxStreams = def.Limits.Streams
+	fc.RateLimit.Window = duration(def.RateLimit.Window)
+	fc.RateLimit.IPv4Prefix = def.RateLimit.IPv4Prefix
+	fc.RateLimit.IPv6Prefix = def.RateLimit.IPv6Prefix
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("load config %s: %w", path, err)
+	}
+
+	var debug bool
+	switch fc.Log.Level {
+	case "info":
+	case "debug":
+		debug = true
+	default:
+		return Config{}, fmt.Errorf("load config %s: log.level must be \"info\" or \"debug\", not %q", path, fc.Log.Level)
+	}
+
+	cfg := Config{
+		ListenAddrs:       fc.Listen,
+		MetricsAddr:       fc.Metrics,
+		HTTPAddr:          fc.HTTP,
+		Web:               fc.Web,
+		MDNS:              fc.MDNS,
+		RegistryURL:       fc.Registry.URL,
+		RegistryTokenFile: fc.Registry.TokenFile,
+		Cname:             fc.Cname,
+		Location:          fc.Location,
+		Debug:             debug,
+		LogFormat:         fc.Log.Format,
+		MaxTests:          fc.Limits.MaxTests,
+		MaxQueue:          fc.Limits.MaxQueue,
+		TLSCertFile:       fc.TLS.Cert,
+		TLSKeyFile:        fc.TLS.Key,
+		TLSClientCAFile:   fc.TLS.ClientCA,
+		AuthFile:          fc.Auth.TokensFile,
+		RateLimit: RateLimit{
+			Tests:       fc.RateLimit.Tests,
+			Window:      time.Duration(fc.RateLimit.Window),
+			BytesPerDay: int64(fc.RateLimit.BytesPerDay),
+			Cooldown:    time.Duration(fc.RateLimit.Cooldown),
+			IPv4Prefix:  fc.RateLimit.IPv4Prefix,
+			IPv6Prefix:  fc.RateLimit.IPv6Prefix,
+		},
+	}
+	cfg.Limits.Duration = time.Duration(fc.Limits.MaxDuration)
+	cfg.Limits.Pings = fc.Limits.MaxPings
+	cfg.Limits.Streams = fc.Limits.MaxStreams
+	for _, p := range fc.Allow {
+		cfg.Allow = append(cfg.Allow, netip.Prefix(p))
+	}
+	for _, p := range fc.Deny {
+		cfg.Deny = append(cfg.Deny, netip.Prefix(p))
+	}
+	return cfg, nil
+}
+
+// validate checks cfg and fills unset parameter limits from
+// DefaultLimits.
+func (cfg *Config) validate() error {
+	if len(cfg.ListenAddrs) == 0 {
+		return errors.New("at least one listen address is required")
+	}
+	for _, addr := range cfg.ListenAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	}
+	if cfg.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+			return fmt.Errorf("invalid HTTP address %q: %w", cfg.HTTPAddr, err)
+		}
+	} else if cfg.Web {
+		return errors.New("the web test page requires an HTTP address")
+	}
+	if cfg.RegistryURL != "" {
+		if u, err := url.Parse(cfg.RegistryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registry URL must be an http:// or https:// URL, not %q", cfg.RegistryURL)
+		}
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return fmt.Errorf("log format must be \"text\" or \"json\", not %q", cfg.LogFormat)
+	}
+	if cfg.MaxTests < 0 || cfg.MaxQueue < 0 {
+		return errors.New("test limits must not be negative")
+	}
+
+	def := DefaultLimits()
+	if cfg.Limits.Duration <= 0 {
+		cfg.Limits.Duration = def.Duration
+	}
+	if cfg.Limits.Pings <= 0 {
+		cfg.Limits.Pings = def.Pings
+	}
+	if cfg.Limits.Streams <= 0 {
+		cfg.Limits.Streams = def.Streams
+	}
+	if cfg.Limits.Duration < time.Second || cfg.Limits.Duration%time.Second != 0 {
+		return errors.New("maximum test duration must be a whole number of seconds, at least 1s")
+	}
+
+	rl := cfg.RateLimit
+	if rl.Tests < 0 || rl.Window < 0 || rl.BytesPerDay < 0 || rl.Cooldown < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if rl.Tests > 0 && rl.Window <= 0 {
+		return errors.New("a test rate limit requires a window")
+	}
+	if rl.IPv4Prefix < 0 || rl.IPv4Prefix > 32 || rl.IPv6Prefix < 0 || rl.IPv6Prefix > 128 {
+		return errors.New("rate limit prefix lengths must be 0-32 for IPv4 and 0-128 for IPv6")
+	}
+	return nil
+}
+
+// ParseSize parses a byte count with an optional K, M, G, or T suffix, in
+// powers of 1000.
+func ParseSize(s string) (int64, error) {
+	digits, mult := s, int64(1)
+	if i := strings.IndexAny(s, "KMGTkmgt"); i >= 0 && i == len(s)-1 {
+		digits, mult = s[:i], map[byte]int64{'k': 1e3, 'm': 1e6, 'g': 1e9, 't': 1e12}[s[i]|0x20]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// ParsePrefix parses a CIDR prefix. A bare address is taken as a single
+// host.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// stringList is a list of strings in the config file, written as a
+// sequence or, for a single item, as a plain string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = stringList{node.Value}
+		return nil
+	}
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+// byteSize is a byte count in the config file, written as a number with
+// an optional K, M, G, or T suffix.
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	n, err := ParseSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+// duration is a duration in the config file, such as "30s" or "1h". A
+// unit is required.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q, want a number with a unit such as 30s or 1h", node.Line, node.Value)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// prefix is a CIDR prefix or a bare address in the config file.
+type prefix netip.Prefix
+
+func (p *prefix) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := ParsePrefix(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*p = prefix(parsed)
+	return nil
+}
+
+// Reload applies cfg to a running server. The cname, location, parameter
+// limits, queue sizes, rate limits, allow and deny lists, token file, and
+// log level take effect for new connections. Settings that are bound to
+// the listeners or the logger (listen, metrics, and HTTP addresses, the
+// web test page, TLS, and log format) keep their startup values, with a
+// warning if they changed, as does the mDNS advertisement. If cfg is
+// invalid, nothing changes.
+func (s *Server) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	st, err := newSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, fixed := range []struct {
+		name    string
+		changed bool
+	}{
+		{"listen addresses", !slices.Equal(cfg.ListenAddrs, s.cfg.ListenAddrs)},
+		{"metrics address", cfg.MetricsAddr != s.cfg.MetricsAddr},
+		{"HTTP address", cfg.HTTPAddr != s.cfg.HTTPAddr},
+		{"web test page", cfg.Web != s.cfg.Web},
+		{"registry", cfg.RegistryURL != s.cfg.RegistryURL || cfg.RegistryTokenFile != s.cfg.RegistryTokenFile},
+		{"mDNS advertisement", cfg.MDNS != s.cfg.MDNS || (cfg.MDNS && (cfg.Cname != s.cfg.Cname || cfg.Location != s.cfg.Location))},
+		{"log format", cfg.LogFormat != s.cfg.LogFormat},
+		{"TLS", cfg.TLSCertFile != s.cfg.TLSCertFile || cfg.TLSKeyFile != s.cfg.TLSKeyFile || cfg.TLSClientCAFile != s.cfg.TLSClientCAFile},
+	} {
+		if fixed.changed {
+			s.logger.Warn("setting changed; restart to apply it", "setting", fixed.name)
+		}
+	}
+
+	s.settings.Store(st)
+	s.queue.resize(cfg.MaxTests, cfg.MaxQueue)
+	s.limiter.setLimit(cfg.RateLimit)
+	if cfg.Debug {
+		s.level.Set(slog.LevelDebug)
+	} else {
+		s.level.Set(slog.LevelInfo)
+	}
+	s.logger.Info("configuration reloaded")
+	return nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sparkyfish-server.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  - 0.0.0.0:7121
+  - "[::]:7121"
+metrics: ":9121"
+http: ":8080"
+web: true
+mdns: true
+registry:
+  url: https://registry.example.com
+  token_file: /etc/sparkyfish/registry-token
+cname: speedtest.example.com
+location: Denver, CO
+log:
+  level: debug
+  format: json
+limits:
+  max_tests: 4
+  max_queue: 20
+  max_duration: 20s
+  max_streams: 4
+tls:
+  cert: /etc/sparkyfish/tls/tls.crt
+  key: /etc/sparkyfish/tls/tls.key
+auth:
+  tokens_file: /etc/sparkyfish/auth/tokens
+rate_limit:
+  tests: 10
+  bytes_per_day: 50G
+  ipv6_prefix: 56
+allow:
+  - 10.0.0.0/8
+  - 2001:db8::1
+deny:
+  - 10.1.0.0/16
+`)
+
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		ListenAddrs:       []string{"0.0.0.0:7121", "[::]:7121"},
+		MetricsAddr:       ":9121",
+		HTTPAddr:          ":8080",
+		Web:               true,
+		MDNS:              true,
+		RegistryURL:       "https://registry.example.com",
+		RegistryTokenFile: "/etc/sparkyfish/registry-token",
+		Cname:             "speedtest.example.com",
+		Location:          "Denver, CO",
+		Debug:             true,
+		LogFormat:         "json",
+		MaxTests:          4,
+		MaxQueue:          20,
+		Limits:            protocol.Params{Duration: 20 * time.Second, Pings: 100, Streams: 4},
+		TLSCertFile:       "/etc/sparkyfish/tls/tls.crt",
+		TLSKeyFile:        "/etc/sparkyfish/tls/tls.key",
+		AuthFile:          "/etc/sparkyfish/auth/tokens",
+		RateLimit:         RateLimit{Tests: 10, Window: time.Hour, BytesPerDay: 50e9, IPv4Prefix: 32, IPv6Prefix: 56},
+		Allow:             []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::1/128")},
+		Deny:              []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadConfig:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLoadConfig_Empty(t *testing.T) {
+	got, err := LoadConfig(writeConfig(t, "# nothing set\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := DefaultConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadConfig:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+// The packaged example config has every setting commented out at its
+// default value.
+func TestLoadConfig_Example(t *testing.T) {
+	got, err := LoadConfig("../../packaging/systemd/sparkyfish-server.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := DefaultConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadConfig:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLoadConfig_SingleListenAddr(t *testing.T) {
+	got, err := LoadConfig(writeConfig(t, "listen: 127.0.0.1:7121\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:7121"}; !reflect.DeepEqual(got.ListenAddrs, want) {
+		t.Errorf("ListenAddrs = %q, want %q", got.ListenAddrs, want)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown key", "locaton: Denver\n", "field locaton not found"},
+		{"unknown nested key", "limits:\n  max_test: 4\n", "field max_test not found"},
+		{"log level", "log:\n  level: trace\n", `log.level must be "info" or "debug"`},
+		{"size", "rate_limit:\n  bytes_per_day: 50X\n", `line 2: invalid size "50X"`},
+		{"prefix", "allow:\n  - 10.0.0.0/8\n  - 10.0.0.0/33\n", `line 3: netip.ParsePrefix("10.0.0.0/33")`},
+		{"duration", "limits:\n  max_duration: 20\n", `line 2: invalid duration "20"`},
+		{"type", "limits:\n  max_tests: four\n", "line 2: cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"no listen address", func(c *Config) { c.ListenAddrs = nil }, "at least one listen address"},
+		{"listen address", func(c *Config) { c.ListenAddrs = []string{":7121", "7122"} }, `invalid listen address "7122"`},
+		{"log format", func(c *Config) { c.LogFormat = "xml" }, `log format must be "text" or "json"`},
+		{"registry URL", func(c *Config) { c.RegistryURL = "registry.example.com" }, "registry URL must be an http:// or https:// URL"},
+		{"web without HTTP", func(c *Config) { c.Web = true }, "web test page requires an HTTP address"},
+		{"negative max tests", func(c *Config) { c.MaxTests = -1 }, "must not be negative"},
+		{"fractional duration", func(c *Config) { c.Limits.Duration = 1500 * time.Millisecond }, "whole number of seconds"},
+		{"negative cooldown", func(c *Config) { c.RateLimit.Cooldown = -time.Second }, "must not be negative"},
+		{"tests without window", func(c *Config) { c.RateLimit.Tests, c.RateLimit.Window = 5, 0 }, "requires a window"},
+		{"ipv4 prefix", func(c *Config) { c.RateLimit.IPv4Prefix = 33 }, "prefix lengths"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(&cfg)
+			err := cfg.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"50G", 50e9, true},
+		{"2t", 2e12, true},
+		{"500k", 500e3, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"-1M", 0, false},
+		{"1.5G", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func reloadServer() *Server {
+	s := testServer()
+	s.cfg = DefaultConfig()
+	s.level = new(slog.LevelVar)
+	s.settings.Store(&settings{location: "Denver", limits: DefaultLimits()})
+	return s
+}
+
+func TestReload(t *testing.T) {
+	s := reloadServer()
+
+	cfg := DefaultConfig()
+	cfg.Location = "Boulder"
+	cfg.Debug = true
+	cfg.MaxTests = 3
+	cfg.Limits.Streams = 2
+	cfg.RateLimit.Tests = 5
+	cfg.Deny = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	st := s.settings.Load()
+	if st.location != "Boulder" {
+		t.Errorf("location = %q, want Boulder", st.location)
+	}
+	if st.limits.Streams != 2 {
+		t.Errorf("stream limit = %d, want 2", st.limits.Streams)
+	}
+	if st.access.permits(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("deny list not applied")
+	}
+	if s.queue.max != 3 {
+		t.Errorf("queue max = %d, want 3", s.queue.max)
+	}
+	if s.limiter.limit.Tests != 5 {
+		t.Errorf("rate limit tests = %d, want 5", s.limiter.limit.Tests)
+	}
+	if s.level.Level() != slog.LevelDebug {
+		t.Errorf("log level = %v, want debug", s.level.Level())
+	}
+}
+
+func TestReload_Invalid(t *testing.T) {
+	s := reloadServer()
+	before := s.settings.Load()
+
+	cfg := DefaultConfig()
+	cfg.Location = "Boulder"
+	cfg.AuthFile = filepath.Join(t.TempDir(), "missing")
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("expected an error for a missing token file")
+	}
+
+	cfg.AuthFile = ""
+	cfg.RateLimit.IPv6Prefix = 129
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("expected a validation error")
+	}
+
+	if s.settings.Load() != before {
+		t.Error("a failed reload replaced the settings")
+	}
+}
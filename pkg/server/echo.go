@@ -1,9 +1,12 @@
 package server
 
-const maxPings = 30
+import "time"
 
 func (s *Server) handleEcho(c *conn) {
-	for i := 0; i < maxPings; i++ {
+	start := time.Now()
+	defer func() { s.metrics.testFinished("ECO", 0, time.Since(start)) }()
+
+	for i := 0; i < c.params.Pings; i++ {
 		b, err := c.reader.ReadByte()
 		if err != nil {
 			c.logger.Debug("echo read", "err", err)
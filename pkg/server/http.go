@@ -0,0 +1,463 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+const (
+	// httpClaimTimeout is how long the streams of a reserved HTTP test
+	// have to start. The test's slot is given up for any that don't.
+	httpClaimTimeout = 10 * time.Second
+	// httpChunkSize is how much random data a download writes at a time.
+	httpChunkSize = 1024 * 1024
+	// httpChallengeTimeout is how long an authentication challenge can be
+	// answered, and maxHTTPChallenges how many may be outstanding.
+	httpChallengeTimeout = 30 * time.Second
+	maxHTTPChallenges    = 10000
+)
+
+// serveHTTP serves the HTTP transport (see protocol.HTTPHelloPath) on
+// addr until ctx is cancelled, over TLS if the server has a certificate.
+// The listener is bound before returning so that a bad address is
+// reported at startup.
+func (s *Server) serveHTTP(ctx context.Context, addr string) error {
+	ln, err := net.Listen(listenNetwork(addr), addr)
+	if err != nil {
+		return fmt.Errorf("listen HTTP %s: %w", addr, err)
+	}
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	srv := &http.Server{Handler: s.httpHandler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("HTTP server", "err", err)
+		}
+	}()
+
+	s.logger.Info("serving HTTP", "addr", ln.Addr(), "tls", s.tls != nil)
+	return nil
+}
+
+// httpHandler returns the HTTP transport's handler. Every request is
+// subject to the allow and deny lists and, if the server requires it,
+// authentication.
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+protocol.HTTPHelloPath, s.handleHTTPHello)
+	mux.HandleFunc("GET "+protocol.HTTPChallengePath, s.handleHTTPChallenge)
+	mux.HandleFunc("GET "+protocol.HTTPPingPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST "+protocol.HTTPTestsPath, s.handleHTTPReserve)
+	mux.HandleFunc("GET "+protocol.HTTPDownloadPath, s.handleHTTPDownload)
+	mux.HandleFunc("POST "+protocol.HTTPUploadPath, s.handleHTTPUpload)
+	if s.cfg.Web {
+		s.webHandlers(mux)
+	}
+	return s.httpAccess(mux)
+}
+
+// httpAccess checks that a request may be served before passing it on.
+// Clients authenticate each request with the answer to a challenge from
+// protocol.HTTPChallengePath, as over TCP, so the token never goes over
+// the wire. Browsers, which can't, may use HTTP basic authentication
+// with the user name, or an empty one for the shared secret, and the
+// token as the password, but only over TLS.
+func (s *Server) httpAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.settings.Load()
+		if ip, ok := requestIP(r); ok && !st.access.permits(ip) {
+			s.metrics.connsDenied.Inc()
+			s.logger.Info("connection denied", "addr", r.RemoteAddr)
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if st.auth != nil && r.URL.Path != protocol.HTTPChallengePath {
+			user, err := s.httpAuthenticate(r, st.auth)
+			if err != nil {
+				if errors.Is(err, errAuthFailed) {
+					s.logger.Warn("authentication failed", "addr", r.RemoteAddr, "err", err)
+				}
+				s.metrics.handshakeFailed(err)
+				w.Header().Set("WWW-Authenticate", protocol.HTTPAuthScheme)
+				if r.TLS != nil {
+					w.Header().Add("WWW-Authenticate", `Basic realm="sparkyfish"`)
+				}
+				http.Error(w, "Authentication failed", http.StatusUnauthorized)
+				return
+			}
+			s.logger.Debug("authenticated", "addr", r.RemoteAddr, "user", user)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpAuthenticate checks a request's credentials against auth and
+// returns the user they belong to.
+func (s *Server) httpAuthenticate(r *http.Request, auth tokens) (string, error) {
+	if user, challenge, response, ok := protocol.ParseHTTPAuthorization(r.Header.Get("Authorization")); ok {
+		token, known := auth[user]
+		if !s.httpAuth.redeem(challenge) {
+			return "", fmt.Errorf("%w: user %q: unknown or expired challenge", errAuthFailed, user)
+		}
+		if !known || !hmac.Equal([]byte(response), []byte(protocol.AuthResponse(token, user, challenge))) {
+			return "", fmt.Errorf("%w: user %q", errAuthFailed, user)
+		}
+		return user, nil
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errAuthRequired
+	}
+	if r.TLS == nil {
+		// The password is the token itself.
+		return "", fmt.Errorf("%w: basic authentication without TLS", errAuthFailed)
+	}
+	if user == "" {
+		user = protocol.SharedUser
+	}
+	if token, known := auth[user]; !known || !hmac.Equal([]byte(password), []byte(token)) {
+		return "", fmt.Errorf("%w: user %q", errAuthFailed, user)
+	}
+	return user, nil
+}
+
+// handleHTTPChallenge issues a challenge for a client to answer in the
+// Authorization header of its next request.
+func (s *Server) handleHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := s.httpAuth.issue()
+	if !ok {
+		retryAfter(w, httpChallengeTimeout)
+		http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, protocol.Challenge{Challenge: challenge})
+}
+
+func (s *Server) handleHTTPHello(w http.ResponseWriter, r *http.Request) {
+	request, err := protocol.ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid parameters received", http.StatusBadRequest)
+		return
+	}
+	st := s.settings.Load()
+	writeJSON(w, protocol.Hello{
+		Cname:    st.cname,
+		Location: st.location,
+		Version:  s.cfg.Version,
+		Params:   request.Accept(st.limits).String(),
+		Limits:   st.limits.String(),
+	})
+}
+
+// handleHTTPReserve reserves a slot for a download or upload test, once
+// the rate limits and the queue allow it. The answer is a line of JSON (a
+// protocol.TestStatus) each time the test's queue position changes, and a
+// last one with the token that the test's streams present.
+func (s *Server) handleHTTPReserve(w http.ResponseWriter, r *http.Request) {
+	var cmd string
+	switch r.URL.Query().Get("test") {
+	case "download":
+		cmd = "SND"
+	case "upload":
+		cmd = "RCV"
+	default:
+		http.Error(w, "Invalid test requested", http.StatusBadRequest)
+		return
+	}
+	request, err := protocol.ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid parameters received", http.StatusBadRequest)
+		return
+	}
+	params := request.Accept(s.settings.Load().limits)
+
+	ip, _ := requestIP(r)
+	if ip.IsValid() {
+		if rf := s.limiter.start(ip, cmd); rf != nil {
+			s.metrics.testsRejected.WithLabelValues(rf.reason).Inc()
+			s.logger.Info("test rejected", "addr", r.RemoteAddr, "cmd", cmd, "reason", rf.reason, "retry_after", rf.retryAfter.Round(time.Second))
+			retryAfter(w, rf.retryAfter)
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	release, err := s.queue.acquire(func(position int) error {
+		s.logger.Debug("test queued", "addr", r.RemoteAddr, "cmd", cmd, "position", position)
+		if err := enc.Encode(protocol.TestStatus{Queue: position}); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && ip.IsValid() {
+		s.limiter.cancel(ip)
+	}
+	if errors.Is(err, errQueueFull) {
+		s.metrics.testsRejected.WithLabelValues("busy").Inc()
+		s.logger.Info("test rejected", "addr", r.RemoteAddr, "cmd", cmd, "reason", "busy")
+		retryAfter(w, params.Duration+protocol.RecvGrace)
+		http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		s.logger.Debug("queued client went away", "addr", r.RemoteAddr, "err", err)
+		return
+	}
+
+	token := s.httpTests.reserve(cmd, params, release)
+	enc.Encode(protocol.TestStatus{Test: token, Params: params.String()})
+}
+
+func (s *Server) handleHTTPDownload(w http.ResponseWriter, r *http.Request) {
+	t, ip, ok := s.claimHTTPTest(w, r, "SND")
+	if !ok {
+		return
+	}
+	defer s.httpTests.finish(t)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	start := time.Now()
+	timer := time.NewTimer(t.params.Duration)
+	defer timer.Stop()
+
+	var totalBytes int64
+	for offset := 0; ; offset = (offset + httpChunkSize) % len(s.randBuf) {
+		select {
+		case <-timer.C:
+			s.recordThroughput(s.logger, r.RemoteAddr, ip, "SND", totalBytes, time.Since(start))
+			return
+		default:
+		}
+		n, err := w.Write(s.randBuf[offset : offset+httpChunkSize])
+		totalBytes += int64(n)
+		if err != nil {
+			s.recordThroughput(s.logger, r.RemoteAddr, ip, "SND", totalBytes, time.Since(start))
+			return
+		}
+	}
+}
+
+// handleHTTPUpload reads the request body until the client ends it or
+// the test runs out of time, and answers with a protocol.UploadReport.
+func (s *Server) handleHTTPUpload(w http.ResponseWriter, r *http.Request) {
+	t, ip, ok := s.claimHTTPTest(w, r, "RCV")
+	if !ok {
+		return
+	}
+	defer s.httpTests.finish(t)
+
+	start := time.Now()
+	// Grace period lets the client finish its last block
+	http.NewResponseController(w).SetReadDeadline(start.Add(t.params.Duration + protocol.RecvGrace))
+	counter := &receiveCounter{start: start}
+	if _, err := io.Copy(counter, r.Body); err != nil {
+		// Most likely the deadline, if the client kept sending.
+		s.logger.Debug("HTTP upload", "addr", r.RemoteAddr, "err", err)
+	}
+	s.recordThroughput(s.logger, r.RemoteAddr, ip, "RCV", counter.bytes.Load(), time.Since(start))
+
+	bytes, elapsed := counter.totals()
+	writeJSON(w, protocol.UploadReport{Bytes: bytes, ElapsedMs: elapsed.Milliseconds()})
+}
+
+// claimHTTPTest claims a stream of the reserved test named in the
+// request, or answers with an error and returns false. The caller must
+// hand the test back to s.httpTests.finish.
+func (s *Server) claimHTTPTest(w http.ResponseWriter, r *http.Request, cmd string) (t *httpTest, ip netip.Addr, ok bool) {
+	t, ok = s.httpTests.claim(r.URL.Query().Get("test"), cmd)
+	if !ok {
+		s.metrics.testsRejected.WithLabelValues("unknown_join").Inc()
+		s.logger.Info("test rejected", "addr", r.RemoteAddr, "cmd", cmd, "reason", "unknown test")
+		http.Error(w, "Unknown test", http.StatusNotFound)
+		return nil, ip, false
+	}
+	ip, _ = requestIP(r)
+	family := "unknown"
+	if ip.IsValid() {
+		family = addrFamily(ip)
+	}
+	s.logger.Info("test", "addr", r.RemoteAddr, "family", family, "cmd", cmd, "transport", "http")
+	s.metrics.tests.WithLabelValues(cmd).Inc()
+	return t, ip, true
+}
+
+// requestIP returns the IP address a request came from.
+func requestIP(r *http.Request) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// retryAfter sets the Retry-After header to d, rounded up to whole seconds.
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpChallenges tracks the authentication challenges issued over HTTP.
+// Each may be redeemed once, within httpChallengeTimeout.
+type httpChallenges struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time // by challenge
+}
+
+func newHTTPChallenges() *httpChallenges {
+	return &httpChallenges{timeout: httpChallengeTimeout, expires: make(map[string]time.Time)}
+}
+
+// issue returns a new challenge. It reports false if maxHTTPChallenges
+// are outstanding.
+func (h *httpChallenges) issue() (string, bool) {
+	b := make([]byte, protocol.ChallengeLen)
+	rand.Read(b)
+	challenge := hex.EncodeToString(b)
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.expires) >= maxHTTPChallenges {
+		for c, exp := range h.expires {
+			if now.After(exp) {
+				delete(h.expires, c)
+			}
+		}
+		if len(h.expires) >= maxHTTPChallenges {
+			return "", false
+		}
+	}
+	h.expires[challenge] = now.Add(h.timeout)
+	return challenge, true
+}
+
+// redeem reports whether challenge was issued and has neither expired
+// nor been redeemed before.
+func (h *httpChallenges) redeem(challenge string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	exp, ok := h.expires[challenge]
+	delete(h.expires, challenge)
+	return ok && time.Now().Before(exp)
+}
+
+// httpTests tracks the download and upload tests reserved over HTTP. A
+// reserved test holds a queue slot until each of its streams has been
+// claimed and has finished, or until claimTimeout passes without the
+// rest being claimed and the claimed ones have finished.
+type httpTests struct {
+	claimTimeout time.Duration
+
+	mu    sync.Mutex
+	tests map[string]*httpTest // by token, until fully claimed or expired
+}
+
+// httpTest is a reserved test. Its counts are guarded by httpTests.mu.
+type httpTest struct {
+	cmd       string
+	params    protocol.Params
+	unclaimed int    // streams that may still be claimed
+	running   int    // streams claimed and not yet finished
+	release   func() // frees the queue slot; nil once called
+	expire    *time.Timer
+}
+
+func newHTTPTests() *httpTests {
+	return &httpTests{claimTimeout: httpClaimTimeout, tests: make(map[string]*httpTest)}
+}
+
+// reserve registers a test of params.Streams streams running cmd, which
+// holds the slot that release frees. It returns the token that claims
+// the streams.
+func (h *httpTests) reserve(cmd string, params protocol.Params, release func()) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	t := &httpTest{cmd: cmd, params: params, unclaimed: params.Streams, release: release}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tests[token] = t
+	t.expire = time.AfterFunc(h.claimTimeout, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.tests[token] == t {
+			delete(h.tests, token)
+			t.unclaimed = 0
+			t.releaseIfDone()
+		}
+	})
+	return token
+}
+
+// claim claims a stream of the test named by token. It reports false if
+// there is no such test, it runs a different command, or all its streams
+// have been claimed. Each stream returned must be passed to finish.
+func (h *httpTests) claim(token, cmd string) (*httpTest, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tests[token]
+	if !ok || t.cmd != cmd {
+		return nil, false
+	}
+	t.unclaimed--
+	t.running++
+	if t.unclaimed == 0 {
+		delete(h.tests, token)
+		t.expire.Stop()
+	}
+	return t, true
+}
+
+// finish records the end of a stream returned by claim.
+func (h *httpTests) finish(t *httpTest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t.running--
+	t.releaseIfDone()
+}
+
+// releaseIfDone frees the test's slot once no stream is running or can
+// still be claimed. The caller must hold httpTests.mu.
+func (t *httpTest) releaseIfDone() {
+	if t.running == 0 && t.unclaimed == 0 && t.release != nil {
+		t.release()
+		t.release = nil
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// httpTestServer serves s's HTTP transport for the length of the test.
+func httpTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	s.randBuf = make([]byte, randBufSize)
+	ts := httptest.NewServer(s.httpHandler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// reserve reserves a test and returns the last status line of the
+// server's answer.
+func reserve(t *testing.T, ts *httptest.Server, query string) (protocol.TestStatus, *http.Response) {
+	t.Helper()
+	resp, err := http.Post(ts.URL+protocol.HTTPTestsPath+"?"+query, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status protocol.TestStatus
+	if resp.StatusCode != http.StatusOK {
+		return status, resp
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &status); err != nil {
+			t.Fatalf("status line %q: %v", scanner.Text(), err)
+		}
+	}
+	return status, resp
+}
+
+func TestHTTP_Hello(t *testing.T) {
+	s := testServer()
+	s.cfg.Version = "1.2.3"
+	s.settings.Store(&settings{cname: "speedtest.example.com", limits: protocol.Params{Duration: 20 * time.Second, Pings: 50, Streams: 4}})
+	ts := httpTestServer(t, s)
+
+	resp, err := http.Get(ts.URL + protocol.HTTPHelloPath + "?duration=60&streams=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var hello protocol.Hello
+	if err := json.NewDecoder(resp.Body).Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+	want := protocol.Hello{
+		Cname:   "speedtest.example.com",
+		Version: "1.2.3",
+		Params:  "duration=20 pings=30 streams=2",
+		Limits:  "duration=20 pings=50 streams=4",
+	}
+	if hello != want {
+		t.Errorf("hello = %+v, want %+v", hello, want)
+	}
+}
+
+func TestHTTP_DownloadAndUpload(t *testing.T) {
+	s := testServer()
+	s.queue = newTestQueue(1, 0)
+	ts := httpTestServer(t, s)
+
+	status, resp := reserve(t, ts, "test=download&duration=1&streams=2")
+	if resp.StatusCode != http.StatusOK || status.Test == "" || status.Params != "duration=1 pings=30 streams=2" {
+		t.Fatalf("reserve: %s %+v", resp.Status, status)
+	}
+	if running, _ := s.queue.stats(); running != 1 {
+		t.Errorf("%d tests running after reservation, want 1", running)
+	}
+
+	// Both streams may claim the test, and no more.
+	done := make(chan int64, 2)
+	for range 2 {
+		resp, err := http.Get(ts.URL + protocol.HTTPDownloadPath + "?test=" + status.Test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download: %s", resp.Status)
+		}
+		go func() {
+			defer resp.Body.Close()
+			n, _ := io.Copy(io.Discard, resp.Body)
+			done <- n
+		}()
+	}
+	resp, err := http.Get(ts.URL + protocol.HTTPDownloadPath + "?test=" + status.Test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("third stream: %s, want 404", resp.Status)
+	}
+	for range 2 {
+		if n := <-done; n == 0 {
+			t.Error("a download stream received nothing")
+		}
+	}
+
+	// The slot is free again once the streams are done.
+	status, resp = reserve(t, ts, "test=upload&duration=1")
+	if resp.StatusCode != http.StatusOK || status.Test == "" {
+		t.Fatalf("reserve upload: %s %+v", resp.Status, status)
+	}
+	// An upload token doesn't start a download.
+	resp, err = http.Get(ts.URL + protocol.HTTPDownloadPath + "?test=" + status.Test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download with upload token: %s, want 404", resp.Status)
+	}
+
+	resp, err = http.Post(ts.URL+protocol.HTTPUploadPath+"?test="+status.Test, "application/octet-stream", strings.NewReader(strings.Repeat("x", 100_000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report protocol.UploadReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Bytes != 100_000 {
+		t.Errorf("upload report %+v, want 100000 bytes", report)
+	}
+	// The handler finishes the test just after answering.
+	for i := 0; ; i++ {
+		if running, _ := s.queue.stats(); running == 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("%d tests running after upload, want 0", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTP_Busy(t *testing.T) {
+	s := testServer()
+	s.queue = newTestQueue(1, 0)
+	ts := httpTestServer(t, s)
+
+	if status, resp := reserve(t, ts, "test=download&duration=5"); status.Test == "" {
+		t.Fatalf("first reservation: %s", resp.Status)
+	}
+	_, resp := reserve(t, ts, "test=upload&duration=5")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("second reservation: %s, Retry-After %q; want 503 after 7s", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestHTTPTests_Expire(t *testing.T) {
+	h := newHTTPTests()
+	h.claimTimeout = 50 * time.Millisecond
+	released := make(chan struct{})
+	token := h.reserve("SND", protocol.Params{Streams: 2}, func() { close(released) })
+
+	st, ok := h.claim(token, "SND")
+	if !ok {
+		t.Fatal("claim failed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := h.claim(token, "SND"); ok {
+		t.Error("claimed a stream after the reservation expired")
+	}
+	select {
+	case <-released:
+		t.Fatal("slot released while a stream was running")
+	default:
+	}
+	h.finish(st)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("slot not released")
+	}
+}
+
+func TestHTTPChallenges(t *testing.T) {
+	h := newHTTPChallenges()
+	h.timeout = 50 * time.Millisecond
+
+	c, ok := h.issue()
+	if !ok || !h.redeem(c) {
+		t.Fatal("fresh challenge not redeemed")
+	}
+	if h.redeem(c) {
+		t.Error("challenge redeemed twice")
+	}
+	c, _ = h.issue()
+	time.Sleep(100 * time.Millisecond)
+	if h.redeem(c) {
+		t.Error("expired challenge redeemed")
+	}
+
+	// Once full, expired challenges make way for new ones.
+	for range maxHTTPChallenges {
+		h.issue()
+	}
+	if _, ok := h.issue(); ok {
+		t.Error("issued more than maxHTTPChallenges")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := h.issue(); !ok {
+		t.Error("expired challenges not pruned")
+	}
+}
+
+func TestHTTP_Auth(t *testing.T) {
+	s := testServer()
+	s.settings.Store(&settings{auth: tokens{"alice": "t0k3n", protocol.SharedUser: "sh4red"}})
+	ts := httpTestServer(t, s)
+
+	challenge := func(t *testing.T) string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + protocol.HTTPChallengePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var ch protocol.Challenge
+		if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil || len(ch.Challenge) != 2*protocol.ChallengeLen {
+			t.Fatalf("challenge: %+v, %v", ch, err)
+		}
+		return ch.Challenge
+	}
+	ping := func(t *testing.T, authorization string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+protocol.HTTPPingPath, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		name        string
+		user, token string
+		want        int
+	}{
+		{"user", "alice", "t0k3n", http.StatusNoContent},
+		{"shared secret", protocol.SharedUser, "sh4red", http.StatusNoContent},
+		{"wrong token", "alice", "sh4red", http.StatusUnauthorized},
+		{"unknown user", "bob", "t0k3n", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := ping(t, protocol.HTTPAuthorization(tt.token, tt.user, challenge(t)))
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %s, want %d", resp.Status, tt.want)
+			}
+		})
+	}
+
+	t.Run("challenge reused", func(t *testing.T) {
+		auth := protocol.HTTPAuthorization("t0k3n", "alice", challenge(t))
+		ping(t, auth)
+		if resp := ping(t, auth); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status %s, want 401", resp.Status)
+		}
+	})
+	t.Run("challenge not issued", func(t *testing.T) {
+		auth := protocol.HTTPAuthorization("t0k3n", "alice", "00112233445566778899aabbccddeeff")
+		if resp := ping(t, auth); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status %s, want 401", resp.Status)
+		}
+	})
+	t.Run("none", func(t *testing.T) {
+		resp := ping(t, "")
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != protocol.HTTPAuthScheme {
+			t.Errorf("status %s, WWW-Authenticate %q; want 401 asking for %s", resp.Status, resp.Header.Values("WWW-Authenticate"), protocol.HTTPAuthScheme)
+		}
+	})
+	t.Run("basic without TLS", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+protocol.HTTPPingPath, nil)
+		req.SetBasicAuth("alice", "t0k3n")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status %s, want 401", resp.Status)
+		}
+	})
+}
+
+// TestHTTP_BasicAuthTLS checks that browsers, which can only send the
+// token itself, may do so over TLS.
+func TestHTTP_BasicAuthTLS(t *testing.T) {
+	s := testServer()
+	s.settings.Store(&settings{auth: tokens{"alice": "t0k3n", protocol.SharedUser: "sh4red"}})
+	ts := httptest.NewTLSServer(s.httpHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		user, token string
+		want        int
+	}{
+		{"user", "alice", "t0k3n", http.StatusNoContent},
+		{"shared secret", "", "sh4red", http.StatusNoContent},
+		{"wrong token", "alice", "sh4red", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+protocol.HTTPPingPath, nil)
+			req.SetBasicAuth(tt.user, tt.token)
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %s, want %d", resp.Status, tt.want)
+			}
+		})
+	}
+}
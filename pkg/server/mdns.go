@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chrissnell/sparkyfish/pkg/discovery"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// advertise announces the server on the local network with DNS-SD until
+// ctx is cancelled. Failing to advertise is logged, not fatal: the server
+// still works for clients that know its address.
+func (s *Server) advertise(ctx context.Context) {
+	svc, err := s.service()
+	if err != nil {
+		s.logger.Error("mDNS advertisement disabled", "err", err)
+		return
+	}
+	go func() {
+		if err := discovery.NewResponder(svc).ListenAndServe(ctx); err != nil {
+			s.logger.Error("mDNS advertisement", "err", err)
+		}
+	}()
+	s.logger.Info("advertising over mDNS", "instance", svc.Instance, "service", discovery.ServiceType, "addrs", svc.Addrs)
+}
+
+// service describes the server for DNS-SD, as of startup.
+func (s *Server) service() (discovery.Service, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return discovery.Service{}, err
+	}
+	host, _, _ := strings.Cut(hostname, ".")
+	local, err := discovery.LocalAddrs()
+	if err != nil {
+		return discovery.Service{}, err
+	}
+	_, portStr, _ := net.SplitHostPort(s.cfg.ListenAddrs[0])
+	port, _ := strconv.Atoi(portStr)
+
+	st := s.settings.Load()
+	instance := st.cname
+	if instance == "" {
+		instance = host
+	}
+	return discovery.Service{
+		Instance: instance,
+		Host:     host,
+		Port:     port,
+		Addrs:    advertisedAddrs(s.cfg.ListenAddrs, local),
+		Cname:    st.cname,
+		Location: st.location,
+		Version:  s.cfg.Version,
+		Protocol: protocol.Version,
+		Capacity: s.cfg.MaxTests,
+		TLS:      s.tls != nil,
+		Auth:     st.auth != nil,
+	}, nil
+}
+
+// advertisedAddrs returns the addresses clients can reach the listeners
+// at: each literal listen address, or the host's local addresses for a
+// wildcard or host name, of the wildcard's family only.
+func advertisedAddrs(listen, local []string) []string {
+	var addrs []string
+	add := func(addr string) {
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, l := range listen {
+		host, _, _ := net.SplitHostPort(l)
+		ip, err := netip.ParseAddr(host)
+		if err == nil && !ip.IsUnspecified() {
+			add(ip.String())
+			continue
+		}
+		for _, addr := range local {
+			if err == nil && familyOf(addr) != addrFamily(ip) {
+				continue
+			}
+			add(addr)
+		}
+	}
+	return addrs
+}
+
+// familyOf returns the address family of addr, as addrFamily does.
+func familyOf(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ""
+	}
+	return addrFamily(ip)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors updated by the server. They are
+// always maintained; Config.MetricsAddr only controls whether they are
+// exposed over HTTP.
+type metrics struct {
+	registry *prometheus.Registry
+
+	connsAccepted     *prometheus.CounterVec
+	activeConns       prometheus.Gauge
+	connsDenied       prometheus.Counter
+	handshakeFailures *prometheus.CounterVec
+	tests             *prometheus.CounterVec
+	bytesSent         prometheus.Counter
+	bytesReceived     prometheus.Counter
+	testsRejected     *prometheus.CounterVec
+	testDuration      *prometheus.HistogramVec
+	testThroughput    *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sparkyfish_connections_accepted_total",
+			Help: "TCP connections accepted, by address family (ipv4 or ipv6).",
+		}, []string{"family"}),
+		activeConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sparkyfish_active_connections",
+			Help: "Client connections currently open.",
+		}),
+		connsDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sparkyfish_connections_denied_total",
+			Help: "Connections refused by the allow and deny lists.",
+		}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sparkyfish_handshake_failures_total",
+			Help: "TLS, HELO, and authentication handshakes that failed, by reason.",
+		}, []string{"reason"}),
+		tests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sparkyfish_tests_total",
+			Help: "Tests run, by protocol command.",
+		}, []string{"command"}),
+		testsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sparkyfish_tests_rejected_total",
+			Help: "Tests refused before starting, by reason.",
+		}, []string{"reason"}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sparkyfish_bytes_sent_total",
+			Help: "Bytes sent to clients during download tests.",
+		}),
+		bytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sparkyfish_bytes_received_total",
+			Help: "Bytes received from clients during upload and UDP tests.",
+		}),
+		testDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sparkyfish_test_duration_seconds",
+			Help:    "Wall-clock duration of each test, by protocol command.",
+			Buckets: []float64{0.5, 1, 2, 5, 10, 12, 15, 20, 30, 60},
+		}, []string{"command"}),
+		testThroughput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sparkyfish_test_throughput_mbps",
+			Help:    "Average throughput of each throughput test in Mbit/s, by protocol command.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16), // 1 Mbit/s .. ~32 Gbit/s
+		}, []string{"command"}),
+	}
+
+	m.registry.MustRegister(
+		m.connsAccepted,
+		m.activeConns,
+		m.connsDenied,
+		m.handshakeFailures,
+		m.tests,
+		m.testsRejected,
+		m.bytesSent,
+		m.bytesReceived,
+		m.testDuration,
+		m.testThroughput,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// watchQueue exposes the running and waiting counts of q as gauges.
+func (m *metrics) watchQueue(q *testQueue) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sparkyfish_throughput_tests_running",
+			Help: "SND/RCV tests currently holding a test slot.",
+		}, func() float64 {
+			running, _ := q.stats()
+			return float64(running)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sparkyfish_throughput_tests_queued",
+			Help: "SND/RCV tests waiting for a test slot.",
+		}, func() float64 {
+			_, queued := q.stats()
+			return float64(queued)
+		}),
+	)
+}
+
+// handshakeFailed records a failed handshake, classifying err into a
+// low-cardinality reason label.
+func (m *metrics) handshakeFailed(err error) {
+	reason := "read"
+	switch {
+	case errors.Is(err, errInvalidHelo):
+		reason = "invalid_helo"
+	case errors.Is(err, errInvalidParams):
+		reason = "invalid_params"
+	case errors.Is(err, errTLSHandshake):
+		reason = "tls"
+	case errors.Is(err, errAuthRequired):
+		reason = "auth_required"
+	case errors.Is(err, errAuthFailed):
+		reason = "auth_failed"
+	}
+	m.handshakeFailures.WithLabelValues(reason).Inc()
+}
+
+// testFinished records the duration of a test. For throughput tests,
+// totalBytes is added to the byte counters and the throughput histogram.
+func (m *metrics) testFinished(cmd string, totalBytes int64, dur time.Duration) {
+	m.testDuration.WithLabelValues(cmd).Observe(dur.Seconds())
+
+	switch cmd {
+	case "SND":
+		m.bytesSent.Add(float64(totalBytes))
+	case "RCV", "UDP":
+		m.bytesReceived.Add(float64(totalBytes))
+	default:
+		return
+	}
+	if secs := dur.Seconds(); secs > 0 {
+		m.testThroughput.WithLabelValues(cmd).Observe(float64(totalBytes) * 8 / secs / 1_000_000)
+	}
+}
+
+// serveMetrics exposes the registry at /metrics on addr until ctx is
+// cancelled. The listener is bound before returning so that a bad address
+// is reported at startup.
+func (s *Server) serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen metrics %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("metrics server", "err", err)
+		}
+	}()
+
+	s.logger.Info("serving metrics", "addr", addr)
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func testServer() *Server {
+	s := &Server{
+		logger:    testLogger(),
+		metrics:   newMetrics(),
+		queue:     newTestQueue(0, 0),
+		streams:   newStreamGroups(),
+		httpTests: newHTTPTests(),
+		httpAuth:  newHTTPChallenges(),
+		udp:       newUDPTests(),
+		limiter:   newRateLimiter(RateLimit{}),
+	}
+	s.settings.Store(&settings{})
+	return s
+}
+
+// serve runs handleConn on the server end of a pipe and returns the client
+// end plus a channel closed when handleConn returns.
+func serve(s *Server) (net.Conn, <-chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(server, true)
+		close(done)
+	}()
+	return client, done
+}
+
+func TestMetrics_HandshakeFailureReasons(t *testing.T) {
+	tests := []struct {
+		helo   string
+		reason string
+	}{
+		{"XELO0", "invalid_helo"},
+		{"HELOx", "invalid_helo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.helo, func(t *testing.T) {
+			s := testServer()
+			client, done := serve(s)
+			defer client.Close()
+
+			client.Write([]byte(tt.helo + "\r\n"))
+			bufio.NewReader(client).ReadString('\n') // ERR line
+			<-done
+
+			got := testutil.ToFloat64(s.metrics.handshakeFailures.WithLabelValues(tt.reason))
+			if got != 1 {
+				t.Errorf("handshake failures{reason=%q} = %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestMetrics_EchoTest(t *testing.T) {
+	s := testServer()
+	client, done := serve(s)
+
+	reader := bufio.NewReader(client)
+	client.Write([]byte("HELO0\r\n"))
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	if got := testutil.ToFloat64(s.metrics.activeConns); got != 1 {
+		t.Errorf("active connections during test = %v, want 1", got)
+	}
+
+	client.Write([]byte("ECO\r\n"))
+	for i := 0; i < protocol.DefaultPings; i++ {
+		client.Write([]byte{'0'})
+		if _, err := reader.ReadByte(); err != nil {
+			t.Fatalf("echo read %d: %v", i, err)
+		}
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConn did not return after client closed")
+	}
+
+	if got := testutil.ToFloat64(s.metrics.tests.WithLabelValues("ECO")); got != 1 {
+		t.Errorf("tests{command=ECO} = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(s.metrics.testDuration); got != 1 {
+		t.Errorf("test duration series = %d, want 1", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.activeConns); got != 0 {
+		t.Errorf("active connections after close = %v, want 0", got)
+	}
+}
+
+func TestMetrics_ThroughputFinished(t *testing.T) {
+	m := newMetrics()
+	m.testFinished("SND", 125_000_000, 10*time.Second) // 100 Mbit/s
+	m.testFinished("RCV", 2_000, time.Second)
+
+	if got := testutil.ToFloat64(m.bytesSent); got != 125_000_000 {
+		t.Errorf("bytes sent = %v", got)
+	}
+	if got := testutil.ToFloat64(m.bytesReceived); got != 2_000 {
+		t.Errorf("bytes received = %v", got)
+	}
+	if got := testutil.CollectAndCount(m.testThroughput); got != 2 {
+		t.Errorf("throughput series = %d, want 2", got)
+	}
+}
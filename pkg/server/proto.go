@@ -2,20 +2,44 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
-const protocolVersion = 0
+// protocolVersion is the highest version this server speaks. Version 1
+// negotiates test parameters during HELO and adds status lines (QUEUE,
+// GO, ERR) before throughput tests. Version 2 adds receive reports
+// (RCVD, DONE) during upload tests. Version 3 adds authentication at the
+// end of HELO. Version 4 adds the UDP test.
+const protocolVersion = protocol.Version
+
+// noUDPVersion is the highest version spoken on listeners whose UDP port
+// couldn't be bound: the one before the UDP test.
+const noUDPVersion = 3
+
+var (
+	errInvalidHelo   = errors.New("invalid HELO")
+	errInvalidParams = errors.New("invalid parameters")
+)
 
 // conn represents a single client connection and its buffered reader.
 type conn struct {
-	rwc    net.Conn
-	reader *bufio.Reader
-	logger *slog.Logger
+	rwc     net.Conn
+	reader  *bufio.Reader
+	logger  *slog.Logger
+	version uint16             // protocol version agreed in the HELO
+	maxVer  uint16             // highest version to agree to; 0 for protocolVersion
+	params  protocol.Params    // test parameters in effect for this connection
+	user    string             // authenticated user, or protocol.SharedUser; empty if the server is open
+	ip      netip.Addr         // client address; invalid if unknown, which exempts it from rate limits
+	udp     protocol.UDPParams // parameters of the last UDP command
 }
 
 func newConn(rwc net.Conn, logger *slog.Logger) *conn {
@@ -23,11 +47,19 @@ func newConn(rwc net.Conn, logger *slog.Logger) *conn {
 		rwc:    rwc,
 		reader: bufio.NewReader(rwc),
 		logger: logger,
+		params: protocol.DefaultParams(),
 	}
 }
 
-// handshake reads the client HELO, validates it, and sends the server response.
-func (c *conn) handshake(cname, location string) error {
+// handshake reads the client HELO, validates it, and sends the server
+// response. Clients asking for a newer version than the server speaks,
+// or than the connection's maxVer, are answered with that version
+// instead. For version 1 clients it also reads the requested test
+// parameters and answers with the accepted values and the server's
+// limits, tagged with the software version if it is set. Version 3
+// clients then authenticate if auth is not nil; older clients are
+// turned away.
+func (c *conn) handshake(cname, location, software string, limits protocol.Params, auth tokens) error {
 	helo, err := c.reader.ReadString('\n')
 	if err != nil {
 		return fmt.Errorf("read HELO: %w", err)
@@ -36,18 +68,50 @@ func (c *conn) handshake(cname, location string) error {
 
 	if len(helo) != 5 || helo[:4] != "HELO" {
 		fmt.Fprintf(c.rwc, "ERR:Invalid HELO received\n")
-		return fmt.Errorf("invalid HELO: %q", helo)
+		return fmt.Errorf("%w: %q", errInvalidHelo, helo)
 	}
 
 	version, err := strconv.ParseUint(helo[4:], 10, 16)
 	if err != nil {
 		fmt.Fprintf(c.rwc, "ERR:Invalid HELO received\n")
-		return fmt.Errorf("parse version: %w", err)
+		return fmt.Errorf("%w: parse version: %v", errInvalidHelo, err)
+	}
+
+	// Clients newer than the server are told which version it speaks and
+	// continue at that version, rather than reconnecting to find out.
+	c.version = min(uint16(version), protocolVersion)
+	if c.maxVer > 0 {
+		c.version = min(c.version, c.maxVer)
 	}
 
-	if uint16(version) > protocolVersion {
-		fmt.Fprintf(c.rwc, "ERR:Protocol version not supported\n")
-		return fmt.Errorf("unsupported version: %d", version)
+	if auth != nil && c.version < 3 {
+		fmt.Fprintf(c.rwc, "ERR:Authentication required\n")
+		return fmt.Errorf("%w: client speaks version %d", errAuthRequired, version)
+	}
+
+	// Version 0 clients always run the default tests; they would break if
+	// the server echoed fewer pings than they send.
+	c.params = protocol.DefaultParams()
+	if c.version >= 1 {
+		// Accept the version before reading the request, so clients know
+		// whether to send one.
+		accept := "HELO"
+		if c.version < uint16(version) {
+			accept = fmt.Sprintf("HELO %d", c.version)
+		}
+		if _, err := fmt.Fprintf(c.rwc, "%s\n", accept); err != nil {
+			return err
+		}
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("read parameters: %w", err)
+		}
+		request, err := protocol.ParseParams(line)
+		if err != nil {
+			fmt.Fprintf(c.rwc, "ERR:Invalid parameters received\n")
+			return fmt.Errorf("%w: %v", errInvalidParams, err)
+		}
+		c.params = request.Accept(limits)
 	}
 
 	cn := cname
@@ -59,11 +123,22 @@ func (c *conn) handshake(cname, location string) error {
 		loc = "none"
 	}
 
+	if c.version >= 1 {
+		if _, err := fmt.Fprintf(c.rwc, "%s\n%s\n%s\n%s\n", cn, loc, c.params, protocol.LimitsLine(limits, software)); err != nil {
+			return err
+		}
+		if c.version >= 3 {
+			return c.authenticate(auth)
+		}
+		return nil
+	}
 	_, err = fmt.Fprintf(c.rwc, "HELO\n%s\n%s\n", cn, loc)
 	return err
 }
 
-// readCommand reads and validates the next protocol command (ECO, SND, or RCV).
+// readCommand reads and validates the next protocol command: ECO, SND,
+// RCV, or, from version 4 clients, UDP followed by its parameters, which
+// are stored in c.udp.
 func (c *conn) readCommand() (string, error) {
 	cmd, err := c.reader.ReadString('\n')
 	if err != nil {
@@ -71,6 +146,16 @@ func (c *conn) readCommand() (string, error) {
 	}
 	cmd = strings.TrimSpace(cmd)
 
+	if params, ok := strings.CutPrefix(cmd, "UDP "); ok && c.version >= 4 {
+		p, err := protocol.ParseUDPParams(params)
+		if err != nil {
+			fmt.Fprintf(c.rwc, "ERR:Invalid UDP parameters received\n")
+			return "", fmt.Errorf("%w: %v", errInvalidParams, err)
+		}
+		c.udp = p
+		return "UDP", nil
+	}
+
 	if len(cmd) != 3 {
 		fmt.Fprintf(c.rwc, "ERR:Invalid command received\n")
 		return "", fmt.Errorf("invalid command: %q", cmd)
@@ -3,11 +3,15 @@ package server
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
 func testLogger() *slog.Logger {
@@ -33,7 +37,7 @@ func TestHandshake_Valid(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("test.example.com", "Seattle, WA")
+		errCh <- c.handshake("test.example.com", "Seattle, WA", "", DefaultLimits(), nil)
 	}()
 
 	// Client sends HELO
@@ -69,7 +73,7 @@ func TestHandshake_EmptyCnameLocation(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("", "")
+		errCh <- c.handshake("", "", "", DefaultLimits(), nil)
 	}()
 
 	client.Write([]byte("HELO0\r\n"))
@@ -98,7 +102,7 @@ func TestHandshake_InvalidLength(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("host", "loc")
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
 	}()
 
 	client.Write([]byte("HEL\r\n"))
@@ -122,7 +126,7 @@ func TestHandshake_InvalidPrefix(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("host", "loc")
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
 	}()
 
 	client.Write([]byte("XELO0\r\n"))
@@ -139,27 +143,34 @@ func TestHandshake_InvalidPrefix(t *testing.T) {
 	}
 }
 
-func TestHandshake_UnsupportedVersion(t *testing.T) {
+func TestHandshake_NewerClient(t *testing.T) {
 	c, client := pipeConn()
 	defer c.rwc.Close()
 	defer client.Close()
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("host", "loc")
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
 	}()
 
-	client.Write([]byte("HELO9\r\n"))
+	go client.Write([]byte("HELO9\r\n"))
 
 	reader := bufio.NewReader(client)
 	resp, _ := reader.ReadString('\n')
-
-	if !strings.Contains(resp, "ERR:Protocol version not supported") {
-		t.Errorf("expected version ERR, got %q", resp)
+	if want := fmt.Sprintf("HELO %d\n", protocolVersion); resp != want {
+		t.Fatalf("expected %q, got %q", want, resp)
 	}
 
-	if err := <-errCh; err == nil {
-		t.Error("expected error for unsupported version")
+	// The session continues at the server's version.
+	go client.Write([]byte("\r\n"))
+	for range 5 {
+		reader.ReadString('\n') // cname, location, params, limits, OPEN
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	if c.version != protocolVersion {
+		t.Errorf("conn version = %d, want %d", c.version, protocolVersion)
 	}
 }
 
@@ -169,7 +180,7 @@ func TestHandshake_ClientHangup(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- c.handshake("host", "loc")
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
 	}()
 
 	// Close client immediately — simulates hangup
@@ -180,6 +191,118 @@ func TestHandshake_ClientHangup(t *testing.T) {
 	}
 }
 
+func TestHandshake_V1Negotiation(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      string
+		wantAccepted string
+		wantParams   protocol.Params
+	}{
+		{"defaults", "", "duration=10 pings=30 streams=1", protocol.DefaultParams()},
+		{"within limits", "duration=20 pings=10 streams=4", "duration=20 pings=10 streams=4",
+			protocol.Params{Duration: 20 * time.Second, Pings: 10, Streams: 4}},
+		{"clamped", "duration=600 pings=5000 streams=64", "duration=30 pings=100 streams=8", DefaultLimits()},
+		{"unknown keys ignored", "pings=5 future=1", "duration=10 pings=5 streams=1",
+			protocol.Params{Duration: 10 * time.Second, Pings: 5, Streams: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := pipeConn()
+			defer c.rwc.Close()
+			defer client.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- c.handshake("host", "loc", "1.4.0", DefaultLimits(), nil)
+			}()
+
+			go client.Write([]byte("HELO1\r\n"))
+
+			reader := bufio.NewReader(client)
+			line, _ := reader.ReadString('\n')
+			lines := []string{strings.TrimSpace(line)}
+			go client.Write([]byte(tt.request + "\r\n"))
+			for i := 1; i < 5; i++ {
+				line, _ := reader.ReadString('\n')
+				lines = append(lines, strings.TrimSpace(line))
+			}
+
+			if lines[0] != "HELO" || lines[1] != "host" || lines[2] != "loc" {
+				t.Errorf("unexpected HELO response: %q", lines[:3])
+			}
+			if lines[3] != tt.wantAccepted {
+				t.Errorf("accepted params = %q, want %q", lines[3], tt.wantAccepted)
+			}
+			if lines[4] != "duration=30 pings=100 streams=8 version=1.4.0" {
+				t.Errorf("limits = %q", lines[4])
+			}
+
+			if err := <-errCh; err != nil {
+				t.Fatalf("handshake returned error: %v", err)
+			}
+			if c.params != tt.wantParams {
+				t.Errorf("conn params = %+v, want %+v", c.params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestHandshake_V1InvalidParams(t *testing.T) {
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.handshake("host", "loc", "", DefaultLimits(), nil)
+	}()
+
+	go client.Write([]byte("HELO1\r\n"))
+
+	reader := bufio.NewReader(client)
+	if resp, _ := reader.ReadString('\n'); strings.TrimSpace(resp) != "HELO" {
+		t.Fatalf("expected HELO before parameters, got %q", resp)
+	}
+	go client.Write([]byte("pings=lots\r\n"))
+	resp, _ := reader.ReadString('\n')
+
+	if !strings.Contains(resp, "ERR:Invalid parameters received") {
+		t.Errorf("expected parameters ERR, got %q", resp)
+	}
+
+	if err := <-errCh; !errors.Is(err, errInvalidParams) {
+		t.Errorf("expected errInvalidParams, got %v", err)
+	}
+}
+
+func TestHandshake_V0IgnoresLimits(t *testing.T) {
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// Limits below the defaults must not shorten a version 0 test,
+		// which always sends the default number of pings.
+		errCh <- c.handshake("host", "loc", "", protocol.Params{Duration: 5 * time.Second, Pings: 10, Streams: 1}, nil)
+	}()
+
+	client.Write([]byte("HELO0\r\n"))
+
+	reader := bufio.NewReader(client)
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	if c.params != protocol.DefaultParams() {
+		t.Errorf("conn params = %+v, want defaults", c.params)
+	}
+}
+
 func TestReadCommand_Valid(t *testing.T) {
 	for _, cmd := range []string{"ECO", "SND", "RCV"} {
 		t.Run(cmd, func(t *testing.T) {
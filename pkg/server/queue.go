@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// errQueueFull is returned by testQueue.acquire when both the running
+// slots and the waiting line are full.
+var errQueueFull = errors.New("test queue full")
+
+// testQueue limits the number of throughput tests that run at once.
+// Tests beyond the limit wait in FIFO order and are told their position
+// as it changes.
+type testQueue struct {
+	mu       sync.Mutex
+	max      int // concurrent tests allowed; 0 means unlimited
+	maxQueue int // tests allowed to wait; 0 means none
+	active   int
+	waiting  []*waiter
+}
+
+type waiter struct {
+	ready   chan struct{} // closed when the waiter is granted a slot
+	changed chan struct{} // signalled when the waiter's position changes
+}
+
+func newTestQueue(max, maxQueue int) *testQueue {
+	return &testQueue{max: max, maxQueue: maxQueue}
+}
+
+// acquire blocks until a test slot is free. While waiting, notify is
+// called with the 1-based queue position each time it changes; if notify
+// returns an error the wait is abandoned and that error returned. The
+// returned release func must be called when the test finishes.
+func (q *testQueue) acquire(notify func(position int) error) (release func(), err error) {
+	q.mu.Lock()
+	if q.max <= 0 || (q.active < q.max && len(q.waiting) == 0) {
+		q.active++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	if len(q.waiting) >= q.maxQueue {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	w := &waiter{
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}, 1),
+	}
+	q.waiting = append(q.waiting, w)
+	w.changed <- struct{}{}
+	q.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ready:
+			return q.release, nil
+		case <-w.changed:
+			pos := q.position(w)
+			if pos == 0 {
+				continue // granted; ready is already closed
+			}
+			if err := notify(pos); err != nil {
+				q.abandon(w)
+				return nil, err
+			}
+		}
+	}
+}
+
+// release frees a slot, handing it directly to the first waiter if any
+// and the slot is still within the limit.
+func (q *testQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 || (q.max > 0 && q.active > q.max) {
+		q.active--
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+	q.notifyAll()
+}
+
+// resize changes the limits. If they grow, waiters are let in while slots
+// are free. If they shrink, running and waiting tests are left alone and
+// the limits take hold as tests finish.
+func (q *testQueue) resize(max, maxQueue int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.max, q.maxQueue = max, maxQueue
+	granted := false
+	for len(q.waiting) > 0 && (q.max <= 0 || q.active < q.max) {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		close(next.ready)
+		granted = true
+	}
+	if granted {
+		q.notifyAll()
+	}
+}
+
+// abandon removes w from the line. If w was granted a slot concurrently,
+// the slot is released.
+func (q *testQueue) abandon(w *waiter) {
+	q.mu.Lock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.notifyAll()
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.mu.Unlock()
+
+	// Not in line, so it was granted a slot before we got the lock.
+	<-w.ready
+	q.release()
+}
+
+// position returns w's 1-based position, or 0 if it is no longer waiting.
+func (q *testQueue) position(w *waiter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.waiting {
+		if other == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// stats returns the number of tests holding a slot and the number waiting.
+func (q *testQueue) stats() (running, queued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active, len(q.waiting)
+}
+
+// limit returns the number of tests allowed to run at once; 0 means
+// unlimited.
+func (q *testQueue) limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.max
+}
+
+// notifyAll signals every waiter that its position may have changed.
+// Caller must hold q.mu.
+func (q *testQueue) notifyAll() {
+	for _, w := range q.waiting {
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}
+}
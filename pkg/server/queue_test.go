@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestQueue_Unlimited(t *testing.T) {
+	q := newTestQueue(0, 0)
+	for i := 0; i < 5; i++ {
+		if _, err := q.acquire(nil); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+	if running, queued := q.stats(); running != 5 || queued != 0 {
+		t.Errorf("stats = (%d, %d), want (5, 0)", running, queued)
+	}
+}
+
+// queuedAcquire starts an acquire in the background and returns channels
+// carrying each reported position and the final acquire result.
+func queuedAcquire(q *testQueue) (<-chan int, <-chan error, <-chan func()) {
+	positions := make(chan int, 10)
+	errCh := make(chan error, 1)
+	releaseCh := make(chan func(), 1)
+	go func() {
+		release, err := q.acquire(func(pos int) error {
+			positions <- pos
+			return nil
+		})
+		errCh <- err
+		releaseCh <- release
+	}()
+	return positions, errCh, releaseCh
+}
+
+func expectPosition(t *testing.T, ch <-chan int, want int) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Errorf("position = %d, want %d", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for position %d", want)
+	}
+}
+
+func TestTestQueue_FIFO(t *testing.T) {
+	q := newTestQueue(1, 2)
+
+	release1, err := q.acquire(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos2, err2, rel2 := queuedAcquire(q)
+	expectPosition(t, pos2, 1)
+	pos3, err3, _ := queuedAcquire(q)
+	expectPosition(t, pos3, 2)
+
+	if _, err := q.acquire(nil); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+
+	// Finishing the first test hands its slot to the second and moves
+	// the third up the line.
+	release1()
+	if err := <-err2; err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+	expectPosition(t, pos3, 1)
+
+	(<-rel2)()
+	if err := <-err3; err != nil {
+		t.Fatalf("third acquire: %v", err)
+	}
+	if running, queued := q.stats(); running != 1 || queued != 0 {
+		t.Errorf("stats = (%d, %d), want (1, 0)", running, queued)
+	}
+}
+
+func TestTestQueue_Resize(t *testing.T) {
+	q := newTestQueue(1, 2)
+	release1, _ := q.acquire(nil)
+	pos2, err2, _ := queuedAcquire(q)
+	expectPosition(t, pos2, 1)
+
+	// Growing the limit lets the waiter in straight away.
+	q.resize(2, 2)
+	if err := <-err2; err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+
+	// Shrinking it leaves running tests alone, and a freed slot is not
+	// handed on while the queue is over the new limit.
+	q.resize(1, 2)
+	pos3, err3, _ := queuedAcquire(q)
+	expectPosition(t, pos3, 1)
+	release1()
+	if running, queued := q.stats(); running != 1 || queued != 1 {
+		t.Errorf("stats = (%d, %d), want (1, 1)", running, queued)
+	}
+	select {
+	case err := <-err3:
+		t.Fatalf("third acquire returned early: %v", err)
+	default:
+	}
+}
+
+func TestTestQueue_Abandon(t *testing.T) {
+	q := newTestQueue(1, 1)
+	release, _ := q.acquire(nil)
+
+	gone := errors.New("client went away")
+	_, err := q.acquire(func(int) error { return gone })
+	if !errors.Is(err, gone) {
+		t.Fatalf("expected notify error, got %v", err)
+	}
+	if _, queued := q.stats(); queued != 0 {
+		t.Errorf("abandoned waiter still queued: %d", queued)
+	}
+
+	release()
+	if running, _ := q.stats(); running != 0 {
+		t.Errorf("running = %d after release, want 0", running)
+	}
+}
+
+func TestAcquireTestSlot_Version1(t *testing.T) {
+	s := testServer()
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+	c.version = 1
+
+	go func() {
+		release, ok := s.acquireTestSlot(c, "SND")
+		if ok {
+			release()
+		}
+	}()
+
+	resp, _ := bufio.NewReader(client).ReadString('\n')
+	if strings.TrimSpace(resp) != "GO" {
+		t.Errorf("expected GO, got %q", resp)
+	}
+}
+
+func TestAcquireTestSlot_Busy(t *testing.T) {
+	s := testServer()
+	s.queue = newTestQueue(1, 0)
+	s.queue.acquire(nil) // occupy the only slot
+
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+	c.version = 1
+
+	okCh := make(chan bool, 1)
+	go func() {
+		_, ok := s.acquireTestSlot(c, "RCV")
+		okCh <- ok
+	}()
+
+	resp, _ := bufio.NewReader(client).ReadString('\n')
+	if !strings.HasPrefix(resp, "ERR:Server busy, retry after ") {
+		t.Errorf("expected busy ERR, got %q", resp)
+	}
+	if <-okCh {
+		t.Error("expected acquireTestSlot to refuse the test")
+	}
+}
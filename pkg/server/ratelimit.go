@@ -0,0 +1,275 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RateLimit holds the per-client limits on throughput tests. Clients are
+// grouped by subnet, so that a host can't get around the limits by
+// switching addresses within its IPv6 /64. Zero values disable a limit.
+type RateLimit struct {
+	// Tests is the most throughput tests a client may start in any
+	// Window. Each stream of a multi-stream test counts once in total.
+	Tests  int
+	Window time.Duration
+
+	// BytesPerDay caps the bytes sent to and received from a client in
+	// any 24 hours. A test that starts below the cap runs to completion.
+	BytesPerDay int64
+
+	// Cooldown is the least time between the end of one test and the
+	// start of the next with the same command. A normal run's download
+	// and upload still follow each other straight away.
+	Cooldown time.Duration
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths that clients are
+	// grouped by. Zero values default to /32 and /64.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// enabled reports whether any limit is set.
+func (rl RateLimit) enabled() bool {
+	return rl.Tests > 0 || rl.BytesPerDay > 0 || rl.Cooldown > 0
+}
+
+// refusal is returned by rateLimiter.start when a test is refused.
+type refusal struct {
+	reason     string // metrics and log label
+	retryAfter time.Duration
+}
+
+// usage is what a rateLimiter remembers about one client subnet.
+type usage struct {
+	starts  []time.Time          // test starts within the window
+	bytes   []transfer           // transfers within the last day
+	lastEnd map[string]time.Time // end of the last test, by command
+}
+
+type transfer struct {
+	at    time.Time
+	bytes int64
+}
+
+// rateLimiter enforces a RateLimit. It is safe for concurrent use. With no
+// limits set it lets every test through and keeps no records.
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	clients   map[netip.Prefix]*usage
+	lastPrune time.Time
+}
+
+const day = 24 * time.Hour
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	rl := &rateLimiter{
+		now:     time.Now,
+		clients: make(map[netip.Prefix]*usage),
+	}
+	rl.setLimit(limit)
+	return rl
+}
+
+// setLimit replaces the limits. Clients' records are kept, unless the
+// prefix lengths change and they no longer match the new grouping.
+func (rl *rateLimiter) setLimit(limit RateLimit) {
+	if limit.IPv4Prefix == 0 {
+		limit.IPv4Prefix = 32
+	}
+	if limit.IPv6Prefix == 0 {
+		limit.IPv6Prefix = 64
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if limit.IPv4Prefix != rl.limit.IPv4Prefix || limit.IPv6Prefix != rl.limit.IPv6Prefix {
+		clear(rl.clients)
+	}
+	rl.limit = limit
+}
+
+// key returns the subnet addr is accounted under.
+func (rl *rateLimiter) key(addr netip.Addr) netip.Prefix {
+	bits := rl.limit.IPv6Prefix
+	if addr.Is4() {
+		bits = rl.limit.IPv4Prefix
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// start records the start of a cmd test from addr, or returns a refusal
+// if one of the limits does not allow it. A test that then doesn't get to
+// run is given back with cancel.
+func (rl *rateLimiter) start(addr netip.Addr, cmd string) *refusal {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.limit.enabled() {
+		return nil
+	}
+
+	now := rl.now()
+	rl.prune(now)
+	u := rl.usage(addr)
+
+	if end, ok := u.lastEnd[cmd]; ok && rl.limit.Cooldown > 0 {
+		if wait := end.Add(rl.limit.Cooldown).Sub(now); wait > 0 {
+			return &refusal{reason: "cooldown", retryAfter: wait}
+		}
+	}
+
+	if rl.limit.Tests > 0 {
+		u.starts = slices.DeleteFunc(u.starts, func(t time.Time) bool { return now.Sub(t) >= rl.limit.Window })
+		if len(u.starts) >= rl.limit.Tests {
+			return &refusal{reason: "rate_limit", retryAfter: u.starts[0].Add(rl.limit.Window).Sub(now)}
+		}
+	}
+
+	if rl.limit.BytesPerDay > 0 {
+		u.bytes = slices.DeleteFunc(u.bytes, func(t transfer) bool { return now.Sub(t.at) >= day })
+		var total int64
+		for _, t := range u.bytes {
+			total += t.bytes
+		}
+		if total >= rl.limit.BytesPerDay {
+			// Wait until enough of the oldest transfers have aged out.
+			retry := day
+			for _, t := range u.bytes {
+				total -= t.bytes
+				if total < rl.limit.BytesPerDay {
+					retry = t.at.Add(day).Sub(now)
+					break
+				}
+			}
+			return &refusal{reason: "byte_limit", retryAfter: retry}
+		}
+	}
+
+	if rl.limit.Tests > 0 {
+		u.starts = append(u.starts, now)
+	}
+	return nil
+}
+
+// cancel takes back the latest start recorded for addr, for a test that
+// was refused a slot or abandoned in the queue, so that it doesn't count
+// against the client.
+func (rl *rateLimiter) cancel(addr netip.Addr) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.limit.Tests <= 0 {
+		return
+	}
+	if u, ok := rl.clients[rl.key(addr)]; ok && len(u.starts) > 0 {
+		u.starts = u.starts[:len(u.starts)-1]
+	}
+}
+
+// finish records the end of a cmd test from addr that moved n bytes. It
+// is called for every stream of a multi-stream test.
+func (rl *rateLimiter) finish(addr netip.Addr, cmd string, n int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.limit.enabled() {
+		return
+	}
+
+	now := rl.now()
+	u := rl.usage(addr)
+	u.lastEnd[cmd] = now
+	if rl.limit.BytesPerDay > 0 {
+		u.bytes = append(u.bytes, transfer{at: now, bytes: n})
+	}
+}
+
+// usage returns the record for addr's subnet, creating it if needed. The
+// caller must hold rl.mu.
+func (rl *rateLimiter) usage(addr netip.Addr) *usage {
+	k := rl.key(addr)
+	u, ok := rl.clients[k]
+	if !ok {
+		u = &usage{lastEnd: make(map[string]time.Time)}
+		rl.clients[k] = u
+	}
+	return u
+}
+
+// prune forgets clients with nothing left to limit, at most once a
+// minute. The caller must hold rl.mu.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	keep := max(rl.limit.Window, rl.limit.Cooldown)
+	if rl.limit.BytesPerDay > 0 {
+		keep = max(keep, day)
+	}
+	for k, u := range rl.clients {
+		last := time.Time{}
+		for _, t := range u.lastEnd {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if n := len(u.starts); n > 0 && u.starts[n-1].After(last) {
+			last = u.starts[n-1]
+		}
+		if now.Sub(last) >= keep {
+			delete(rl.clients, k)
+		}
+	}
+}
+
+// accessList decides which clients may connect at all.
+type accessList struct {
+	allow []netip.Prefix // if not empty, only these clients may connect
+	deny  []netip.Prefix // never allowed; takes precedence over allow
+}
+
+func (l accessList) permits(addr netip.Addr) bool {
+	for _, p := range l.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, p := range l.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of a connection's peer, with IPv4
+// addresses mapped into IPv6 unmapped.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// refuse answers a client's HELO with an ERR line. It reads the HELO
+// first, because closing a connection with unread data resets it and the
+// client might never see the reply.
+func (c *conn) refuse(msg string) {
+	c.rwc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.reader.ReadString('\n'); err != nil {
+		return
+	}
+	fmt.Fprintf(c.rwc, "ERR:%s\n", msg)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock returns a rateLimiter using a clock that the test advances.
+func fakeClock(limit RateLimit) (*rateLimiter, func(time.Duration)) {
+	rl := newRateLimiter(limit)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+	return rl, func(d time.Duration) { now = now.Add(d) }
+}
+
+var clientIP = netip.MustParseAddr("192.0.2.10")
+
+func TestRateLimiter_Tests(t *testing.T) {
+	rl, advance := fakeClock(RateLimit{Tests: 2, Window: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if r := rl.start(clientIP, "SND"); r != nil {
+			t.Fatalf("test %d refused: %+v", i, r)
+		}
+		advance(10 * time.Minute)
+	}
+
+	r := rl.start(clientIP, "RCV")
+	if r == nil || r.reason != "rate_limit" {
+		t.Fatalf("expected rate_limit refusal, got %+v", r)
+	}
+	if r.retryAfter != 40*time.Minute {
+		t.Errorf("retry after %v, want 40m", r.retryAfter)
+	}
+
+	advance(40 * time.Minute)
+	if r := rl.start(clientIP, "RCV"); r != nil {
+		t.Errorf("refused after the first test left the window: %+v", r)
+	}
+}
+
+func TestRateLimiter_Cooldown(t *testing.T) {
+	rl, advance := fakeClock(RateLimit{Cooldown: 5 * time.Minute})
+
+	if r := rl.start(clientIP, "SND"); r != nil {
+		t.Fatal(r)
+	}
+	advance(10 * time.Second)
+	rl.finish(clientIP, "SND", 1000)
+
+	// A normal run uploads right after downloading.
+	if r := rl.start(clientIP, "RCV"); r != nil {
+		t.Fatalf("upload after download refused: %+v", r)
+	}
+
+	advance(time.Minute)
+	r := rl.start(clientIP, "SND")
+	if r == nil || r.reason != "cooldown" || r.retryAfter != 4*time.Minute {
+		t.Fatalf("expected a 4m cooldown, got %+v", r)
+	}
+
+	advance(4 * time.Minute)
+	if r := rl.start(clientIP, "SND"); r != nil {
+		t.Errorf("refused after the cooldown: %+v", r)
+	}
+}
+
+func TestRateLimiter_BytesPerDay(t *testing.T) {
+	rl, advance := fakeClock(RateLimit{BytesPerDay: 1000})
+
+	for _, n := range []int64{600, 500} {
+		if r := rl.start(clientIP, "SND"); r != nil {
+			t.Fatalf("refused below the cap: %+v", r)
+		}
+		rl.finish(clientIP, "SND", n)
+		advance(time.Hour)
+	}
+
+	r := rl.start(clientIP, "SND")
+	if r == nil || r.reason != "byte_limit" {
+		t.Fatalf("expected byte_limit refusal, got %+v", r)
+	}
+	// Dropping the first 600 bytes brings the total under the cap.
+	if want := 22 * time.Hour; r.retryAfter != want {
+		t.Errorf("retry after %v, want %v", r.retryAfter, want)
+	}
+
+	advance(22 * time.Hour)
+	if r := rl.start(clientIP, "SND"); r != nil {
+		t.Errorf("refused after old transfers aged out: %+v", r)
+	}
+}
+
+func TestRateLimiter_Subnets(t *testing.T) {
+	rl, _ := fakeClock(RateLimit{Tests: 1, Window: time.Hour, IPv4Prefix: 24})
+
+	tests := []struct {
+		addr    string
+		refused bool
+	}{
+		{"192.0.2.10", false},
+		{"192.0.2.99", true}, // same /24
+		{"198.51.100.1", false},
+		{"2001:db8:1:2::1", false},
+		{"2001:db8:1:2::ffff", true}, // same /64
+		{"2001:db8:1:3::1", false},
+	}
+	for _, tt := range tests {
+		r := rl.start(netip.MustParseAddr(tt.addr), "SND")
+		if (r != nil) != tt.refused {
+			t.Errorf("%s: refusal = %+v, want refused=%v", tt.addr, r, tt.refused)
+		}
+	}
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	rl, advance := fakeClock(RateLimit{Tests: 1, Window: time.Hour})
+	rl.start(clientIP, "SND")
+	rl.finish(clientIP, "SND", 1)
+
+	advance(2 * time.Hour)
+	rl.start(netip.MustParseAddr("198.51.100.1"), "SND")
+
+	if _, ok := rl.clients[rl.key(clientIP)]; ok {
+		t.Error("idle client was not pruned")
+	}
+	if len(rl.clients) != 1 {
+		t.Errorf("clients = %d, want 1", len(rl.clients))
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var ps []netip.Prefix
+		for _, p := range s {
+			ps = append(ps, netip.MustParsePrefix(p))
+		}
+		return ps
+	}
+
+	tests := []struct {
+		name  string
+		list  accessList
+		addr  string
+		allow bool
+	}{
+		{"empty", accessList{}, "192.0.2.1", true},
+		{"denied", accessList{deny: prefixes("192.0.2.0/24")}, "192.0.2.1", false},
+		{"not denied", accessList{deny: prefixes("192.0.2.0/24")}, "198.51.100.1", true},
+		{"allowed", accessList{allow: prefixes("10.0.0.0/8", "2001:db8::/32")}, "2001:db8::1", true},
+		{"not allowed", accessList{allow: prefixes("10.0.0.0/8")}, "192.0.2.1", false},
+		{"deny wins", accessList{allow: prefixes("10.0.0.0/8"), deny: prefixes("10.1.0.0/16")}, "10.1.2.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.list.permits(netip.MustParseAddr(tt.addr)); got != tt.allow {
+				t.Errorf("permits(%s) = %v, want %v", tt.addr, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestAcquireTestSlot_RateLimited(t *testing.T) {
+	// Version 0 clients have no status lines, but still get the reason.
+	for _, version := range []uint16{0, 1} {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			s := testServer()
+			s.limiter = newRateLimiter(RateLimit{Tests: 1, Window: time.Hour})
+
+			c, client := pipeConn()
+			defer c.rwc.Close()
+			defer client.Close()
+			c.version = version
+			c.ip = clientIP
+			s.limiter.start(clientIP, "SND")
+
+			okCh := make(chan bool, 1)
+			go func() {
+				_, ok := s.acquireTestSlot(c, "SND")
+				okCh <- ok
+			}()
+
+			resp, _ := bufio.NewReader(client).ReadString('\n')
+			if !strings.HasPrefix(resp, "ERR:Rate limit exceeded, retry after ") {
+				t.Errorf("expected rate limit ERR, got %q", resp)
+			}
+			if <-okCh {
+				t.Error("expected acquireTestSlot to refuse the test")
+			}
+			if got := testutil.ToFloat64(s.metrics.testsRejected.WithLabelValues("rate_limit")); got != 1 {
+				t.Errorf("tests rejected{reason=\"rate_limit\"} = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAcquireTestSlot_BusyNotCounted(t *testing.T) {
+	s := testServer()
+	s.limiter = newRateLimiter(RateLimit{Tests: 1, Window: time.Hour})
+	s.queue = newTestQueue(1, 0)
+	release, _ := s.queue.acquire(nil)
+
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+	c.version = 1
+	c.ip = clientIP
+
+	go s.acquireTestSlot(c, "SND")
+	resp, _ := bufio.NewReader(client).ReadString('\n')
+	if !strings.HasPrefix(resp, "ERR:Server busy") {
+		t.Fatalf("expected busy ERR, got %q", resp)
+	}
+
+	// The refused test mustn't use up the client's one test an hour.
+	release()
+	if r := s.limiter.start(clientIP, "SND"); r != nil {
+		t.Errorf("busy refusal counted against the rate limit: %+v", r)
+	}
+}
+
+func TestHandleConn_Denied(t *testing.T) {
+	s := testServer()
+	s.settings.Store(&settings{access: accessList{deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(server, true)
+		close(done)
+	}()
+
+	client.Write([]byte("HELO3\r\n"))
+	resp, _ := bufio.NewReader(client).ReadString('\n')
+	if strings.TrimSpace(resp) != "ERR:Access denied" {
+		t.Errorf("expected access denied ERR, got %q", resp)
+	}
+	<-done
+
+	if got := testutil.ToFloat64(s.metrics.connsDenied); got != 1 {
+		t.Errorf("connections denied = %v, want 1", got)
+	}
+}
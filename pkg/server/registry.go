@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/registry"
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
+)
+
+// startHeartbeats sends a heartbeat to the registry now and then every
+// registry.HeartbeatInterval until ctx is cancelled, when it asks the
+// registry to drop the server. Failed heartbeats are logged, and retried
+// at the next interval.
+func (s *Server) startHeartbeats(ctx context.Context, wg *sync.WaitGroup) error {
+	var token string
+	if s.cfg.RegistryTokenFile != "" {
+		data, err := os.ReadFile(s.cfg.RegistryTokenFile)
+		if err != nil {
+			return fmt.Errorf("load registry token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	url := s.cfg.RegistryURL
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(registry.HeartbeatInterval)
+		defer ticker.Stop()
+
+		failing := false
+		for {
+			err := sendWithTimeout(ctx, func(ctx context.Context) error {
+				return registry.Send(ctx, url, token, s.heartbeat())
+			})
+			switch {
+			case ctx.Err() != nil:
+			case err != nil && !failing:
+				s.logger.Warn("registry heartbeat failed", "registry", url, "err", err)
+				failing = true
+			case err == nil && failing:
+				s.logger.Info("registry heartbeat succeeded again", "registry", url)
+				failing = false
+			}
+
+			select {
+			case <-ctx.Done():
+				// Give the registry a moment to drop us, even though
+				// ctx is done.
+				err := sendWithTimeout(context.Background(), func(ctx context.Context) error {
+					return registry.Remove(ctx, url, token, s.heartbeat())
+				})
+				if err != nil {
+					s.logger.Warn("registry removal failed", "registry", url, "err", err)
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	s.logger.Info("sending heartbeats", "registry", url, "interval", registry.HeartbeatInterval)
+	return nil
+}
+
+// sendWithTimeout calls send with a context that expires after 10
+// seconds, so that a hung registry can't delay the next heartbeat.
+func sendWithTimeout(ctx context.Context, send func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return send(ctx)
+}
+
+// heartbeat describes the server's current state for the registry.
+func (s *Server) heartbeat() registry.Heartbeat {
+	st := s.settings.Load()
+	_, portStr, _ := net.SplitHostPort(s.cfg.ListenAddrs[0])
+	port, _ := strconv.Atoi(portStr)
+	running, queued := s.queue.stats()
+	return registry.Heartbeat{
+		Host:     st.cname,
+		Port:     port,
+		Location: st.location,
+		Load:     serverlist.TestLoad{Running: running, Queued: queued, MaxTests: s.queue.limit()},
+	}
+}
@@ -3,83 +3,377 @@ package server
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
 const randBufSize = 10 * 1024 * 1024 // 10 MB shared random data
 
-// Config holds server configuration parsed from CLI flags.
+// Config holds server configuration, read from the config file (see
+// LoadConfig) and CLI flags. Start from DefaultConfig.
 type Config struct {
-	ListenAddr string
-	Cname      string
-	Location   string
-	Debug      bool
+	// ListenAddrs are the IP:port addresses to accept clients on. An
+	// IPv4 or IPv6 address listens on that family only, so "0.0.0.0:7121"
+	// and "[::]:7121" can be bound side by side; a host name or an empty
+	// host listens on both.
+	ListenAddrs []string
+	MetricsAddr string // if set, serve Prometheus metrics over HTTP on this address
+	// HTTPAddr, if set, is the IP:port to also serve the tests over HTTP
+	// on, or HTTPS if TLS is enabled, for clients behind firewalls that
+	// only let web traffic out.
+	HTTPAddr string
+	// Web also serves a test page on HTTPAddr, which runs the tests from
+	// a browser for those who can't install the client.
+	Web       bool
+	MDNS      bool // advertise the server on the local network with DNS-SD
+	Cname     string
+	Location  string
+	Debug     bool
+	LogFormat string // "text" or "json"
+
+	// MaxTests limits how many SND/RCV/UDP tests run at once so that
+	// concurrent clients don't split the link; 0 means unlimited. ECO
+	// tests are never limited.
+	MaxTests int
+	// MaxQueue is how many throughput tests may wait for a slot once
+	// MaxTests are running. Further tests are refused as busy.
+	MaxQueue int
+
+	// Limits caps the test parameters a version 1 client may request.
+	// Zero fields are filled from DefaultLimits.
+	Limits protocol.Params
+
+	// TLSCertFile and TLSKeyFile enable TLS on the listener. If
+	// TLSClientCAFile is also set, clients must present a certificate
+	// signed by one of its CAs.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// AuthFile is a token file (see loadTokens). If set, clients must
+	// authenticate with one of its tokens, and clients older than
+	// protocol version 3 are refused.
+	AuthFile string
+
+	// RateLimit limits the throughput tests each client may run.
+	RateLimit RateLimit
+	// Allow, if not empty, lists the only networks clients may connect
+	// from. Deny lists networks that may never connect; it takes
+	// precedence over Allow.
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+
+	// RegistryURL is the base URL of a registry (see package registry)
+	// to send heartbeats to, authenticating with the token in
+	// RegistryTokenFile if set. The server is listed under its Cname, or
+	// the address the heartbeats come from if Cname is empty.
+	RegistryURL       string
+	RegistryTokenFile string
+
+	// Version is the server software version, advertised over mDNS and
+	// to version 1 clients in the HELO response. It is set by the caller,
+	// not the config file.
+	Version string
+}
+
+// DefaultLimits returns the parameter limits used when Config.Limits
+// leaves a field unset.
+func DefaultLimits() protocol.Params {
+	return protocol.Params{Duration: 30 * time.Second, Pings: 100, Streams: 8}
 }
 
 // Server accepts TCP connections and runs sparkyfish speed tests.
 type Server struct {
-	cfg     Config
-	randBuf []byte
-	logger  *slog.Logger
+	cfg       Config // as of New; Reload only changes the settings below
+	randBuf   []byte
+	logger    *slog.Logger
+	level     *slog.LevelVar
+	metrics   *metrics
+	queue     *testQueue
+	streams   *streamGroups
+	httpTests *httpTests
+	httpAuth  *httpChallenges
+	udp       *udpTests
+	limiter   *rateLimiter
+	tls       *tls.Config // nil unless TLS is enabled
+	settings  atomic.Pointer[settings]
+}
+
+// settings are the parts of the configuration that connections read as
+// they go, and that Reload may replace at any time.
+type settings struct {
+	cname    string
+	location string
+	limits   protocol.Params
+	auth     tokens // nil unless authentication is required
+	access   accessList
 }
 
 // New creates a Server with pre-generated random data for throughput tests.
 func New(cfg Config) (*Server, error) {
-	level := slog.LevelInfo
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	level := new(slog.LevelVar)
 	if cfg.Debug {
-		level = slog.LevelDebug
+		level.Set(slog.LevelDebug)
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+		// Log addresses as host:port, not as JSON objects.
+		if addr, ok := a.Value.Any().(net.Addr); ok {
+			a.Value = slog.StringValue(addr.String())
+		}
+		return a
+	}}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
 
 	randBuf := make([]byte, randBufSize)
 	if _, err := rand.Read(randBuf); err != nil {
 		return nil, fmt.Errorf("generate random data: %w", err)
 	}
 
-	return &Server{cfg: cfg, randBuf: randBuf, logger: logger}, nil
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	st, err := newSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		randBuf:   randBuf,
+		logger:    slog.New(handler),
+		level:     level,
+		metrics:   newMetrics(),
+		queue:     newTestQueue(cfg.MaxTests, cfg.MaxQueue),
+		streams:   newStreamGroups(),
+		httpTests: newHTTPTests(),
+		httpAuth:  newHTTPChallenges(),
+		udp:       newUDPTests(),
+		limiter:   newRateLimiter(cfg.RateLimit),
+		tls:       tlsConfig,
+	}
+	s.settings.Store(st)
+	s.metrics.watchQueue(s.queue)
+	return s, nil
 }
 
-// ListenAndServe starts the TCP listener and blocks until ctx is cancelled.
-func (s *Server) ListenAndServe(ctx context.Context) error {
-	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
-	if err != nil {
-		return fmt.Errorf("listen %s: %w", s.cfg.ListenAddr, err)
+// newSettings builds the reloadable settings from a validated cfg.
+func newSettings(cfg Config) (*settings, error) {
+	st := &settings{
+		cname:    cfg.Cname,
+		location: cfg.Location,
+		limits:   cfg.Limits,
+		access:   accessList{allow: cfg.Allow, deny: cfg.Deny},
+	}
+	if cfg.AuthFile != "" {
+		var err error
+		if st.auth, err = loadTokens(cfg.AuthFile); err != nil {
+			return nil, err
+		}
 	}
-	defer ln.Close()
+	return st, nil
+}
 
-	// Close listener on context cancellation to unblock Accept
-	go func() {
-		<-ctx.Done()
-		ln.Close()
+// Logger returns the server's logger.
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+// ListenAndServe starts a TCP listener on every listen address, with a
+// UDP socket on the same port for UDP tests, and blocks until ctx is
+// cancelled. If any TCP address can't be bound, none are served. A UDP
+// port that can't be bound only disables UDP tests on that address: its
+// clients are offered protocol version 3, which has none.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	var listeners []net.Listener
+	var withUDP []bool // by listener
+	var packetConns []net.PacketConn
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		for _, pc := range packetConns {
+			pc.Close()
+		}
 	}()
+	for _, addr := range s.cfg.ListenAddrs {
+		ln, err := net.Listen(listenNetwork(addr), addr)
+		if err != nil {
+			return fmt.Errorf("listen %s: %w", addr, err)
+		}
+		pc, err := listenUDP(addr, ln)
+		if err != nil {
+			s.logger.Warn("UDP tests disabled", "addr", addr, "err", err)
+		} else {
+			packetConns = append(packetConns, pc)
+		}
+		if s.tls != nil {
+			ln = tls.NewListener(ln, s.tls)
+		}
+		listeners = append(listeners, ln)
+		withUDP = append(withUDP, err == nil)
+	}
 
-	s.logger.Info("listening", "addr", s.cfg.ListenAddr)
+	if s.cfg.MetricsAddr != "" {
+		if err := s.serveMetrics(ctx, s.cfg.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if s.cfg.HTTPAddr != "" {
+		if err := s.serveHTTP(ctx, s.cfg.HTTPAddr); err != nil {
+			return err
+		}
+	}
+	if s.cfg.MDNS {
+		s.advertise(ctx)
+	}
+	var heartbeats sync.WaitGroup
+	if s.cfg.RegistryURL != "" {
+		if err := s.startHeartbeats(ctx, &heartbeats); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, ln := range listeners {
+		s.logger.Info("listening", "addr", ln.Addr(), "tls", s.tls != nil, "auth", s.settings.Load().auth != nil, "udp", withUDP[i])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, ln, withUDP[i])
+		}()
+	}
+	for _, pc := range packetConns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveUDP(ctx, pc)
+		}()
+	}
+
+	// Close the listeners on context cancellation to unblock Accept
+	<-ctx.Done()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, pc := range packetConns {
+		pc.Close()
+	}
+	wg.Wait()
+	heartbeats.Wait()
+	return nil
+}
 
+// serve accepts connections on ln until it is closed. udp reports
+// whether ln has a UDP socket for UDP tests.
+func (s *Server) serve(ctx context.Context, ln net.Listener, udp bool) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if ctx.Err() != nil {
-				return nil // clean shutdown
+				return // clean shutdown
 			}
-			s.logger.Error("accept", "err", err)
+			s.logger.Error("accept", "addr", ln.Addr(), "err", err)
 			continue
 		}
-		go s.handleConn(conn)
+		family := "unknown"
+		if ip, ok := remoteIP(conn.RemoteAddr()); ok {
+			family = addrFamily(ip)
+		}
+		s.metrics.connsAccepted.WithLabelValues(family).Inc()
+		go s.handleConn(conn, udp)
 	}
 }
 
-func (s *Server) handleConn(netConn net.Conn) {
+// listenNetwork returns the network to listen on addr with: "tcp4" or
+// "tcp6" for a literal address of that family, so that the IPv6 wildcard
+// doesn't also claim IPv4, and "tcp" otherwise.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return "tcp"
+	case ip.Is4():
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// addrFamily returns "ipv4" or "ipv6", as used in metrics and logs.
+func addrFamily(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func (s *Server) handleConn(netConn net.Conn, udp bool) {
 	defer netConn.Close()
 
+	s.metrics.activeConns.Inc()
+	defer s.metrics.activeConns.Dec()
+
+	if tc, ok := netConn.(*tls.Conn); ok {
+		if err := tlsHandshake(tc); err != nil {
+			s.metrics.handshakeFailed(err)
+			s.logger.Debug("handshake failed", "addr", netConn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+
 	c := newConn(netConn, s.logger)
+	if !udp {
+		c.maxVer = noUDPVersion
+	}
+	st := s.settings.Load()
 
-	if err := c.handshake(s.cfg.Cname, s.cfg.Location); err != nil {
-		s.logger.Debug("handshake failed", "addr", netConn.RemoteAddr(), "err", err)
+	family := "unknown"
+	if ip, ok := remoteIP(netConn.RemoteAddr()); ok {
+		c.ip = ip
+		family = addrFamily(ip)
+		if !st.access.permits(ip) {
+			s.metrics.connsDenied.Inc()
+			s.logger.Info("connection denied", "addr", netConn.RemoteAddr())
+			c.refuse("Access denied")
+			return
+		}
+	}
+
+	if err := c.handshake(st.cname, st.location, s.cfg.Version, st.limits, st.auth); err != nil {
+		s.metrics.handshakeFailed(err)
+		if errors.Is(err, errAuthFailed) {
+			s.logger.Warn("authentication failed", "addr", netConn.RemoteAddr(), "err", err)
+		} else {
+			s.logger.Debug("handshake failed", "addr", netConn.RemoteAddr(), "err", err)
+		}
 		return
 	}
+	if c.user != "" {
+		c.logger = c.logger.With("user", c.user)
+	}
 
 	for {
 		cmd, err := c.readCommand()
@@ -88,7 +382,16 @@ func (s *Server) handleConn(netConn net.Conn) {
 			return
 		}
 
-		s.logger.Info("test", "addr", netConn.RemoteAddr(), "cmd", cmd)
+		release := func() {}
+		if cmd == "SND" || cmd == "RCV" || cmd == "UDP" {
+			var ok bool
+			if release, ok = s.acquireTestSlot(c, cmd); !ok {
+				return
+			}
+		}
+
+		c.logger.Info("test", "addr", netConn.RemoteAddr(), "family", family, "cmd", cmd)
+		s.metrics.tests.WithLabelValues(cmd).Inc()
 
 		switch cmd {
 		case "ECO":
@@ -97,7 +400,98 @@ func (s *Server) handleConn(netConn net.Conn) {
 			s.handleSend(c)
 		case "RCV":
 			s.handleReceive(c)
-			return // RCV is terminal; client closes after upload
+		case "UDP":
+			s.handleUDP(c)
+		}
+		release()
+
+		if cmd == "RCV" || cmd == "UDP" {
+			return // RCV and UDP are terminal; client closes after the test
 		}
 	}
 }
+
+// acquireTestSlot waits for a throughput test slot. Version 1 clients are
+// sent a QUEUE line each time their position changes and a GO line once
+// the test may start; version 0 clients wait silently. It returns false
+// if the test must not run, in which case the connection should be closed.
+// Clients of any version refused for the rate limit or a full queue are
+// sent an ERR line saying why.
+//
+// The first stream of a multi-stream test is given a join token in its GO
+// line. The other streams present it and share the first stream's slot.
+func (s *Server) acquireTestSlot(c *conn, cmd string) (release func(), ok bool) {
+	addr := c.rwc.RemoteAddr()
+
+	if c.params.Join != "" {
+		if !s.streams.join(c.params.Join, cmd) {
+			s.metrics.testsRejected.WithLabelValues("unknown_join").Inc()
+			s.logger.Info("test rejected", "addr", addr, "cmd", cmd, "reason", "unknown join token")
+			fmt.Fprintf(c.rwc, "ERR:Unknown test to join\n")
+			return nil, false
+		}
+		if _, err := fmt.Fprintf(c.rwc, "GO\n"); err != nil {
+			return nil, false
+		}
+		return func() {}, true
+	}
+
+	if c.ip.IsValid() {
+		if r := s.limiter.start(c.ip, cmd); r != nil {
+			s.metrics.testsRejected.WithLabelValues(r.reason).Inc()
+			s.logger.Info("test rejected", "addr", addr, "version", c.version, "cmd", cmd, "reason", r.reason, "retry_after", r.retryAfter.Round(time.Second))
+			// Version 0 clients get the reason too. They have no status
+			// lines, but a person reading the stream can still tell why.
+			fmt.Fprintf(c.rwc, "ERR:Rate limit exceeded, retry after %d seconds\n", int(math.Ceil(r.retryAfter.Seconds())))
+			return nil, false
+		}
+	}
+
+	release, err := s.queue.acquire(func(position int) error {
+		s.logger.Debug("test queued", "addr", addr, "cmd", cmd, "position", position)
+		if c.version < 1 {
+			return nil
+		}
+		_, err := fmt.Fprintf(c.rwc, "QUEUE %d\n", position)
+		return err
+	})
+	if err != nil && c.ip.IsValid() {
+		s.limiter.cancel(c.ip)
+	}
+	if errors.Is(err, errQueueFull) {
+		s.metrics.testsRejected.WithLabelValues("busy").Inc()
+		s.logger.Info("test rejected", "addr", addr, "version", c.version, "cmd", cmd, "reason", "busy")
+		retry := c.params.Duration + protocol.RecvGrace
+		fmt.Fprintf(c.rwc, "ERR:Server busy, retry after %d seconds\n", int(retry.Seconds()))
+		return nil, false
+	}
+	if err != nil {
+		s.logger.Debug("queued client went away", "addr", addr, "err", err)
+		return nil, false
+	}
+
+	if c.version < 1 {
+		return release, true
+	}
+
+	// A UDP test always runs on its one connection.
+	if c.params.Streams <= 1 || cmd == "UDP" {
+		if _, err := fmt.Fprintf(c.rwc, "GO\n"); err != nil {
+			release()
+			return nil, false
+		}
+		return release, true
+	}
+
+	token, closeGroup := s.streams.open(cmd, c.params.Streams-1)
+	if _, err := fmt.Fprintf(c.rwc, "GO %s\n", token); err != nil {
+		closeGroup()
+		release()
+		return nil, false
+	}
+	releaseSlot := release
+	return func() {
+		closeGroup()
+		releaseSlot()
+	}, true
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/chrissnell/sparkyfish/pkg/registry"
+	"github.com/chrissnell/sparkyfish/pkg/serverlist"
+)
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{":7121", "tcp"},
+		{"0.0.0.0:7121", "tcp4"},
+		{"192.0.2.1:7121", "tcp4"},
+		{"[::]:7121", "tcp6"},
+		{"[2001:db8::1]:7121", "tcp6"},
+		{"speedtest.example.com:7121", "tcp"},
+		{"localhost:7121", "tcp"},
+	}
+	for _, tt := range tests {
+		if got := listenNetwork(tt.addr); got != tt.want {
+			t.Errorf("listenNetwork(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// freeAddr returns a loopback address with a port that was free a moment
+// ago, or skips the test if the address family isn't available.
+func freeAddr(t *testing.T, network, host string) string {
+	t.Helper()
+	ln, err := net.Listen(network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("%s not available: %v", network, err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestListenAndServe_MultipleAddrs(t *testing.T) {
+	addrs := []string{freeAddr(t, "tcp4", "127.0.0.1"), freeAddr(t, "tcp6", "::1")}
+
+	s := testServer()
+	s.cfg.ListenAddrs = addrs
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.ListenAndServe(ctx) }()
+
+	for _, addr := range addrs {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		conn.Write([]byte("HELO0\r\n"))
+		resp, _ := bufio.NewReader(conn).ReadString('\n')
+		if strings.TrimSpace(resp) != "HELO" {
+			t.Errorf("%s: expected HELO, got %q", addr, resp)
+		}
+		conn.Close()
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if got := testutil.ToFloat64(s.metrics.connsAccepted.WithLabelValues(family)); got != 1 {
+			t.Errorf("connections accepted{family=%q} = %v, want 1", family, got)
+		}
+	}
+}
+
+func TestListenAndServe_BindFailure(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := testServer()
+	s.cfg.ListenAddrs = []string{freeAddr(t, "tcp4", "127.0.0.1"), ln.Addr().String()}
+	err = s.ListenAndServe(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ln.Addr().String()) {
+		t.Errorf("expected an error for the address in use, got %v", err)
+	}
+}
+
+// TestListenAndServe_UDPBindFailure checks that a UDP port in use only
+// takes the UDP test away: clients are offered protocol version 3.
+func TestListenAndServe_UDPBindFailure(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := testServer()
+	addr := pc.LocalAddr().String()
+	s.cfg.ListenAddrs = []string{addr}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.ListenAndServe(ctx) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		cancel()
+		t.Fatalf("dial %s: %v (%v)", addr, err, <-errCh)
+	}
+	conn.Write([]byte("HELO4\r\n"))
+	resp, _ := bufio.NewReader(conn).ReadString('\n')
+	if strings.TrimSpace(resp) != "HELO 3" {
+		t.Errorf("expected HELO 3, got %q", resp)
+	}
+	conn.Close()
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+}
+
+func TestAdvertisedAddrs(t *testing.T) {
+	local := []string{"192.0.2.10", "2001:db8::10"}
+	tests := []struct {
+		listen []string
+		want   []string
+	}{
+		{[]string{":7121"}, local},
+		{[]string{"speedtest.example.com:7121"}, local},
+		{[]string{"0.0.0.0:7121"}, []string{"192.0.2.10"}},
+		{[]string{"[::]:7121"}, []string{"2001:db8::10"}},
+		{[]string{"0.0.0.0:7121", "[::]:7121"}, local},
+		{[]string{"192.0.2.20:7121", "0.0.0.0:7122"}, []string{"192.0.2.20", "192.0.2.10"}},
+	}
+	for _, tt := range tests {
+		if got := advertisedAddrs(tt.listen, local); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("advertisedAddrs(%q) = %q, want %q", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	reg := registry.New(registry.Config{Token: "s3cret"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	srv := httptest.NewServer(reg.Handler())
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "registry-token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := testServer()
+	s.cfg = DefaultConfig()
+	s.cfg.RegistryURL = srv.URL
+	s.cfg.RegistryTokenFile = tokenFile
+	s.queue = newTestQueue(4, 10)
+	s.settings.Store(&settings{cname: "speedtest.example.com", location: "Denver, CO"})
+	release, _ := s.queue.acquire(nil)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.startHeartbeats(ctx, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []serverlist.Server{{
+		Host:     "speedtest.example.com",
+		Port:     7121,
+		Location: "Denver, CO",
+		Load:     &serverlist.TestLoad{Running: 1, MaxTests: 4},
+	}}
+	var got []serverlist.Server
+	for i := 0; i < 100 && len(got) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		got = reg.Servers()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registered:\n got %+v\nwant %+v", got, want)
+	}
+
+	cancel()
+	wg.Wait()
+	if got := reg.Servers(); len(got) != 0 {
+		t.Errorf("still listed after shutdown: %+v", got)
+	}
+}
+
+func TestHeartbeats_MissingToken(t *testing.T) {
+	s := testServer()
+	s.cfg = DefaultConfig()
+	s.cfg.RegistryURL = "http://registry.example.com"
+	s.cfg.RegistryTokenFile = filepath.Join(t.TempDir(), "missing")
+	if err := s.startHeartbeats(context.Background(), new(sync.WaitGroup)); err == nil {
+		t.Error("expected an error for a missing token file")
+	}
+}
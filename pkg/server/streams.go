@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// streamGroups tracks multi-stream tests that are accepting extra
+// connections. The first stream of a test holds the queue slot and opens a
+// group; the remaining streams join it with the token from its GO line and
+// start without queueing.
+type streamGroups struct {
+	mu     sync.Mutex
+	groups map[string]*streamGroup
+}
+
+type streamGroup struct {
+	cmd       string // SND or RCV; joining streams must run the same test
+	remaining int    // streams that may still join
+}
+
+func newStreamGroups() *streamGroups {
+	return &streamGroups{groups: make(map[string]*streamGroup)}
+}
+
+// open registers a group that up to extra connections may join to run
+// cmd. It returns the join token and a func that closes the group once
+// the first stream's test is over.
+func (g *streamGroups) open(cmd string, extra int) (token string, closeGroup func()) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+
+	g.mu.Lock()
+	g.groups[token] = &streamGroup{cmd: cmd, remaining: extra}
+	g.mu.Unlock()
+
+	return token, func() {
+		g.mu.Lock()
+		delete(g.groups, token)
+		g.mu.Unlock()
+	}
+}
+
+// join claims a place in the group named by token. It reports false if
+// the group does not exist, runs a different command, or is full.
+func (g *streamGroups) join(token, cmd string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	grp, ok := g.groups[token]
+	if !ok || grp.cmd != cmd || grp.remaining <= 0 {
+		return false
+	}
+	grp.remaining--
+	return true
+}
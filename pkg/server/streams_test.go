@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestStreamGroups(t *testing.T) {
+	g := newStreamGroups()
+	token, closeGroup := g.open("SND", 2)
+
+	if g.join(token, "RCV") {
+		t.Error("joined a group running a different command")
+	}
+	if !g.join(token, "SND") || !g.join(token, "SND") {
+		t.Fatal("expected two streams to join")
+	}
+	if g.join(token, "SND") {
+		t.Error("joined a full group")
+	}
+
+	other, closeOther := g.open("SND", 1)
+	defer closeOther()
+	if other == token {
+		t.Error("groups share a token")
+	}
+
+	closeGroup()
+	if g.join(token, "SND") {
+		t.Error("joined a closed group")
+	}
+	if g.join("0123", "SND") {
+		t.Error("joined an unknown group")
+	}
+}
+
+func TestAcquireTestSlot_MultiStream(t *testing.T) {
+	s := testServer()
+	s.queue = newTestQueue(1, 0)
+
+	first, firstClient := pipeConn()
+	defer first.rwc.Close()
+	defer firstClient.Close()
+	first.version = 1
+	first.params.Streams = 2
+
+	type slot struct {
+		release func()
+		ok      bool
+	}
+	firstSlot := make(chan slot, 1)
+	go func() {
+		release, ok := s.acquireTestSlot(first, "SND")
+		firstSlot <- slot{release, ok}
+	}()
+
+	resp, _ := bufio.NewReader(firstClient).ReadString('\n')
+	token, found := strings.CutPrefix(strings.TrimSpace(resp), "GO ")
+	if !found || token == "" {
+		t.Fatalf("expected GO with a join token, got %q", resp)
+	}
+	held := <-firstSlot
+
+	// The only slot is taken by the first stream, so the second stream
+	// would be refused as busy if it did not share it.
+	second, secondClient := pipeConn()
+	defer second.rwc.Close()
+	defer secondClient.Close()
+	second.version = 1
+	second.params.Streams = 2
+	second.params.Join = token
+
+	go s.acquireTestSlot(second, "SND")
+	if resp, _ := bufio.NewReader(secondClient).ReadString('\n'); strings.TrimSpace(resp) != "GO" {
+		t.Errorf("joining stream: expected GO, got %q", resp)
+	}
+
+	held.release()
+	if s.streams.join(token, "SND") {
+		t.Error("group still open after the first stream released its slot")
+	}
+}
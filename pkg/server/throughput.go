@@ -4,31 +4,33 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"net"
+	"log/slog"
+	"net/netip"
+	"sync/atomic"
 	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
 )
 
 const (
-	sendTestLength = 10 * time.Second
-	recvTestLength = 12 * time.Second // 10s + 2s grace for client to finish
-	sendBufSize    = 10 * 1024 * 1024 // copy entire 10MB buffer per iteration
-	recvBlockSize  = 1024 * 1024      // read in ~1MB chunks
+	sendBufSize   = 10 * 1024 * 1024 // copy entire 10MB buffer per iteration
+	recvBlockSize = 1024 * 1024      // read in ~1MB chunks
 )
 
 func (s *Server) handleSend(c *conn) {
 	reader := bytes.NewReader(s.randBuf)
 	start := time.Now()
-	timer := time.NewTimer(sendTestLength)
+	timer := time.NewTimer(c.params.Duration)
 	defer timer.Stop()
 
 	var totalBytes int64
 	for {
 		select {
 		case <-timer.C:
-			s.logThroughput(c, "sent", totalBytes, time.Since(start))
+			s.logThroughput(c, "SND", totalBytes, time.Since(start))
 			// Half-close write so client gets EOF but can still send commands
-			if tc, ok := c.rwc.(*net.TCPConn); ok {
-				tc.CloseWrite()
+			if cw, ok := c.rwc.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
 			}
 			return
 		default:
@@ -39,7 +41,7 @@ func (s *Server) handleSend(c *conn) {
 			if err != io.EOF && !isConnClosed(err) {
 				c.logger.Error("send copy", "err", err)
 			}
-			s.logThroughput(c, "sent", totalBytes, time.Since(start))
+			s.logThroughput(c, "SND", totalBytes, time.Since(start))
 			return
 		}
 		reader.Seek(0, io.SeekStart)
@@ -48,34 +50,111 @@ func (s *Server) handleSend(c *conn) {
 
 func (s *Server) handleReceive(c *conn) {
 	start := time.Now()
-	timer := time.NewTimer(recvTestLength)
+	// Grace period lets the client finish its last block
+	timer := time.NewTimer(c.params.Duration + protocol.RecvGrace)
 	defer timer.Stop()
 
-	var totalBytes int64
+	counter := &receiveCounter{start: start}
+	if c.version >= 2 {
+		stopReports := s.reportReceived(c, counter)
+		defer func() {
+			stopReports()
+			bytes, elapsed := counter.totals()
+			fmt.Fprintf(c.rwc, "DONE %d %d\n", bytes, elapsed.Milliseconds())
+		}()
+	}
+
 	for {
 		select {
 		case <-timer.C:
-			s.logThroughput(c, "received", totalBytes, time.Since(start))
+			s.logThroughput(c, "RCV", counter.bytes.Load(), time.Since(start))
 			return
 		default:
 		}
-		n, err := io.CopyN(io.Discard, c.rwc, recvBlockSize)
-		totalBytes += n
+		_, err := io.CopyN(counter, c.rwc, recvBlockSize)
 		if err != nil {
 			if err != io.EOF && !isConnClosed(err) {
 				c.logger.Error("recv copy", "err", err)
 			}
-			s.logThroughput(c, "received", totalBytes, time.Since(start))
+			s.logThroughput(c, "RCV", counter.bytes.Load(), time.Since(start))
 			return
 		}
 	}
 }
 
-func (s *Server) logThroughput(c *conn, direction string, totalBytes int64, dur time.Duration) {
+// receiveCounter discards the data it is written while counting it and
+// noting when the last of it arrived.
+type receiveCounter struct {
+	start time.Time
+	bytes atomic.Int64
+	last  atomic.Int64 // time of the last write, in ns since start
+}
+
+func (rc *receiveCounter) Write(p []byte) (int, error) {
+	rc.bytes.Add(int64(len(p)))
+	rc.last.Store(int64(time.Since(rc.start)))
+	return len(p), nil
+}
+
+// totals returns the bytes received so far and the time from the start of
+// the test until the last of them arrived.
+func (rc *receiveCounter) totals() (int64, time.Duration) {
+	// Load bytes first: a write that lands in between then only makes the
+	// elapsed time slightly generous, never the rate.
+	bytes := rc.bytes.Load()
+	return bytes, time.Duration(rc.last.Load())
+}
+
+// reportReceived sends a RCVD line with the running totals every
+// protocol.ReportInterval until the returned func is called. Write errors
+// are ignored: the client may already have stopped listening.
+func (s *Server) reportReceived(c *conn, counter *receiveCounter) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(protocol.ReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				bytes, elapsed := counter.totals()
+				if _, err := fmt.Fprintf(c.rwc, "RCVD %d %d\n", bytes, elapsed.Milliseconds()); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited // so that DONE is never interleaved with a RCVD line
+	}
+}
+
+// logThroughput logs the outcome of a SND, RCV, or UDP test, records it in
+// metrics, and charges it to the client's rate limits.
+func (s *Server) logThroughput(c *conn, cmd string, totalBytes int64, dur time.Duration) {
+	s.recordThroughput(c.logger, c.rwc.RemoteAddr().String(), c.ip, cmd, totalBytes, dur)
+}
+
+// recordThroughput does the work of logThroughput for a test from the
+// client at addr, whose IP is ip, or invalid if unknown.
+func (s *Server) recordThroughput(logger *slog.Logger, addr string, ip netip.Addr, cmd string, totalBytes int64, dur time.Duration) {
+	s.metrics.testFinished(cmd, totalBytes, dur)
+	if ip.IsValid() {
+		s.limiter.finish(ip, cmd, totalBytes)
+	}
+
+	direction := "sent"
+	if cmd == "RCV" || cmd == "UDP" {
+		direction = "received"
+	}
 	mb := float64(totalBytes) / (1024 * 1024)
 	secs := dur.Seconds()
-	s.logger.Info(direction,
-		"addr", c.rwc.RemoteAddr(),
+	logger.Info(direction,
+		"addr", addr,
 		"mb", fmt.Sprintf("%.1f", mb),
 		"duration", fmt.Sprintf("%.2fs", secs),
 		"mbps", fmt.Sprintf("%.2f", mb/secs*8))
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// tcpConn returns a conn wrapping the server end of a loopback TCP
+// connection, plus the client end. Unlike net.Pipe, TCP supports the
+// half-close that ends a version 2 upload test.
+func tcpConn(t *testing.T) (*conn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return newConn(server, testLogger()), client.(*net.TCPConn)
+}
+
+func TestHandleReceive_Reports(t *testing.T) {
+	s := testServer()
+	c, client := tcpConn(t)
+	c.version = 2
+	c.params = protocol.Params{Duration: 5 * time.Second, Pings: 1, Streams: 1}
+
+	done := make(chan struct{})
+	go func() {
+		s.handleReceive(c)
+		close(done)
+	}()
+
+	const sent = 3 * 1024 * 1024
+	block := make([]byte, sent/3)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(block); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(protocol.ReportInterval / 2)
+	}
+	// Half-closing ends the test early; the server must still report.
+	client.CloseWrite()
+
+	var rcvd []string
+	var final string
+	reader := bufio.NewReader(client)
+	for final == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read report: %v (got %q)", err, rcvd)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "RCVD "):
+			rcvd = append(rcvd, line)
+		case strings.HasPrefix(line, "DONE "):
+			final = line
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	<-done
+
+	if len(rcvd) == 0 {
+		t.Error("no interim RCVD reports")
+	}
+	var bytes, ms int64
+	if _, err := fmt.Sscanf(final, "DONE %d %d", &bytes, &ms); err != nil {
+		t.Fatalf("parse %q: %v", final, err)
+	}
+	if bytes != sent {
+		t.Errorf("server reported %d bytes, sent %d", bytes, sent)
+	}
+	if ms <= 0 || ms >= 5000 {
+		t.Errorf("server reported %d ms, want the time until the last byte", ms)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/chrissnell/sparkyfish/pkg/internal/testcert"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	certs := testcert.Generate(t)
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		wantNil    bool
+		wantErr    bool
+		wantClient tls.ClientAuthType
+	}{
+		{"disabled", Config{}, true, false, tls.NoClientCert},
+		{"server only", Config{TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ServerKey}, false, false, tls.NoClientCert},
+		{"mutual", Config{TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ServerKey, TLSClientCAFile: certs.CA},
+			false, false, tls.RequireAndVerifyClientCert},
+		{"missing key", Config{TLSCertFile: certs.ServerCert}, false, true, 0},
+		{"client CA without certificate", Config{TLSClientCAFile: certs.CA}, false, true, 0},
+		{"key does not match", Config{TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ClientKey}, false, true, 0},
+		{"client CA is not PEM", Config{TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ServerKey, TLSClientCAFile: os.DevNull},
+			false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := loadTLSConfig(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadTLSConfig error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (conf == nil) != tt.wantNil {
+				t.Fatalf("loadTLSConfig returned %v, want nil: %v", conf, tt.wantNil)
+			}
+			if conf != nil && conf.ClientAuth != tt.wantClient {
+				t.Errorf("ClientAuth = %v, want %v", conf.ClientAuth, tt.wantClient)
+			}
+		})
+	}
+}
+
+// serveTLS runs handleConn behind TLS on the server end of a pipe and
+// returns a TLS client for the other end, plus a channel closed when
+// handleConn returns.
+func serveTLS(t *testing.T, s *Server, clientConf *tls.Config) (*tls.Conn, <-chan struct{}) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(tls.Server(server, s.tls), true)
+		close(done)
+	}()
+	tc := tls.Client(client, clientConf)
+	t.Cleanup(func() { tc.Close() })
+	return tc, done
+}
+
+func caPool(t *testing.T, path string) *x509.CertPool {
+	t.Helper()
+	pool, err := loadCertPool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestHandleConn_TLS(t *testing.T) {
+	certs := testcert.Generate(t)
+	s := testServer()
+	var err error
+	if s.tls, err = loadTLSConfig(Config{TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ServerKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := serveTLS(t, s, &tls.Config{RootCAs: caPool(t, certs.CA), ServerName: "localhost"})
+	if _, err := client.Write([]byte("HELO0\r\n")); err != nil {
+		t.Fatalf("write HELO over TLS: %v", err)
+	}
+	reader := bufio.NewReader(client)
+	if resp, _ := reader.ReadString('\n'); strings.TrimSpace(resp) != "HELO" {
+		t.Errorf("expected HELO over TLS, got %q", resp)
+	}
+}
+
+func TestHandleConn_TLSClientCertRequired(t *testing.T) {
+	certs := testcert.Generate(t)
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		wantOK   bool
+	}{
+		{"trusted certificate", certs.ClientCert, certs.ClientKey, true},
+		{"no certificate", "", "", false},
+		{"untrusted certificate", certs.OtherCert, certs.OtherKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer()
+			var err error
+			s.tls, err = loadTLSConfig(Config{
+				TLSCertFile: certs.ServerCert, TLSKeyFile: certs.ServerKey, TLSClientCAFile: certs.CA,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientConf := &tls.Config{RootCAs: caPool(t, certs.CA), ServerName: "localhost"}
+			if tt.certFile != "" {
+				cert, err := tls.LoadX509KeyPair(tt.certFile, tt.keyFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConf.Certificates = []tls.Certificate{cert}
+			}
+
+			client, done := serveTLS(t, s, clientConf)
+			// Write concurrently: on a rejected certificate the server sends
+			// an alert instead of reading, and the pipe is unbuffered.
+			go client.Write([]byte("HELO0\r\n"))
+			resp, _ := bufio.NewReader(client).ReadString('\n')
+
+			if got := strings.TrimSpace(resp) == "HELO"; got != tt.wantOK {
+				t.Errorf("got HELO response %q, want success %v", resp, tt.wantOK)
+			}
+			if tt.wantOK {
+				return
+			}
+			<-done
+			if got := testutil.ToFloat64(s.metrics.handshakeFailures.WithLabelValues("tls")); got != 1 {
+				t.Errorf("handshake failures{reason=\"tls\"} = %v, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+// udpReadBuffer is the socket receive buffer requested for the UDP
+// sockets, so that bursts are counted rather than dropped by the server's
+// own kernel.
+const udpReadBuffer = 4 * 1024 * 1024
+
+// udpTests routes the datagrams of running UDP tests, which arrive on the
+// UDP socket beside each listener, to their test by the token at the
+// start of each datagram.
+type udpTests struct {
+	mu    sync.RWMutex
+	tests map[uint64]*udpReceiver
+}
+
+func newUDPTests() *udpTests {
+	return &udpTests{tests: make(map[uint64]*udpReceiver)}
+}
+
+// open registers r under a new token. It returns the token and a func
+// that removes r once its test is over.
+func (u *udpTests) open(r *udpReceiver) (token uint64, closeTest func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		token = binary.BigEndian.Uint64(b[:])
+		if _, taken := u.tests[token]; !taken && token != 0 {
+			break
+		}
+	}
+	u.tests[token] = r
+	return token, func() {
+		u.mu.Lock()
+		delete(u.tests, token)
+		u.mu.Unlock()
+	}
+}
+
+// deliver counts datagram b, which arrived at now, towards its test.
+// Datagrams for unknown tests are dropped.
+func (u *udpTests) deliver(b []byte, now time.Time) {
+	h, ok := protocol.ParseUDPHeader(b)
+	if !ok {
+		return
+	}
+	u.mu.RLock()
+	r := u.tests[h.Token]
+	u.mu.RUnlock()
+	if r != nil {
+		r.add(h, len(b), now)
+	}
+}
+
+// udpReceiver keeps the counts of one UDP test. Sequence numbers are
+// tracked in a bitmap sized for twice the datagrams the test should
+// send; higher ones are ignored.
+type udpReceiver struct {
+	start time.Time
+	limit uint64
+
+	mu         sync.Mutex
+	seen       []uint64
+	received   int64
+	next       uint64 // one past the highest sequence number received
+	reordered  int64
+	duplicates int64
+	bytes      int64
+	last       time.Duration // arrival of the last datagram, since start
+	transit    time.Duration // of the previous datagram, for jitter
+	jitter     float64       // RFC 3550 interarrival jitter, in ns
+}
+
+func newUDPReceiver(p protocol.UDPParams, d time.Duration) *udpReceiver {
+	limit := uint64(2*p.Packets(d) + 64)
+	return &udpReceiver{
+		start: time.Now(),
+		limit: limit,
+		seen:  make([]uint64, (limit+63)/64),
+	}
+}
+
+// add counts a datagram of n bytes with header h that arrived at now.
+func (r *udpReceiver) add(h protocol.UDPHeader, n int, now time.Time) {
+	if h.Seq >= r.limit {
+		return
+	}
+	arrival := now.Sub(r.start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += int64(n)
+	r.last = arrival
+
+	word, bit := h.Seq/64, uint64(1)<<(h.Seq%64)
+	if r.seen[word]&bit != 0 {
+		r.duplicates++
+		return
+	}
+	r.seen[word] |= bit
+
+	if h.Seq < r.next {
+		r.reordered++
+	} else {
+		r.next = h.Seq + 1
+	}
+
+	// The client's clock only appears as a constant offset in the
+	// transit time, which cancels out in the difference.
+	transit := arrival - h.Sent
+	if r.received > 0 {
+		d := transit - r.transit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.transit = transit
+	r.received++
+}
+
+// stats returns the counts so far. Datagrams count as lost up to the
+// highest sequence number received, or up to sent if it is not negative.
+func (r *udpReceiver) stats(sent int64) protocol.UDPStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expected := int64(r.next)
+	if sent >= 0 {
+		expected = sent
+	}
+	return protocol.UDPStats{
+		Received:   r.received,
+		Lost:       max(expected-r.received, 0),
+		Reordered:  r.reordered,
+		Duplicates: r.duplicates,
+		Jitter:     time.Duration(r.jitter),
+		Bytes:      r.bytes,
+		Elapsed:    r.last,
+	}
+}
+
+// handleUDP runs a UDP test. The server sends the UDP port and the
+// test's token, and the client sends datagrams at the rate it asked for
+// while the server reports what has arrived in STAT lines. The client
+// ends the test by sending SENT and the number of datagrams it sent; the
+// server counts stragglers for protocol.UDPDrain and answers DONE with
+// the final counts.
+func (s *Server) handleUDP(c *conn) {
+	port, ok := localPort(c.rwc.LocalAddr())
+	if !ok {
+		fmt.Fprintf(c.rwc, "ERR:UDP tests are not available\n")
+		return
+	}
+	r := newUDPReceiver(c.udp, c.params.Duration)
+	token, closeTest := s.udp.open(r)
+	defer closeTest()
+
+	if _, err := fmt.Fprintf(c.rwc, "UDP %d %016x\n", port, token); err != nil {
+		return
+	}
+
+	stopReports := s.reportUDP(c, r)
+	sent, err := c.readSent(c.params.Duration + protocol.RecvGrace)
+	stopReports()
+	if err != nil {
+		stats := r.stats(-1)
+		s.logThroughput(c, "UDP", stats.Bytes, stats.Elapsed)
+		c.logger.Debug("udp test ended without a count", "addr", c.rwc.RemoteAddr(), "err", err)
+		return
+	}
+
+	time.Sleep(protocol.UDPDrain)
+	stats := r.stats(sent)
+	s.logThroughput(c, "UDP", stats.Bytes, stats.Elapsed)
+	c.logger.Info("udp",
+		"addr", c.rwc.RemoteAddr(),
+		"sent", sent,
+		"lost", stats.Lost,
+		"reordered", stats.Reordered,
+		"duplicates", stats.Duplicates,
+		"jitter", stats.Jitter)
+	fmt.Fprintf(c.rwc, "DONE %s\n", stats)
+}
+
+// reportUDP sends a STAT line with r's counts so far every
+// protocol.ReportInterval until the returned func is called.
+func (s *Server) reportUDP(c *conn, r *udpReceiver) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(protocol.ReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprintf(c.rwc, "STAT %s\n", r.stats(-1)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited // so that DONE is never interleaved with a STAT line
+	}
+}
+
+// readSent reads the SENT line that ends a UDP test, waiting at most
+// timeout, and returns the number of datagrams the client sent.
+func (c *conn) readSent(timeout time.Duration) (int64, error) {
+	c.rwc.SetReadDeadline(time.Now().Add(timeout))
+	defer c.rwc.SetReadDeadline(time.Time{})
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("read SENT: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	count, ok := strings.CutPrefix(line, "SENT ")
+	if !ok {
+		return 0, fmt.Errorf("expected SENT, got %q", line)
+	}
+	sent, err := strconv.ParseInt(count, 10, 64)
+	if err != nil || sent < 0 {
+		return 0, fmt.Errorf("invalid SENT count %q", count)
+	}
+	return sent, nil
+}
+
+// localPort returns the port of addr if it is a TCP address.
+func localPort(addr net.Addr) (int, bool) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return 0, false
+	}
+	return tcp.Port, true
+}
+
+// listenUDP binds the UDP socket for UDP tests beside the TCP listener
+// ln, which was bound for addr: same host, same port.
+func listenUDP(addr string, ln net.Listener) (net.PacketConn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	port, ok := localPort(ln.Addr())
+	if !ok {
+		return nil, fmt.Errorf("listener %s is not TCP", ln.Addr())
+	}
+	network := "udp" + strings.TrimPrefix(listenNetwork(addr), "tcp")
+	pc, err := net.ListenPacket(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if uc, ok := pc.(*net.UDPConn); ok {
+		uc.SetReadBuffer(udpReadBuffer)
+	}
+	return pc, nil
+}
+
+// serveUDP counts the datagrams that arrive on pc until it is closed.
+func (s *Server) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Debug("udp read", "addr", pc.LocalAddr(), "err", err)
+			continue
+		}
+		s.udp.deliver(buf[:n], time.Now())
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+)
+
+func TestUDPReceiver(t *testing.T) {
+	p := protocol.UDPParams{Rate: 96_000, Size: 1200} // 10 packets per second
+	r := newUDPReceiver(p, time.Second)
+	start := r.start
+
+	// Every datagram takes 10 ms, except 3, which takes 30 ms and arrives
+	// after 2; 4 never arrives, and 2 arrives twice.
+	arrivals := []struct {
+		seq     uint64
+		transit time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 10 * time.Millisecond},
+		{3, 30 * time.Millisecond},
+		{2, 10 * time.Millisecond},
+		{2, 10 * time.Millisecond},
+		{5, 10 * time.Millisecond},
+		{1 << 40, 0}, // beyond anything the test could send
+	}
+	for _, a := range arrivals {
+		sent := time.Duration(a.seq) * 100 * time.Millisecond
+		r.add(protocol.UDPHeader{Seq: a.seq, Sent: sent}, 1200, start.Add(sent+a.transit))
+	}
+
+	got := r.stats(-1)
+	want := protocol.UDPStats{Received: 5, Lost: 1, Reordered: 1, Duplicates: 1, Bytes: 6 * 1200}
+	if got.Received != want.Received || got.Lost != want.Lost || got.Reordered != want.Reordered ||
+		got.Duplicates != want.Duplicates || got.Bytes != want.Bytes {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	if got.Elapsed != 510*time.Millisecond {
+		t.Errorf("elapsed = %v, want the arrival of the last datagram", got.Elapsed)
+	}
+	// Successive transit times differ by 0, 20, 20, and 0 ms.
+	j := 20e6 / 16
+	j += (20e6 - j) / 16
+	j -= j / 16
+	if want := time.Duration(j); got.Jitter != want {
+		t.Errorf("jitter = %v, want %v", got.Jitter, want)
+	}
+
+	// Once the client says how many it sent, the tail counts as lost too.
+	if got := r.stats(8); got.Lost != 3 {
+		t.Errorf("lost with 8 sent = %d, want 3", got.Lost)
+	}
+}
+
+func TestReadCommand_UDP(t *testing.T) {
+	c, client := pipeConn()
+	defer c.rwc.Close()
+	defer client.Close()
+	c.version = 4
+
+	go client.Write([]byte("UDP rate=1000000 size=500\r\n"))
+	cmd, err := c.readCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (protocol.UDPParams{Rate: 1_000_000, Size: 500}); cmd != "UDP" || c.udp != want {
+		t.Errorf("readCommand = %q with %+v, want UDP with %+v", cmd, c.udp, want)
+	}
+
+	// Older clients don't know the command.
+	c.version = 3
+	reader := bufio.NewReader(client)
+	go client.Write([]byte("UDP rate=1000000 size=500\r\n"))
+	go reader.ReadString('\n')
+	if _, err := c.readCommand(); err == nil {
+		t.Error("version 3 client ran a UDP test")
+	}
+}
+
+func TestHandleConn_UDP(t *testing.T) {
+	addr := freeAddr(t, "tcp4", "127.0.0.1")
+	s := testServer()
+	s.cfg.ListenAddrs = []string{addr}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.ListenAndServe(ctx)
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "HELO4\nduration=1\n")
+	for i := 0; i < 6; i++ {
+		reader.ReadString('\n') // HELO, cname, location, params, limits, OPEN
+	}
+	p := protocol.UDPParams{Rate: 800_000, Size: 100} // 1000 packets per second
+	fmt.Fprintf(conn, "UDP %s\n", p)
+	if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != "GO" {
+		t.Fatalf("expected GO, got %q", line)
+	}
+	line, _ := reader.ReadString('\n')
+	var port int
+	var token uint64
+	if _, err := fmt.Sscanf(line, "UDP %d %x", &port, &token); err != nil {
+		t.Fatalf("parse %q: %v", line, err)
+	}
+
+	udp, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	b := make([]byte, p.Size)
+	const sent = 50
+	for seq := uint64(0); seq < sent; seq++ {
+		if seq == 10 {
+			continue // lost
+		}
+		protocol.UDPHeader{Token: token, Seq: seq}.Put(b)
+		udp.Write(b)
+		time.Sleep(time.Millisecond)
+	}
+	// Datagrams with another token belong to no test.
+	protocol.UDPHeader{Token: token + 1, Seq: 0}.Put(b)
+	udp.Write(b)
+	fmt.Fprintf(conn, "SENT %d\n", sent)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read report: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "STAT ") {
+			continue
+		}
+		stats, ok := strings.CutPrefix(line, "DONE ")
+		if !ok {
+			t.Fatalf("unexpected line %q", line)
+		}
+		got, err := protocol.ParseUDPStats(stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Received != sent-1 || got.Lost != 1 || got.Bytes != (sent-1)*int64(p.Size) {
+			t.Errorf("final stats %+v, want %d received and 1 lost", got, sent-1)
+		}
+		return
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/tls"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+const (
+	// wsIdleTimeout is how long a latency probe socket may sit idle.
+	wsIdleTimeout = 30 * time.Second
+	// wsChunkSize is how much random data a download sends per message.
+	wsChunkSize = 256 * 1024
+	// wsMaxMessage is the largest upload message the server accepts.
+	wsMaxMessage = 4 * 1024 * 1024
+	// maxResultSize bounds the samples a browser may send to be
+	// summarized.
+	maxResultSize = 4 * 1024 * 1024
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// webHandlers adds the browser test page to mux: the page itself,
+// WebSockets for its latency probes and test streams, and the summary of
+// its results. The page reserves tests and reads the server's parameters
+// with the HTTP transport's requests.
+func (s *Server) webHandlers(mux *http.ServeMux) {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("GET /", http.FileServerFS(root))
+	mux.HandleFunc("GET "+protocol.HTTPWebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		s.serveWebSocket(w, r, s.wsEcho)
+	})
+	mux.HandleFunc("GET "+protocol.HTTPWebSocketPath+"/download", func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocketTest(w, r, "SND")
+	})
+	mux.HandleFunc("GET "+protocol.HTTPWebSocketPath+"/upload", func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocketTest(w, r, "RCV")
+	})
+	mux.HandleFunc("POST "+protocol.HTTPResultsPath, s.handleWebResult)
+}
+
+// handleWebSocketTest opens a WebSocket for a stream of a reserved
+// download or upload test. For a download, the server sends random binary
+// messages for the test's duration and then closes. For an upload, it
+// counts the binary messages it receives until the page sends a text
+// message, and answers with a protocol.UploadReport.
+func (s *Server) handleWebSocketTest(w http.ResponseWriter, r *http.Request, cmd string) {
+	// Claiming the stream before the handshake lets a bad token fail
+	// with an HTTP status.
+	t, ip, ok := s.claimHTTPTest(w, r, cmd)
+	if !ok {
+		return
+	}
+	s.serveWebSocket(w, r, func(ws *websocket.Conn) {
+		defer s.httpTests.finish(t)
+		if cmd == "SND" {
+			s.wsDownload(ws, r, ip, t.params)
+		} else {
+			s.wsUpload(ws, r, ip, t.params)
+		}
+	})
+}
+
+// serveWebSocket completes the WebSocket handshake and runs handler on
+// the connection. Only pages served from this server may open one, so
+// that other sites can't borrow a visitor's credentials.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, handler websocket.Handler) {
+	websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			origin, err := websocket.Origin(cfg, r)
+			if err != nil || origin == nil || origin.Host != r.Host {
+				return errors.New("cross-origin WebSocket")
+			}
+			cfg.Origin = origin
+			return nil
+		},
+		Handler: handler,
+	}.ServeHTTP(w, r)
+}
+
+// wsEcho echoes text messages back, for the latency test.
+func (s *Server) wsEcho(ws *websocket.Conn) {
+	for {
+		ws.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return
+		}
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) wsDownload(ws *websocket.Conn, r *http.Request, ip netip.Addr, params protocol.Params) {
+	start := time.Now()
+	ws.PayloadType = websocket.BinaryFrame
+	ws.SetWriteDeadline(start.Add(params.Duration + protocol.RecvGrace))
+	timer := time.NewTimer(params.Duration)
+	defer timer.Stop()
+
+	var totalBytes int64
+	for offset := 0; ; offset = (offset + wsChunkSize) % len(s.randBuf) {
+		select {
+		case <-timer.C:
+			s.recordThroughput(s.logger, r.RemoteAddr, ip, "SND", totalBytes, time.Since(start))
+			return
+		default:
+		}
+		n, err := ws.Write(s.randBuf[offset : offset+wsChunkSize])
+		totalBytes += int64(n)
+		if err != nil {
+			s.recordThroughput(s.logger, r.RemoteAddr, ip, "SND", totalBytes, time.Since(start))
+			return
+		}
+	}
+}
+
+// wsMessage is a message received with wsCodec.
+type wsMessage struct {
+	text bool
+	data []byte
+}
+
+// wsCodec receives messages of either type, noting which it was.
+var wsCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		m := v.(*wsMessage)
+		m.text = payloadType == websocket.TextFrame
+		m.data = data
+		return nil
+	},
+}
+
+func (s *Server) wsUpload(ws *websocket.Conn, r *http.Request, ip netip.Addr, params protocol.Params) {
+	start := time.Now()
+	ws.MaxPayloadBytes = wsMaxMessage
+	// Grace period lets the page finish its last message
+	ws.SetReadDeadline(start.Add(params.Duration + protocol.RecvGrace))
+	counter := &receiveCounter{start: start}
+	for {
+		var msg wsMessage
+		if err := wsCodec.Receive(ws, &msg); err != nil {
+			s.logger.Debug("WebSocket upload", "addr", r.RemoteAddr, "err", err)
+			break
+		}
+		if msg.text {
+			break
+		}
+		counter.Write(msg.data)
+	}
+	s.recordThroughput(s.logger, r.RemoteAddr, ip, "RCV", counter.bytes.Load(), time.Since(start))
+
+	bytes, elapsed := counter.totals()
+	ws.SetWriteDeadline(time.Now().Add(protocol.RecvGrace))
+	websocket.JSON.Send(ws, protocol.UploadReport{Bytes: bytes, ElapsedMs: elapsed.Milliseconds()})
+}
+
+// handleWebResult summarizes the samples of a browser test. The page
+// sends a result.Result holding only its samples, and gets back the
+// result the Go client would have produced from them, with the server's
+// details filled in.
+func (s *Server) handleWebResult(w http.ResponseWriter, r *http.Request) {
+	var in result.Result
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxResultSize)).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid result: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	res := result.Recompute(&in)
+	res.ClientVersion = "web"
+	if s.cfg.Version != "" {
+		res.ClientVersion += "/" + s.cfg.Version
+	}
+	st := s.settings.Load()
+	res.Server = result.Server{
+		Addr:     r.Host,
+		Hostname: st.cname,
+		Location: st.location,
+		Version:  s.cfg.Version,
+	}
+	if res.Server.Hostname == "" {
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			res.Server.Hostname = host
+		} else {
+			res.Server.Hostname = r.Host
+		}
+	}
+	if r.TLS != nil {
+		res.Server.TLS = tls.VersionName(r.TLS.Version) + ", " + tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ap, err := netip.ParseAddrPort(local.String()); err == nil {
+			res.Server.IP = ap.Addr().Unmap().String()
+			res.Server.Family = "IPv6"
+			if ap.Addr().Unmap().Is4() {
+				res.Server.Family = "IPv4"
+			}
+		}
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,325 @@
+// The browser side of the web test. It runs the same tests as the
+// command-line client, with the parameters the server grants, and has
+// the server summarize its samples the way the client does, so that the
+// numbers are comparable. See docs/PROTOCOL.md for the requests.
+"use strict";
+
+const REPORT_INTERVAL = 500; // ms between throughput samples, as in the client
+const PING_INTERVAL = 100; // ms between latency probes
+const RECV_GRACE = 2000; // ms the server keeps receiving after an upload
+const UPLOAD_CHUNK = 256 * 1024;
+const UPLOAD_BUFFER = 4 * 1024 * 1024; // bytes queued on each upload socket
+
+const $ = (id) => document.getElementById(id);
+
+// Parameters in the page's own query string (duration, pings, streams)
+// are requested from the server, like the client's flags.
+function requested() {
+  const page = new URLSearchParams(location.search);
+  const q = new URLSearchParams();
+  for (const key of ["duration", "pings", "streams"]) {
+    if (page.has(key)) {
+      q.set(key, page.get(key));
+    }
+  }
+  return q;
+}
+
+// parseParams parses a parameter line, e.g. "duration=10 pings=30 streams=1".
+function parseParams(line) {
+  const params = {};
+  for (const field of line.trim().split(/\s+/)) {
+    const [key, value] = field.split("=");
+    params[key] = Number(value);
+  }
+  return params;
+}
+
+function status(text, error) {
+  $("status").textContent = text;
+  $("status").className = error ? "error" : "";
+}
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+const fmtMs = (v) => v.toFixed(2) + " ms";
+const fmtMbps = (v) => v.toFixed(1) + " Mbit/s";
+
+// refusal describes a failed request, including when to retry if the
+// server is busy or the client is rate limited.
+async function refusal(resp) {
+  const text = (await resp.text()).trim() || resp.status + " " + resp.statusText;
+  const retry = resp.headers.get("Retry-After");
+  return retry ? `${text}; try again in ${retry} s` : text;
+}
+
+async function hello() {
+  const resp = await fetch("/v1/hello?" + requested());
+  if (!resp.ok) {
+    throw new Error(await refusal(resp));
+  }
+  return resp.json();
+}
+
+// connect opens a WebSocket to the server. The socket's closed promise
+// resolves when it closes.
+function connect(path, token) {
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+  let url = scheme + "//" + location.host + path;
+  if (token) {
+    url += "?test=" + encodeURIComponent(token);
+  }
+  return new Promise((resolve, reject) => {
+    const ws = new WebSocket(url);
+    ws.binaryType = "arraybuffer";
+    ws.closed = new Promise((closed) => {
+      ws.onclose = (e) => {
+        reject(new Error("could not open a WebSocket to the server"));
+        closed(e);
+      };
+    });
+    ws.onopen = () => resolve(ws);
+  });
+}
+
+async function ping(count, samples) {
+  const ws = await connect("/v1/ws");
+  try {
+    for (let seq = 0; seq < count; seq++) {
+      const reply = new Promise((resolve, reject) => {
+        ws.onmessage = resolve;
+        ws.closed.then(() => reject(new Error("the server closed the connection")));
+      });
+      const time = new Date();
+      const start = performance.now();
+      ws.send("ping");
+      await reply;
+      const latency = performance.now() - start;
+
+      samples.push({ seq: seq, time: time.toISOString(), latency_ms: latency });
+      $("ping").textContent = fmtMs(latency);
+      status(`Latency: probe ${seq + 1} of ${count}`);
+      if (seq < count - 1) {
+        await sleep(Math.max(0, PING_INTERVAL - latency));
+      }
+    }
+  } finally {
+    ws.close();
+  }
+}
+
+// reserve reserves a download or upload test, showing the test's place in
+// the server's queue while it waits, and returns its token and parameters.
+async function reserve(test) {
+  const q = requested();
+  q.set("test", test);
+  const resp = await fetch("/v1/tests?" + q, { method: "POST" });
+  if (!resp.ok) {
+    throw new Error(await refusal(resp));
+  }
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buf = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      throw new Error("the server did not start the test");
+    }
+    buf += value;
+    let nl;
+    while ((nl = buf.indexOf("\n")) >= 0) {
+      const line = JSON.parse(buf.slice(0, nl));
+      buf = buf.slice(nl + 1);
+      if (line.test) {
+        reader.cancel();
+        return { token: line.test, params: parseParams(line.params) };
+      }
+      if (line.queue) {
+        status(`Waiting for the server (position ${line.queue})`);
+      }
+    }
+  }
+}
+
+// sample records the throughput of streams every REPORT_INTERVAL, from
+// the bytes each stream's count() reports, until the returned function
+// is called.
+function sample(streams, samples, cell, label) {
+  const prev = streams.map(() => 0);
+  let last = performance.now();
+  const timer = setInterval(() => {
+    const now = performance.now();
+    const seconds = (now - last) / 1000;
+    last = now;
+    const rates = streams.map((s, i) => {
+      const count = s.count();
+      const mbps = ((count - prev[i]) * 8) / seconds / 1e6;
+      prev[i] = count;
+      return mbps;
+    });
+    const s = { time: new Date().toISOString(), mbps: rates.reduce((a, b) => a + b, 0) };
+    if (streams.length > 1) {
+      s.streams = rates;
+    }
+    samples.push(s);
+    $(cell).textContent = fmtMbps(s.mbps);
+    status(`${label}: ${fmtMbps(s.mbps)}`);
+  }, REPORT_INTERVAL);
+  return () => clearInterval(timer);
+}
+
+async function download(samples) {
+  const { token, params } = await reserve("download");
+  status("Download: starting");
+  const sockets = await Promise.all(
+    Array.from({ length: params.streams }, () => connect("/v1/ws/download", token)),
+  );
+  const streams = sockets.map((ws) => {
+    const s = { bytes: 0, count: () => s.bytes };
+    ws.onmessage = (e) => {
+      s.bytes += e.data.byteLength;
+    };
+    return s;
+  });
+
+  const stop = sample(streams, samples, "download", "Download");
+  await Promise.race([
+    Promise.all(sockets.map((ws) => ws.closed)),
+    sleep(params.duration * 1000 + RECV_GRACE),
+  ]);
+  stop();
+  sockets.forEach((ws) => ws.close());
+}
+
+async function upload(samples, totals) {
+  const chunk = new Uint8Array(UPLOAD_CHUNK);
+  for (let i = 0; i < chunk.length; i += 65536) {
+    crypto.getRandomValues(chunk.subarray(i, i + 65536));
+  }
+
+  const { token, params } = await reserve("upload");
+  status("Upload: starting");
+  const sockets = await Promise.all(
+    Array.from({ length: params.streams }, () => connect("/v1/ws/upload", token)),
+  );
+  // What has left the browser is what was sent less what is still queued.
+  const streams = sockets.map((ws) => {
+    const s = { sent: 0, count: () => s.sent - ws.bufferedAmount };
+    return s;
+  });
+  const fill = () => {
+    sockets.forEach((ws, i) => {
+      while (ws.readyState === WebSocket.OPEN && ws.bufferedAmount < UPLOAD_BUFFER) {
+        ws.send(chunk);
+        streams[i].sent += chunk.length;
+      }
+    });
+  };
+  fill();
+  const pump = setInterval(fill, 5);
+  const stop = sample(streams, samples, "upload", "Upload");
+  await sleep(params.duration * 1000);
+  clearInterval(pump);
+  stop();
+
+  // The server answers each stream with what it received once the page
+  // says it is done. A stream that doesn't answer in time leaves the
+  // page's own measurement to stand.
+  const reports = await Promise.all(
+    sockets.map(
+      (ws) =>
+        new Promise((resolve) => {
+          ws.onmessage = (e) => resolve(JSON.parse(e.data));
+          ws.closed.then(() => resolve(null));
+          setTimeout(() => resolve(null), RECV_GRACE);
+          ws.send("done");
+        }),
+    ),
+  );
+  sockets.forEach((ws) => ws.close());
+  if (reports.every((r) => r)) {
+    const bytes = reports.reduce((sum, r) => sum + r.bytes, 0);
+    const elapsed = Math.max(...reports.map((r) => r.elapsed_ms));
+    if (elapsed > 0) {
+      totals.server_bytes = bytes;
+      totals.server_mbps = (bytes * 8) / (elapsed / 1000) / 1e6;
+    }
+  }
+}
+
+// summarize has the server compute the result from the samples.
+async function summarize(doc) {
+  const resp = await fetch("/v1/results", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(doc),
+  });
+  if (!resp.ok) {
+    throw new Error(await refusal(resp));
+  }
+  return resp.json();
+}
+
+function show(res) {
+  const p = res.ping;
+  $("ping").textContent =
+    `avg ${fmtMs(p.mean_ms)}, min ${fmtMs(p.min_ms)}, max ${fmtMs(p.max_ms)}; ` +
+    `median ${fmtMs(p.median_ms)}, p95 ${fmtMs(p.p95_ms)}, jitter ${fmtMs(p.jitter_ms)}`;
+  for (const kind of ["download", "upload"]) {
+    const t = res[kind];
+    let text = `avg ${fmtMbps(t.mean_mbps)}, max ${fmtMbps(t.max_mbps)}, steady ${fmtMbps(t.steady_mbps)}`;
+    if (t.server_mbps) {
+      text += `, server-confirmed ${fmtMbps(t.server_mbps)}`;
+    }
+    $(kind).textContent = text;
+  }
+
+  const blob = new Blob([JSON.stringify(res, null, 2)], { type: "application/json" });
+  $("json").href = URL.createObjectURL(blob);
+  $("details").hidden = false;
+}
+
+async function run(pings) {
+  $("start").disabled = true;
+  $("details").hidden = true;
+  for (const cell of ["ping", "download", "upload"]) {
+    $(cell).textContent = "–";
+  }
+  try {
+    const doc = {
+      start: new Date().toISOString(),
+      ping: { samples: [] },
+      download: { samples: [] },
+      upload: { samples: [] },
+    };
+    await ping(pings, doc.ping.samples);
+    await download(doc.download.samples);
+    await upload(doc.upload.samples, doc.upload);
+    doc.end = new Date().toISOString();
+
+    status("Summarizing");
+    show(await summarize(doc));
+    status("Done");
+  } catch (err) {
+    status("Error: " + err.message, true);
+  } finally {
+    $("start").disabled = false;
+  }
+}
+
+hello().then(
+  (h) => {
+    const params = parseParams(h.params);
+    let server = h.cname || location.hostname;
+    if (h.location) {
+      server += ` (${h.location})`;
+    }
+    $("server").textContent =
+      `Server: ${server}. ${params.pings} latency probes, ` +
+      `${params.duration} s download and upload with ${params.streams} stream${params.streams === 1 ? "" : "s"}.`;
+    $("start").onclick = () => run(params.pings);
+    $("start").disabled = false;
+  },
+  (err) => {
+    $("server").textContent = "";
+    status("Error: " + err.message, true);
+  },
+);
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+	"github.com/chrissnell/sparkyfish/pkg/result"
+)
+
+// webTestServer serves s's HTTP transport with the web test page.
+func webTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	s.cfg.Web = true
+	return httpTestServer(t, s)
+}
+
+func dialWeb(t *testing.T, ts *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func TestWeb_Page(t *testing.T) {
+	ts := webTestServer(t, testServer())
+
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %s", path, resp.Status)
+		}
+	}
+
+	// Without -web, only the HTTP transport is served.
+	ts = httpTestServer(t, testServer())
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET / without the web page: %s, want 404", resp.Status)
+	}
+}
+
+func TestWeb_Ping(t *testing.T) {
+	ts := webTestServer(t, testServer())
+	ws := dialWeb(t, ts, protocol.HTTPWebSocketPath)
+
+	for range 3 {
+		if err := websocket.Message.Send(ws, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != "ping" {
+			t.Errorf("echo %q, want %q", reply, "ping")
+		}
+	}
+}
+
+func TestWeb_CrossOrigin(t *testing.T) {
+	ts := webTestServer(t, testServer())
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + protocol.HTTPWebSocketPath
+	if ws, err := websocket.Dial(url, "", "https://evil.example.com"); err == nil {
+		ws.Close()
+		t.Error("WebSocket opened from another origin")
+	}
+}
+
+func TestWeb_DownloadAndUpload(t *testing.T) {
+	s := testServer()
+	s.queue = newTestQueue(1, 0)
+	ts := webTestServer(t, s)
+
+	status, resp := reserve(t, ts, "test=download&duration=1")
+	if resp.StatusCode != http.StatusOK || status.Test == "" {
+		t.Fatalf("reserve: %s %+v", resp.Status, status)
+	}
+	ws := dialWeb(t, ts, protocol.HTTPWebSocketPath+"/download?test="+status.Test)
+	n, err := io.Copy(io.Discard, ws)
+	if err != nil || n == 0 {
+		t.Errorf("download received %d bytes: %v", n, err)
+	}
+	ws.Close()
+
+	// The slot is free again once the download has finished.
+	for i := 0; ; i++ {
+		if status, resp = reserve(t, ts, "test=upload&duration=1"); resp.StatusCode == http.StatusOK {
+			break
+		} else if i == 100 {
+			t.Fatalf("reserve upload: %s", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ws = dialWeb(t, ts, protocol.HTTPWebSocketPath+"/upload?test="+status.Test)
+	ws.PayloadType = websocket.BinaryFrame
+	for range 10 {
+		if _, err := ws.Write(make([]byte, 10_000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := websocket.Message.Send(ws, "done"); err != nil {
+		t.Fatal(err)
+	}
+	var report protocol.UploadReport
+	if err := websocket.JSON.Receive(ws, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Bytes != 100_000 {
+		t.Errorf("upload report %+v, want 100000 bytes", report)
+	}
+}
+
+func TestWeb_UnknownTest(t *testing.T) {
+	ts := webTestServer(t, testServer())
+	resp, err := http.Get(ts.URL + protocol.HTTPWebSocketPath + "/download?test=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown test: %s, want 404", resp.Status)
+	}
+}
+
+func TestWeb_Result(t *testing.T) {
+	s := testServer()
+	s.cfg.Version = "1.2.3"
+	s.settings.Store(&settings{cname: "speedtest.example.com", location: "Dallas, TX"})
+	ts := webTestServer(t, s)
+
+	body := `{
+		"ping": {"samples": [{"seq": 0, "latency_ms": 10}, {"seq": 1, "latency_ms": 20}]},
+		"download": {"samples": [{"mbps": 100}, {"mbps": 300}], "mean_mbps": 1},
+		"upload": {"samples": [{"mbps": 50}], "server_bytes": 6250000, "server_mbps": 50}
+	}`
+	resp, err := http.Post(ts.URL+protocol.HTTPResultsPath, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res result.Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.ClientVersion != "web/1.2.3" {
+		t.Errorf("client version %q, want web/1.2.3", res.ClientVersion)
+	}
+	want := result.Server{
+		Addr:     strings.TrimPrefix(ts.URL, "http://"),
+		Hostname: "speedtest.example.com",
+		Location: "Dallas, TX",
+		Version:  "1.2.3",
+		IP:       "127.0.0.1",
+		Family:   "IPv4",
+	}
+	if res.Server != want {
+		t.Errorf("server %+v, want %+v", res.Server, want)
+	}
+	if res.Ping.MeanMs != 15 || res.Download.MeanMbps != 200 || res.Upload.ServerMbps != 50 {
+		t.Errorf("aggregates: ping %+v, download %+v, upload %+v", res.Ping, res.Download, res.Upload)
+	}
+}
@@ -0,0 +1,109 @@
+package serverlist
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+const (
+	// ProbePings is the number of latency probes to request from each
+	// candidate server.
+	ProbePings = 3
+	// probeTimeout bounds the probe of one server, so that a dead server
+	// can't hold up the choice.
+	probeTimeout = 5 * time.Second
+	// maxProbes is how many servers are probed at once.
+	maxProbes = 8
+)
+
+// Probe is the outcome of a short latency test against one server.
+type Probe struct {
+	Server  Server
+	Latency time.Duration // lowest round trip measured; 0 if Err is set
+	Err     error
+}
+
+// Rank runs a short ECO test against every server, several at a time,
+// using a fresh backend from newBackend for each. The backend should ask
+// for ProbePings probes. Probes are returned fastest first, followed by
+// the servers that could not be reached, in list order.
+func Rank(ctx context.Context, servers []Server, newBackend func() backend.Backend) []Probe {
+	probes := make([]Probe, len(servers))
+	sem := make(chan struct{}, maxProbes)
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			latency, err := probe(ctx, newBackend(), s.Addr())
+			probes[i] = Probe{Server: s, Latency: latency, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortStableFunc(probes, func(a, b Probe) int {
+		if (a.Err == nil) != (b.Err == nil) {
+			if a.Err == nil {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Latency, b.Latency)
+	})
+	return probes
+}
+
+// Nearest returns the fastest server of probes, as returned by Rank, or
+// an error if none could be reached.
+func Nearest(probes []Probe) (Probe, error) {
+	if len(probes) == 0 || probes[0].Err != nil {
+		return Probe{}, errors.New("no server could be reached")
+	}
+	return probes[0], nil
+}
+
+// probe connects to addr and returns the lowest latency of a ping test.
+func probe(ctx context.Context, b backend.Backend, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	if _, err := b.Connect(ctx, addr); err != nil {
+		return 0, err
+	}
+	ch := make(chan backend.PingSample, ProbePings)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.Ping(ctx, ch)
+	}()
+
+	// Don't wait for a backend that ignores ctx while it blocks on a
+	// server that stopped answering.
+	var best time.Duration
+	for done := false; !done; {
+		select {
+		case s, ok := <-ch:
+			if !ok {
+				done = true
+			} else if best == 0 || s.Latency < best {
+				best = s.Latency
+			}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	if err := <-errCh; err != nil {
+		return 0, err
+	}
+	if best == 0 {
+		return 0, errors.New("no ping samples received")
+	}
+	return best, nil
+}
@@ -0,0 +1,148 @@
+// Package serverlist reads lists of sparkyfish servers and picks the one
+// with the lowest latency.
+//
+// A server list is a JSON document:
+//
+//	{
+//	  "servers": [
+//	    {
+//	      "host": "us-seattle.sparkyfish.chrissnell.com",
+//	      "port": 7121,
+//	      "location": "Seattle, WA",
+//	      "coordinates": {"lat": 47.61, "lon": -122.33},
+//	      "capacity_mbps": 150
+//	    }
+//	  ]
+//	}
+//
+// Only host is required; port defaults to 7121. Lists served by a
+// registry (see package registry) also give each server's load.
+package serverlist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port of servers that don't list one.
+const DefaultPort = 7121
+
+// maxListSize caps the size of a server list fetched over HTTP.
+const maxListSize = 4 * 1024 * 1024
+
+// List is a server list document.
+type List struct {
+	Servers []Server `json:"servers"`
+}
+
+// Server is one entry of a server list.
+type Server struct {
+	Host         string       `json:"host"`
+	Port         int          `json:"port,omitempty"`
+	Location     string       `json:"location,omitempty"`
+	Coordinates  *Coordinates `json:"coordinates,omitempty"`
+	CapacityMbps int          `json:"capacity_mbps,omitempty"` // link capacity; 0 if unknown
+	Load         *TestLoad    `json:"load,omitempty"`          // as last reported to a registry; nil in static lists
+}
+
+// TestLoad is a server's throughput test load.
+type TestLoad struct {
+	Running  int `json:"running"`   // tests holding a test slot
+	Queued   int `json:"queued"`    // tests waiting for a slot
+	MaxTests int `json:"max_tests"` // concurrent tests allowed; 0 for unlimited
+}
+
+// Coordinates locate a server, in decimal degrees.
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Addr returns the host:port to connect to s at.
+func (s Server) Addr() string {
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// Load reads a server list from source, a file path or an http:// or
+// https:// URL.
+func Load(ctx context.Context, source string) ([]Server, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetch(ctx, source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load server list: %w", err)
+	}
+	servers, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("load server list %s: %w", source, err)
+	}
+	return servers, nil
+}
+
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxListSize {
+		return nil, fmt.Errorf("GET %s: server list larger than %d bytes", url, maxListSize)
+	}
+	return data, nil
+}
+
+// Parse decodes and checks a server list document.
+func Parse(data []byte) ([]Server, error) {
+	var list List
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Servers) == 0 {
+		return nil, errors.New("no servers listed")
+	}
+	for i, s := range list.Servers {
+		if s.Host == "" {
+			return nil, fmt.Errorf("server %d: host is required", i+1)
+		}
+		if s.Port < 0 || s.Port > 65535 {
+			return nil, fmt.Errorf("server %d (%s): invalid port %d", i+1, s.Host, s.Port)
+		}
+		if c := s.Coordinates; c != nil && (c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180) {
+			return nil, fmt.Errorf("server %d (%s): coordinates out of range", i+1, s.Host)
+		}
+		if s.CapacityMbps < 0 {
+			return nil, fmt.Errorf("server %d (%s): capacity must not be negative", i+1, s.Host)
+		}
+	}
+	return list.Servers, nil
+}
@@ -0,0 +1,180 @@
+package serverlist
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrissnell/sparkyfish/pkg/backend"
+)
+
+const testList = `{
+  "servers": [
+    {"host": "us-seattle.example.com", "location": "Seattle, WA", "coordinates": {"lat": 47.61, "lon": -122.33}, "capacity_mbps": 150},
+    {"host": "2001:db8::1", "port": 7122}
+  ]
+}`
+
+var testServers = []Server{
+	{Host: "us-seattle.example.com", Location: "Seattle, WA", Coordinates: &Coordinates{Lat: 47.61, Lon: -122.33}, CapacityMbps: 150},
+	{Host: "2001:db8::1", Port: 7122},
+}
+
+func TestParse(t *testing.T) {
+	got, err := Parse([]byte(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testServers) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", got, testServers)
+	}
+	if addr := got[0].Addr(); addr != "us-seattle.example.com:7121" {
+		t.Errorf("Addr() = %q", addr)
+	}
+	if addr := got[1].Addr(); addr != "[2001:db8::1]:7122" {
+		t.Errorf("Addr() = %q", addr)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"not JSON", "servers:", "invalid character"},
+		{"empty", `{"servers": []}`, "no servers listed"},
+		{"no host", `{"servers": [{"port": 7121}]}`, "server 1: host is required"},
+		{"port", `{"servers": [{"host": "a"}, {"host": "b", "port": 70000}]}`, "server 2 (b): invalid port"},
+		{"coordinates", `{"servers": [{"host": "a", "coordinates": {"lat": 91, "lon": 0}}]}`, "coordinates out of range"},
+		{"capacity", `{"servers": [{"host": "a", "capacity_mbps": -1}]}`, "capacity must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoad_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	if err := os.WriteFile(path, []byte(testList), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testServers) {
+		t.Errorf("Load:\n got %+v\nwant %+v", got, testServers)
+	}
+}
+
+func TestLoad_URL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/servers.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testList))
+	}))
+	defer srv.Close()
+
+	got, err := Load(context.Background(), srv.URL+"/servers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testServers) {
+		t.Errorf("Load:\n got %+v\nwant %+v", got, testServers)
+	}
+
+	if _, err := Load(context.Background(), srv.URL+"/missing.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
+
+// fakeBackend answers pings with a fixed latency per server address, or
+// fails to connect to addresses without one.
+type fakeBackend struct {
+	latency map[string]time.Duration
+	addr    string
+}
+
+func (b *fakeBackend) Connect(ctx context.Context, addr string) (backend.ServerInfo, error) {
+	if _, ok := b.latency[addr]; !ok {
+		return backend.ServerInfo{}, errors.New("connection refused")
+	}
+	b.addr = addr
+	return backend.ServerInfo{}, nil
+}
+
+func (b *fakeBackend) Ping(ctx context.Context, results chan<- backend.PingSample) error {
+	defer close(results)
+	base := b.latency[b.addr]
+	for i := 0; i < ProbePings; i++ {
+		// The first probe is the slowest, as when a connection warms up.
+		results <- backend.PingSample{Seq: i, Latency: base + time.Duration(ProbePings-i)*time.Millisecond}
+	}
+	return nil
+}
+
+func (b *fakeBackend) Download(context.Context, chan<- backend.ThroughputSample) error { return nil }
+func (b *fakeBackend) Upload(context.Context, chan<- backend.ThroughputSample) error   { return nil }
+func (b *fakeBackend) Close() error                                                    { return nil }
+
+func TestRank(t *testing.T) {
+	servers := []Server{{Host: "far"}, {Host: "down"}, {Host: "near"}, {Host: "mid"}, {Host: "gone"}}
+	latency := map[string]time.Duration{
+		"far:7121":  80 * time.Millisecond,
+		"near:7121": 5 * time.Millisecond,
+		"mid:7121":  20 * time.Millisecond,
+	}
+	probes := Rank(context.Background(), servers, func() backend.Backend {
+		return &fakeBackend{latency: latency}
+	})
+
+	var order []string
+	for _, p := range probes {
+		order = append(order, p.Server.Host)
+	}
+	if want := []string{"near", "mid", "far", "down", "gone"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %q, want %q", order, want)
+	}
+	if got, want := probes[0].Latency, 6*time.Millisecond; got != want {
+		t.Errorf("latency = %v, want the lowest probe, %v", got, want)
+	}
+	if probes[3].Err == nil || probes[4].Err == nil {
+		t.Error("unreachable servers should carry their error")
+	}
+
+	nearest, err := Nearest(probes)
+	if err != nil || nearest.Server.Host != "near" {
+		t.Errorf("Nearest = %+v, %v; want near", nearest, err)
+	}
+}
+
+func TestNearest_NoneReachable(t *testing.T) {
+	probes := Rank(context.Background(), []Server{{Host: "down"}}, func() backend.Backend {
+		return &fakeBackend{}
+	})
+	if _, err := Nearest(probes); err == nil {
+		t.Error("expected an error when no server is reachable")
+	}
+}
+
+// The list of public servers in docs is a valid server list.
+func TestLoad_PublicServers(t *testing.T) {
+	if _, err := Load(context.Background(), "../../docs/servers.json"); err != nil {
+		t.Fatal(err)
+	}
+}
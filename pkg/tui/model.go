@@ -16,16 +16,16 @@ import (
 
 	"github.com/chrissnell/sparkyfish/pkg/backend"
 	"github.com/chrissnell/sparkyfish/pkg/measure"
+	"github.com/chrissnell/sparkyfish/pkg/protocol"
+	"github.com/chrissnell/sparkyfish/pkg/result"
 )
 
 const (
 	minWidth  = 60
 	minHeight = 24
 
-	// Expected sample counts per phase, used to scale charts to full width.
-	expectedPingSamples = 30 // numPings
-	expectedDlSamples  = 24 // (10s + 2s grace) / 500ms
-	expectedUlSamples  = 20 // 10s / 500ms
+	// sampleInterval is how often backends report throughput samples.
+	sampleInterval = 500 * time.Millisecond
 )
 
 type phase int
@@ -35,6 +35,7 @@ const (
 	phasePing
 	phaseDownload
 	phaseUpload
+	phaseUDP
 	phaseDone
 	phaseError
 )
@@ -58,11 +59,29 @@ type (
 		sample backend.ThroughputSample
 		ch     <-chan backend.ThroughputSample
 	}
+	udpSampleMsg struct {
+		sample backend.UDPSample
+		ch     <-chan backend.UDPSample
+		errCh  <-chan error
+	}
+	udpDoneMsg struct{ err error }
 )
 
+// Options adjusts the display to match how the backend was configured.
+type Options struct {
+	// LoadedLatency shows the latency measured during the throughput
+	// tests next to the idle latency.
+	LoadedLatency bool
+
+	// UDP runs a UDP test after the upload and shows its loss and jitter
+	// in a panel of its own. The backend must implement backend.UDPTester.
+	UDP bool
+}
+
 type Model struct {
 	backend backend.Backend
 	addr    string
+	opts    Options
 	ctx     context.Context
 	cancel  context.CancelFunc
 
@@ -71,6 +90,18 @@ type Model struct {
 	height int
 
 	serverInfo backend.ServerInfo
+	queuePos   int // position in the server's test queue, 0 if not waiting
+
+	// Expected sample counts per phase, derived from the negotiated test
+	// parameters and used to scale charts to full width.
+	expectedPingSamples int
+	expectedDlSamples   int
+	expectedUlSamples   int
+	expectedUDPSamples  int
+
+	// Raw samples and aggregates for export after the run
+	res       *result.Result
+	completed []*result.Result // every run that finished, oldest first
 
 	// Latency data
 	pings     []time.Duration
@@ -79,6 +110,9 @@ type Model struct {
 	pingMean  time.Duration
 	pingStdev time.Duration
 
+	// Latency measured during the throughput tests, both directions
+	loaded []time.Duration
+
 	// Throughput data
 	dlSamples []float64
 	ulSamples []float64
@@ -89,10 +123,25 @@ type Model struct {
 	ulMax     float64
 	ulAvg     float64
 
+	// Latest per-stream rates of a multi-stream test, nil otherwise
+	dlStreams []float64
+	ulStreams []float64
+
+	// Upload rate reported by the server: the latest interim rate, then
+	// the average from its final report
+	ulServer float64
+
+	// UDP test progress: reports received, the latest received rate, and
+	// the error that ended the test early, if any
+	udpReports int
+	udpCur     float64
+	udpErr     error
+
 	// Chart sub-models
 	dlChart      streamlinechart.Model
 	ulChart      streamlinechart.Model
 	latencyChart sparkline.Model
+	loadedChart  sparkline.Model
 
 	// Columns pushed so far per chart, for proportional fill
 	dlColsPushed  int
@@ -102,11 +151,12 @@ type Model struct {
 	err error
 }
 
-func New(b backend.Backend, addr string) Model {
+func New(b backend.Backend, addr string, opts Options) Model {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	chartStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("10")) // green
-	latStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("14"))   // cyan
+	chartStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("10"))  // green
+	latStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("14"))    // cyan
+	loadedStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("11")) // yellow
 
 	dlChart := streamlinechart.New(26, 10,
 		streamlinechart.WithStyles(runes.ArcLineStyle, chartStyle),
@@ -119,17 +169,25 @@ func New(b backend.Backend, addr string) Model {
 	latencyChart := sparkline.New(28, 3,
 		sparkline.WithStyle(latStyle),
 	)
+	loadedChart := sparkline.New(28, 3,
+		sparkline.WithStyle(loadedStyle),
+	)
 
-	return Model{
+	m := Model{
 		backend:      b,
 		addr:         addr,
+		opts:         opts,
 		ctx:          ctx,
 		cancel:       cancel,
 		phase:        phaseConnecting,
+		res:          result.New(addr, time.Now()),
 		dlChart:      dlChart,
 		ulChart:      ulChart,
 		latencyChart: latencyChart,
+		loadedChart:  loadedChart,
 	}
+	m.setExpectedSamples()
+	return m
 }
 
 func (m Model) Init() tea.Cmd {
@@ -158,6 +216,8 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case serverInfoMsg:
 		m.serverInfo = backend.ServerInfo(msg)
+		m.res.SetServer(m.serverInfo)
+		m.setExpectedSamples()
 		m.phase = phasePing
 		return m, m.startPingCmd()
 
@@ -170,6 +230,14 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, m.startDownloadCmd()
 
 	case dlSampleMsg:
+		if m.setQueuePos(msg.sample) {
+			return m, waitForThroughput(msg.ch, false)
+		}
+		if msg.sample.Latency > 0 {
+			m.res.AddDownload(msg.sample)
+			m.addLoadedSample(msg.sample)
+			return m, waitForThroughput(msg.ch, false)
+		}
 		m.addDlSample(msg.sample)
 		return m, waitForThroughput(msg.ch, false)
 
@@ -178,12 +246,41 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, m.startUploadCmd()
 
 	case ulSampleMsg:
+		if m.setQueuePos(msg.sample) {
+			return m, waitForThroughput(msg.ch, true)
+		}
+		if msg.sample.Latency > 0 {
+			m.res.AddUpload(msg.sample)
+			m.addLoadedSample(msg.sample)
+			return m, waitForThroughput(msg.ch, true)
+		}
+		if msg.sample.Server != nil {
+			m.res.AddUpload(msg.sample)
+			m.ulServer = msg.sample.Server.Mbps()
+			return m, waitForThroughput(msg.ch, true)
+		}
 		m.addUlSample(msg.sample)
 		return m, waitForThroughput(msg.ch, true)
 
 	case ulDoneMsg:
-		m.phase = phaseDone
-		return m, nil
+		if m.opts.UDP {
+			m.phase = phaseUDP
+			return m, m.startUDPCmd()
+		}
+		return m.finish(), nil
+
+	case udpSampleMsg:
+		m.queuePos = msg.sample.QueuePosition
+		if msg.sample.QueuePosition == 0 {
+			m.addUDPSample(msg.sample)
+		}
+		return m, waitForUDP(msg.ch, msg.errCh)
+
+	case udpDoneMsg:
+		// A failed UDP test doesn't invalidate the TCP results, so the
+		// error is shown in the UDP panel rather than replacing the view.
+		m.udpErr = msg.err
+		return m.finish(), nil
 
 	case testErrorMsg:
 		m.err = msg.err
@@ -224,6 +321,11 @@ func (m Model) View() string {
 	// Throughput summary
 	sections = append(sections, m.renderSummary())
 
+	// UDP loss and jitter
+	if m.opts.UDP {
+		sections = append(sections, m.renderUDP())
+	}
+
 	// Progress bar
 	sections = append(sections, m.renderProgress())
 
@@ -233,6 +335,18 @@ func (m Model) View() string {
 	return lipgloss.JoinVertical(lipgloss.Left, sections...)
 }
 
+// Result returns the result of the most recent run and whether that run
+// completed all tests.
+func (m Model) Result() (*result.Result, bool) {
+	return m.res, m.phase == phaseDone
+}
+
+// Completed returns every run that finished during this session, including
+// those discarded by a retest, oldest first.
+func (m Model) Completed() []*result.Result {
+	return m.completed
+}
+
 // --- Rendering helpers ---
 
 func (m Model) renderTitle() string {
@@ -253,6 +367,17 @@ func (m Model) renderBanner() string {
 	if m.serverInfo.Location != "" {
 		banner += " :: " + m.serverInfo.Location
 	}
+	if m.serverInfo.Family != "" && m.serverInfo.IP != "" {
+		banner += "  [" + m.serverInfo.Family + " " + m.serverInfo.IP + "]"
+	} else if m.serverInfo.Family != "" {
+		banner += "  [" + m.serverInfo.Family + "]"
+	}
+	if m.serverInfo.TLS != "" {
+		banner += "  [" + m.serverInfo.TLS + "]"
+	}
+	if m.queuePos > 0 {
+		banner += fmt.Sprintf("  --  waiting for server (position %d)", m.queuePos)
+	}
 	if len(banner) > m.width {
 		banner = banner[:m.width]
 	}
@@ -266,23 +391,52 @@ func (m Model) renderLatencyRow() string {
 	}
 
 	m.latencyChart.Draw()
-	sparkView := latencyLabelStyle.Render("Latency") + "\n" + m.latencyChart.View()
-	left := lipgloss.NewStyle().Width(chartW).Render(sparkView)
+	var left string
+	if m.opts.LoadedLatency {
+		m.loadedChart.Draw()
+		idle := latencyLabelStyle.Render("Idle") + "\n" + m.latencyChart.View()
+		loaded := latencyLabelStyle.Render("Under load") + "\n" + m.loadedChart.View()
+		left = lipgloss.NewStyle().Width(chartW).Render(
+			lipgloss.JoinHorizontal(lipgloss.Top, idle, " ", loaded))
+	} else {
+		sparkView := latencyLabelStyle.Render("Latency") + "\n" + m.latencyChart.View()
+		left = lipgloss.NewStyle().Width(chartW).Render(sparkView)
+	}
 
 	var stats string
 	if len(m.pings) > 0 {
-		stats = fmt.Sprintf("Cur/Min/Max\n%.2f/%.2f/%.2f ms\nAvg/σ\n%.2f/%.2f ms",
+		stats = fmt.Sprintf("Cur/Min/Max\n%.2f/%.2f/%.2f ms\nAvg/σ/Jitter\n%.2f/%.2f/%.2f ms",
 			ms(m.pings[len(m.pings)-1]),
 			ms(m.pingMin), ms(m.pingMax),
-			ms(m.pingMean), ms(m.pingStdev))
+			ms(m.pingMean), ms(m.pingStdev), m.res.Ping.JitterMs)
 	} else {
-		stats = "Cur/Min/Max\n--/--/-- ms\nAvg/σ\n--/-- ms"
+		stats = "Cur/Min/Max\n--/--/-- ms\nAvg/σ/Jitter\n--/--/-- ms"
 	}
 	right := latencyStatsStyle.Render(stats)
+	if m.opts.LoadedLatency {
+		right = lipgloss.JoinHorizontal(lipgloss.Top, right, "   ",
+			latencyStatsStyle.Render(m.loadedStats()))
+	}
 
 	return lipgloss.JoinHorizontal(lipgloss.Top, left, right)
 }
 
+// loadedStats formats the mean latency under load of each throughput
+// test, its increase over idle, and the responsiveness it implies, with
+// dashes for tests without probes yet.
+func (m Model) loadedStats() string {
+	latency, increase, rpm := [2]string{"--", "--"}, [2]string{"--", "--"}, [2]string{"--", "--"}
+	for i, l := range []*result.LoadedLatency{m.res.Download.LoadedLatency, m.res.Upload.LoadedLatency} {
+		if l != nil {
+			latency[i] = fmt.Sprintf("%.2f", l.MeanMs)
+			increase[i] = fmt.Sprintf("%+.2f", l.IncreaseMs)
+			rpm[i] = fmt.Sprintf("%d", l.RPM)
+		}
+	}
+	return fmt.Sprintf("Under load DL/UL\n%s/%s ms\n%s/%s ms\n%s/%s RPM",
+		latency[0], latency[1], increase[0], increase[1], rpm[0], rpm[1])
+}
+
 func (m Model) renderChartsRow() string {
 	chartW := m.width/2 - 1
 	if chartW < 10 {
@@ -309,14 +463,17 @@ func (m Model) renderChartsRow() string {
 }
 
 func (m Model) renderSummary() string {
-	dl := fmt.Sprintf("Current: %.1f Mbit/s\tMax: %.1f\tAvg: %.1f", m.dlCur, m.dlMax, m.dlAvg)
-	ul := fmt.Sprintf("Current: %.1f Mbit/s\tMax: %.1f\tAvg: %.1f", m.ulCur, m.ulMax, m.ulAvg)
+	dl := fmt.Sprintf("Current: %.1f Mbit/s\tMax: %.1f\tAvg: %.1f\tSteady: %.1f", m.dlCur, m.dlMax, m.dlAvg, m.res.Download.SteadyMbps)
+	ul := fmt.Sprintf("Current: %.1f Mbit/s\tMax: %.1f\tAvg: %.1f\tSteady: %.1f", m.ulCur, m.ulMax, m.ulAvg, m.res.Upload.SteadyMbps)
+	if m.ulServer > 0 {
+		ul += fmt.Sprintf("\tServer: %.1f", m.ulServer)
+	}
 
 	content := lipgloss.JoinVertical(lipgloss.Left,
-		summaryHeaderStyle.Render("DOWNLOAD"),
+		summaryHeaderStyle.Render("DOWNLOAD")+summaryValueStyle.Render(streamRates(m.dlStreams)),
 		summaryValueStyle.Render(dl),
 		"",
-		summaryHeaderStyle.Render("UPLOAD"),
+		summaryHeaderStyle.Render("UPLOAD")+summaryValueStyle.Render(streamRates(m.ulStreams)),
 		summaryValueStyle.Render(ul),
 	)
 
@@ -331,6 +488,50 @@ func (m Model) renderSummary() string {
 	return box
 }
 
+// renderUDP shows the UDP test's target, the rate the server is
+// receiving, and the loss, reordering, duplication, and jitter it has seen.
+func (m Model) renderUDP() string {
+	target := "Target: -- Mbit/s\tPacket size: -- B\tReceived: -- Mbit/s"
+	counts := "Sent: --\tLost: --\tReordered: --\tDuplicates: --\tJitter: -- ms"
+	if u := m.res.UDP; u != nil {
+		rate := m.udpCur
+		if m.phase == phaseDone {
+			rate = u.Mbps
+		}
+		target = fmt.Sprintf("Target: %.1f Mbit/s\tPacket size: %d B\tReceived: %.1f Mbit/s", u.TargetMbps, u.PacketSize, rate)
+		counts = fmt.Sprintf("Sent: %d\tLost: %d (%.2f%%)\tReordered: %d\tDuplicates: %d\tJitter: %.2f ms",
+			u.Sent, u.Lost, u.LossPercent, u.Reordered, u.Duplicates, u.JitterMs)
+	}
+	if m.udpErr != nil {
+		counts = fmt.Sprintf("UDP test failed: %v", m.udpErr)
+	}
+
+	border := lipgloss.RoundedBorder()
+	box := lipgloss.NewStyle().
+		Border(border).
+		BorderForeground(lipgloss.Color("7")).
+		Width(m.width - 2).
+		Render(
+			progressLabelStyle.Render(" UDP Loss & Jitter") + "\n" +
+				lipgloss.JoinVertical(lipgloss.Left, summaryValueStyle.Render(target), summaryValueStyle.Render(counts)),
+		)
+	return box
+}
+
+// streamRates formats the current rate of each stream of a multi-stream
+// test for the summary header, so that an imbalance between streams is
+// visible. It returns an empty string for single-stream tests.
+func streamRates(streams []float64) string {
+	if len(streams) < 2 {
+		return ""
+	}
+	rates := make([]string, len(streams))
+	for i, mbps := range streams {
+		rates[i] = fmt.Sprintf("%.0f", mbps)
+	}
+	return fmt.Sprintf("  %d streams: %s Mbit/s", len(streams), strings.Join(rates, " / "))
+}
+
 func (m Model) renderProgress() string {
 	pct := m.progressPct()
 	barWidth := m.width - 4
@@ -392,29 +593,60 @@ func (m Model) renderHelp() string {
 
 // --- Data processing ---
 
+// setQueuePos tracks the server queue position reported by s and reports
+// whether s was a queue notification rather than a throughput sample.
+func (m *Model) setQueuePos(s backend.ThroughputSample) bool {
+	m.queuePos = s.QueuePosition
+	return s.QueuePosition > 0
+}
+
 func (m *Model) addPingSample(s backend.PingSample) {
 	m.pings = append(m.pings, s.Latency)
+	m.res.AddPing(s)
 	m.pingMin, m.pingMax, m.pingMean, m.pingStdev = measure.DurationStats(m.pings)
 
 	v := ms(s.Latency)
 	chartW := m.latencyChart.Width()
-	targetCols := proportionalColumns(len(m.pings), expectedPingSamples, chartW)
+	targetCols := proportionalColumns(len(m.pings), m.expectedPingSamples, chartW)
 	for m.latColsPushed < targetCols {
 		m.latencyChart.Push(v)
 		m.latColsPushed++
 	}
+	m.syncLatencyScale()
+}
+
+// addLoadedSample charts a latency probe run during a throughput test.
+// The chart scrolls rather than fills, as the number of probes depends on
+// how many the server allows.
+func (m *Model) addLoadedSample(s backend.ThroughputSample) {
+	m.loaded = append(m.loaded, s.Latency)
+	m.loadedChart.Push(ms(s.Latency))
+	m.syncLatencyScale()
+}
+
+// syncLatencyScale puts the idle and loaded latency charts on the same
+// scale, so that their heights can be compared.
+func (m *Model) syncLatencyScale() {
+	if !m.opts.LoadedLatency {
+		return
+	}
+	top := math.Max(m.latencyChart.MaxValue(), m.loadedChart.MaxValue())
+	m.latencyChart.SetMax(top)
+	m.loadedChart.SetMax(top)
 }
 
 func (m *Model) addDlSample(s backend.ThroughputSample) {
 	m.dlSamples = append(m.dlSamples, s.Mbps)
+	m.res.AddDownload(s)
 	m.dlCur = s.Mbps
+	m.dlStreams = s.Streams
 	if s.Mbps > m.dlMax {
 		m.dlMax = s.Mbps
 	}
 	m.dlAvg = measure.Mean(m.dlSamples)
 
 	chartW := m.dlChart.GraphWidth()
-	targetCols := proportionalColumns(len(m.dlSamples), expectedDlSamples, chartW)
+	targetCols := proportionalColumns(len(m.dlSamples), m.expectedDlSamples, chartW)
 	for m.dlColsPushed < targetCols {
 		m.dlChart.Push(s.Mbps)
 		m.dlColsPushed++
@@ -423,20 +655,54 @@ func (m *Model) addDlSample(s backend.ThroughputSample) {
 
 func (m *Model) addUlSample(s backend.ThroughputSample) {
 	m.ulSamples = append(m.ulSamples, s.Mbps)
+	m.res.AddUpload(s)
 	m.ulCur = s.Mbps
+	m.ulStreams = s.Streams
+	m.ulServer = s.ServerMbps
 	if s.Mbps > m.ulMax {
 		m.ulMax = s.Mbps
 	}
 	m.ulAvg = measure.Mean(m.ulSamples)
 
 	chartW := m.ulChart.GraphWidth()
-	targetCols := proportionalColumns(len(m.ulSamples), expectedUlSamples, chartW)
+	targetCols := proportionalColumns(len(m.ulSamples), m.expectedUlSamples, chartW)
 	for m.ulColsPushed < targetCols {
 		m.ulChart.Push(s.Mbps)
 		m.ulColsPushed++
 	}
 }
 
+// addUDPSample records a report from the UDP test. The final report
+// carries the server's totals and is recorded but not counted toward
+// progress.
+func (m *Model) addUDPSample(s backend.UDPSample) {
+	m.res.AddUDP(s)
+	if s.Final {
+		return
+	}
+	m.udpReports++
+	m.udpCur = s.Mbps
+}
+
+// setExpectedSamples derives the expected sample counts from the test
+// parameters in serverInfo, using the protocol defaults for any the
+// backend did not report.
+func (m *Model) setExpectedSamples() {
+	pings := m.serverInfo.PingCount
+	if pings <= 0 {
+		pings = protocol.DefaultPings
+	}
+	dur := m.serverInfo.TestDuration
+	if dur <= 0 {
+		dur = protocol.DefaultDuration
+	}
+
+	m.expectedPingSamples = pings
+	m.expectedDlSamples = int((dur + protocol.RecvGrace) / sampleInterval)
+	m.expectedUlSamples = int(dur / sampleInterval)
+	m.expectedUDPSamples = int(dur / sampleInterval)
+}
+
 // proportionalColumns returns how many chart columns should be filled
 // after receiving sampleCount of expectedTotal samples, given chartWidth
 // total columns. This ensures the chart is exactly full at the last sample.
@@ -460,7 +726,14 @@ func (m *Model) resizeCharts() {
 
 	m.dlChart.Resize(chartW, chartH)
 	m.ulChart.Resize(chartW, chartH)
-	m.latencyChart.Resize(latW, 3)
+	if m.opts.LoadedLatency {
+		// Idle latency takes fewer samples, so it gets the narrower chart.
+		idleW := max(latW*2/5, 4)
+		m.latencyChart.Resize(idleW, 3)
+		m.loadedChart.Resize(max(latW-idleW-1, 4), 3)
+	} else {
+		m.latencyChart.Resize(latW, 3)
+	}
 
 	// Re-push historical data with new proportions after resize
 	m.repushChartData()
@@ -471,7 +744,7 @@ func (m *Model) repushChartData() {
 	m.dlColsPushed = 0
 	graphW := m.dlChart.GraphWidth()
 	for i, v := range m.dlSamples {
-		target := proportionalColumns(i+1, expectedDlSamples, graphW)
+		target := proportionalColumns(i+1, m.expectedDlSamples, graphW)
 		for m.dlColsPushed < target {
 			m.dlChart.Push(v)
 			m.dlColsPushed++
@@ -482,7 +755,7 @@ func (m *Model) repushChartData() {
 	m.ulColsPushed = 0
 	graphW = m.ulChart.GraphWidth()
 	for i, v := range m.ulSamples {
-		target := proportionalColumns(i+1, expectedUlSamples, graphW)
+		target := proportionalColumns(i+1, m.expectedUlSamples, graphW)
 		for m.ulColsPushed < target {
 			m.ulChart.Push(v)
 			m.ulColsPushed++
@@ -493,18 +766,27 @@ func (m *Model) repushChartData() {
 	m.latColsPushed = 0
 	latW := m.latencyChart.Width()
 	for i, d := range m.pings {
-		target := proportionalColumns(i+1, expectedPingSamples, latW)
+		target := proportionalColumns(i+1, m.expectedPingSamples, latW)
 		for m.latColsPushed < target {
 			m.latencyChart.Push(ms(d))
 			m.latColsPushed++
 		}
 	}
+
+	m.loadedChart.Clear()
+	for _, d := range m.loaded {
+		m.loadedChart.Push(ms(d))
+	}
+	m.syncLatencyScale()
 }
 
 func (m Model) chartHeight() int {
 	// Allocate available height to charts
 	// Fixed rows: title(1) + banner(1) + spacing(2) + latency(5) + summary(~8) + progress(~4) + help(1) = ~22
 	avail := m.height - 22
+	if m.opts.UDP {
+		avail -= 4 // UDP panel
+	}
 	if avail < 6 {
 		avail = 6
 	}
@@ -515,18 +797,22 @@ func (m Model) chartHeight() int {
 }
 
 func (m Model) progressPct() float64 {
-	const numPings = 30
-	const expectedSamples = 20 // 10s / 500ms
-
+	// Each test takes an equal share of the bar.
+	share := 1.0 / 3.0
+	if m.opts.UDP {
+		share = 1.0 / 4.0
+	}
 	switch m.phase {
 	case phaseConnecting:
 		return 0
 	case phasePing:
-		return float64(len(m.pings)) / float64(numPings) * (1.0 / 3.0)
+		return float64(len(m.pings)) / float64(m.expectedPingSamples) * share
 	case phaseDownload:
-		return (1.0 / 3.0) + float64(len(m.dlSamples))/float64(expectedSamples)*(1.0/3.0)
+		return share + float64(len(m.dlSamples))/float64(m.expectedDlSamples)*share
 	case phaseUpload:
-		return (2.0 / 3.0) + float64(len(m.ulSamples))/float64(expectedSamples)*(1.0/3.0)
+		return 2*share + float64(len(m.ulSamples))/float64(m.expectedUlSamples)*share
+	case phaseUDP:
+		return 3*share + math.Min(float64(m.udpReports)/float64(m.expectedUDPSamples), 1)*share
 	case phaseDone:
 		return 1.0
 	default:
@@ -543,12 +829,16 @@ func (m Model) resetTest() (tea.Model, tea.Cmd) {
 	m.phase = phaseConnecting
 	m.err = nil
 	m.serverInfo = backend.ServerInfo{}
+	m.setExpectedSamples()
+	m.queuePos = 0
+	m.res = result.New(m.addr, time.Now())
 
 	m.pings = nil
 	m.pingMin = 0
 	m.pingMax = 0
 	m.pingMean = 0
 	m.pingStdev = 0
+	m.loaded = nil
 
 	m.dlSamples = nil
 	m.ulSamples = nil
@@ -558,6 +848,12 @@ func (m Model) resetTest() (tea.Model, tea.Cmd) {
 	m.ulCur = 0
 	m.ulMax = 0
 	m.ulAvg = 0
+	m.dlStreams = nil
+	m.ulStreams = nil
+	m.ulServer = 0
+	m.udpReports = 0
+	m.udpCur = 0
+	m.udpErr = nil
 
 	m.dlColsPushed = 0
 	m.ulColsPushed = 0
@@ -566,10 +862,19 @@ func (m Model) resetTest() (tea.Model, tea.Cmd) {
 	m.dlChart.ClearAllData()
 	m.ulChart.ClearAllData()
 	m.latencyChart.Clear()
+	m.loadedChart.Clear()
 
 	return m, m.connectCmd()
 }
 
+// finish records the end of a run that completed all its tests.
+func (m Model) finish() Model {
+	m.res.Finish(time.Now())
+	m.completed = append(m.completed, m.res)
+	m.phase = phaseDone
+	return m
+}
+
 func ms(d time.Duration) float64 {
 	return float64(d.Microseconds()) / 1000.0
 }
@@ -653,3 +958,31 @@ func waitForThroughput(ch <-chan backend.ThroughputSample, isUpload bool) tea.Cm
 		return dlSampleMsg{sample: sample, ch: ch}
 	}
 }
+
+// startUDPCmd runs the UDP test. Unlike the throughput tests, its error is
+// kept and delivered with udpDoneMsg, since the most common one, a server
+// too old for UDP tests, needs explaining.
+func (m Model) startUDPCmd() tea.Cmd {
+	return func() tea.Msg {
+		tester, ok := m.backend.(backend.UDPTester)
+		if !ok {
+			return udpDoneMsg{err: fmt.Errorf("backend does not support UDP tests")}
+		}
+		ch := make(chan backend.UDPSample, 10)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- tester.UDP(m.ctx, ch)
+		}()
+		return waitForUDP(ch, errCh)()
+	}
+}
+
+func waitForUDP(ch <-chan backend.UDPSample, errCh <-chan error) tea.Cmd {
+	return func() tea.Msg {
+		sample, ok := <-ch
+		if !ok {
+			return udpDoneMsg{err: <-errCh}
+		}
+		return udpSampleMsg{sample: sample, ch: ch, errCh: errCh}
+	}
+}